@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&addCmd{}, "")
+}
+
+type addCmd struct{}
+
+func (*addCmd) Name() string     { return "add" }
+func (*addCmd) Synopsis() string { return "git add path..." }
+func (*addCmd) Usage() string {
+	return `git add path...
+  Stages the files, recording executable bits, symlinks and gitlinks.
+  Directories are added recursively.
+`
+}
+func (*addCmd) SetFlags(f *flag.FlagSet) {}
+func (c *addCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() < 1 {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitFailure
+	}
+	if err := add(f.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "add: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+func add(paths []string) error {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return err
+	}
+	return git.Add(r, paths)
+}
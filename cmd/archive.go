@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&archiveCmd{}, "")
+}
+
+type archiveCmd struct {
+	format, prefix, output string
+}
+
+func (*archiveCmd) Name() string { return "archive" }
+func (*archiveCmd) Synopsis() string {
+	return "git archive [--format=tar|tar.gz|zip] [--prefix=prefix] [-o file] tree-ish [paths...]"
+}
+func (*archiveCmd) Usage() string {
+	return `git archive [--format=<format>] [--prefix=<prefix>] [-o|--output <file>] <tree-ish> [<path>...]
+  Writes an archive of the tree-ish, limited to the paths if given, to the standard output
+  or the file. The format is tar, tar.gz, tgz or zip, by default the one the extension of
+  the file tells, or tar. The prefix, e.g. project/, is prepended to the paths in the
+  archive. The files have the time of the commit, whose ID is recorded in the archive.
+  Paths with the export-ignore attribute are left out, and $Format:<format>$ in files with
+  the export-subst attribute is expanded with the commit as in git log --format.
+`
+}
+func (c *archiveCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.format, "format", "", "write the archive in the `format`")
+	f.StringVar(&c.prefix, "prefix", "", "prepend the `prefix` to the paths")
+	f.StringVar(&c.output, "o", "", "write the archive to the `file`")
+	f.StringVar(&c.output, "output", "", "write the archive to the `file`")
+}
+
+func (c *archiveCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "archive: ", err)
+		return subcommands.ExitFailure
+	}
+	opts := &git.ArchiveOptions{Format: c.format, Prefix: c.prefix, Paths: f.Args()[1:]}
+	if opts.Format == "" {
+		opts.Format = git.ArchiveFormat(c.output)
+	}
+	if err := c.archive(r, f.Arg(0), opts); err != nil {
+		fmt.Fprintln(os.Stderr, "archive: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// archive writes the archive to the output, removing the file on failure.
+func (c *archiveCmd) archive(r *git.Repo, treeish string, opts *git.ArchiveOptions) (err error) {
+	var out io.Writer = os.Stdout
+	if c.output != "" {
+		f, err := os.Create(c.output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(c.output)
+			}
+		}()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	if err := git.Archive(r, w, treeish, opts); err != nil {
+		return err
+	}
+	return w.Flush()
+}
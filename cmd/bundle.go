@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&bundleCmd{}, "")
+}
+
+type bundleCmd struct{}
+
+func (*bundleCmd) Name() string { return "bundle" }
+func (*bundleCmd) Synopsis() string {
+	return "git bundle (create [--version n] file rev-list-args... | verify [-q] file | list-heads file [refname...] | unbundle file [refname...])"
+}
+func (*bundleCmd) Usage() string {
+	return `git bundle create [-q|--quiet] [--version <version>] <file> <rev-list-args>...
+  Writes a bundle of the commits the arguments select to the file, or to the standard output
+  if it is -. The arguments are revisions, ^<rev>, <rev1>..<rev2>, --all, --branches, --tags
+  and --remotes, and the refs they name are stored in the bundle. The version is 2 or 3.
+
+git bundle verify [-q|--quiet] <file>
+  Checks that the bundle is valid and that the repository has the commits it requires.
+
+git bundle list-heads <file> [<refname>...]
+  Lists the refs in the bundle, or those with the full names given.
+
+git bundle unbundle <file> [<refname>...]
+  Stores the objects in the bundle in the repository and lists its refs as list-heads does.
+  The refs are not updated; git fetch and git clone take a bundle as a remote to do so.
+`
+}
+func (*bundleCmd) SetFlags(f *flag.FlagSet) {}
+
+func (c *bundleCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	action := f.Arg(0)
+	fs := flag.NewFlagSet("bundle "+action, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	var quiet bool
+	var version int
+	switch action {
+	case "create":
+		fs.IntVar(&version, "version", 2, "write a bundle of the `version`")
+		fallthrough
+	case "verify":
+		fs.BoolVar(&quiet, "q", false, "do not list the refs")
+		fs.BoolVar(&quiet, "quiet", false, "do not list the refs")
+	case "list-heads", "unbundle":
+	default:
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	if err := fs.Parse(f.Args()[1:]); err != nil || fs.NArg() == 0 || action == "create" && fs.NArg() < 2 || action == "verify" && fs.NArg() > 1 {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	var err error
+	switch action {
+	case "create":
+		err = createBundle(fs.Arg(0), fs.Args()[1:], version)
+	case "verify":
+		err = verifyBundle(fs.Arg(0), quiet)
+	case "list-heads", "unbundle":
+		err = listBundleHeads(fs.Arg(0), fs.Args()[1:], action == "unbundle")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bundle: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// createBundle writes the bundle to the file, removing it on failure.
+func createBundle(file string, args []string, version int) (err error) {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return err
+	}
+	opts := &git.BundleOptions{Version: version}
+	if file == "-" {
+		w := bufio.NewWriter(os.Stdout)
+		if err := git.CreateBundle(r, w, args, opts); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(file)
+		}
+	}()
+	w := bufio.NewWriter(out)
+	if err := git.CreateBundle(r, w, args, opts); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// verifyBundle prints the refs and the prerequisites of the bundle unless quiet, and
+// whether the repository has the prerequisites, as git bundle verify does.
+func verifyBundle(file string, quiet bool) error {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return err
+	}
+	b, err := git.OpenBundle(file)
+	if err != nil {
+		return err
+	}
+	if err := b.Verify(r); err != nil {
+		return err
+	}
+	if !quiet {
+		if len(b.Refs) == 1 {
+			fmt.Println("The bundle contains this ref:")
+		} else {
+			fmt.Printf("The bundle contains these %d refs:\n", len(b.Refs))
+		}
+		for _, ref := range b.Refs {
+			fmt.Println(ref.SHA, ref.Name)
+		}
+		switch len(b.Prerequisites) {
+		case 0:
+			fmt.Println("The bundle records a complete history.")
+		case 1:
+			fmt.Println("The bundle requires this ref:")
+		default:
+			fmt.Printf("The bundle requires these %d refs:\n", len(b.Prerequisites))
+		}
+		for _, p := range b.Prerequisites {
+			fmt.Println(p.SHA, p.Comment)
+		}
+		fmt.Println("The bundle uses this hash algorithm: sha1")
+	}
+	fmt.Fprintf(os.Stderr, "%s is okay\n", file)
+	return nil
+}
+
+// listBundleHeads prints the refs of the bundle with the names, or all of them if names is
+// empty, after storing its objects in the repository if unbundle is true.
+func listBundleHeads(file string, names []string, unbundle bool) error {
+	b, err := git.OpenBundle(file)
+	if err != nil {
+		return err
+	}
+	if unbundle {
+		r, err := git.NewRepo("", false)
+		if err != nil {
+			return err
+		}
+		if err := b.Unbundle(r); err != nil {
+			return err
+		}
+	}
+	wanted := make(map[string]bool)
+	for _, n := range names {
+		wanted[n] = true
+	}
+	for _, ref := range b.Refs {
+		if len(names) > 0 && !wanted[ref.Name] {
+			continue
+		}
+		fmt.Println(ref.SHA, ref.Name)
+	}
+	return nil
+}
@@ -1,10 +1,15 @@
 package cmd
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/google/subcommands"
 	"github.com/ogiekako/gogit/git"
@@ -14,33 +19,261 @@ func init() {
 	subcommands.Register(&catFileCmd{}, "")
 }
 
-type catFileCmd struct{}
+// batchFlag is the value of --batch and --batch-check, which may be given without the format.
+type batchFlag struct {
+	set    bool
+	format string
+}
 
-func (*catFileCmd) Name() string             { return "cat-file" }
-func (*catFileCmd) Synopsis() string         { return "git cat-file" }
-func (*catFileCmd) Usage() string            { return "git cat-file type object\n" }
-func (*catFileCmd) SetFlags(f *flag.FlagSet) {}
-func (c *catFileCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if f.NArg() < 2 {
-		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
-		return subcommands.ExitFailure
+func (f *batchFlag) String() string { return f.format }
+func (f *batchFlag) Set(s string) error {
+	f.set = s != "false"
+	f.format = ""
+	if s != "true" && s != "false" {
+		f.format = s
 	}
-	if err := catFile(f.Arg(0), f.Arg(1)); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+	return nil
+}
+func (f *batchFlag) IsBoolFlag() bool { return true }
+
+// defaultBatchFormat is the format of the object lines of --batch and --batch-check.
+const defaultBatchFormat = "%(objectname) %(objecttype) %(objectsize)"
+
+type catFileCmd struct {
+	typ, size, exists, pretty bool
+
+	batch, batchCheck batchFlag
+	allObjects        bool
+	buffer            bool
+}
+
+func (*catFileCmd) Name() string     { return "cat-file" }
+func (*catFileCmd) Synopsis() string { return "git cat-file (-t|-s|-e|-p|type) object" }
+func (*catFileCmd) Usage() string {
+	return `git cat-file type object
+  Prints the content of the object, peeling tags and commits to the type.
+
+git cat-file (-t|-s|-e|-p) object
+  Prints the type or the size of the object, checks that it exists, or pretty-prints it.
+
+git cat-file (--batch|--batch-check)[=format] [--batch-all-objects] [--buffer]
+  Prints the objects named on the lines of stdin, or all the objects with
+  --batch-all-objects, as "<sha> <type> <size>" lines, followed by the contents with
+  --batch. Missing objects are printed as "<name> missing". The format may contain
+  %(objectname), %(objecttype), %(objectsize) and %(rest), the text after the first
+  whitespace of the input line.
+`
+}
+func (c *catFileCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.typ, "t", false, "show the object type")
+	f.BoolVar(&c.size, "s", false, "show the object size")
+	f.BoolVar(&c.exists, "e", false, "exit with zero status if the object exists and is valid")
+	f.BoolVar(&c.pretty, "p", false, "pretty-print the object based on its type")
+	f.Var(&c.batch, "batch", "show the info and the content of the objects read from stdin")
+	f.Var(&c.batchCheck, "batch-check", "show the info of the objects read from stdin")
+	f.BoolVar(&c.allObjects, "batch-all-objects", false, "show all the objects instead of reading stdin")
+	f.BoolVar(&c.buffer, "buffer", false, "do not flush the output after each object")
+}
+func (c *catFileCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	var err error
+	switch {
+	case c.batch.set || c.batchCheck.set:
+		if f.NArg() != 0 {
+			fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+			return subcommands.ExitUsageError
+		}
+		err = c.runBatch(os.Stdin, os.Stdout)
+	case c.allObjects:
+		err = errors.New("--batch-all-objects requires --batch or --batch-check")
+	case c.typ || c.size || c.exists || c.pretty:
+		if f.NArg() != 1 {
+			fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+			return subcommands.ExitUsageError
+		}
+		var ok bool
+		if ok, err = c.query(os.Stdout, f.Arg(0)); err == nil && !ok {
+			return subcommands.ExitFailure
+		}
+	default:
+		if f.NArg() != 2 {
+			fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+			return subcommands.ExitUsageError
+		}
+		err = catFile(os.Stdout, f.Arg(0), f.Arg(1))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cat-file: ", err)
 		return subcommands.ExitFailure
 	}
 	return subcommands.ExitSuccess
 }
 
-func catFile(typ, sha string) error {
+// catFile prints the content of the object peeled to the type.
+func catFile(w io.Writer, typ, name string) error {
 	r, err := git.NewRepo("", false)
 	if err != nil {
 		return err
 	}
-	o, err := git.ReadObject(r, sha)
+	sha, err := git.ResolveRevision(r, name, typ)
 	if err != nil {
 		return err
 	}
-	fmt.Print(string(o.Encode()))
-	return nil
+	_, data, err := git.ReadRawObject(r, sha)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// query runs -t, -s, -e or -p. It reports false without an error if the object does not
+// exist with -e.
+func (c *catFileCmd) query(w io.Writer, name string) (bool, error) {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return false, err
+	}
+	sha, err := git.ResolveRevision(r, name, "")
+	if err != nil {
+		return false, err
+	}
+	typ, data, err := git.ReadRawObject(r, sha)
+	if c.exists {
+		return err == nil, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case c.typ:
+		fmt.Fprintln(w, typ)
+	case c.size:
+		fmt.Fprintln(w, len(data))
+	case typ == "tree":
+		o, err := git.ReadObject(r, sha)
+		if err != nil {
+			return false, err
+		}
+		for _, l := range o.Tree {
+			fmt.Fprintf(w, "%06s %s %s\t%s\n", l.Mode, entryType(l.Mode), l.SHA, l.Path)
+		}
+	default:
+		if _, err := w.Write(data); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// entryType returns the type of the object a tree entry with the mode points at.
+func entryType(mode string) string {
+	switch strings.TrimLeft(mode, "0") {
+	case "40000":
+		return "tree"
+	case "160000":
+		return "commit"
+	}
+	return "blob"
+}
+
+// runBatch prints the objects named on the lines of in, or all the objects with --batch-all-objects.
+func (c *catFileCmd) runBatch(in io.Reader, out io.Writer) error {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return err
+	}
+	bf := c.batchCheck
+	if c.batch.set {
+		bf = c.batch
+	}
+	format := bf.format
+	if format == "" {
+		format = defaultBatchFormat
+	}
+	wantRest := strings.Contains(format, "%(rest)")
+	bw := bufio.NewWriter(out)
+	defer bw.Flush()
+
+	object := func(name, rest string) error {
+		sha, err := git.ResolveRevision(r, name, "")
+		var typ string
+		var data []byte
+		if err == nil {
+			typ, data, err = git.ReadRawObject(r, sha)
+		}
+		if err != nil {
+			fmt.Fprintf(bw, "%s missing\n", name)
+		} else {
+			line, err := expandBatchFormat(format, sha, typ, len(data), rest)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(bw, line)
+			if c.batch.set {
+				bw.Write(data)
+				fmt.Fprintln(bw)
+			}
+		}
+		if !c.buffer {
+			return bw.Flush()
+		}
+		return nil
+	}
+
+	if c.allObjects {
+		shas, err := git.ObjectSHAs(r)
+		if err != nil {
+			return err
+		}
+		for _, sha := range shas {
+			if err := object(sha, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	sc := bufio.NewScanner(in)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		name, rest := sc.Text(), ""
+		if wantRest {
+			if i := strings.IndexAny(name, " \t"); i >= 0 {
+				name, rest = name[:i], strings.TrimLeft(name[i:], " \t")
+			}
+		}
+		if err := object(name, rest); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// expandBatchFormat expands the %(atom)s in the format of --batch and --batch-check.
+func expandBatchFormat(format, sha, typ string, size int, rest string) (string, error) {
+	var sb strings.Builder
+	for {
+		i := strings.Index(format, "%(")
+		if i < 0 {
+			sb.WriteString(format)
+			return sb.String(), nil
+		}
+		j := strings.Index(format[i:], ")")
+		if j < 0 {
+			return "", fmt.Errorf("unterminated format element %s", format[i:])
+		}
+		sb.WriteString(format[:i])
+		switch atom := format[i+2 : i+j]; atom {
+		case "objectname":
+			sb.WriteString(sha)
+		case "objecttype":
+			sb.WriteString(typ)
+		case "objectsize":
+			sb.WriteString(strconv.Itoa(size))
+		case "rest":
+			sb.WriteString(rest)
+		default:
+			return "", fmt.Errorf("unknown format element: %s", atom)
+		}
+		format = format[i+j+1:]
+	}
 }
@@ -16,28 +16,90 @@ func init() {
 	subcommands.Register(&checkoutCmd{}, "")
 }
 
-type checkoutCmd struct{}
+type checkoutCmd struct {
+	branch string
+	detach bool
+	force  bool
+}
 
 func (*checkoutCmd) Name() string     { return "checkout" }
-func (*checkoutCmd) Synopsis() string { return "git checkout commit path" }
+func (*checkoutCmd) Synopsis() string { return "git checkout [-f] [--detach] [-b new_branch] [branch]" }
 func (*checkoutCmd) Usage() string {
-	return `git checkout commit path
+	return `git checkout [-f] [--detach] [-b new_branch] [branch|commit]
+  Switches to the branch or the commit, updating the index and the worktree.
+  Local changes to files which differ between the commits are refused unless -f is given.
+
+git checkout [tree-ish] -- pathspec...
+  Restores the files from the index, or from the tree-ish updating the index too.
+
+git checkout commit path
   commit - commit or tree to checkout.
-  path - The EMPTY directory to checkout on.`
+  path - The EMPTY directory to checkout on.
+`
+}
+func (c *checkoutCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.branch, "b", "", "create a new branch at the commit and switch to it")
+	f.BoolVar(&c.detach, "detach", false, "detach HEAD at the commit")
+	f.BoolVar(&c.force, "f", false, "discard local changes")
 }
-func (*checkoutCmd) SetFlags(f *flag.FlagSet) {}
 func (c *checkoutCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if f.NArg() < 2 {
+	if c.branch == "" && f.NArg() == 0 {
 		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
 		return subcommands.ExitFailure
 	}
-	if err := checkout(f.Arg(0), f.Arg(1)); err != nil {
+	if err := c.checkout(f.Args()); err != nil {
 		fmt.Fprintln(os.Stderr, "checkout: ", err)
 		return subcommands.ExitFailure
 	}
 	return subcommands.ExitSuccess
 }
 
+func (c *checkoutCmd) checkout(args []string) error {
+	if c.branch != "" {
+		start := ""
+		if len(args) > 0 {
+			start = args[0]
+		}
+		return switchTo(start, c.branch, c.detach, c.force, true)
+	}
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return err
+	}
+	for _, a := range args {
+		if a == "--" {
+			rev, paths := splitRevPaths(r, args)
+			return checkoutPaths(rev, paths)
+		}
+	}
+	isRev := func(name string) bool {
+		_, err := git.ResolveRevision(r, name, "")
+		return err == nil
+	}
+	if len(args) == 1 && isRev(args[0]) {
+		return switchTo(args[0], "", c.detach, c.force, true)
+	}
+	if len(args) == 2 && isRev(args[0]) && isEmptyDir(args[1]) {
+		sha, err := git.ResolveRevision(r, args[0], "")
+		if err != nil {
+			return err
+		}
+		return checkout(sha, args[1])
+	}
+	// The flag package consumes a leading "--", so without a revision the arguments are paths.
+	rev, paths := splitRevPaths(r, args)
+	return checkoutPaths(rev, paths)
+}
+
+// isEmptyDir reports whether path does not exist or is an empty directory.
+func isEmptyDir(path string) bool {
+	fs, err := ioutil.ReadDir(path)
+	if os.IsNotExist(err) {
+		return true
+	}
+	return err == nil && len(fs) == 0
+}
+
 func checkout(sha, path string) error {
 	if s, err := os.Stat(path); os.IsNotExist(err) {
 		if err := os.Mkdir(path, 0755); err != nil {
@@ -76,23 +138,25 @@ func checkoutTree(repo *git.Repo, tree *git.Object, path string) error {
 		return fmt.Errorf("format %s != tree", tree.Type)
 	}
 	for _, c := range tree.Tree {
-		o, err := git.ReadObject(repo, c.SHA)
-		if err != nil {
+		if err := git.VerifyPath(c.Path); err != nil {
 			return err
 		}
 		dest := filepath.Join(path, c.Path)
-		switch o.Type {
-		case "blob":
-			if err := ioutil.WriteFile(dest, o.Blob, 0644); err != nil {
-				return err
-			}
-		case "tree":
-			if err := os.Mkdir(dest, 0755); err != nil {
-				return err
-			}
-			if err := checkoutTree(repo, o, dest); err != nil {
+		if c.Mode != "40000" {
+			if err := git.WriteLeaf(repo, c, dest); err != nil {
 				return err
 			}
+			continue
+		}
+		o, err := git.ReadObject(repo, c.SHA)
+		if err != nil {
+			return err
+		}
+		if err := os.Mkdir(dest, 0755); err != nil {
+			return err
+		}
+		if err := checkoutTree(repo, o, dest); err != nil {
+			return err
 		}
 	}
 	return nil
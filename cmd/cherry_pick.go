@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/diff"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&cherryPickCmd{}, "")
+}
+
+// cherryPickCmd implements cherry-pick, and revert with action set to git.ActionRevert.
+type cherryPickCmd struct {
+	action            git.PickAction
+	recordOrigin      bool
+	noCommit          bool
+	mainline          int
+	strategyOption    string
+	cont, skip, abort bool
+}
+
+func (*cherryPickCmd) Name() string { return "cherry-pick" }
+func (*cherryPickCmd) Synopsis() string {
+	return "git cherry-pick [-x] [-n] [-m parent-number] commit..."
+}
+func (*cherryPickCmd) Usage() string {
+	return `git cherry-pick [-x] [-n] [-m parent-number] [-X ours|theirs|union] commit...
+  Applies the changes made by the commits onto HEAD by merging, committing each of them with
+  its original author and message. A range A..B picks the commits reachable from B but not
+  from A, oldest first. If a commit conflicts, the conflicts are left in the index and the
+  worktree to be resolved and concluded with --continue.
+
+git cherry-pick (--continue | --skip | --abort)
+  Commits the resolved conflicts and goes on, skips the commit which stopped, or abandons
+  the cherry-pick resetting HEAD to where it was.
+`
+}
+func (c *cherryPickCmd) SetFlags(f *flag.FlagSet) {
+	if c.action == git.ActionPick {
+		f.BoolVar(&c.recordOrigin, "x", false, "append \"(cherry picked from commit ...)\" to the messages")
+	}
+	f.BoolVar(&c.noCommit, "n", false, "apply the changes to the index and the worktree without committing")
+	f.BoolVar(&c.noCommit, "no-commit", false, "apply the changes to the index and the worktree without committing")
+	f.IntVar(&c.mainline, "m", 0, "take the changes of merges relative to the `parent-number`, starting from 1")
+	f.IntVar(&c.mainline, "mainline", 0, "take the changes of merges relative to the `parent-number`, starting from 1")
+	f.StringVar(&c.strategyOption, "X", "", "resolve conflicts favoring ours, theirs or union")
+	f.StringVar(&c.strategyOption, "strategy-option", "", "resolve conflicts favoring ours, theirs or union")
+	f.BoolVar(&c.cont, "continue", false, "commit the resolved conflicts and go on")
+	f.BoolVar(&c.skip, "skip", false, "skip the commit which stopped")
+	f.BoolVar(&c.abort, "abort", false, "abandon the sequence and reset HEAD to where it was")
+}
+func (c *cherryPickCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	n := 0
+	for _, b := range []bool{c.cont, c.skip, c.abort} {
+		if b {
+			n++
+		}
+	}
+	if n > 1 || (n == 1) != (f.NArg() == 0) {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	r, err := git.NewRepo("", false)
+	var outs []*git.PickOutcome
+	if err == nil {
+		switch {
+		case c.abort:
+			err = git.AbortSequence(r)
+		case c.cont:
+			outs, err = git.ContinueSequence(r)
+		case c.skip:
+			outs, err = git.SkipSequence(r)
+		default:
+			outs, err = c.pick(r, f.Args())
+		}
+	}
+	stopped := printPicked(os.Stdout, r, outs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, c.action.String()+": ", err)
+		return subcommands.ExitFailure
+	}
+	if stopped {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+func (c *cherryPickCmd) pick(r *git.Repo, args []string) ([]*git.PickOutcome, error) {
+	opts := &git.PickOptions{Action: c.action, Mainline: c.mainline, NoCommit: c.noCommit, RecordOrigin: c.recordOrigin}
+	var err error
+	if opts.Tree.Style, err = diff.ParseMergeStyle(git.Config(r, "merge", "conflictStyle")); err != nil {
+		return nil, err
+	}
+	switch c.strategyOption {
+	case "":
+	case "ours":
+		opts.Tree.Favor = diff.FavorOurs
+	case "theirs":
+		opts.Tree.Favor = diff.FavorTheirs
+	case "union":
+		opts.Tree.Favor = diff.FavorUnion
+	default:
+		return nil, fmt.Errorf("unknown strategy option: -X%s", c.strategyOption)
+	}
+	commits, err := pickCommits(r, args)
+	if err != nil {
+		return nil, err
+	}
+	return git.Sequence(r, commits, opts)
+}
+
+// pickCommits resolves the commits to pick, expanding ranges A..B to the commits reachable
+// from B but not from A, oldest first.
+func pickCommits(r *git.Repo, args []string) ([]string, error) {
+	var commits []string
+	for _, arg := range args {
+		i := strings.Index(arg, "..")
+		if i < 0 {
+			sha, err := git.ResolveRevision(r, arg, "commit")
+			if err != nil {
+				return nil, err
+			}
+			commits = append(commits, sha)
+			continue
+		}
+		var ends []string
+		for _, rev := range []string{arg[:i], arg[i+2:]} {
+			if rev == "" {
+				rev = "HEAD"
+			}
+			sha, err := git.ResolveRevision(r, rev, "commit")
+			if err != nil {
+				return nil, err
+			}
+			ends = append(ends, sha)
+		}
+		cs, err := git.RevList(r, ends[1:], ends[:1])
+		if err != nil {
+			return nil, err
+		}
+		for i := len(cs) - 1; i >= 0; i-- {
+			commits = append(commits, cs[i])
+		}
+	}
+	return commits, nil
+}
+
+// printPicked prints the merge messages and the results of the commits picked, reporting
+// whether the sequence stopped.
+func printPicked(w io.Writer, r *git.Repo, outs []*git.PickOutcome) bool {
+	for _, o := range outs {
+		if o.Tree != nil {
+			for _, m := range o.Tree.Messages {
+				fmt.Fprintln(w, m)
+			}
+		}
+		if o.Status == git.PickCommitted {
+			// As git does, the author date is shown unless the commit concludes a revert
+			// which stopped.
+			printCommitted(w, r, o.New, o.Tree != nil || o.Action == git.ActionPick)
+		}
+		if !o.Stopped() {
+			continue
+		}
+		verb, name := "apply", o.Action.String()
+		if o.Action == git.ActionRevert {
+			verb = "revert"
+		}
+		if o.Status == git.PickEmpty {
+			fmt.Fprintf(os.Stderr, `The previous %s is now empty, possibly due to conflict resolution.
+If you wish to commit it anyway, use:
+
+    git commit --allow-empty
+
+Otherwise, please use 'git %s --skip'
+`, name, name)
+			return true
+		}
+		fmt.Fprintf(os.Stderr, `error: could not %s %s... %s
+hint: After resolving the conflicts, mark them with
+hint: "git add/rm <pathspec>", then run
+hint: "git %s --continue".
+hint: You can instead skip this commit with "git %s --skip".
+hint: To abort and get back to the state before "git %s",
+hint: run "git %s --abort".
+`, verb, o.Commit[:7], subject(r, o.Commit), name, name, name, name)
+		return true
+	}
+	return false
+}
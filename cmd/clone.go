@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&cloneCmd{}, "")
+}
+
+type cloneCmd struct {
+	quiet, bare, mirror bool
+	shallow             shallowFlags
+	filter              string
+}
+
+// shallowFlags are the flags which limit the history fetched.
+type shallowFlags struct {
+	depth   int
+	since   string
+	exclude stringsFlag
+}
+
+func (s *shallowFlags) setFlags(f *flag.FlagSet) {
+	f.IntVar(&s.depth, "depth", 0, "fetch the history to the `depth` from the tips")
+	f.StringVar(&s.since, "shallow-since", "", "fetch the history after the `date`")
+	f.Var(&s.exclude, "shallow-exclude", "fetch the history not reachable from the remote branch or tag `ref`")
+}
+
+// parse returns the depth, the time since which the history is fetched and the refs whose
+// history is not fetched.
+func (s *shallowFlags) parse() (depth int, since time.Time, exclude []string, err error) {
+	if s.depth < 0 {
+		return 0, time.Time{}, nil, fmt.Errorf("depth %d is not a positive number", s.depth)
+	}
+	if s.since != "" {
+		if since, err = git.ParseDate(s.since); err != nil {
+			return 0, time.Time{}, nil, err
+		}
+	}
+	return s.depth, since, s.exclude, nil
+}
+
+// stringsFlag collects the values of a flag given more than once.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+func (*cloneCmd) Name() string { return "clone" }
+func (*cloneCmd) Synopsis() string {
+	return "git clone [-q] [--bare|--mirror] [--depth n] [--filter spec] url [dir]"
+}
+func (*cloneCmd) Usage() string {
+	return `git clone [-q|--quiet] [--bare|--mirror] [--depth <depth>] [--shallow-since <date>]
+          [--shallow-exclude <ref>...] [--filter <filter-spec>] url [dir]
+  Clones the repository at url, a smart HTTP(S) URL, an ext::<command> URL, a file:// URL or
+  a local path, which may also be of a bundle file, into dir, which defaults to the last
+  component of url without .git or .bundle. ext:: URLs, which run the command, need ext in
+  GIT_ALLOW_PROTOCOL or protocol.ext.allow = always. The branches of the remote become
+  remote-tracking branches of origin, and the branch the remote HEAD points to is checked
+  out. --bare makes a bare repository with the branches of the remote as its branches, and
+  --mirror a bare repository with all the refs of the remote, which git fetch keeps in sync.
+  --depth, --shallow-since and --shallow-exclude make a shallow clone of the branch HEAD
+  points to, whose history is cut at the depth, the date or the history of the refs.
+  --filter makes a partial clone without the blobs and trees the filter spec, blob:none,
+  blob:limit=<n>[kmg] or tree:<depth>, omits; they are fetched from origin when needed.
+`
+}
+func (c *cloneCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.quiet, "q", false, "suppress the progress messages")
+	f.BoolVar(&c.quiet, "quiet", false, "suppress the progress messages")
+	f.BoolVar(&c.bare, "bare", false, "make a bare repository")
+	f.BoolVar(&c.mirror, "mirror", false, "make a bare repository mirroring all the refs")
+	c.shallow.setFlags(f)
+	f.StringVar(&c.filter, "filter", "", "make a partial clone with the `filter-spec`")
+}
+func (c *cloneCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() < 1 || f.NArg() > 2 {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	depth, since, exclude, err := c.shallow.parse()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "clone: ", err)
+		return subcommands.ExitUsageError
+	}
+	url, dir := f.Arg(0), f.Arg(1)
+	bare := c.bare || c.mirror
+	if dir == "" {
+		dir = git.CloneDir(url, bare)
+	}
+	if !c.quiet {
+		if bare {
+			fmt.Fprintf(os.Stderr, "Cloning into bare repository '%s'...\n", dir)
+		} else {
+			fmt.Fprintf(os.Stderr, "Cloning into '%s'...\n", dir)
+		}
+	}
+	opts := &git.CloneOptions{
+		Progress:       progress(c.quiet),
+		Bare:           c.bare,
+		Mirror:         c.mirror,
+		Depth:          depth,
+		ShallowSince:   since,
+		ShallowExclude: exclude,
+		Filter:         c.filter,
+	}
+	r, err := git.Clone(url, dir, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "clone: ", err)
+		return subcommands.ExitFailure
+	}
+	if refs, err := git.AllRefs(r); err == nil && len(refs) == 0 {
+		fmt.Fprintln(os.Stderr, "warning: You appear to have cloned an empty repository.")
+	}
+	return subcommands.ExitSuccess
+}
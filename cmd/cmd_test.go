@@ -1,9 +1,16 @@
 package cmd
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -12,6 +19,8 @@ import (
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/ogiekako/gogit/git"
+	"github.com/ogiekako/gogit/smarthttp"
 	"github.com/ogiekako/gogit/testutil"
 )
 
@@ -109,6 +118,121 @@ func TestCatFile(t *testing.T) {
 	}
 }
 
+func TestCatFileModes(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	testutil.Copy(t, filepath.Join(td.dir, ".git"), "testdata/gitdir3")
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-t", "hevy"}, "tag\n"},
+		{[]string{"-s", "HEAD"}, "216\n"},
+		{[]string{"-e", "HEAD:a"}, ""},
+		{[]string{"-p", "HEAD^{tree}"}, `100644 blob 2262de0c121f22df8e78f5a37d6e114fd322c0b0	a
+100644 blob e69de29bb2d1d6434b8b29ae775ad8c2e48c5391	b
+100644 blob e69de29bb2d1d6434b8b29ae775ad8c2e48c5391	c
+040000 tree 496d6428b9cf92981dc9495211e6e1120fb6f2ba	d
+`},
+		{[]string{"commit", "hevy"}, `tree 2823188337a27d8b30fa3b1876d1e46ef8f4ba57
+parent 0a380ee19ff3c304bd4c6bd8d0000d4c1070b3d3
+author Keigo Oka <ogiekako@gmail.com> 1584785273 +0900
+committer Keigo Oka <ogiekako@gmail.com> 1584785273 +0900
+
+add dir
+`},
+	} {
+		if diff := cmp.Diff(run(td, append([]string{"cat-file"}, tc.args...)...), tc.want); diff != "" {
+			t.Errorf("%v: (-got +want)\n%s", tc.args, diff)
+		}
+	}
+	runFail(td, "cat-file", "-e", "0123456789012345678901234567890123456789")
+	runFail(td, "cat-file", "blob", "HEAD")
+
+	in := "HEAD\nhevy extra\nnope\nHEAD:a\n"
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--batch-check"}, `7a7dd58919381869a1e39be3d0c7f45978a3a04f commit 216
+hevy extra missing
+nope missing
+2262de0c121f22df8e78f5a37d6e114fd322c0b0 blob 5
+`},
+		{[]string{"--batch=%(objecttype) %(rest)"}, `commit 
+tree 2823188337a27d8b30fa3b1876d1e46ef8f4ba57
+parent 0a380ee19ff3c304bd4c6bd8d0000d4c1070b3d3
+author Keigo Oka <ogiekako@gmail.com> 1584785273 +0900
+committer Keigo Oka <ogiekako@gmail.com> 1584785273 +0900
+
+add dir
+
+tag extra
+object 7a7dd58919381869a1e39be3d0c7f45978a3a04f
+type commit
+tag hevy
+tagger Keigo Oka <ogiekako@gmail.com> 1584892287 +0900
+
+hevy
+
+nope missing
+blob 
+hoge
+
+`},
+	} {
+		if diff := cmp.Diff(runStdin(td, in, append([]string{"cat-file"}, tc.args...)...), tc.want); diff != "" {
+			t.Errorf("%v: (-got +want)\n%s", tc.args, diff)
+		}
+	}
+	if got := strings.Count(run(td, "cat-file", "--batch-check", "--batch-all-objects"), "\n"); got != 21 {
+		t.Errorf("--batch-all-objects printed %d objects; want 21", got)
+	}
+}
+
+// runStdin runs the command with the input on its stdin and returns its stdout.
+func runStdin(td testD, in string, args ...string) string {
+	must := func(err error) {
+		if err != nil {
+			td.t.Error(err)
+		}
+	}
+	must(os.Chdir(td.dir))
+	defer func() { must(os.Chdir(gitdir)) }()
+
+	cmd := exec.CommandContext(td.ctx, prog, args...)
+	cmd.Stdin = strings.NewReader(in)
+	var eb bytes.Buffer
+	cmd.Stderr = &eb
+	b, err := cmd.Output()
+	if err != nil {
+		td.t.Fatalf("%v: %v", eb.String(), err)
+	}
+	return string(b)
+}
+
+// runStdinFail runs the command with the input expecting it to fail and returns its
+// stdout and stderr.
+func runStdinFail(td testD, in string, args ...string) string {
+	must := func(err error) {
+		if err != nil {
+			td.t.Error(err)
+		}
+	}
+	must(os.Chdir(td.dir))
+	defer func() { must(os.Chdir(gitdir)) }()
+
+	cmd := exec.CommandContext(td.ctx, prog, args...)
+	cmd.Stdin = strings.NewReader(in)
+	b, err := cmd.CombinedOutput()
+	if err == nil {
+		td.t.Fatalf("%v: succeeded unexpectedly", args)
+	}
+	return string(b)
+}
+
 func TestHashObject(t *testing.T) {
 	td, cancel := testData(t)
 	defer cancel()
@@ -152,6 +276,38 @@ c_8c93c7625fe3d44432383432565e2fc31090833d -> c_f6cd3846af74cdaf49efe8874e0ecdf6
 		t.Errorf("(-got +want)\n%s", diff)
 	}
 }
+
+func TestLogPath(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	run(td, "init")
+	var commits []string
+	for _, f := range []string{"b/t.txt", "a", "b/t.txt"} {
+		testutil.WriteFile(t, []byte(fmt.Sprintln(len(commits))), td.dir, filepath.FromSlash(f))
+		run(td, "add", ".")
+		run(td, "commit", "-m", fmt.Sprint(len(commits)))
+		commits = append(commits, strings.TrimSpace(run(td, "rev-parse", "HEAD")))
+	}
+	all := fmt.Sprintf("digraph wyaglog{\nc_%s -> c_%s\nc_%s -> c_%s\n}\n", commits[2], commits[1], commits[1], commits[0])
+	for _, args := range [][]string{{"log"}, {"log", "HEAD"}, {"log", "master"}} {
+		if diff := cmp.Diff(run(td, args...), all); diff != "" {
+			t.Errorf("%v: (-got +want)\n%s", args, diff)
+		}
+	}
+	want := fmt.Sprintf("digraph wyaglog{\nc_%s -> c_%s\n}\n", commits[2], commits[0])
+	for _, args := range [][]string{
+		{"log", "--", "b/t.txt"},
+		{"log", "HEAD", "--", "b/t.txt"},
+		{"log", "b/t.txt"},
+		{"log", "--follow", "b/t.txt"},
+	} {
+		if diff := cmp.Diff(run(td, args...), want); diff != "" {
+			t.Errorf("%v: (-got +want)\n%s", args, diff)
+		}
+	}
+}
+
 func TestLsTree(t *testing.T) {
 	td, cancel := testData(t)
 	defer cancel()
@@ -167,6 +323,34 @@ func TestLsTree(t *testing.T) {
 		t.Errorf("(-got +want)\n%s", diff)
 	}
 }
+
+func TestLsTreeOptions(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	testutil.Copy(t, filepath.Join(td.dir, ".git"), "testdata/gitdir3")
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-r", "-t", "-l", "HEAD"}, `100644 blob 2262de0c121f22df8e78f5a37d6e114fd322c0b0       5	a
+100644 blob e69de29bb2d1d6434b8b29ae775ad8c2e48c5391       0	b
+100644 blob e69de29bb2d1d6434b8b29ae775ad8c2e48c5391       0	c
+040000 tree 496d6428b9cf92981dc9495211e6e1120fb6f2ba       -	d
+100644 blob e69de29bb2d1d6434b8b29ae775ad8c2e48c5391       0	d/a
+`},
+		{[]string{"hevy", "d/"}, "100644 blob e69de29bb2d1d6434b8b29ae775ad8c2e48c5391\td/a\n"},
+		{[]string{"HEAD", "d"}, "040000 tree 496d6428b9cf92981dc9495211e6e1120fb6f2ba\td\n"},
+		{[]string{"-d", "HEAD"}, "040000 tree 496d6428b9cf92981dc9495211e6e1120fb6f2ba\td\n"},
+		{[]string{"--name-only", "-z", "-r", "HEAD", "a", "d"}, "a\x00d/a\x00"},
+	} {
+		if diff := cmp.Diff(run(td, append([]string{"ls-tree"}, tc.args...)...), tc.want); diff != "" {
+			t.Errorf("%v: (-got +want)\n%s", tc.args, diff)
+		}
+	}
+}
+
 func TestCheckout(t *testing.T) {
 	td, cancel := testData(t)
 	defer cancel()
@@ -259,9 +443,1869 @@ func TestRevParse(t *testing.T) {
 		{"HEAD^{tree}", "2823188337a27d8b30fa3b1876d1e46ef8f4ba57\n"},
 		{"hevy^{commit}", "7a7dd58919381869a1e39be3d0c7f45978a3a04f\n"},
 		{"hevy", "cae02c8b5610cb970fa2f5c16b1a9d53b38221f4\n"},
+		{"HEAD~1", "0a380ee19ff3c304bd4c6bd8d0000d4c1070b3d3\n"},
+		{"HEAD^^2", "8c93c7625fe3d44432383432565e2fc31090833d\n"},
+		{"hevy~2", "6aba443f3b8da367cafd04b17c0d33acbdec8475\n"},
+		{"HEAD:d/a", "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391\n"},
+		{"hevy:a", "2262de0c121f22df8e78f5a37d6e114fd322c0b0\n"},
 	} {
 		if got := run(td, "rev-parse", tc.name); got != tc.want {
 			t.Errorf("%s: got %s; want %s", tc.name, got, tc.want)
 		}
 	}
 }
+
+// runFail runs the command expecting it to fail and returns its stderr.
+func runFail(td testD, args ...string) string {
+	must := func(err error) {
+		if err != nil {
+			td.t.Error(err)
+		}
+	}
+	must(os.Chdir(td.dir))
+	defer func() { must(os.Chdir(gitdir)) }()
+
+	cmd := exec.CommandContext(td.ctx, prog, args...)
+	var eb bytes.Buffer
+	cmd.Stderr = &eb
+	if err := cmd.Run(); err == nil {
+		td.t.Fatalf("%v: succeeded unexpectedly", args)
+	}
+	return eb.String()
+}
+
+func TestSwitch(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	testutil.Copy(t, filepath.Join(td.dir, ".git"), "testdata/gitdir2")
+
+	exists := func(elem ...string) bool {
+		_, err := os.Stat(filepath.Join(append([]string{td.dir}, elem...)...))
+		return err == nil
+	}
+
+	run(td, "checkout", "-f", "master")
+	for _, p := range []string{"a", "b", "c", "d/a"} {
+		if !exists(p) {
+			t.Errorf("%s does not exist", p)
+		}
+	}
+
+	run(td, "checkout", "hoge")
+	if exists("c") || exists("d") {
+		t.Errorf("c or d exists after checking out hoge")
+	}
+	if got, want := string(testutil.ReadFile(t, td.dir, ".git", "HEAD")), "ref: refs/heads/hoge\n"; got != want {
+		t.Errorf("HEAD = %q; want %q", got, want)
+	}
+
+	// Local changes to files which are the same in both branches are carried over.
+	testutil.WriteFile(t, []byte("local\n"), td.dir, "a")
+	run(td, "switch", "c")
+	if exists("b") || !exists("c") {
+		t.Errorf("b exists or c does not exist after switching to c")
+	}
+	if got := testutil.ReadFile(t, td.dir, "a"); string(got) != "local\n" {
+		t.Errorf("a = %q; want local changes", got)
+	}
+
+	// Local changes to files which differ are refused.
+	testutil.WriteFile(t, []byte("local\n"), td.dir, "c")
+	if got := runFail(td, "checkout", "hoge"); !strings.Contains(got, "\tc\n") {
+		t.Errorf("got %q; want error about c", got)
+	}
+	if got := string(testutil.ReadFile(t, td.dir, ".git", "HEAD")); got != "ref: refs/heads/c\n" {
+		t.Errorf("HEAD = %q; want unchanged", got)
+	}
+	run(td, "checkout", "-f", "c")
+
+	// Further local changes to files whose index entry already matches the target are carried over.
+	testutil.WriteFile(t, nil, td.dir, "b")
+	run(td, "add", "b")
+	testutil.WriteFile(t, []byte("more\n"), td.dir, "b")
+	run(td, "switch", "hoge")
+	if got := testutil.ReadFile(t, td.dir, "b"); string(got) != "more\n" {
+		t.Errorf("b = %q; want local changes", got)
+	}
+	run(td, "checkout", "-f", "c")
+	os.Remove(filepath.Join(td.dir, "b"))
+
+	run(td, "checkout", "-b", "topic", "hoge")
+	if got, want := string(testutil.ReadFile(t, td.dir, ".git", "refs", "heads", "topic")), "8c93c7625fe3d44432383432565e2fc31090833d\n"; got != want {
+		t.Errorf("topic = %q; want %q", got, want)
+	}
+	if got, want := string(testutil.ReadFile(t, td.dir, ".git", "HEAD")), "ref: refs/heads/topic\n"; got != want {
+		t.Errorf("HEAD = %q; want %q", got, want)
+	}
+
+	runFail(td, "switch", "f6cd3846af74cdaf49efe8874e0ecdf6b8c56327")
+	run(td, "checkout", "f6cd384")
+	if got, want := string(testutil.ReadFile(t, td.dir, ".git", "HEAD")), "f6cd3846af74cdaf49efe8874e0ecdf6b8c56327\n"; got != want {
+		t.Errorf("HEAD = %q; want %q", got, want)
+	}
+	if exists("b") || !exists("a") {
+		t.Errorf("b exists or a does not exist after checking out f6cd384")
+	}
+	if got := testutil.ReadFile(t, td.dir, ".git", "logs", "HEAD"); !strings.HasSuffix(string(got), "\tcheckout: moving from topic to f6cd384\n") {
+		t.Errorf("unexpected reflog:\n%s", got)
+	}
+	if got := run(td, "ls-files"); got != "a\n" {
+		t.Errorf("ls-files = %q", got)
+	}
+
+	run(td, "checkout", "master", "out")
+	if !exists("out", "d", "a") {
+		t.Errorf("out/d/a does not exist after checking out master to out")
+	}
+
+	// Creating a branch on an unborn branch repoints HEAD.
+	run(td, "init", "unborn")
+	ud := testD{t, filepath.Join(td.dir, "unborn"), td.ctx}
+	run(ud, "checkout", "-b", "dev")
+	run(ud, "switch", "-c", "topic")
+	if got, want := string(testutil.ReadFile(t, ud.dir, ".git", "HEAD")), "ref: refs/heads/topic\n"; got != want {
+		t.Errorf("HEAD = %q; want %q", got, want)
+	}
+}
+
+func TestAddCheckoutModes(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	run(td, "init")
+	testutil.WriteFile(t, []byte("[core]\n\trepositoryformatversion = 0\n\tfilemode = true\n"), td.dir, ".git", "config")
+	testutil.WriteFile(t, []byte("hi\n"), td.dir, "a")
+	testutil.WriteFile(t, []byte("#!/bin/sh\n"), td.dir, "x.sh")
+	if err := os.Chmod(filepath.Join(td.dir, "x.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", filepath.Join(td.dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WriteFile(t, []byte("z\n"), td.dir, "d", "e", "f")
+	run(td, "init", "sub")
+	testutil.WriteFile(t, []byte("a9bf434324dba625c7d00387e648fdc83da3000a\n"), td.dir, "sub", ".git", "refs", "heads", "master")
+
+	run(td, "add", ".")
+	got := run(td, "ls-files", "-s")
+	want := `100644 45b983be36b73c0788dc9cbcb76cbb80fc7bb057 0	a
+100644 b68025345d5301abad4d9ec9166f455243a0d746 0	d/e/f
+120000 2e65efe2a145dda7ee51d1741299f848e5bf752e 0	link
+160000 a9bf434324dba625c7d00387e648fdc83da3000a 0	sub
+100755 1a2485251c33a70432394c93fb89330ef214bfc9 0	x.sh
+`
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("(-got +want)\n%s", diff)
+	}
+	tree := strings.TrimSpace(run(td, "write-tree"))
+	if want := "9991e88a015e86f3bfcf4f4defd0d982e31604be"; tree != want {
+		t.Errorf("write-tree = %s; want %s", tree, want)
+	}
+
+	run(td, "checkout", tree, "out")
+	if fi, err := os.Stat(filepath.Join(td.dir, "out", "x.sh")); err != nil || fi.Mode()&0100 == 0 {
+		t.Errorf("x.sh is not executable: %v", err)
+	}
+	if s, err := os.Readlink(filepath.Join(td.dir, "out", "link")); err != nil || s != "a" {
+		t.Errorf("link -> %q, %v; want a", s, err)
+	}
+	if fi, err := os.Stat(filepath.Join(td.dir, "out", "sub")); err != nil || !fi.IsDir() {
+		t.Errorf("sub is not a directory: %v", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(td.dir, ".git", "config"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("\tsymlinks = false\n")
+	f.Close()
+	run(td, "checkout", tree, "out2")
+	if got := testutil.ReadFile(t, td.dir, "out2", "link"); string(got) != "a" {
+		t.Errorf("link = %q; want a plain file containing a", got)
+	}
+}
+
+func TestReset(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	testutil.Copy(t, filepath.Join(td.dir, ".git"), "testdata/gitdir2")
+	run(td, "checkout", "-f", "master")
+
+	head := func() string {
+		return string(testutil.ReadFile(t, td.dir, ".git", "refs", "heads", "master"))
+	}
+	exists := func(p string) bool {
+		_, err := os.Stat(filepath.Join(td.dir, p))
+		return err == nil
+	}
+
+	run(td, "reset", "--soft", "HEAD~1")
+	if got, want := head(), "0a380ee19ff3c304bd4c6bd8d0000d4c1070b3d3\n"; got != want {
+		t.Errorf("master = %q; want %q", got, want)
+	}
+	if got, want := string(testutil.ReadFile(t, td.dir, ".git", "ORIG_HEAD")), "7a7dd58919381869a1e39be3d0c7f45978a3a04f\n"; got != want {
+		t.Errorf("ORIG_HEAD = %q; want %q", got, want)
+	}
+	if got, want := run(td, "ls-files"), "a\nb\nc\nd/a\n"; got != want {
+		t.Errorf("ls-files = %q; want %q", got, want)
+	}
+
+	run(td, "reset")
+	if got, want := run(td, "ls-files"), "a\nb\nc\n"; got != want {
+		t.Errorf("ls-files = %q; want %q", got, want)
+	}
+	if !exists("d/a") {
+		t.Errorf("d/a is removed by mixed reset")
+	}
+
+	run(td, "reset", "7a7dd58", "--", "d")
+	if got, want := run(td, "ls-files"), "a\nb\nc\nd/a\n"; got != want {
+		t.Errorf("ls-files = %q; want %q", got, want)
+	}
+	if got, want := head(), "0a380ee19ff3c304bd4c6bd8d0000d4c1070b3d3\n"; got != want {
+		t.Errorf("master = %q; want %q", got, want)
+	}
+
+	run(td, "reset", "--hard", "hoge")
+	if got, want := head(), "8c93c7625fe3d44432383432565e2fc31090833d\n"; got != want {
+		t.Errorf("master = %q; want %q", got, want)
+	}
+	if got, want := run(td, "ls-files"), "a\nb\n"; got != want {
+		t.Errorf("ls-files = %q; want %q", got, want)
+	}
+	if exists("c") || exists("d/a") {
+		t.Errorf("c or d/a exists after hard reset")
+	}
+	if got := testutil.ReadFile(t, td.dir, ".git", "logs", "refs", "heads", "master"); !strings.HasSuffix(string(got), "\treset: moving to hoge\n") {
+		t.Errorf("unexpected reflog:\n%s", got)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	testutil.Copy(t, filepath.Join(td.dir, ".git"), "testdata/gitdir2")
+	run(td, "checkout", "-f", "master")
+
+	read := func(p string) string {
+		return string(testutil.ReadFile(t, td.dir, p))
+	}
+	exists := func(p string) bool {
+		_, err := os.Stat(filepath.Join(td.dir, p))
+		return err == nil
+	}
+	const hoge = "2262de0c121f22df8e78f5a37d6e114fd322c0b0"
+
+	testutil.WriteFile(t, []byte("x\n"), td.dir, "a")
+	run(td, "restore", "a")
+	if got := read("a"); got != "hoge\n" {
+		t.Errorf("a = %q; want hoge", got)
+	}
+
+	testutil.WriteFile(t, []byte("x\n"), td.dir, "b")
+	testutil.WriteFile(t, []byte("x\n"), td.dir, "c")
+	run(td, "restore", "[bc]")
+	if read("b") != "" || read("c") != "" {
+		t.Errorf("b or c is not restored")
+	}
+
+	testutil.WriteFile(t, []byte("x\n"), td.dir, "a")
+	run(td, "add", "a")
+	run(td, "restore", "--staged", "a")
+	if got := run(td, "ls-files", "-s"); !strings.Contains(got, hoge+" 0\ta\n") {
+		t.Errorf("a is not restored in the index:\n%s", got)
+	}
+	if got := read("a"); got != "x\n" {
+		t.Errorf("a = %q; want the local change kept", got)
+	}
+
+	run(td, "restore", "--source=hoge", "d/*")
+	if exists("d/a") {
+		t.Errorf("d/a exists after restoring from hoge")
+	}
+	run(td, "checkout", "--", "d")
+	if !exists("d/a") {
+		t.Errorf("d/a is not restored from the index")
+	}
+
+	run(td, "checkout", "hoge", "--", "*")
+	if got := read("a"); got != "hoge\n" {
+		t.Errorf("a = %q; want hoge", got)
+	}
+	if !exists("c") || !exists("d/a") {
+		t.Errorf("checkout with a tree-ish removed files missing in it")
+	}
+	runFail(td, "checkout", "hoge", "--", "c")
+	run(td, "restore", "--source", "f6cd384", "--staged", "--worktree", "b")
+	if exists("b") {
+		t.Errorf("b exists after restoring from f6cd384")
+	}
+	if got, want := run(td, "ls-files"), "a\nc\nd/a\n"; got != want {
+		t.Errorf("ls-files = %q; want %q", got, want)
+	}
+}
+
+// craftCommit stores a commit whose tree has a file with the content at the slash separated
+// path p, which may be one git refuses to check out, and returns the commit.
+func craftCommit(td testD, p, content string) string {
+	hash := func(typ, data string) string {
+		testutil.WriteFile(td.t, []byte(data), td.dir, ".git", "crafted")
+		return strings.TrimSpace(run(td, "hash-object", "-w", "-t", typ, filepath.Join(".git", "crafted")))
+	}
+	sha, mode := hash("blob", content), "100644"
+	cs := strings.Split(p, "/")
+	for i := len(cs) - 1; i >= 0; i-- {
+		b, err := hex.DecodeString(sha)
+		if err != nil {
+			td.t.Fatal(err)
+		}
+		sha, mode = hash("tree", mode+" "+cs[i]+"\x00"+string(b)), "40000"
+	}
+	return hash("commit", "tree "+sha+"\nauthor A <a@example.com> 0 +0000\ncommitter A <a@example.com> 0 +0000\n\ncrafted\n")
+}
+
+func TestInvalidPaths(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+	work := testD{t, filepath.Join(td.dir, "work"), td.ctx}
+	if err := os.Mkdir(work.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	run(work, "init")
+	testutil.WriteFile(t, []byte("a\n"), work.dir, "a")
+	run(work, "add", "a")
+	run(work, "commit", "-m", "one")
+	config := string(testutil.ReadFile(t, work.dir, ".git", "config"))
+
+	for _, p := range []string{"../escaped.txt", ".git/config", ".GIT/config", "d/./x"} {
+		c := craftCommit(work, p, "evil\n")
+		for _, args := range [][]string{{"checkout", c}, {"reset", "--hard", c}, {"checkout", c, "out"}} {
+			if got := runFail(work, args...); !strings.Contains(got, "invalid path '") {
+				t.Errorf("%v for %s = %q; want an invalid path error", args, p, got)
+			}
+		}
+		run(work, "reset", "--hard", "master")
+	}
+	if _, err := os.Stat(filepath.Join(td.dir, "escaped.txt")); !os.IsNotExist(err) {
+		t.Errorf("escaped.txt is written outside the worktree: %v", err)
+	}
+	if got := string(testutil.ReadFile(t, work.dir, ".git", "config")); got != config {
+		t.Errorf(".git/config = %q; want it untouched", got)
+	}
+
+	// A file is not written through a symlink in place of its directory.
+	if err := os.Mkdir(filepath.Join(td.dir, "outside"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(td.dir, "outside"), filepath.Join(work.dir, "d")); err != nil {
+		t.Fatal(err)
+	}
+	run(work, "reset", "--hard", craftCommit(work, "d/x", "x\n"))
+	if _, err := os.Stat(filepath.Join(td.dir, "outside", "x")); !os.IsNotExist(err) {
+		t.Errorf("d/x is written through the symlink: %v", err)
+	}
+	if got := string(testutil.ReadFile(t, work.dir, "d", "x")); got != "x\n" {
+		t.Errorf("d/x = %q; want %q", got, "x\n")
+	}
+}
+
+func TestDiffTree(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	testutil.Copy(t, filepath.Join(td.dir, ".git"), "testdata/gitdir2")
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"0a380ee", "7a7dd58"}, ":000000 040000 0000000000000000000000000000000000000000 496d6428b9cf92981dc9495211e6e1120fb6f2ba A\td\n"},
+		{[]string{"-r", "7a7dd58"}, "7a7dd58919381869a1e39be3d0c7f45978a3a04f\n:000000 100644 0000000000000000000000000000000000000000 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 A\td/a\n"},
+		{[]string{"-r", "--name-status", "f6cd384", "7a7dd58"}, "A\tb\nA\tc\nA\td/a\n"},
+		{[]string{"-r", "--name-status", "7a7dd58", "hoge"}, "D\tc\nD\td/a\n"},
+		{[]string{"-r", "--name-only", "f6cd384", "7a7dd58", "--", "d", "b"}, "b\nd/a\n"},
+		{[]string{"--name-only", "f6cd384", "7a7dd58", "d/a"}, "d\n"},
+		{[]string{"-r", "0a380ee", "7a7dd58", "a"}, ""},
+		{[]string{"0a380ee"}, ""},
+	} {
+		if got := run(td, append([]string{"diff-tree"}, tc.args...)...); got != tc.want {
+			t.Errorf("diff-tree %v = %q; want %q", tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestDiffTreePatch(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	run(td, "init")
+	testutil.WriteFile(t, []byte("a\nb\nc\nd\ne\nf\ng\nh\n"), td.dir, "f")
+	testutil.WriteFile(t, []byte("gone\n"), td.dir, "g")
+	run(td, "add", ".")
+	t1 := strings.TrimSpace(run(td, "write-tree"))
+	testutil.WriteFile(t, []byte("a\nB\nc\nd\ne\nf\ng\nH"), td.dir, "f")
+	if err := os.Remove(filepath.Join(td.dir, "g")); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WriteFile(t, []byte("\x00"), td.dir, "bin")
+	run(td, "add", ".")
+	t2 := strings.TrimSpace(run(td, "write-tree"))
+
+	got := run(td, "diff-tree", "-p", t1, t2)
+	want := `diff --git a/bin b/bin
+new file mode 100644
+index 0000000..f76dd23
+Binary files /dev/null and b/bin differ
+diff --git a/f b/f
+index 71ac1b5..9e4cf15 100644
+--- a/f
++++ b/f
+@@ -1,8 +1,8 @@
+ a
+-b
++B
+ c
+ d
+ e
+ f
+ g
+-h
++H
+\ No newline at end of file
+diff --git a/g b/g
+deleted file mode 100644
+index 286c5f5..0000000
+--- a/g
++++ /dev/null
+@@ -1 +0,0 @@
+-gone
+`
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("(-got +want)\n%s", diff)
+	}
+
+	got = run(td, "diff-tree", "-p", "-U", "1", t1, t2, "f")
+	want = `diff --git a/f b/f
+index 71ac1b5..9e4cf15 100644
+--- a/f
++++ b/f
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+@@ -7,2 +7,2 @@ f
+ g
+-h
++H
+\ No newline at end of file
+`
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("(-got +want)\n%s", diff)
+	}
+	if got := run(td, "diff-tree", "-p", "-U1", t1, t2, "f"); got != want {
+		t.Errorf("diff-tree -U1 = %q; want %q", got, want)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	testutil.Copy(t, filepath.Join(td.dir, ".git"), "testdata/gitdir2")
+	run(td, "checkout", "-f", "master")
+	testutil.WriteFile(t, []byte("hoge\nfuga\n"), td.dir, "a")
+	run(td, "add", "a")
+	testutil.WriteFile(t, []byte("hoge\nfuga\npiyo\n"), td.dir, "a")
+	testutil.WriteFile(t, []byte("new\n"), td.dir, "c")
+	if err := os.Chmod(filepath.Join(td.dir, "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(td.dir, "d", "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"diff"}, `diff --git a/a b/a
+index e42f4ce..1a57997 100644
+--- a/a
++++ b/a
+@@ -1,2 +1,3 @@
+ hoge
+ fuga
++piyo
+diff --git a/b b/b
+old mode 100644
+new mode 100755
+diff --git a/c b/c
+index e69de29..3e75765 100644
+--- a/c
++++ b/c
+@@ -0,0 +1 @@
++new
+diff --git a/d/a b/d/a
+deleted file mode 100644
+index e69de29..0000000
+`},
+		{[]string{"diff", "--cached"}, `diff --git a/a b/a
+index 2262de0..e42f4ce 100644
+--- a/a
++++ b/a
+@@ -1 +1,2 @@
+ hoge
++fuga
+`},
+		{[]string{"diff", "HEAD", "--", "a"}, `diff --git a/a b/a
+index 2262de0..1a57997 100644
+--- a/a
++++ b/a
+@@ -1 +1,3 @@
+ hoge
++fuga
++piyo
+`},
+		{[]string{"diff", "HEAD~1", "HEAD"}, `diff --git a/d/a b/d/a
+new file mode 100644
+index 0000000..e69de29
+`},
+		{[]string{"diff", "HEAD~2..HEAD", "--stat"}, ` b   | 0
+ d/a | 0
+ 2 files changed, 0 insertions(+), 0 deletions(-)
+`},
+		{[]string{"diff", "--numstat"}, "1\t0\ta\n0\t0\tb\n1\t0\tc\n0\t0\td/a\n"},
+		{[]string{"diff", "--name-only", "HEAD"}, "a\nb\nc\nd/a\n"},
+		{[]string{"diff", "--cached", "--color=always"}, "\x1b[1mdiff --git a/a b/a\x1b[m\n" +
+			"\x1b[1mindex 2262de0..e42f4ce 100644\x1b[m\n" +
+			"\x1b[1m--- a/a\x1b[m\n" +
+			"\x1b[1m+++ b/a\x1b[m\n" +
+			"\x1b[36m@@ -1 +1,2 @@\x1b[m\n" +
+			" hoge\x1b[m\n" +
+			"\x1b[32m+\x1b[m\x1b[32mfuga\x1b[m\n"},
+	} {
+		if diff := cmp.Diff(run(td, tc.args...), tc.want); diff != "" {
+			t.Errorf("%v: (-got +want)\n%s", tc.args, diff)
+		}
+	}
+
+	runFail(td, "diff", "--exit-code")
+}
+
+func TestDiffNoIndex(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	testutil.WriteFile(t, []byte("a\n"), td.dir, "d1", "a")
+	testutil.WriteFile(t, []byte("b\n"), td.dir, "d2", "a")
+	testutil.WriteFile(t, []byte("x\n"), td.dir, "d1", "s", "b")
+	testutil.WriteFile(t, []byte("y\n"), td.dir, "d2", "s", "c")
+
+	if got, want := runFail(td, "diff", "--no-index", "d1", "nope"), "diff:  Could not access 'nope'\n"; got != want {
+		t.Errorf("diff --no-index d1 nope: got %q; want %q", got, want)
+	}
+	cmd := exec.CommandContext(td.ctx, prog, "diff", "--no-index", "--stat", "d1", "d2")
+	cmd.Dir = td.dir
+	b, err := cmd.Output()
+	if e, ok := err.(*exec.ExitError); !ok || e.ExitCode() != 1 {
+		t.Fatalf("diff --no-index: got %v; want exit status 1", err)
+	}
+	want := ` {d1 => d2}/a        | 2 +-
+ d1/s/b => /dev/null | 1 -
+ /dev/null => d2/s/c | 1 +
+ 3 files changed, 2 insertions(+), 2 deletions(-)
+`
+	if diff := cmp.Diff(string(b), want); diff != "" {
+		t.Errorf("(-got +want)\n%s", diff)
+	}
+}
+
+func TestDiffRenames(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	run(td, "init")
+	var b strings.Builder
+	for i := 1; i <= 19; i++ {
+		fmt.Fprintln(&b, i)
+	}
+	testutil.WriteFile(t, []byte("same\n"), td.dir, "a")
+	testutil.WriteFile(t, []byte(b.String()+"20\n"), td.dir, "c")
+	run(td, "add", ".")
+	t1 := strings.TrimSpace(run(td, "write-tree"))
+	for _, p := range []string{"a", "c"} {
+		if err := os.Remove(filepath.Join(td.dir, p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testutil.WriteFile(t, []byte("same\n"), td.dir, "b")
+	testutil.WriteFile(t, []byte(b.String()+"x\n"), td.dir, "d")
+	run(td, "add", ".")
+	t2 := strings.TrimSpace(run(td, "write-tree"))
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"diff", t1, t2}, `diff --git a/a b/b
+similarity index 100%
+rename from a
+rename to b
+diff --git a/c b/d
+similarity index 94%
+rename from c
+rename to d
+index 0ff3bbb..0eb0c05 100644
+--- a/c
++++ b/d
+@@ -17,4 +17,4 @@
+ 17
+ 18
+ 19
+-20
++x
+`},
+		{[]string{"diff", "--stat", t1, t2}, ` a => b | 0
+ c => d | 2 +-
+ 2 files changed, 1 insertion(+), 1 deletion(-)
+`},
+		{[]string{"diff", "--name-status", "-M95%", t1, t2}, "R100\ta\tb\nD\tc\nA\td\n"},
+		{[]string{"diff-tree", "--name-status", "-M50%", t1, t2}, "R100\ta\tb\nR094\tc\td\n"},
+		{[]string{"diff-tree", "--name-status", "-C95%", t1, t2}, "R100\ta\tb\nD\tc\nA\td\n"},
+		{[]string{"diff", "--name-status", "--no-renames", t1, t2}, "D\ta\nA\tb\nD\tc\nA\td\n"},
+		{[]string{"diff-tree", "-r", "-M", t1, t2}, `:100644 100644 1275430f1765c63e539cb0452565563bd6aef6a6 1275430f1765c63e539cb0452565563bd6aef6a6 R100	a	b
+:100644 100644 0ff3bbb9c8bba2291654cd64067fa417ff54c508 0eb0c053cfdbd93a6af4053777c2db2052da0fdd R094	c	d
+`},
+	} {
+		if diff := cmp.Diff(run(td, tc.args...), tc.want); diff != "" {
+			t.Errorf("%v: (-got +want)\n%s", tc.args, diff)
+		}
+	}
+}
+
+func TestShow(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	testutil.Copy(t, filepath.Join(td.dir, ".git"), "testdata/gitdir3")
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"hevy"}, `tag hevy
+Tagger: Keigo Oka <ogiekako@gmail.com>
+Date:   Mon Mar 23 00:51:27 2020 +0900
+
+hevy
+
+commit 7a7dd58919381869a1e39be3d0c7f45978a3a04f
+Author: Keigo Oka <ogiekako@gmail.com>
+Date:   Sat Mar 21 19:07:53 2020 +0900
+
+    add dir
+
+diff --git a/d/a b/d/a
+new file mode 100644
+index 0000000..e69de29
+`},
+		{[]string{"HEAD~1"}, `commit 0a380ee19ff3c304bd4c6bd8d0000d4c1070b3d3
+Merge: 6aba443 8c93c76
+Author: Keigo Oka <ogiekako@gmail.com>
+Date:   Sat Mar 21 15:54:13 2020 +0900
+
+    Merge branch 'hoge'
+
+`},
+		{[]string{"--stat", "HEAD"}, `commit 7a7dd58919381869a1e39be3d0c7f45978a3a04f
+Author: Keigo Oka <ogiekako@gmail.com>
+Date:   Sat Mar 21 19:07:53 2020 +0900
+
+    add dir
+
+ d/a | 0
+ 1 file changed, 0 insertions(+), 0 deletions(-)
+`},
+		{[]string{"HEAD:a", "HEAD^{tree}", "HEAD:d"}, `hoge
+tree HEAD^{tree}
+
+a
+b
+c
+d/
+
+tree HEAD:d
+
+a
+`},
+	} {
+		if diff := cmp.Diff(run(td, append([]string{"show"}, tc.args...)...), tc.want); diff != "" {
+			t.Errorf("%v: (-got +want)\n%s", tc.args, diff)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	lines := func(ls ...string) []byte { return []byte(strings.Join(ls, "\n") + "\n") }
+	commit := func(msg string, files map[string][]byte) {
+		for p, b := range files {
+			testutil.WriteFile(t, b, td.dir, p)
+		}
+		run(td, "add", ".")
+		run(td, "commit", "-m", msg)
+	}
+	parents := func() int {
+		return strings.Count(run(td, "cat-file", "-p", "HEAD"), "\nparent ")
+	}
+
+	run(td, "init")
+	commit("base", map[string][]byte{"a": lines("1", "2", "3", "4", "5", "6", "7", "8", "9")})
+	run(td, "checkout", "-b", "side")
+	commit("side", map[string][]byte{"a": lines("1", "2", "3", "4", "5", "6", "7", "8", "nine"), "s": lines("s")})
+	run(td, "checkout", "master")
+	run(td, "checkout", "-b", "ff")
+	commit("ff", map[string][]byte{"f": lines("f")})
+	run(td, "checkout", "master")
+
+	if got := run(td, "merge", "--ff-only", "ff"); !strings.Contains(got, "Fast-forward\n") {
+		t.Errorf("merge --ff-only = %q; want a fast-forward", got)
+	}
+	runFail(td, "merge", "--ff-only", "side")
+	if got, want := run(td, "merge", "side"), "Merge made by the 'ort' strategy.\n"; !strings.HasPrefix(got, want) {
+		t.Errorf("merge = %q; want prefix %q", got, want)
+	}
+	if got, want := string(testutil.ReadFile(t, td.dir, "a")), string(lines("1", "2", "3", "4", "5", "6", "7", "8", "nine")); got != want {
+		t.Errorf("a = %q; want %q", got, want)
+	}
+	if got := parents(); got != 2 {
+		t.Errorf("merge commit has %d parents; want 2", got)
+	}
+	if got, want := run(td, "merge", "side"), "Already up to date.\n"; got != want {
+		t.Errorf("merge = %q; want %q", got, want)
+	}
+
+	// Conflicts are recorded in the index and the worktree until the merge is concluded.
+	run(td, "checkout", "-b", "conflict")
+	commit("theirs", map[string][]byte{"a": lines("1", "2", "3", "4", "FIVE", "6", "7", "8", "nine")})
+	run(td, "checkout", "master")
+	commit("ours", map[string][]byte{"a": lines("1", "2", "3", "4", "five", "6", "7", "8", "nine")})
+	head := run(td, "rev-parse", "HEAD")
+	runFail(td, "merge", "conflict")
+	if got, want := run(td, "ls-files", "-s"), `100644 e952784d6ea184b32977bcc43ba488ef9d1ee9a5 1	a
+100644 96be67428518d7e9bca3b19a0c4212ef82924d27 2	a
+100644 0ed32f6e3f586769ef7b6bd01401d68e55b19b8c 3	a
+100644 6a69f92020f5df77af6e8813ff1232493383b708 0	f
+100644 b4785957bc986dc39c629de9fac9df46972c00fc 0	s
+`; got != want {
+		t.Errorf("ls-files -s = %q; want %q", got, want)
+	}
+	wantA := lines("1", "2", "3", "4", "<<<<<<< HEAD", "five", "=======", "FIVE", ">>>>>>> conflict", "6", "7", "8", "nine")
+	if got := testutil.ReadFile(t, td.dir, "a"); string(got) != string(wantA) {
+		t.Errorf("a = %q; want %q", got, wantA)
+	}
+	runFail(td, "commit", "-m", "unresolved")
+
+	run(td, "merge", "--abort")
+	if got := run(td, "rev-parse", "HEAD"); got != head {
+		t.Errorf("HEAD = %q after --abort; want %q", got, head)
+	}
+	if _, err := os.Stat(filepath.Join(td.dir, ".git", "MERGE_HEAD")); !os.IsNotExist(err) {
+		t.Errorf("MERGE_HEAD exists after --abort: %v", err)
+	}
+
+	// A hard reset forgets the merge, so that it can be started again.
+	runFail(td, "merge", "conflict")
+	run(td, "reset", "--hard")
+	for _, f := range []string{"MERGE_HEAD", "MERGE_MSG", "MERGE_MODE"} {
+		if _, err := os.Stat(filepath.Join(td.dir, ".git", f)); !os.IsNotExist(err) {
+			t.Errorf("%s exists after reset --hard: %v", f, err)
+		}
+	}
+
+	if got := runFail(td, "merge", "conflict"); strings.Contains(got, "not concluded") {
+		t.Errorf("merge after reset --hard = %q", got)
+	}
+	testutil.WriteFile(t, lines("1", "2", "3", "4", "5", "6", "7", "8", "nine"), td.dir, "a")
+	run(td, "add", "a")
+	if got, want := run(td, "merge", "--continue"), "Merge branch 'conflict'"; !strings.HasSuffix(got, "] "+want+"\n") {
+		t.Errorf("merge --continue = %q; want subject %q", got, want)
+	}
+	if got := parents(); got != 2 {
+		t.Errorf("merge commit has %d parents; want 2", got)
+	}
+}
+
+func TestMergeBase(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	testutil.Copy(t, filepath.Join(td.dir, ".git"), "testdata/gitdir2")
+
+	const (
+		base = "f6cd3846af74cdaf49efe8874e0ecdf6b8c56327\n"
+		c    = "6aba443f3b8da367cafd04b17c0d33acbdec8475\n"
+		hoge = "8c93c7625fe3d44432383432565e2fc31090833d\n"
+	)
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"c", "hoge"}, base},
+		{[]string{"--all", "c", "hoge"}, base},
+		{[]string{"c", "master"}, c},
+		{[]string{"-a", "c", "hoge", "master"}, c},
+		{[]string{"--octopus", "c", "hoge", "master"}, base},
+	} {
+		if got := run(td, append([]string{"merge-base"}, tc.args...)...); got != tc.want {
+			t.Errorf("merge-base %v = %q; want %q", tc.args, got, tc.want)
+		}
+	}
+	run(td, "merge-base", "--is-ancestor", "hoge", "master")
+	runFail(td, "merge-base", "--is-ancestor", "master", "hoge")
+
+	// Rewind hoge after forking topic from it.
+	run(td, "checkout", "hoge")
+	run(td, "checkout", "-b", "topic")
+	testutil.WriteFile(t, []byte("t\n"), td.dir, "t")
+	run(td, "add", "t")
+	run(td, "commit", "-m", "topic")
+	run(td, "checkout", "hoge")
+	run(td, "reset", "--hard", "HEAD~1")
+	testutil.WriteFile(t, []byte("u\n"), td.dir, "u")
+	run(td, "add", "u")
+	run(td, "commit", "-m", "upstream")
+
+	if got := run(td, "merge-base", "hoge", "topic"); got != base {
+		t.Errorf("merge-base = %q; want %q", got, base)
+	}
+	if got := run(td, "merge-base", "--fork-point", "hoge", "topic"); got != hoge {
+		t.Errorf("merge-base --fork-point = %q; want %q", got, hoge)
+	}
+	runFail(td, "merge-base", "--is-ancestor", "hoge", "topic")
+}
+
+func TestCherryPick(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	testutil.Copy(t, filepath.Join(td.dir, ".git"), "testdata/gitdir2")
+	exists := func(p string) bool {
+		_, err := os.Stat(filepath.Join(td.dir, p))
+		return err == nil
+	}
+	message := func(rev string) string {
+		return strings.SplitN(run(td, "cat-file", "-p", rev), "\n\n", 2)[1]
+	}
+	subjects := func() string {
+		var ss []string
+		for _, rev := range []string{"HEAD", "HEAD~1", "HEAD~2"} {
+			ss = append(ss, strings.SplitN(message(rev), "\n", 2)[0])
+		}
+		return strings.Join(ss, "\n") + "\n"
+	}
+
+	run(td, "checkout", "c")
+	if got, want := run(td, "cherry-pick", "-x", "hoge"), "add b\n"; !strings.Contains(got, "] "+want) {
+		t.Errorf("cherry-pick = %q; want subject %q", got, want)
+	}
+	got := run(td, "cat-file", "-p", "HEAD")
+	for _, want := range []string{
+		"parent 6aba443f3b8da367cafd04b17c0d33acbdec8475\n",
+		"author Keigo Oka <ogiekako@gmail.com> 1584773531 +0900\n",
+		"\nadd b\n\n(cherry picked from commit 8c93c7625fe3d44432383432565e2fc31090833d)\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("cherry-picked commit %q lacks %q", got, want)
+		}
+	}
+	if !exists("b") {
+		t.Error("b is not cherry-picked")
+	}
+
+	run(td, "revert", "HEAD")
+	if got, want := message("HEAD"), "Revert \"add b\"\n\nThis reverts commit "; !strings.HasPrefix(got, want) {
+		t.Errorf("revert message = %q; want prefix %q", got, want)
+	}
+	if exists("b") {
+		t.Error("b is not reverted")
+	}
+
+	runFail(td, "cherry-pick", "0a380ee")
+	run(td, "cherry-pick", "-m", "1", "0a380ee")
+	if !exists("b") {
+		t.Error("b is not cherry-picked from the merge")
+	}
+
+	// A sequence stopping at a conflict.
+	run(td, "checkout", "-b", "side")
+	testutil.WriteFile(t, []byte("side\n"), td.dir, "a")
+	run(td, "add", "a")
+	run(td, "commit", "-m", "side a")
+	testutil.WriteFile(t, []byte("s\n"), td.dir, "s")
+	run(td, "add", "s")
+	run(td, "commit", "-m", "side s")
+	run(td, "checkout", "c")
+	testutil.WriteFile(t, []byte("c\n"), td.dir, "a")
+	run(td, "add", "a")
+	run(td, "commit", "-m", "c a")
+	head := run(td, "rev-parse", "HEAD")
+
+	runFail(td, "cherry-pick", "side~1", "side")
+	if !exists(".git/CHERRY_PICK_HEAD") || !exists(".git/sequencer/todo") {
+		t.Error("cherry-pick did not record the sequence")
+	}
+	runFail(td, "cherry-pick", "side")
+	run(td, "cherry-pick", "--abort")
+	if got := run(td, "rev-parse", "HEAD"); got != head {
+		t.Errorf("HEAD = %q after --abort; want %q", got, head)
+	}
+	if exists(".git/CHERRY_PICK_HEAD") || exists(".git/sequencer") {
+		t.Error("--abort left the sequence")
+	}
+
+	runFail(td, "cherry-pick", "side~1", "side")
+	run(td, "cherry-pick", "--skip")
+	if got, want := subjects(), "side s\nc a\nMerge branch 'hoge'\n"; got != want {
+		t.Errorf("subjects after --skip = %q; want %q", got, want)
+	}
+
+	run(td, "reset", "--hard", "HEAD~1")
+	runFail(td, "cherry-pick", "side~1", "side")
+	testutil.WriteFile(t, []byte("resolved\n"), td.dir, "a")
+	run(td, "add", "a")
+	run(td, "cherry-pick", "--continue")
+	if got, want := subjects(), "side s\nside a\nc a\n"; got != want {
+		t.Errorf("subjects after --continue = %q; want %q", got, want)
+	}
+	if exists(".git/CHERRY_PICK_HEAD") || exists(".git/sequencer") {
+		t.Error("--continue left the sequence")
+	}
+	if got := string(testutil.ReadFile(t, td.dir, "a")); got != "resolved\n" {
+		t.Errorf("a = %q; want the resolution", got)
+	}
+}
+
+func TestRebase(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	testutil.Copy(t, filepath.Join(td.dir, ".git"), "testdata/gitdir2")
+	exists := func(p string) bool {
+		_, err := os.Stat(filepath.Join(td.dir, p))
+		return err == nil
+	}
+	subjects := func(n int) string {
+		var ss []string
+		for i := 0; i < n; i++ {
+			msg := strings.SplitN(run(td, "cat-file", "-p", fmt.Sprintf("HEAD~%d", i)), "\n\n", 2)[1]
+			ss = append(ss, strings.SplitN(msg, "\n", 2)[0])
+		}
+		return strings.Join(ss, "\n") + "\n"
+	}
+	commit := func(file, content, msg string) {
+		testutil.WriteFile(t, []byte(content), td.dir, file)
+		run(td, "add", file)
+		run(td, "commit", "-m", msg)
+	}
+	for k, v := range map[string]string{"GIT_EDITOR": "true", "GIT_SEQUENCE_EDITOR": "true"} {
+		old, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+		defer func(k string) {
+			if ok {
+				os.Setenv(k, old)
+			} else {
+				os.Unsetenv(k)
+			}
+		}(k)
+	}
+
+	run(td, "checkout", "c")
+	run(td, "reset", "--hard")
+	run(td, "checkout", "-b", "side")
+	commit("s", "s\n", "side s")
+	commit("a", "side\n", "side a")
+	commit("t", "t\n", "side t")
+	run(td, "checkout", "c")
+	commit("a", "c\n", "c a")
+	commit("u", "u\n", "c u")
+	base := run(td, "rev-parse", "HEAD")
+
+	// A conflict aborted.
+	run(td, "checkout", "side")
+	orig := run(td, "rev-parse", "HEAD")
+	runFail(td, "rebase", "c")
+	if !exists(".git/rebase-merge/git-rebase-todo") || !exists(".git/REBASE_HEAD") {
+		t.Error("rebase did not record its state")
+	}
+	runFail(td, "rebase", "c")
+	run(td, "rebase", "--abort")
+	if got := run(td, "rev-parse", "HEAD"); got != orig {
+		t.Errorf("HEAD = %q after --abort; want %q", got, orig)
+	}
+	if got, want := string(testutil.ReadFile(t, td.dir, ".git/HEAD")), "ref: refs/heads/side\n"; got != want {
+		t.Errorf("HEAD = %q after --abort; want %q", got, want)
+	}
+
+	// A conflict resolved.
+	runFail(td, "rebase", "c")
+	testutil.WriteFile(t, []byte("resolved\n"), td.dir, "a")
+	run(td, "add", "a")
+	run(td, "rebase", "--continue")
+	if got, want := subjects(5), "side t\nside a\nside s\nc u\nc a\n"; got != want {
+		t.Errorf("subjects after rebase = %q; want %q", got, want)
+	}
+	if got, want := run(td, "rev-parse", "HEAD~3"), base; got != want {
+		t.Errorf("rebased onto %q; want %q", got, want)
+	}
+	if exists(".git/rebase-merge") {
+		t.Error("--continue left the rebase state")
+	}
+	if got := run(td, "rev-parse", "ORIG_HEAD"); got != orig {
+		t.Errorf("ORIG_HEAD = %q; want %q", got, orig)
+	}
+	run(td, "rebase", "c")
+
+	// An interactive rebase with autosquash, drop and exec.
+	commit("s", "s2\n", "fixup! side s")
+	commit("v", "v\n", "side v")
+	os.Setenv("GIT_SEQUENCE_EDITOR", `sed -i -e "s/^pick \(.*\) side t$/drop \1 side t/" -e "\$a exec touch executed"`)
+	run(td, "rebase", "-i", "--autosquash", "c")
+	if got, want := subjects(4), "side v\nside a\nside s\nc u\n"; got != want {
+		t.Errorf("subjects after rebase -i = %q; want %q", got, want)
+	}
+	if got := string(testutil.ReadFile(t, td.dir, "s")); got != "s2\n" {
+		t.Errorf("s = %q; want the fixup", got)
+	}
+	if exists("t") {
+		t.Error("t is not dropped")
+	}
+	if !exists("executed") {
+		t.Error("exec did not run")
+	}
+
+	// An edit stop, amended and continued.
+	os.Setenv("GIT_SEQUENCE_EDITOR", `sed -i -e "s/^pick \(.*\) side a$/edit \1 side a/"`)
+	run(td, "rebase", "-i", "HEAD~3")
+	testutil.WriteFile(t, []byte("edited\n"), td.dir, "a")
+	run(td, "add", "a")
+	run(td, "commit", "--amend", "-m", "side a edited")
+	run(td, "rebase", "--continue")
+	if got, want := subjects(3), "side v\nside a edited\nside s\n"; got != want {
+		t.Errorf("subjects after edit = %q; want %q", got, want)
+	}
+}
+
+func TestStash(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	exists := func(p string) bool {
+		_, err := os.Stat(filepath.Join(td.dir, p))
+		return err == nil
+	}
+	read := func(p string) string { return string(testutil.ReadFile(t, td.dir, p)) }
+
+	run(td, "init")
+	testutil.WriteFile(t, []byte("a\n"), td.dir, "a")
+	testutil.WriteFile(t, []byte("b\n"), td.dir, "b")
+	run(td, "add", ".")
+	run(td, "commit", "-m", "base")
+	if got, want := run(td, "stash"), "No local changes to save\n"; got != want {
+		t.Errorf("stash = %q; want %q", got, want)
+	}
+
+	testutil.WriteFile(t, []byte("a2\n"), td.dir, "a")
+	testutil.WriteFile(t, []byte("b2\n"), td.dir, "b")
+	run(td, "add", "b")
+	testutil.WriteFile(t, []byte("u\n"), td.dir, "u")
+	run(td, "stash", "push", "-u", "-m", "work")
+	if got, want := run(td, "stash", "list"), "stash@{0}: On master: work\n"; got != want {
+		t.Errorf("stash list = %q; want %q", got, want)
+	}
+	if read("a") != "a\n" || read("b") != "b\n" || exists("u") {
+		t.Error("stash did not reset the worktree")
+	}
+	if got, want := strings.Count(run(td, "cat-file", "-p", "stash"), "parent "), 3; got != want {
+		t.Errorf("stash commit has %d parents; want %d", got, want)
+	}
+	if got, want := run(td, "cat-file", "-p", "stash^2:b"), "b2\n"; got != want {
+		t.Errorf("stashed index b = %q; want %q", got, want)
+	}
+
+	run(td, "stash", "apply", "--index")
+	if read("a") != "a2\n" || read("b") != "b2\n" || read("u") != "u\n" {
+		t.Error("stash apply did not restore the worktree")
+	}
+	if got, want := run(td, "ls-files", "-s"), "100644 78981922613b2afb6025042ff6bd878ac1994e85 0\ta\n100644 e6bfff5c1d0f0ecd501552b43a1e13d8008abc31 0\tb\n"; got != want {
+		t.Errorf("index after apply --index = %q; want %q", got, want)
+	}
+
+	// The entry is kept when popping it conflicts.
+	run(td, "reset", "--hard")
+	os.Remove(filepath.Join(td.dir, "u"))
+	testutil.WriteFile(t, []byte("a3\n"), td.dir, "a")
+	run(td, "add", "a")
+	run(td, "commit", "-m", "a3")
+	runFail(td, "stash", "pop")
+	if got := read("a"); !strings.Contains(got, "<<<<<<< Updated upstream\na3\n=======\na2\n>>>>>>> Stashed changes\n") {
+		t.Errorf("a = %q; want conflict markers", got)
+	}
+	if got, want := run(td, "stash", "list"), "stash@{0}: On master: work\n"; got != want {
+		t.Errorf("stash list after the conflict = %q; want %q", got, want)
+	}
+
+	run(td, "reset", "--hard")
+	os.Remove(filepath.Join(td.dir, "u"))
+	testutil.WriteFile(t, []byte("b3\n"), td.dir, "b")
+	run(td, "stash")
+	if got := run(td, "stash", "list"); !strings.HasPrefix(got, "stash@{0}: WIP on master: ") {
+		t.Errorf("stash list = %q; want the WIP entry first", got)
+	}
+	run(td, "stash", "drop", "1")
+	run(td, "stash", "pop")
+	if got, want := read("b"), "b3\n"; got != want {
+		t.Errorf("b = %q after pop; want %q", got, want)
+	}
+	if got := run(td, "stash", "list"); got != "" {
+		t.Errorf("stash list = %q after pop; want none", got)
+	}
+	runFail(td, "stash", "drop")
+}
+
+// uploadPackServer serves the repository in dir at /src.git for fetching over the smart HTTP
+// protocol.
+func uploadPackServer(t *testing.T, dir string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r, err := git.NewRepo(dir, false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch {
+		case req.URL.Path == "/src.git/info/refs" && req.URL.Query().Get("service") == "git-upload-pack":
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+			io.WriteString(w, "001e# service=git-upload-pack\n0000")
+			err = git.UploadPack(r, nil, w, &git.UploadPackOptions{AdvertiseRefs: true})
+		case req.URL.Path == "/src.git/git-upload-pack":
+			w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+			err = git.UploadPack(r, req.Body, w, &git.UploadPackOptions{StatelessRPC: true})
+		default:
+			http.NotFound(w, req)
+		}
+		if err != nil {
+			t.Error("upload-pack: ", err)
+		}
+	}))
+}
+
+func TestCloneFetch(t *testing.T) {
+	src, cancel := testData(t)
+	defer cancel()
+	dst, cancel2 := testData(t)
+	defer cancel2()
+	srv := uploadPackServer(t, src.dir)
+	defer srv.Close()
+	url := srv.URL + "/src.git"
+
+	run(src, "init")
+	if got := runFail(dst, "clone", srv.URL+"/nope"); !strings.Contains(got, "not found") {
+		t.Errorf("clone of a missing repository: %q", got)
+	}
+	run(dst, "clone", url, "empty")
+	if b, err := ioutil.ReadFile(filepath.Join(dst.dir, "empty", ".git", "config")); err != nil || !strings.Contains(string(b), "[remote \"origin\"]\n\turl = "+url+"\n") {
+		t.Errorf("config of the empty clone = %q, %v", b, err)
+	}
+	if err := os.RemoveAll(filepath.Join(dst.dir, "empty")); err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.WriteFile(t, []byte("a\n"), src.dir, "a")
+	testutil.WriteFile(t, []byte("b\n"), src.dir, "d", "b")
+	run(src, "add", ".")
+	run(src, "commit", "-m", "one")
+	one := strings.TrimSpace(run(src, "rev-parse", "HEAD"))
+	run(src, "tag", "-a", "v1", one)
+
+	run(dst, "clone", url, ".")
+	if got := string(testutil.ReadFile(t, dst.dir, "d", "b")); got != "b\n" {
+		t.Errorf("d/b = %q; want %q", got, "b\n")
+	}
+	v1 := strings.TrimSpace(run(src, "rev-parse", "v1"))
+	want := fmt.Sprintf("%s refs/heads/master\n%s refs/remotes/origin/HEAD\n%s refs/remotes/origin/master\n%s refs/tags/v1\n", one, one, one, v1)
+	if diff := cmp.Diff(run(dst, "show-ref"), want); diff != "" {
+		t.Errorf("refs of the clone: (-got +want)\n%s", diff)
+	}
+	run(dst, "diff", "--quiet", "HEAD")
+
+	// A fast-forward and a new tag.
+	testutil.WriteFile(t, []byte("a2\n"), src.dir, "a")
+	run(src, "add", "a")
+	run(src, "commit", "-m", "two")
+	two := strings.TrimSpace(run(src, "rev-parse", "HEAD"))
+	run(src, "tag", "v2", two)
+	run(dst, "fetch")
+	if got := strings.TrimSpace(run(dst, "rev-parse", "origin/master")); got != two {
+		t.Errorf("origin/master = %s; want %s", got, two)
+	}
+	if got := strings.TrimSpace(run(dst, "rev-parse", "v2")); got != two {
+		t.Errorf("v2 = %s; want %s", got, two)
+	}
+	if got, want := string(testutil.ReadFile(t, dst.dir, ".git", "FETCH_HEAD")), two+"\t\tbranch 'master' of "+srv.URL+"/src\n"+two+"\tnot-for-merge\ttag 'v2' of "+srv.URL+"/src\n"; got != want {
+		t.Errorf("FETCH_HEAD = %q; want %q", got, want)
+	}
+
+	// A non fast-forward update needs force.
+	run(dst, "fetch", "origin", "master:refs/heads/x")
+	run(src, "reset", "--hard", one)
+	testutil.WriteFile(t, []byte("a3\n"), src.dir, "a")
+	run(src, "add", "a")
+	run(src, "commit", "-m", "three")
+	three := strings.TrimSpace(run(src, "rev-parse", "HEAD"))
+	if got := runFail(dst, "fetch", "origin", "master:x"); !strings.Contains(got, " ! [rejected]        master     -> x  (non-fast-forward)\n") {
+		t.Errorf("fetch of a non fast-forward = %q", got)
+	}
+	run(dst, "fetch", "origin", "+master:x")
+	if got := strings.TrimSpace(run(dst, "rev-parse", "x")); got != three {
+		t.Errorf("x = %s; want %s", got, three)
+	}
+	runFail(dst, "fetch", "origin", "master:master")
+}
+
+func TestPush(t *testing.T) {
+	src, cancel := testData(t)
+	defer cancel()
+	dst, cancel2 := testData(t)
+	defer cancel2()
+	srv := httptest.NewServer(&smarthttp.Handler{Root: filepath.Dir(src.dir), ReceivePack: true})
+	defer srv.Close()
+	url := srv.URL + "/" + filepath.Base(src.dir)
+
+	run(src, "init")
+	testutil.WriteFile(t, []byte("a\n"), src.dir, "a")
+	run(src, "add", "a")
+	run(src, "commit", "-m", "one")
+	run(dst, "clone", url, ".")
+	testutil.WriteFile(t, []byte("b\n"), dst.dir, "b")
+	run(dst, "add", "b")
+	run(dst, "commit", "-m", "two")
+	two := strings.TrimSpace(run(dst, "rev-parse", "HEAD"))
+
+	// The branch checked out in the remote is not updated.
+	if got := runFail(dst, "push"); !strings.Contains(got, " ! [remote rejected] master -> master (branch is currently checked out)\n") {
+		t.Errorf("push to the checked out branch = %q", got)
+	}
+	run(dst, "push", "origin", "master:feature")
+	if got := strings.TrimSpace(run(src, "rev-parse", "feature")); got != two {
+		t.Errorf("feature = %s; want %s", got, two)
+	}
+	if got := strings.TrimSpace(run(dst, "rev-parse", "origin/feature")); got != two {
+		t.Errorf("origin/feature = %s; want %s", got, two)
+	}
+	if got := string(testutil.ReadFile(t, src.dir, "a")); got != "a\n" {
+		t.Errorf("a = %q in the remote; want it untouched", got)
+	}
+
+	// A non fast-forward update needs force.
+	run(dst, "reset", "--hard", "HEAD^")
+	testutil.WriteFile(t, []byte("c\n"), dst.dir, "c")
+	run(dst, "add", "c")
+	run(dst, "commit", "-m", "three")
+	three := strings.TrimSpace(run(dst, "rev-parse", "HEAD"))
+	if got := runFail(dst, "push", "origin", "master:feature"); !strings.Contains(got, " ! [rejected]        master -> feature (non-fast-forward)\n") {
+		t.Errorf("push of a non fast-forward = %q", got)
+	}
+	run(dst, "push", "origin", "+master:feature")
+	if got := strings.TrimSpace(run(src, "rev-parse", "feature")); got != three {
+		t.Errorf("feature = %s; want %s", got, three)
+	}
+
+	run(dst, "push", "origin", ":feature")
+	if got := run(src, "show-ref"); strings.Contains(got, "feature") {
+		t.Errorf("refs of the remote after deleting feature = %q", got)
+	}
+	if got := run(dst, "show-ref"); strings.Contains(got, "origin/feature") {
+		t.Errorf("refs after deleting feature = %q", got)
+	}
+}
+
+func TestLocalCloneFetchPush(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+	src := testD{t, filepath.Join(td.dir, "src"), td.ctx}
+	if err := os.Mkdir(src.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	run(src, "init")
+	testutil.WriteFile(t, []byte("a\n"), src.dir, "a")
+	run(src, "add", "a")
+	run(src, "commit", "-m", "one")
+	one := strings.TrimSpace(run(src, "rev-parse", "HEAD"))
+	run(src, "tag", "v1", one)
+
+	run(td, "clone", "-q", "--bare", "src")
+	bare := testD{t, filepath.Join(td.dir, "src.git"), td.ctx}
+	if got, want := run(bare, "show-ref"), one+" refs/heads/master\n"+one+" refs/tags/v1\n"; got != want {
+		t.Errorf("refs of the bare clone = %q; want %q", got, want)
+	}
+	if got := string(testutil.ReadFile(t, bare.dir, "config")); !strings.Contains(got, "bare = true") || strings.Contains(got, "fetch =") {
+		t.Errorf("config of the bare clone = %q", got)
+	}
+
+	run(td, "clone", "-q", "file://"+bare.dir, "work")
+	work := testD{t, filepath.Join(td.dir, "work"), td.ctx}
+	testutil.WriteFile(t, []byte("b\n"), work.dir, "b")
+	run(work, "add", "b")
+	run(work, "commit", "-m", "two")
+	two := strings.TrimSpace(run(work, "rev-parse", "HEAD"))
+	run(work, "push")
+	if got := strings.TrimSpace(run(bare, "rev-parse", "master")); got != two {
+		t.Errorf("master of the bare repository = %s; want %s", got, two)
+	}
+
+	run(td, "clone", "-q", "--mirror", "work", "mirror")
+	mirror := testD{t, filepath.Join(td.dir, "mirror"), td.ctx}
+	if got, want := run(mirror, "show-ref"), two+" refs/heads/master\n"+two+" refs/remotes/origin/HEAD\n"+two+" refs/remotes/origin/master\n"+one+" refs/tags/v1\n"; got != want {
+		t.Errorf("refs of the mirror = %q; want %q", got, want)
+	}
+
+	// The remote is a path.
+	run(src, "fetch", "../src.git")
+	if got := strings.TrimSpace(run(src, "rev-parse", "FETCH_HEAD")); got != two {
+		t.Errorf("FETCH_HEAD = %s; want %s", got, two)
+	}
+	run(src, "reset", "--hard", "FETCH_HEAD")
+	if got := string(testutil.ReadFile(t, src.dir, "b")); got != "b\n" {
+		t.Errorf("b = %q; want %q", got, "b\n")
+	}
+}
+
+func TestCloneInvalidPaths(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+	src := testD{t, filepath.Join(td.dir, "src"), td.ctx}
+	if err := os.Mkdir(src.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	run(src, "init")
+	for i, p := range []string{"../escaped.txt", ".git/config", ".Git/config", "d/../../escaped.txt"} {
+		c := craftCommit(src, p, "evil\n")
+		testutil.WriteFile(t, []byte(c+"\n"), src.dir, ".git", "refs", "heads", "master")
+		dst := fmt.Sprint("dst", i)
+		if got := runFail(td, "clone", "src", dst); !strings.Contains(got, "invalid tree entry name") {
+			t.Errorf("clone of a tree with %s = %q; want an invalid name error", p, got)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(td.dir, dst, ".git", "config")); err == nil && strings.Contains(string(b), "evil") {
+			t.Errorf("config of the clone is overwritten with %s: %q", p, b)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(td.dir, "escaped.txt")); !os.IsNotExist(err) {
+		t.Errorf("escaped.txt is written outside the clone: %v", err)
+	}
+}
+
+func TestFetchInvalidRefNames(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+	src := testD{t, filepath.Join(td.dir, "src"), td.ctx}
+	if err := os.Mkdir(src.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	run(src, "init")
+	testutil.WriteFile(t, []byte("a\n"), src.dir, "a")
+	run(src, "add", "a")
+	run(src, "commit", "-m", "one")
+	one := strings.TrimSpace(run(src, "rev-parse", "HEAD"))
+	var b strings.Builder
+	for _, name := range []string{"refs/heads/../../../../../escaped", "refs/heads/.hidden", "refs/heads/x.lock", "refs/heads/a\x01b"} {
+		fmt.Fprintf(&b, "%s %s\n", one, name)
+	}
+	testutil.WriteFile(t, []byte(b.String()), src.dir, ".git", "packed-refs")
+
+	for _, protocol := range []string{"0", "2"} {
+		dst := "dst" + protocol
+		run(td, "clone", "-q", "src", dst)
+		f, err := os.OpenFile(filepath.Join(td.dir, dst, ".git", "config"), os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString("[protocol]\n\tversion = " + protocol + "\n")
+		f.Close()
+		run(testD{t, filepath.Join(td.dir, dst), td.ctx}, "fetch")
+		if got, want := run(testD{t, filepath.Join(td.dir, dst), td.ctx}, "show-ref"), one+" refs/heads/master\n"+one+" refs/remotes/origin/HEAD\n"+one+" refs/remotes/origin/master\n"; got != want {
+			t.Errorf("refs of %s = %q; want %q", dst, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(td.dir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("escaped is written outside the repository: %v", err)
+	}
+
+	testutil.WriteFile(t, []byte("# v2 git bundle\n"+one+" refs/heads/../../escaped\n\n"), td.dir, "bad.bundle")
+	if got := runFail(td, "bundle", "list-heads", "bad.bundle"); !strings.Contains(got, "bad ref") {
+		t.Errorf("list-heads of a bundle with an invalid ref name = %q", got)
+	}
+}
+
+func TestShallowPartialClone(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+	src := testD{t, filepath.Join(td.dir, "src"), td.ctx}
+	if err := os.Mkdir(src.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	run(src, "init")
+	var commits []string
+	for _, c := range []string{"one", "two", "three"} {
+		testutil.WriteFile(t, []byte(c+"\n"), src.dir, "a")
+		run(src, "add", "a")
+		run(src, "commit", "-m", c)
+		commits = append(commits, strings.TrimSpace(run(src, "rev-parse", "HEAD")))
+	}
+	one, two, three := commits[0], commits[1], commits[2]
+	run(src, "tag", "v1", one)
+
+	run(td, "clone", "-q", "--depth", "1", "file://"+src.dir, "d1")
+	d1 := testD{t, filepath.Join(td.dir, "d1"), td.ctx}
+	if got := string(testutil.ReadFile(t, d1.dir, ".git", "shallow")); got != three+"\n" {
+		t.Errorf("shallow after clone --depth 1 = %q; want %q", got, three+"\n")
+	}
+	runFail(d1, "rev-parse", "HEAD^")
+	if got := run(d1, "show-ref"); strings.Contains(got, "refs/tags/v1") {
+		t.Errorf("refs of the shallow clone = %q; want no v1", got)
+	}
+	run(d1, "fetch", "-q", "--depth", "2")
+	if got := string(testutil.ReadFile(t, d1.dir, ".git", "shallow")); got != two+"\n" {
+		t.Errorf("shallow after fetch --depth 2 = %q; want %q", got, two+"\n")
+	}
+	run(d1, "fetch", "-q", "--unshallow")
+	if _, err := os.Stat(filepath.Join(d1.dir, ".git", "shallow")); !os.IsNotExist(err) {
+		t.Errorf("shallow exists after fetch --unshallow: %v", err)
+	}
+	if got := strings.TrimSpace(run(d1, "rev-parse", "HEAD~2")); got != one {
+		t.Errorf("HEAD~2 = %s; want %s", got, one)
+	}
+	if got := runFail(d1, "fetch", "--unshallow"); !strings.Contains(got, "does not make sense") {
+		t.Errorf("fetch --unshallow of a complete repository: %q", got)
+	}
+
+	run(td, "clone", "-q", "--shallow-exclude", "v1", "src", "d2")
+	if got := string(testutil.ReadFile(t, td.dir, "d2", ".git", "shallow")); got != two+"\n" {
+		t.Errorf("shallow after clone --shallow-exclude v1 = %q; want %q", got, two+"\n")
+	}
+	run(td, "clone", "-q", "--shallow-since", "2000-01-01", "src", "d3")
+	if _, err := os.Stat(filepath.Join(td.dir, "d3", ".git", "shallow")); !os.IsNotExist(err) {
+		t.Errorf("shallow exists after clone --shallow-since 2000-01-01: %v", err)
+	}
+	runFail(td, "clone", "--depth", "-1", "src", "d4")
+
+	run(td, "clone", "-q", "--filter=blob:none", "file://"+src.dir, "p")
+	p := testD{t, filepath.Join(td.dir, "p"), td.ctx}
+	if got := string(testutil.ReadFile(t, p.dir, ".git", "config")); !strings.Contains(got, "partialClone = origin") || !strings.Contains(got, "partialclonefilter = blob:none") {
+		t.Errorf("config of the partial clone = %q", got)
+	}
+	if got := string(testutil.ReadFile(t, p.dir, "a")); got != "three\n" {
+		t.Errorf("a = %q; want %q", got, "three\n")
+	}
+	blob := strings.TrimSpace(run(src, "rev-parse", one+":a"))
+	runFail(p, "cat-file", "-e", "0123456789012345678901234567890123456789")
+	if got := run(p, "cat-file", "-p", blob); got != "one\n" {
+		t.Errorf("lazily fetched blob = %q; want %q", got, "one\n")
+	}
+
+	// Names which are not hashes are resolved locally instead of being asked of the remote.
+	run(td, "clone", "-q", "--filter=tree:0", "file://"+src.dir, "p3")
+	p3 := testD{t, filepath.Join(td.dir, "p3"), td.ctx}
+	head := run(src, "rev-parse", "HEAD")
+	for _, name := range []string{"HEAD", "master", "origin/master"} {
+		if got := run(p3, "rev-parse", name); got != head {
+			t.Errorf("rev-parse %s in the partial clone = %q; want %q", name, got, head)
+		}
+	}
+	if got := runFail(p3, "rev-parse", "nope"); strings.Contains(got, "promisor") {
+		t.Errorf("rev-parse of a missing name = %q; want it not fetched", got)
+	}
+	if got := runFail(td, "clone", "--filter=blob:some", "src", "p2"); !strings.Contains(got, "invalid filter-spec") {
+		t.Errorf("clone --filter=blob:some: %q", got)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+	src := testD{t, filepath.Join(td.dir, "src"), td.ctx}
+	if err := os.Mkdir(src.dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	run(src, "init")
+	var commits []string
+	for _, c := range []string{"one", "two", "three"} {
+		testutil.WriteFile(t, []byte(c+"\n"), src.dir, "a")
+		run(src, "add", "a")
+		run(src, "commit", "-m", c)
+		commits = append(commits, strings.TrimSpace(run(src, "rev-parse", "HEAD")))
+	}
+	one, two, three := commits[0], commits[1], commits[2]
+	run(src, "tag", "v1", one)
+
+	run(src, "bundle", "create", "../all.bundle", "--all")
+	if got, want := run(src, "bundle", "list-heads", "../all.bundle"), three+" HEAD\n"+three+" refs/heads/master\n"+one+" refs/tags/v1\n"; got != want {
+		t.Errorf("list-heads = %q; want %q", got, want)
+	}
+	if got, want := run(src, "bundle", "list-heads", "../all.bundle", "refs/tags/v1"), one+" refs/tags/v1\n"; got != want {
+		t.Errorf("list-heads refs/tags/v1 = %q; want %q", got, want)
+	}
+	run(src, "bundle", "create", "--version", "3", "../inc.bundle", "v1..master")
+	if got, want := string(testutil.ReadFile(t, td.dir, "inc.bundle")), "# v3 git bundle\n@object-format=sha1\n-"+one+" one\n"+three+" refs/heads/master\n\nPACK"; !strings.HasPrefix(got, want) {
+		t.Errorf("inc.bundle = %q; want prefix %q", got, want)
+	}
+	if got := runFail(src, "bundle", "create", "../empty.bundle", "master", "^master"); !strings.Contains(got, "Refusing to create empty bundle.") {
+		t.Errorf("bundle create master ^master: %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(td.dir, "empty.bundle")); !os.IsNotExist(err) {
+		t.Errorf("empty.bundle exists: %v", err)
+	}
+
+	run(td, "clone", "-q", "all.bundle")
+	clone := testD{t, filepath.Join(td.dir, "all"), td.ctx}
+	if got, want := run(clone, "show-ref"), three+" refs/heads/master\n"+three+" refs/remotes/origin/HEAD\n"+three+" refs/remotes/origin/master\n"+one+" refs/tags/v1\n"; got != want {
+		t.Errorf("refs of the clone = %q; want %q", got, want)
+	}
+	if got := string(testutil.ReadFile(t, clone.dir, "a")); got != "three\n" {
+		t.Errorf("a = %q; want %q", got, "three\n")
+	}
+
+	// Without HEAD in the bundle, master or else the first branch is checked out.
+	run(src, "bundle", "create", "../master.bundle", "master")
+	run(src, "checkout", "-b", "side", two)
+	run(src, "bundle", "create", "../side.bundle", "side")
+	for _, tc := range []struct{ bundle, head, a string }{
+		{"master.bundle", "master", "three\n"},
+		{"side.bundle", "side", "two\n"},
+	} {
+		run(td, "clone", "-q", tc.bundle)
+		dir := strings.TrimSuffix(tc.bundle, ".bundle")
+		if got, want := string(testutil.ReadFile(t, td.dir, dir, ".git", "HEAD")), "ref: refs/heads/"+tc.head+"\n"; got != want {
+			t.Errorf("HEAD of the clone of %s = %q; want %q", tc.bundle, got, want)
+		}
+		if got := string(testutil.ReadFile(t, td.dir, dir, "a")); got != tc.a {
+			t.Errorf("a in the clone of %s = %q; want %q", tc.bundle, got, tc.a)
+		}
+	}
+
+	run(td, "init", "partial")
+	partial := testD{t, filepath.Join(td.dir, "partial"), td.ctx}
+	if got := runFail(partial, "bundle", "verify", "../inc.bundle"); !strings.Contains(got, "lacks these prerequisite commits:\n"+one+" one") {
+		t.Errorf("verify without the prerequisite: %q", got)
+	}
+	runFail(partial, "fetch", "../inc.bundle", "master:refs/heads/x")
+	run(partial, "fetch", "../all.bundle", "v1:refs/tags/v1")
+	want := "The bundle contains this ref:\n" + three + " refs/heads/master\nThe bundle requires this ref:\n" + one + " one\nThe bundle uses this hash algorithm: sha1\n"
+	if got := run(partial, "bundle", "verify", "../inc.bundle"); got != want {
+		t.Errorf("verify = %q; want %q", got, want)
+	}
+	run(partial, "fetch", "../inc.bundle", "master:refs/heads/x")
+	if got := strings.TrimSpace(run(partial, "rev-parse", "x~1")); got != two {
+		t.Errorf("x~1 = %s; want %s", got, two)
+	}
+	runFail(partial, "push", "../all.bundle", "x")
+}
+
+func TestArchive(t *testing.T) {
+	td, cancel := testData(t)
+	defer cancel()
+
+	run(td, "init")
+	config := testutil.ReadFile(t, td.dir, ".git", "config")
+	testutil.WriteFile(t, bytes.Replace(config, []byte("filemode = false"), []byte("filemode = true"), 1), td.dir, ".git", "config")
+	testutil.WriteFile(t, []byte("a\n"), td.dir, "a")
+	testutil.WriteFile(t, []byte("#!/bin/sh\n"), td.dir, "d", "run.sh")
+	if err := os.Chmod(filepath.Join(td.dir, "d", "run.sh"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a", filepath.Join(td.dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WriteFile(t, []byte("secret\n"), td.dir, "internal", "x")
+	testutil.WriteFile(t, []byte("tmp\n"), td.dir, "d", "x.tmp")
+	testutil.WriteFile(t, []byte("$Format:%H %s$ $Format:%x$\n"), td.dir, "version")
+	testutil.WriteFile(t, []byte("internal export-ignore\n*.tmp export-ignore\nversion export-subst\n"), td.dir, ".gitattributes")
+	run(td, "add", ".")
+	run(td, "commit", "-m", "snapshot")
+	head := strings.TrimSpace(run(td, "rev-parse", "HEAD"))
+	r, err := git.NewRepo(td.dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := git.ReadObject(r, head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committer, err := git.ParseIdent(o.KVLM.Get("committer")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type entry struct {
+		Name, Link, Data string
+		Mode             int64
+	}
+	tr := tar.NewReader(strings.NewReader(run(td, "archive", "--prefix=p/", "HEAD")))
+	var got []entry
+	comment := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			if got := hdr.PAXRecords["comment"]; got != head {
+				t.Errorf("comment of the tar archive = %q; want %q", got, head)
+			}
+			comment = true
+			continue
+		}
+		if !hdr.ModTime.Equal(committer.When) {
+			t.Errorf("mtime of %s = %v; want %v", hdr.Name, hdr.ModTime, committer.When)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, entry{hdr.Name, hdr.Linkname, string(b), hdr.Mode})
+	}
+	want := []entry{
+		{"p/", "", "", 0775},
+		{"p/.gitattributes", "", "internal export-ignore\n*.tmp export-ignore\nversion export-subst\n", 0664},
+		{"p/a", "", "a\n", 0664},
+		{"p/d/", "", "", 0775},
+		{"p/d/run.sh", "", "#!/bin/sh\n", 0775},
+		{"p/link", "a", "", 0777},
+		{"p/version", "", head + " snapshot %x\n", 0664},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("tar archive: -want +got\n%s", diff)
+	}
+	if !comment {
+		t.Error("tar archive has no pax global header")
+	}
+
+	tr = tar.NewReader(strings.NewReader(run(td, "archive", "--format=tar", "HEAD", "d")))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeXGlobalHeader {
+			names = append(names, hdr.Name)
+		}
+	}
+	if diff := cmp.Diff([]string{"d/", "d/run.sh"}, names); diff != "" {
+		t.Errorf("tar archive of d: -want +got\n%s", diff)
+	}
+	if got := runFail(td, "archive", "HEAD", "nothing"); !strings.Contains(got, "pathspec 'nothing' did not match any files") {
+		t.Errorf("archive of a missing path: %q", got)
+	}
+
+	run(td, "archive", "-o", "a.zip", "HEAD")
+	zr, err := zip.OpenReader(filepath.Join(td.dir, "a.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	if zr.Comment != head {
+		t.Errorf("comment of the zip archive = %q; want %q", zr.Comment, head)
+	}
+	modes := make(map[string]os.FileMode)
+	for _, f := range zr.File {
+		modes[f.Name] = f.Mode()
+	}
+	if diff := cmp.Diff(map[string]os.FileMode{
+		".gitattributes": 0644,
+		"a":              0644,
+		"d/":             os.ModeDir | 0755,
+		"d/run.sh":       0755,
+		"link":           os.ModeSymlink | 0777,
+		"version":        0644,
+	}, modes); diff != "" {
+		t.Errorf("zip archive: -want +got\n%s", diff)
+	}
+}
+
+func TestUploadReceivePack(t *testing.T) {
+	src, cancel := testData(t)
+	defer cancel()
+	dst, cancel2 := testData(t)
+	defer cancel2()
+	pkt := func(s string) string { return fmt.Sprintf("%04x%s", len(s)+4, s) }
+
+	run(src, "init")
+	testutil.WriteFile(t, []byte("a\n"), src.dir, "a")
+	run(src, "add", "a")
+	run(src, "commit", "-m", "one")
+	one := strings.TrimSpace(run(src, "rev-parse", "HEAD"))
+	testutil.WriteFile(t, []byte("b\n"), src.dir, "b")
+	run(src, "add", "b")
+	run(src, "commit", "-m", "two")
+	two := strings.TrimSpace(run(src, "rev-parse", "HEAD"))
+
+	os.Setenv("GIT_PROTOCOL", "version=1")
+	got := runStdin(src, "0000", "upload-pack", ".")
+	os.Unsetenv("GIT_PROTOCOL")
+	if want := pkt("version 1\n"); !strings.HasPrefix(got, want) || !strings.Contains(got, two+" HEAD\x00") || !strings.Contains(got, " multi_ack_detailed ") {
+		t.Errorf("advertisement = %q; want %q and HEAD with multi_ack_detailed", got, want)
+	}
+
+	// With multi_ack_detailed, each common commit is acknowledged and the last one again
+	// at the end.
+	in := pkt("want "+two+" multi_ack_detailed no-progress\n") + "0000" + pkt("have "+one+"\n") + "0000" + pkt("done\n")
+	got = runStdin(src, in, "upload-pack", ".")
+	want := pkt("ACK "+one+" common\n") + pkt("NAK\n") + pkt("ACK "+one+"\n") + "PACK"
+	if i := strings.Index(got, "0000"); i < 0 || !strings.HasPrefix(got[i+4:], want) {
+		t.Errorf("upload-pack response = %q; want %q after the advertisement", got, want)
+	}
+
+	// Only objects reachable from the refs are given, by their full hashes.
+	if got := runStdin(src, pkt("want "+one+" no-progress\n")+"0000"+pkt("done\n"), "upload-pack", "."); !strings.Contains(got, "PACK") {
+		t.Errorf("upload-pack of a reachable commit = %q; want a pack", got)
+	}
+	unreachable := craftCommit(src, "x", "x\n")
+	for _, sha := range []string{unreachable, "../../../../x", one[:7]} {
+		if got := runStdinFail(src, pkt("want "+sha+"\n")+"0000"+pkt("done\n"), "upload-pack", "."); !strings.Contains(got, "not our ref "+sha) {
+			t.Errorf("upload-pack of %s = %q; want it refused", sha, got)
+		}
+	}
+
+	url := "ext::" + prog + " %s " + src.dir
+	// ext:: runs the command in the URL, so it is refused unless allowed.
+	if got := runFail(dst, "clone", url, "."); !strings.Contains(got, "transport 'ext' not allowed") {
+		t.Errorf("clone of an ext:: URL = %q; want it refused", got)
+	}
+	if err := os.RemoveAll(filepath.Join(dst.dir, ".git")); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GIT_ALLOW_PROTOCOL", "file:ext")
+	run(dst, "clone", url, ".")
+	os.Unsetenv("GIT_ALLOW_PROTOCOL")
+	runFail(dst, "fetch")
+	f, err := os.OpenFile(filepath.Join(dst.dir, ".git", "config"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("[protocol \"ext\"]\n\tallow = always\n")
+	f.Close()
+	if got := strings.TrimSpace(run(dst, "rev-parse", "origin/master")); got != two {
+		t.Errorf("origin/master = %s; want %s", got, two)
+	}
+	testutil.WriteFile(t, []byte("c\n"), dst.dir, "c")
+	run(dst, "add", "c")
+	run(dst, "commit", "-m", "three")
+	three := strings.TrimSpace(run(dst, "rev-parse", "HEAD"))
+	run(dst, "push", "origin", "master:feature")
+	if got := strings.TrimSpace(run(src, "rev-parse", "feature")); got != three {
+		t.Errorf("feature = %s; want %s", got, three)
+	}
+	run(dst, "fetch")
+}
+
+func TestProtocolV2(t *testing.T) {
+	src, cancel := testData(t)
+	defer cancel()
+	dst, cancel2 := testData(t)
+	defer cancel2()
+	pkt := func(s string) string { return fmt.Sprintf("%04x%s", len(s)+4, s) }
+
+	run(src, "init")
+	testutil.WriteFile(t, []byte("a\n"), src.dir, "a")
+	run(src, "add", "a")
+	run(src, "commit", "-m", "one")
+	one := strings.TrimSpace(run(src, "rev-parse", "HEAD"))
+	run(src, "tag", "-a", "v1", one)
+	tag := strings.TrimSpace(run(src, "rev-parse", "v1"))
+	testutil.WriteFile(t, []byte("b\n"), src.dir, "b")
+	run(src, "add", "b")
+	run(src, "commit", "-m", "two")
+	two := strings.TrimSpace(run(src, "rev-parse", "HEAD"))
+
+	os.Setenv("GIT_PROTOCOL", "version=2")
+	defer os.Unsetenv("GIT_PROTOCOL")
+	got := runStdin(src, "0000", "upload-pack", ".")
+	if want := pkt("version 2\n"); !strings.HasPrefix(got, want) || !strings.Contains(got, pkt("ls-refs=unborn\n")) || !strings.Contains(got, pkt("fetch=shallow wait-for-done filter\n")) || !strings.Contains(got, pkt("object-info\n")) {
+		t.Errorf("capabilities = %q; want %q with ls-refs, fetch and object-info", got, want)
+	}
+
+	command := func(cmd string, args ...string) string {
+		s := pkt("command="+cmd+"\n") + "0001"
+		for _, a := range args {
+			s += pkt(a + "\n")
+		}
+		return s + "0000"
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"symrefs", "peel", "ref-prefix refs/tags/"}, pkt(tag+" refs/tags/v1 peeled:"+one+"\n") + "0000"},
+		{[]string{"symrefs", "ref-prefix HEAD"}, pkt(two+" HEAD symref-target:refs/heads/master\n") + "0000"},
+	} {
+		if got := runStdin(src, command("ls-refs", tc.args...), "upload-pack", "--stateless-rpc", "."); got != tc.want {
+			t.Errorf("ls-refs %v = %q; want %q", tc.args, got, tc.want)
+		}
+	}
+
+	// The pack is sent once the server is ready unless the client waits for done.
+	got = runStdin(src, command("fetch", "no-progress", "want "+two, "have "+one, "wait-for-done"), "upload-pack", "--stateless-rpc", ".")
+	if want := pkt("acknowledgments\n") + pkt("ACK "+one+"\n") + "0000"; got != want {
+		t.Errorf("fetch with wait-for-done = %q; want %q", got, want)
+	}
+	got = runStdin(src, command("fetch", "no-progress", "want "+two, "have "+one), "upload-pack", "--stateless-rpc", ".")
+	if want := pkt("acknowledgments\n") + pkt("ACK "+one+"\n") + pkt("ready\n") + "0001" + pkt("packfile\n"); !strings.HasPrefix(got, want) {
+		t.Errorf("fetch = %q; want prefix %q", got, want)
+	}
+	unreachable := craftCommit(src, "x", "x\n")
+	for _, sha := range []string{unreachable, "../../../../x"} {
+		if got := runStdinFail(src, command("fetch", "want "+sha, "done"), "upload-pack", "--stateless-rpc", "."); !strings.Contains(got, "not our ref "+sha) {
+			t.Errorf("fetch of %s = %q; want it refused", sha, got)
+		}
+	}
+
+	got = runStdin(src, command("object-info", "size", "oid "+tag, "oid "+strings.Repeat("0", 40)), "upload-pack", "--stateless-rpc", ".")
+	if want := pkt("size\n") + pkt(fmt.Sprintf("%s %d\n", tag, len(run(src, "cat-file", "-p", tag)))) + pkt(strings.Repeat("0", 40)+"\n") + "0000"; got != want {
+		t.Errorf("object-info = %q; want %q", got, want)
+	}
+	os.Unsetenv("GIT_PROTOCOL")
+
+	sizes, err := git.RemoteObjectSizes(src.dir, []string{tag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]int64{tag: int64(len(run(src, "cat-file", "-p", tag)))}, sizes); diff != "" {
+		t.Errorf("RemoteObjectSizes: -want +got\n%s", diff)
+	}
+
+	os.Setenv("GIT_ALLOW_PROTOCOL", "ext")
+	defer os.Unsetenv("GIT_ALLOW_PROTOCOL")
+	run(dst, "clone", "ext::"+prog+" %s "+src.dir, ".")
+	if got := strings.TrimSpace(run(dst, "rev-parse", "origin/master")); got != two {
+		t.Errorf("origin/master = %s; want %s", got, two)
+	}
+	if got := strings.TrimSpace(run(dst, "rev-parse", "v1")); got != tag {
+		t.Errorf("v1 = %s; want %s", got, tag)
+	}
+}
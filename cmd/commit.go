@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&commitCmd{}, "")
+}
+
+// messageFlag collects the messages given by -m, which make separate paragraphs.
+type messageFlag []string
+
+func (f *messageFlag) String() string { return strings.Join(*f, "\n\n") }
+func (f *messageFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// message returns the paragraphs joined, or "" if no message is given.
+func (f *messageFlag) message() string {
+	if len(*f) == 0 {
+		return ""
+	}
+	return f.String() + "\n"
+}
+
+type commitCmd struct {
+	messages   messageFlag
+	file       string
+	allowEmpty bool
+	amend      bool
+}
+
+func (*commitCmd) Name() string { return "commit" }
+func (*commitCmd) Synopsis() string {
+	return "git commit [-m msg | -F file] [--allow-empty] [--amend]"
+}
+func (*commitCmd) Usage() string {
+	return `git commit [-m msg | -F file] [--allow-empty] [--amend]
+  Records the index as a new commit on top of HEAD. If a merge is in progress, the commit
+  is a merge commit, and the message defaults to the prepared one in MERGE_MSG.
+  With --amend, the commit replaces HEAD keeping its author, and the message defaults to
+  that of HEAD.
+`
+}
+func (c *commitCmd) SetFlags(f *flag.FlagSet) {
+	f.Var(&c.messages, "m", "use the `message` as the commit message; paragraphs are joined if given multiple times")
+	f.StringVar(&c.file, "F", "", "take the commit message from the `file`, or stdin if -")
+	f.BoolVar(&c.allowEmpty, "allow-empty", false, "allow a commit not changing the tree")
+	f.BoolVar(&c.amend, "amend", false, "replace HEAD with the new commit")
+}
+func (c *commitCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 0 {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	if err := c.commit(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "commit: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+func (c *commitCmd) commit(w io.Writer) error {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return err
+	}
+	var msg string
+	switch {
+	case len(c.messages) > 0 && c.file != "":
+		return errors.New("-m and -F are mutually exclusive")
+	case len(c.messages) > 0:
+		msg = git.CleanupMessage(c.messages.message(), false)
+	case c.file == "-":
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		msg = git.CleanupMessage(string(b), false)
+	case c.file != "":
+		b, err := ioutil.ReadFile(c.file)
+		if err != nil {
+			return err
+		}
+		msg = git.CleanupMessage(string(b), false)
+	case c.amend:
+		_, head, err := git.Head(r)
+		if err != nil {
+			return err
+		}
+		o, err := git.ReadObject(r, head)
+		if err != nil {
+			return err
+		}
+		msg = first(o.KVLM.Get(""))
+	default:
+		m, err := git.MergeMessage(r)
+		if err != nil {
+			return err
+		}
+		if m == "" {
+			return errors.New("no commit message given; use -m or -F")
+		}
+		msg = git.CleanupMessage(m, true)
+	}
+	action, pick, err := git.PickHead(r)
+	if err != nil {
+		return err
+	}
+	sha, err := git.Commit(r, msg, &git.CommitOptions{AllowEmpty: c.allowEmpty, Amend: c.amend})
+	if err != nil {
+		return err
+	}
+	// The author date is shown when the author of another commit is kept.
+	printCommitted(w, r, sha, c.amend || pick != "" && action == git.ActionPick)
+	return nil
+}
+
+// printCommitted prints the branch, the abbreviated SHA and the subject of the new commit,
+// as in "[master 1234567] subject", followed by the author if it differs from the committer
+// and by the author date if authorDate is true.
+func printCommitted(w io.Writer, r *git.Repo, sha string, authorDate bool) {
+	branch, _, err := git.Head(r)
+	if err != nil {
+		branch = ""
+	}
+	printCommittedOn(w, r, branch, sha, authorDate)
+}
+
+// printCommittedOn is printCommitted for a commit made on the branch, or on a detached HEAD
+// if branch is "".
+func printCommittedOn(w io.Writer, r *git.Repo, branch, sha string, authorDate bool) {
+	name := strings.TrimPrefix(branch, "refs/heads/")
+	if branch == "" {
+		name = "detached HEAD"
+	}
+	if ps, err := git.Parents(r, sha); err == nil && len(ps) == 0 {
+		name += " (root-commit)"
+	}
+	fmt.Fprintf(w, "[%s %s] %s\n", name, sha[:7], subject(r, sha))
+	o, err := git.ReadObject(r, sha)
+	if err != nil {
+		return
+	}
+	author, err := git.ParseIdent(first(o.KVLM.Get("author")))
+	if err != nil {
+		return
+	}
+	committer, err := git.ParseIdent(first(o.KVLM.Get("committer")))
+	if err != nil {
+		return
+	}
+	if author.String() != committer.String() {
+		fmt.Fprintf(w, " Author: %s\n", author)
+	}
+	if authorDate {
+		fmt.Fprintf(w, " Date: %s\n", formatDate(author))
+	}
+}
@@ -0,0 +1,356 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&diffCmd{}, "")
+}
+
+type diffCmd struct {
+	cached   bool
+	noIndex  bool
+	exitCode bool
+	quiet    bool
+	patch    bool
+	diffFlags
+}
+
+func (*diffCmd) Name() string { return "diff" }
+func (*diffCmd) Synopsis() string {
+	return "git diff [--cached] [commit [commit]] [--] [paths...]"
+}
+func (*diffCmd) Usage() string {
+	return `git diff [options] [--] [paths...]
+  Shows the changes in the worktree relative to the index.
+
+git diff [options] --cached [commit] [--] [paths...]
+  Shows the changes in the index relative to the commit, HEAD by default.
+
+git diff [options] commit [--] [paths...]
+  Shows the changes in the worktree relative to the commit.
+
+git diff [options] commit commit [--] [paths...]
+git diff [options] commit..commit [--] [paths...]
+  Shows the changes between the commits. An omitted side of .. means HEAD.
+
+git diff [options] --no-index path path
+  Compares the files or directories on the filesystem.
+
+Options are -U n, --diff-algorithm alg, -b, -w, --stat, --numstat, --name-only,
+--name-status, --color[=when], -M[=n], -C[=n], --no-renames, --exit-code and --quiet.
+With --stat or --numstat, -p also prints the patches. Renames are detected unless
+diff.renames is false.
+`
+}
+func (c *diffCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.cached, "cached", false, "compare the index with a commit")
+	f.BoolVar(&c.cached, "staged", false, "synonym of --cached")
+	f.BoolVar(&c.noIndex, "no-index", false, "compare two paths on the filesystem")
+	f.BoolVar(&c.exitCode, "exit-code", false, "exit with 1 if there are differences")
+	f.BoolVar(&c.quiet, "quiet", false, "print nothing and imply --exit-code")
+	f.BoolVar(&c.patch, "p", false, "show patches in addition to --stat or --numstat")
+	f.BoolVar(&c.patch, "patch", false, "show patches in addition to --stat or --numstat")
+	c.diffFlags.setFlags(f)
+}
+func (c *diffCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	args, err := parseInterspersed(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "diff: ", err)
+		return subcommands.ExitUsageError
+	}
+	changed, err := c.diff(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "diff: ", err)
+		return subcommands.ExitFailure
+	}
+	if changed && (c.exitCode || c.quiet || c.noIndex) {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// parseInterspersed parses the flags following the first non-flag argument, which the flag
+// package leaves unparsed, as git accepts options after revisions. A "--" after the first
+// non-flag argument is kept in the result.
+func parseInterspersed(f *flag.FlagSet) ([]string, error) {
+	var res []string
+	args := f.Args()
+	for len(args) > 0 {
+		a := args[0]
+		if a == "--" || a == "-" || !strings.HasPrefix(a, "-") {
+			if a == "--" {
+				return append(res, args...), nil
+			}
+			res = append(res, a)
+			args = args[1:]
+			continue
+		}
+		if err := f.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := f.Args()
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			rest = append([]string{"--"}, rest...)
+		}
+		args = rest
+	}
+	return res, nil
+}
+
+// diff prints the differences and reports whether there are any.
+func (c *diffCmd) diff(args []string) (bool, error) {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		// Outside a repository, two paths are compared on the filesystem.
+		if len(args) != 2 {
+			return false, err
+		}
+		c.noIndex = true
+	}
+	p, err := newDiffPrinter(r, &c.diffFlags)
+	if err != nil {
+		return false, err
+	}
+	p.patch = c.patch
+	p.renames = c.renameOptions(r, true)
+	changes, err := c.changes(r, p, args)
+	if err != nil {
+		return false, err
+	}
+	if !c.quiet {
+		if err := p.print(os.Stdout, changes); err != nil {
+			return false, err
+		}
+	}
+	return len(changes) > 0, nil
+}
+
+// changes returns the changes to print, setting up p to read the contents of their sides.
+func (c *diffCmd) changes(r *git.Repo, p *diffPrinter, args []string) ([]*git.Change, error) {
+	if c.noIndex {
+		if len(args) != 2 {
+			return nil, errors.New("--no-index requires two paths")
+		}
+		p.noIndex = true
+		p.readOld, p.readNew = readFile, readFile
+		return diffNoIndex(args[0], args[1])
+	}
+	revs, pathspecs, err := splitRevisions(r, args)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c.cached:
+		if len(revs) > 1 {
+			return nil, errors.New("--cached takes at most one commit")
+		}
+		rev := "HEAD"
+		if len(revs) == 1 {
+			rev = revs[0]
+		}
+		tree, err := resolveTree(r, rev)
+		if err != nil {
+			return nil, err
+		}
+		return git.DiffIndex(r, tree, pathspecs)
+	case len(revs) == 0:
+		p.readNew = p.readWorktree
+		return git.DiffFiles(r, pathspecs)
+	case len(revs) == 1:
+		tree, err := resolveTree(r, revs[0])
+		if err != nil {
+			return nil, err
+		}
+		p.readNew = p.readWorktree
+		return git.DiffWorktree(r, tree, pathspecs)
+	case len(revs) == 2:
+		a, err := resolveTree(r, revs[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := resolveTree(r, revs[1])
+		if err != nil {
+			return nil, err
+		}
+		return git.DiffTrees(r, a, b, &git.DiffTreeOptions{Recursive: true, Pathspecs: pathspecs})
+	}
+	return nil, errors.New("too many revisions")
+}
+
+// splitRevisions splits the arguments into the leading revisions and the pathspecs following
+// them, optionally after "--". A..B stands for the two revisions A and B, either of which
+// defaults to HEAD.
+func splitRevisions(r *git.Repo, args []string) ([]string, []string, error) {
+	var revs []string
+	for len(args) > 0 && args[0] != "--" {
+		cand := []string{args[0]}
+		if i := strings.Index(args[0], ".."); i >= 0 {
+			cand = []string{args[0][:i], args[0][i+2:]}
+			for j, s := range cand {
+				if s == "" {
+					cand[j] = "HEAD"
+				}
+			}
+		}
+		ok := true
+		for _, s := range cand {
+			if _, err := resolveTree(r, s); err != nil {
+				ok = false
+			}
+		}
+		if !ok {
+			break
+		}
+		revs = append(revs, cand...)
+		args = args[1:]
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	for _, a := range args {
+		if strings.HasPrefix(a, "-") {
+			return nil, nil, fmt.Errorf("bad revision %s", a)
+		}
+	}
+	return revs, args, nil
+}
+
+// readFile reads the file the leaf represents on the filesystem, or the link target of a symlink.
+func readFile(l *git.TreeLeaf) ([]byte, error) {
+	if l == nil {
+		return nil, nil
+	}
+	if l.Mode == "120000" {
+		s, err := os.Readlink(l.Path)
+		return []byte(s), err
+	}
+	return ioutil.ReadFile(l.Path)
+}
+
+// fileLeaf returns the leaf for the file at the path on the filesystem, or nil if it does not exist.
+func fileLeaf(path string) (*git.TreeLeaf, os.FileInfo, error) {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if fi.IsDir() {
+		return nil, fi, nil
+	}
+	l := &git.TreeLeaf{Mode: "100644", Path: path}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		l.Mode = "120000"
+	case fi.Mode()&0111 != 0:
+		l.Mode = "100755"
+	}
+	b, err := readFile(l)
+	if err != nil {
+		return nil, nil, err
+	}
+	if l.SHA, err = git.ObjectHash(b, "blob", nil); err != nil {
+		return nil, nil, err
+	}
+	return l, fi, nil
+}
+
+// diffNoIndex compares the files or the directories a and b on the filesystem. A file compared
+// with a directory is compared with the file of the same name in it.
+func diffNoIndex(a, b string) ([]*git.Change, error) {
+	for _, p := range []string{a, b} {
+		if _, err := os.Lstat(p); err != nil {
+			return nil, fmt.Errorf("Could not access '%s'", p)
+		}
+	}
+	fa, _ := os.Stat(a)
+	fb, _ := os.Stat(b)
+	switch {
+	case fa.IsDir() && !fb.IsDir():
+		a = joinPath(a, filepath.Base(b))
+	case !fa.IsDir() && fb.IsDir():
+		b = joinPath(b, filepath.Base(a))
+	}
+	var res []*git.Change
+	if err := diffPaths(a, b, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func joinPath(dir, name string) string {
+	return strings.TrimSuffix(dir, "/") + "/" + name
+}
+
+func diffPaths(a, b string, res *[]*git.Change) error {
+	la, fa, err := fileLeaf(a)
+	if err != nil {
+		return err
+	}
+	lb, fb, err := fileLeaf(b)
+	if err != nil {
+		return err
+	}
+	da, db := fa != nil && fa.IsDir(), fb != nil && fb.IsDir()
+	if da || db {
+		if fa != nil && fb != nil && da != db {
+			return fmt.Errorf("file/directory conflict: %s, %s", a, b)
+		}
+		names := make(map[string]bool)
+		for _, d := range []string{a, b} {
+			fis, err := ioutil.ReadDir(d)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			for _, fi := range fis {
+				names[fi.Name()] = true
+			}
+		}
+		var sorted []string
+		for n := range names {
+			sorted = append(sorted, n)
+		}
+		sort.Strings(sorted)
+		for _, n := range sorted {
+			if err := diffPaths(joinPath(a, n), joinPath(b, n), res); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if la == nil && lb == nil || la != nil && lb != nil && la.Mode == lb.Mode && la.SHA == lb.SHA {
+		return nil
+	}
+	c := &git.Change{From: la, To: lb, Status: 'M'}
+	switch {
+	case la == nil:
+		c.Status = 'A'
+	case lb == nil:
+		c.Status = 'D'
+	case objectType(la.Mode) != objectType(lb.Mode):
+		c.Status = 'T'
+	}
+	*res = append(*res, c)
+	return nil
+}
+
+// objectType tells regular files from symlinks by their modes.
+func objectType(mode string) string {
+	if mode == "120000" {
+		return "symlink"
+	}
+	return "file"
+}
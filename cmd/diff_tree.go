@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&diffTreeCmd{}, "")
+}
+
+type diffTreeCmd struct {
+	recursive bool
+	raw       bool
+	patch     bool
+	diffFlags
+}
+
+func (*diffTreeCmd) Name() string { return "diff-tree" }
+func (*diffTreeCmd) Synopsis() string {
+	return "git diff-tree [-r] [-p] [--raw|--name-status|--name-only|--stat|--numstat] tree-ish [tree-ish] [paths...]"
+}
+func (*diffTreeCmd) Usage() string {
+	return `git diff-tree [-r] [-p [-U n] [--diff-algorithm alg] [-b] [-w]] [--raw|--name-status|--name-only|--stat|--numstat] [--color[=when]] [-M[=n]] [-C[=n]] tree-ish [tree-ish] [[--] paths...]
+  Compares two trees. With one commit, compares the commit with its first parent,
+  printing the commit SHA first. -p prints patches, recursing into subtrees.
+`
+}
+func (c *diffTreeCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.recursive, "r", false, "recurse into subtrees")
+	f.BoolVar(&c.raw, "raw", false, "show modes, SHAs and statuses (default)")
+	f.BoolVar(&c.patch, "p", false, "show patches")
+	c.diffFlags.setFlags(f)
+}
+func (c *diffTreeCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() < 1 {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitFailure
+	}
+	if err := c.diffTree(f.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "diff-tree: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+func (c *diffTreeCmd) diffTree(args []string) error {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return err
+	}
+	p, err := newDiffPrinter(r, &c.diffFlags)
+	if err != nil {
+		return err
+	}
+	p.raw = !c.patch
+	p.patch = c.patch
+	p.renames = c.renameOptions(r, false)
+	var revs []string
+	for len(args) > 0 && len(revs) < 2 {
+		if args[0] == "--" {
+			break
+		}
+		if _, err := git.ResolveRevision(r, args[0], ""); err != nil {
+			break
+		}
+		revs = append(revs, args[0])
+		args = args[1:]
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(revs) == 0 {
+		return fmt.Errorf("bad revision %s", args[0])
+	}
+	var a, b string
+	if len(revs) == 2 {
+		if a, err = git.ResolveRevision(r, revs[0], "tree"); err != nil {
+			return err
+		}
+		if b, err = git.ResolveRevision(r, revs[1], "tree"); err != nil {
+			return err
+		}
+	} else {
+		sha, err := git.ResolveRevision(r, revs[0], "commit")
+		if err != nil {
+			return errors.New("a single argument must be a commit")
+		}
+		ps, err := git.Parents(r, sha)
+		if err != nil {
+			return err
+		}
+		if len(ps) != 1 {
+			// Root and merge commits are not compared.
+			return nil
+		}
+		if a, err = git.TreeSHA(r, ps[0]); err != nil {
+			return err
+		}
+		if b, err = git.TreeSHA(r, sha); err != nil {
+			return err
+		}
+		fmt.Println(sha)
+	}
+	opts := &git.DiffTreeOptions{Recursive: c.recursive || c.patch || c.stat || c.numstat, Pathspecs: args}
+	var changes []*git.Change
+	if err := git.DiffTree(r, a, b, opts, func(ch *git.Change) error {
+		changes = append(changes, ch)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return p.print(os.Stdout, changes)
+}
+
+// writeRaw writes the change in the raw diff format.
+func writeRaw(w io.Writer, c *git.Change) {
+	mode := func(l *git.TreeLeaf) string {
+		if l == nil {
+			return "000000"
+		}
+		return fmt.Sprintf("%06s", l.Mode)
+	}
+	sha := func(l *git.TreeLeaf) string {
+		if l == nil {
+			return git.ZeroSHA
+		}
+		return l.SHA
+	}
+	if c.Status == 'R' || c.Status == 'C' {
+		fmt.Fprintf(w, ":%s %s %s %s %c%03d\t%s\t%s\n", mode(c.From), mode(c.To), sha(c.From), sha(c.To), c.Status, similarity(c), c.From.Path, c.To.Path)
+		return
+	}
+	fmt.Fprintf(w, ":%s %s %s %s %c\t%s\n", mode(c.From), mode(c.To), sha(c.From), sha(c.To), c.Status, c.Path())
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&fetchCmd{}, "")
+}
+
+type fetchCmd struct {
+	quiet     bool
+	shallow   shallowFlags
+	unshallow bool
+	filter    string
+}
+
+func (*fetchCmd) Name() string     { return "fetch" }
+func (*fetchCmd) Synopsis() string { return "git fetch [-q] [--depth n] [remote [refspec...]]" }
+func (*fetchCmd) Usage() string {
+	return `git fetch [-q|--quiet] [--depth <depth>] [--shallow-since <date>] [--shallow-exclude <ref>...]
+          [--unshallow] [--filter <filter-spec>] [remote [refspec...]]
+  Fetches the refs of the remote, origin by default, which is a configured remote, a URL or
+  a bundle file.
+  Without refspecs, remote.<remote>.fetch is used and the tags pointing to fetched commits
+  are fetched too. The fetched refs are written to FETCH_HEAD.
+  --depth, --shallow-since and --shallow-exclude cut the history of a shallow repository as
+  git clone does, and --unshallow fetches all of it. --filter omits objects as in a partial
+  clone, whose promisor remote is fetched from with its filter by default.
+`
+}
+func (c *fetchCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.quiet, "q", false, "suppress the progress messages and the updated refs")
+	f.BoolVar(&c.quiet, "quiet", false, "suppress the progress messages and the updated refs")
+	c.shallow.setFlags(f)
+	f.BoolVar(&c.unshallow, "unshallow", false, "fetch the whole history of a shallow repository")
+	f.StringVar(&c.filter, "filter", "", "omit the objects the `filter-spec` filters")
+}
+func (c *fetchCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fetch: ", err)
+		return subcommands.ExitFailure
+	}
+	depth, since, exclude, err := c.shallow.parse()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fetch: ", err)
+		return subcommands.ExitUsageError
+	}
+	opts := &git.FetchOptions{
+		Progress:       progress(c.quiet),
+		ReflogAction:   strings.Join(os.Args[1:], " "),
+		Depth:          depth,
+		ShallowSince:   since,
+		ShallowExclude: exclude,
+		Unshallow:      c.unshallow,
+		Filter:         c.filter,
+	}
+	if f.NArg() > 1 {
+		opts.Refspecs = f.Args()[1:]
+	}
+	res, err := git.Fetch(r, f.Arg(0), opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fetch: ", err)
+		return subcommands.ExitFailure
+	}
+	rejected := false
+	for _, u := range res.Updates {
+		rejected = rejected || u.Status.Rejected()
+	}
+	if !c.quiet || rejected {
+		printRefUpdates(res.URL, res.Updates, c.quiet)
+	}
+	if rejected {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// progress returns where the progress messages of the remote are written: stderr if it is a
+// terminal, unless quiet is true.
+func progress(quiet bool) io.Writer {
+	if quiet {
+		return nil
+	}
+	if fi, err := os.Stderr.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return os.Stderr
+}
+
+// printRefUpdates prints the updates of refs from url to stderr as git fetch does.
+// Refs which are up to date are omitted, and so are the others but rejected ones if quiet.
+func printRefUpdates(url string, updates []*git.RefUpdate, quiet bool) {
+	var shown []*git.RefUpdate
+	width := 10
+	for _, u := range updates {
+		if u.Status == git.UpdateUpToDate || quiet && !u.Status.Rejected() {
+			continue
+		}
+		shown = append(shown, u)
+		if n := len(git.ShortRefName(u.Remote)); u.Status != git.UpdateNone && n > width {
+			width = n
+		}
+	}
+	if len(shown) == 0 {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "From "+url)
+	for _, u := range shown {
+		flag, summary, local, suffix := ' ', "", git.ShortRefName(u.Local), ""
+		switch u.Status {
+		case git.UpdateNone:
+			flag, local = '*', "FETCH_HEAD"
+			switch {
+			case strings.HasPrefix(u.Remote, "refs/tags/"):
+				summary = "tag"
+			case strings.HasPrefix(u.Remote, "refs/remotes/"):
+				summary = "remote-tracking branch"
+			default:
+				summary = "branch"
+			}
+		case git.UpdateNew:
+			flag = '*'
+			switch {
+			case strings.HasPrefix(u.Remote, "refs/tags/"):
+				summary = "[new tag]"
+			case strings.HasPrefix(u.Remote, "refs/heads/"):
+				summary = "[new branch]"
+			default:
+				summary = "[new ref]"
+			}
+		case git.UpdateFastForward:
+			summary = u.Old[:7] + ".." + u.New[:7]
+		case git.UpdateForced:
+			flag, summary, suffix = '+', u.Old[:7]+"..."+u.New[:7], "  (forced update)"
+		case git.UpdateTag:
+			flag, summary = 't', "[tag update]"
+		case git.UpdateRejected:
+			flag, summary, suffix = '!', "[rejected]", "  (non-fast-forward)"
+		case git.UpdateRejectedTag:
+			flag, summary, suffix = '!', "[rejected]", "  (would clobber existing tag)"
+		}
+		fmt.Fprintf(os.Stderr, " %c %-17s %-*s -> %s%s\n", flag, summary, width, git.ShortRefName(u.Remote), local, suffix)
+	}
+}
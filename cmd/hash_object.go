@@ -48,8 +48,17 @@ func hashObject(path, typ string, write bool) error {
 			return err
 		}
 	}
-	b, err := ioutil.ReadFile(path)
-	if err != nil {
+	var b []byte
+	if fi, err := os.Lstat(path); err != nil {
+		return err
+	} else if fi.Mode()&os.ModeSymlink != 0 {
+		// A symlink is stored as a blob of its target.
+		s, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		b = []byte(s)
+	} else if b, err = ioutil.ReadFile(path); err != nil {
 		return err
 	}
 	sha, err := git.ObjectHash(b, typ, r)
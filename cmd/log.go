@@ -15,30 +15,85 @@ func init() {
 }
 
 type logCmd struct {
-	typ   string
-	write bool
+	typ    string
+	write  bool
+	follow bool
 }
 
-func (*logCmd) Name() string             { return "log" }
-func (*logCmd) Synopsis() string         { return "git log" }
-func (*logCmd) Usage() string            { return "git log [object]\n" }
-func (*logCmd) SetFlags(f *flag.FlagSet) {}
-func (*logCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	sha := f.Arg(0)
-	if sha == "" {
-		sha = "HEAD"
-	}
-	if err := doLog(sha); err != nil {
+func (*logCmd) Name() string     { return "log" }
+func (*logCmd) Synopsis() string { return "git log" }
+func (*logCmd) Usage() string {
+	return `git log [object]
+git log [--follow] [commit] -- path
+  With a path, only the commits changing the file are shown, in the order of their
+  committer dates. --follow follows the file across renames.
+`
+}
+func (c *logCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.follow, "follow", false, "follow the file across renames")
+}
+func (c *logCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "log: ", err)
+		return subcommands.ExitFailure
+	}
+	// The path may be given without "--", or with a leading "--" the flag package consumes.
+	rev, paths := splitRevPaths(r, f.Args())
+	if len(paths) > 1 {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	if len(paths) == 0 && c.follow {
+		fmt.Fprintln(os.Stderr, "log: --follow requires exactly one path")
+		return subcommands.ExitUsageError
+	}
+	if rev == "" {
+		rev = "HEAD"
+	}
+	if len(paths) > 0 {
+		if err := logPath(r, rev, paths[0], c.follow); err != nil {
+			fmt.Fprintln(os.Stderr, "log: ", err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+	sha, err := git.ResolveRevision(r, rev, "commit")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "log: ", err)
+		return subcommands.ExitFailure
+	}
+	if err := git.WriteLog(os.Stdout, r, sha); err != nil {
 		fmt.Fprint(os.Stderr, err)
 		return subcommands.ExitFailure
 	}
 	return subcommands.ExitSuccess
 }
 
-func doLog(sha string) error {
-	r, err := git.NewRepo("", false)
+// logPath writes the commits changing the file at the path as a chain in the graphviz format
+// of log, newest first.
+func logPath(r *git.Repo, rev, path string, follow bool) error {
+	sha, err := git.ResolveRevision(r, rev, "commit")
 	if err != nil {
 		return err
 	}
-	return git.WriteLog(os.Stdout, r, sha)
+	fmt.Println("digraph wyaglog{")
+	var prev string
+	n := 0
+	if err := git.LogPath(r, sha, path, follow, func(c, _ string) error {
+		if prev != "" {
+			fmt.Printf("c_%s -> c_%s\n", prev, c)
+		}
+		prev = c
+		n++
+		return nil
+	}); err != nil {
+		return err
+	}
+	if n == 1 {
+		// A single commit has no edges.
+		fmt.Printf("c_%s\n", prev)
+	}
+	fmt.Println("}")
+	return nil
 }
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&lsFilesCmd{}, "")
+}
+
+type lsFilesCmd struct {
+	stage bool
+}
+
+func (*lsFilesCmd) Name() string     { return "ls-files" }
+func (*lsFilesCmd) Synopsis() string { return "git ls-files [-s]" }
+func (*lsFilesCmd) Usage() string    { return "git ls-files [-s]\n" }
+func (c *lsFilesCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.stage, "s", false, "show mode, object name and stage")
+}
+func (c *lsFilesCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if err := lsFiles(c.stage); err != nil {
+		fmt.Fprintln(os.Stderr, "ls-files: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+func lsFiles(stage bool) error {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return err
+	}
+	idx, err := git.ReadIndex(r)
+	if err != nil {
+		return err
+	}
+	for i, e := range idx.Entries {
+		if stage {
+			fmt.Printf("%06o %s %d\t%s\n", e.Mode, e.SHA, e.Stage, e.Path)
+		} else if i == 0 || idx.Entries[i-1].Path != e.Path {
+			fmt.Println(e.Path)
+		}
+	}
+	return nil
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/google/subcommands"
 	"github.com/ogiekako/gogit/git"
@@ -14,47 +17,165 @@ func init() {
 	subcommands.Register(&lsTreeCmd{}, "")
 }
 
-type lsTreeCmd struct{}
+type lsTreeCmd struct {
+	recursive bool
+	showTrees bool
+	treeOnly  bool
+	long      bool
+	nameOnly  bool
+	nullTerm  bool
+}
 
-func (*lsTreeCmd) Name() string             { return "ls-tree" }
-func (*lsTreeCmd) Synopsis() string         { return "git ls-tree" }
-func (*lsTreeCmd) Usage() string            { return "git ls-tree object" }
-func (*lsTreeCmd) SetFlags(f *flag.FlagSet) {}
+func (*lsTreeCmd) Name() string { return "ls-tree" }
+func (*lsTreeCmd) Synopsis() string {
+	return "git ls-tree [-r] [-t] [-d] [-l] [--name-only] [-z] tree-ish [paths...]"
+}
+func (*lsTreeCmd) Usage() string {
+	return `git ls-tree [-r] [-t] [-d] [-l] [--name-only] [-z] tree-ish [paths...]
+  Lists the entries of the tree. With paths, only the entries matching them are listed,
+  descending into the trees leading to them.
+`
+}
+func (c *lsTreeCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.recursive, "r", false, "recurse into subtrees")
+	f.BoolVar(&c.showTrees, "t", false, "show tree entries even when recursing")
+	f.BoolVar(&c.treeOnly, "d", false, "show only tree entries")
+	f.BoolVar(&c.long, "l", false, "show the sizes of blobs")
+	f.BoolVar(&c.long, "long", false, "show the sizes of blobs")
+	f.BoolVar(&c.nameOnly, "name-only", false, "show only the names")
+	f.BoolVar(&c.nameOnly, "name-status", false, "synonym of --name-only")
+	f.BoolVar(&c.nullTerm, "z", false, "terminate the entries with NUL")
+}
 func (c *lsTreeCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if f.NArg() < 1 {
+	args, err := parseInterspersed(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ls-tree: ", err)
+		return subcommands.ExitUsageError
+	}
+	if len(args) > 1 && args[1] == "--" {
+		args = append(args[:1], args[2:]...)
+	}
+	if len(args) < 1 {
 		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
 		return subcommands.ExitFailure
 	}
-	if err := lsTree(f.Arg(0)); err != nil {
+	if err := c.lsTree(os.Stdout, args[0], args[1:]); err != nil {
 		fmt.Fprintln(os.Stderr, "ls-tree: ", err)
 		return subcommands.ExitFailure
 	}
 	return subcommands.ExitSuccess
 }
 
-func lsTree(sha string) error {
+func (c *lsTreeCmd) lsTree(w io.Writer, name string, paths []string) error {
 	r, err := git.NewRepo("", false)
 	if err != nil {
 		return err
 	}
+	sha, err := git.ResolveRevision(r, name, "tree")
+	if err != nil {
+		return err
+	}
+	if c.recursive && c.treeOnly {
+		c.showTrees = true
+	}
+	return c.walk(w, r, sha, "", paths)
+}
+
+// walk lists the entries of the tree whose path is base.
+func (c *lsTreeCmd) walk(w io.Writer, r *git.Repo, sha, base string, paths []string) error {
 	o, err := git.ReadObject(r, sha)
 	if err != nil {
 		return err
 	}
 	if o.Type != "tree" {
-		return fmt.Errorf("format %s != tree", o.Type)
+		return fmt.Errorf("%s is not a tree", sha)
 	}
-	tree := o.Tree
-	for _, c := range tree {
-		pad := ""
-		if len(c.Mode) == 5 {
-			pad = "0"
+	for _, l := range o.Tree {
+		full := base + l.Path
+		typ := entryType(l.Mode)
+		if !lsTreeMatch(full, typ == "tree", paths) {
+			continue
 		}
-		o, err := git.ReadObject(r, c.SHA)
-		if err != nil {
+		if typ == "tree" && c.descend(base, l.Path, paths) {
+			if c.showTrees {
+				if err := c.writeEntry(w, r, l, typ, full); err != nil {
+					return err
+				}
+			}
+			if err := c.walk(w, r, l.SHA, full+"/", paths); err != nil {
+				return err
+			}
+			continue
+		}
+		if typ == "blob" && c.treeOnly {
+			continue
+		}
+		if err := c.writeEntry(w, r, l, typ, full); err != nil {
 			return err
 		}
-		fmt.Printf("%s%s %s %s\t%s\n", pad, string(c.Mode), o.Type, c.SHA, string(c.Path))
 	}
 	return nil
 }
+
+// descend reports whether to list the entries of the tree at base+name, which is the case with
+// -r or if some path lies under it.
+func (c *lsTreeCmd) descend(base, name string, paths []string) bool {
+	if c.recursive {
+		return true
+	}
+	for _, p := range paths {
+		if !strings.HasPrefix(p, base) {
+			continue
+		}
+		p = p[len(base):]
+		if len(p) > len(name) && p[len(name)] == '/' && p[:len(name)] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lsTreeMatch reports whether the entry at the path matches the paths, which are literal.
+// An entry matches a path naming it, a directory containing it, or a path under it if the
+// entry is a tree.
+func lsTreeMatch(full string, tree bool, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		switch {
+		case full == p, tree && full+"/" == p:
+			return true
+		case strings.HasPrefix(full, p) && (strings.HasSuffix(p, "/") || full[len(p)] == '/'):
+			return true
+		case tree && strings.HasPrefix(p, full+"/"):
+			return true
+		}
+	}
+	return false
+}
+
+func (c *lsTreeCmd) writeEntry(w io.Writer, r *git.Repo, l *git.TreeLeaf, typ, full string) error {
+	term := "\n"
+	if c.nullTerm {
+		term = "\x00"
+	}
+	if c.nameOnly {
+		_, err := fmt.Fprint(w, full, term)
+		return err
+	}
+	if !c.long {
+		_, err := fmt.Fprintf(w, "%06s %s %s\t%s%s", l.Mode, typ, l.SHA, full, term)
+		return err
+	}
+	size := "-"
+	if typ == "blob" {
+		_, data, err := git.ReadRawObject(r, l.SHA)
+		if err != nil {
+			return err
+		}
+		size = strconv.Itoa(len(data))
+	}
+	_, err := fmt.Fprintf(w, "%06s %s %s %7s\t%s%s", l.Mode, typ, l.SHA, size, full, term)
+	return err
+}
@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/diff"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&mergeCmd{}, "")
+}
+
+type mergeCmd struct {
+	ffOnly, noFF, ff bool
+	messages         messageFlag
+	strategyOption   string
+	abort, cont      bool
+}
+
+func (*mergeCmd) Name() string { return "merge" }
+func (*mergeCmd) Synopsis() string {
+	return "git merge [--ff-only|--no-ff] [-m msg] commit..."
+}
+func (*mergeCmd) Usage() string {
+	return `git merge [--ff-only|--no-ff] [-m msg] [-X ours|theirs|union] commit...
+  Merges the commits into HEAD. A single commit is fast-forwarded to if possible, and
+  otherwise a merge commit is created. Merging several commits makes an octopus merge.
+  If the merge conflicts, the conflicts are left in the index and the worktree to be
+  resolved and concluded with "git merge --continue" or "git commit". The conflict markers
+  follow merge.conflictStyle (merge, diff3 or zdiff3).
+
+git merge --abort
+  Abandons the merge in progress, resetting the conflicted files to HEAD.
+
+git merge --continue
+  Concludes the merge in progress after the conflicts are resolved.
+`
+}
+func (c *mergeCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.ffOnly, "ff-only", false, "refuse to merge unless fast-forwarding")
+	f.BoolVar(&c.noFF, "no-ff", false, "create a merge commit even when fast-forwarding is possible")
+	f.BoolVar(&c.ff, "ff", false, "fast-forward when possible (default)")
+	f.Var(&c.messages, "m", "use the `message` for the merge commit; paragraphs are joined if given multiple times")
+	f.StringVar(&c.strategyOption, "X", "", "resolve conflicts favoring ours, theirs or union")
+	f.StringVar(&c.strategyOption, "strategy-option", "", "resolve conflicts favoring ours, theirs or union")
+	f.BoolVar(&c.abort, "abort", false, "abandon the merge in progress")
+	f.BoolVar(&c.cont, "continue", false, "conclude the merge in progress")
+}
+func (c *mergeCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if (c.abort || c.cont) != (f.NArg() == 0) || c.abort && c.cont {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	r, err := git.NewRepo("", false)
+	if err == nil {
+		switch {
+		case c.abort:
+			err = git.AbortMerge(r)
+		case c.cont:
+			err = continueMerge(os.Stdout, r)
+		default:
+			var ok bool
+			if ok, err = c.merge(os.Stdout, r, f.Args()); err == nil && !ok {
+				return subcommands.ExitFailure
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "merge: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// merge merges the revisions, reporting false if the merge stopped with conflicts.
+func (c *mergeCmd) merge(w io.Writer, r *git.Repo, revs []string) (bool, error) {
+	opts := &git.MergeCommitOptions{Message: c.messages.message()}
+	switch {
+	case c.ffOnly && c.noFF:
+		return false, errors.New("--ff-only and --no-ff are mutually exclusive")
+	case c.ffOnly:
+		opts.Mode = git.MergeFFOnly
+	case c.noFF:
+		opts.Mode = git.MergeNoFF
+	}
+	var err error
+	if opts.Tree.Style, err = diff.ParseMergeStyle(git.Config(r, "merge", "conflictStyle")); err != nil {
+		return false, err
+	}
+	switch c.strategyOption {
+	case "":
+	case "ours":
+		opts.Tree.Favor = diff.FavorOurs
+	case "theirs":
+		opts.Tree.Favor = diff.FavorTheirs
+	case "union":
+		opts.Tree.Favor = diff.FavorUnion
+	default:
+		return false, fmt.Errorf("unknown strategy option: -X%s", c.strategyOption)
+	}
+
+	var heads []*git.MergeHead
+	for _, rev := range revs {
+		sha, err := git.ResolveRevision(r, rev, "commit")
+		if err != nil {
+			return false, err
+		}
+		heads = append(heads, &git.MergeHead{SHA: sha, Name: rev})
+	}
+	out, err := git.Merge(r, heads, opts)
+	if err != nil {
+		return false, err
+	}
+	if out.Tree != nil {
+		for _, m := range out.Tree.Messages {
+			fmt.Fprintln(w, m)
+		}
+	}
+	switch out.Status {
+	case git.MergeUpToDate:
+		fmt.Fprintln(w, "Already up to date.")
+		return true, nil
+	case git.MergeConflicted:
+		fmt.Fprintln(w, "Automatic merge failed; fix conflicts and then commit the result.")
+		return false, nil
+	case git.MergeFastForwarded:
+		fmt.Fprintf(w, "Updating %s..%s\nFast-forward\n", out.Old[:7], out.New[:7])
+	default:
+		fmt.Fprintf(w, "Merge made by the '%s' strategy.\n", out.Strategy)
+	}
+	return true, printMergeStat(w, r, out.Old, out.New)
+}
+
+// printMergeStat prints the diffstat and the summary of the changes from the commit a to b.
+func printMergeStat(w io.Writer, r *git.Repo, a, b string) error {
+	ta, err := git.TreeSHA(r, a)
+	if err != nil {
+		return err
+	}
+	tb, err := git.TreeSHA(r, b)
+	if err != nil {
+		return err
+	}
+	changes, err := git.DiffTrees(r, ta, tb, &git.DiffTreeOptions{Recursive: true})
+	if err != nil {
+		return err
+	}
+	f := &diffFlags{context: diff.DefaultContext, algorithm: "myers", stat: true, summary: true}
+	p, err := newDiffPrinter(r, f)
+	if err != nil {
+		return err
+	}
+	p.renames = f.renameOptions(r, true)
+	return p.print(w, changes)
+}
+
+// continueMerge commits the merge in progress with the prepared message.
+func continueMerge(w io.Writer, r *git.Repo) error {
+	if mh, err := git.MergeHeads(r); err != nil {
+		return err
+	} else if mh == nil {
+		return errors.New("there is no merge in progress (MERGE_HEAD missing)")
+	}
+	msg, err := git.MergeMessage(r)
+	if err != nil {
+		return err
+	}
+	sha, err := git.Commit(r, git.CleanupMessage(msg, true), nil)
+	if err != nil {
+		return err
+	}
+	printCommitted(w, r, sha, false)
+	return nil
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&mergeBaseCmd{}, "")
+}
+
+type mergeBaseCmd struct {
+	all        bool
+	octopus    bool
+	isAncestor bool
+	forkPoint  bool
+}
+
+func (*mergeBaseCmd) Name() string { return "merge-base" }
+func (*mergeBaseCmd) Synopsis() string {
+	return "git merge-base [-a|--all] [--octopus] commit commit..."
+}
+func (*mergeBaseCmd) Usage() string {
+	return `git merge-base [-a|--all] commit commit...
+  Prints a best common ancestor of the first commit and a hypothetical merge of the others,
+  or all of them with --all. Exits with 1 if there is none.
+
+git merge-base [-a|--all] --octopus commit...
+  Prints the best common ancestors of all the commits, as needed to merge them at once.
+
+git merge-base --is-ancestor commit commit
+  Exits with 0 if the first commit is an ancestor of the second, and with 1 otherwise.
+
+git merge-base --fork-point ref [commit]
+  Prints the commit at which the commit, HEAD by default, forked from the ref, taking the
+  past tips of the ref recorded in its reflog into account.
+`
+}
+func (c *mergeBaseCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.all, "a", false, "print all the best common ancestors")
+	f.BoolVar(&c.all, "all", false, "print all the best common ancestors")
+	f.BoolVar(&c.octopus, "octopus", false, "compute the best common ancestors of all the commits")
+	f.BoolVar(&c.isAncestor, "is-ancestor", false, "check if the first commit is an ancestor of the second")
+	f.BoolVar(&c.forkPoint, "fork-point", false, "find the fork point of the commit from the ref")
+}
+func (c *mergeBaseCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	modes := 0
+	for _, b := range []bool{c.octopus, c.isAncestor, c.forkPoint} {
+		if b {
+			modes++
+		}
+	}
+	n := f.NArg()
+	if modes > 1 || c.isAncestor && (n != 2 || c.all) || c.forkPoint && (n < 1 || n > 2 || c.all) ||
+		c.octopus && n < 1 || modes == 0 && n < 2 {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	ok, err := c.mergeBase(os.Stdout, f.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "merge-base: ", err)
+		return subcommands.ExitFailure
+	}
+	if !ok {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// mergeBase prints the result for the arguments, reporting false if there is none.
+func (c *mergeBaseCmd) mergeBase(w io.Writer, args []string) (bool, error) {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return false, err
+	}
+	if c.forkPoint {
+		commit := "HEAD"
+		if len(args) == 2 {
+			commit = args[1]
+		}
+		sha, err := git.ResolveRevision(r, commit, "commit")
+		if err != nil {
+			return false, err
+		}
+		fp, err := git.ForkPoint(r, args[0], sha)
+		if err != nil || fp == "" {
+			return false, err
+		}
+		fmt.Fprintln(w, fp)
+		return true, nil
+	}
+
+	var shas []string
+	for _, arg := range args {
+		sha, err := git.ResolveRevision(r, arg, "commit")
+		if err != nil {
+			return false, err
+		}
+		shas = append(shas, sha)
+	}
+	var bases []string
+	switch {
+	case c.isAncestor:
+		return git.IsAncestor(r, shas[0], shas[1])
+	case c.octopus:
+		bases, err = git.OctopusMergeBases(r, shas)
+	default:
+		bases, err = git.MergeBases(r, shas[0], shas[1:]...)
+	}
+	if err != nil || len(bases) == 0 {
+		return false, err
+	}
+	if !c.all {
+		bases = bases[:1]
+	}
+	for _, b := range bases {
+		fmt.Fprintln(w, b)
+	}
+	return true, nil
+}
@@ -0,0 +1,801 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ogiekako/gogit/diff"
+	"github.com/ogiekako/gogit/git"
+)
+
+// colorFlag is the value of --color, which may be given without a value to mean always.
+type colorFlag string
+
+func (c *colorFlag) String() string { return string(*c) }
+func (c *colorFlag) Set(s string) error {
+	switch s {
+	case "true":
+		s = "always"
+	case "false":
+		s = "never"
+	}
+	switch s {
+	case "always", "never", "auto":
+		*c = colorFlag(s)
+		return nil
+	}
+	return fmt.Errorf("invalid color mode %s", s)
+}
+func (c *colorFlag) IsBoolFlag() bool { return true }
+
+// enabled reports whether the output is colored. Unless --color is given, color.diff and
+// color.ui are consulted, and in auto mode the output is colored if stdout is a terminal.
+func (c colorFlag) enabled(r *git.Repo) bool {
+	mode := string(c)
+	if mode == "" && r != nil {
+		if mode = git.Config(r, "color", "diff"); mode == "" {
+			mode = git.Config(r, "color", "ui")
+		}
+	}
+	switch mode {
+	case "always":
+		return true
+	case "never", "false":
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// renameFlag is the value of -M and -C, which may be given without the minimum similarity.
+type renameFlag struct {
+	set   bool
+	score int
+}
+
+func (f *renameFlag) String() string { return "" }
+func (f *renameFlag) Set(s string) error {
+	if s == "false" {
+		f.set = false
+		return nil
+	}
+	if s == "true" {
+		s = ""
+	}
+	score, err := git.ParseRenameScore(s)
+	if err != nil {
+		return err
+	}
+	f.set, f.score = true, score
+	return nil
+}
+func (f *renameFlag) IsBoolFlag() bool { return true }
+
+// diffCommands are the commands which take diffFlags.
+var diffCommands = map[string]bool{"diff": true, "diff-tree": true, "show": true}
+
+// NormalizeArgs rewrites the command line args so that the flag package accepts the short
+// options of diffFlags with an attached value as git does, e.g. -U1 and -M50% become -U=1
+// and -M=50%.
+func NormalizeArgs(args []string) []string {
+	if len(args) < 2 || !diffCommands[args[1]] {
+		return args
+	}
+	res := append([]string(nil), args...)
+	for i := 2; i < len(res); i++ {
+		a := res[i]
+		if a == "--" {
+			break
+		}
+		if len(a) > 2 && a[0] == '-' && strings.IndexByte("UMC", a[1]) >= 0 && a[2] != '=' {
+			res[i] = a[:2] + "=" + a[2:]
+		}
+	}
+	return res
+}
+
+// diffFlags are the flags shared by the commands printing diffs.
+type diffFlags struct {
+	context           int
+	algorithm         string
+	ignoreSpaceChange bool
+	ignoreAllSpace    bool
+
+	nameOnly, nameStatus bool
+	stat, numstat        bool
+	summary              bool
+	color                colorFlag
+
+	findRenames, findCopies renameFlag
+	noRenames               bool
+}
+
+func (d *diffFlags) setFlags(f *flag.FlagSet) {
+	f.IntVar(&d.context, "U", diff.DefaultContext, "generate diffs with `n` lines of context")
+	f.IntVar(&d.context, "unified", diff.DefaultContext, "generate diffs with `n` lines of context")
+	f.StringVar(&d.algorithm, "diff-algorithm", "myers", "diff algorithm: myers, patience or histogram")
+	f.BoolVar(&d.ignoreSpaceChange, "b", false, "ignore changes in amount of whitespace")
+	f.BoolVar(&d.ignoreSpaceChange, "ignore-space-change", false, "ignore changes in amount of whitespace")
+	f.BoolVar(&d.ignoreAllSpace, "w", false, "ignore whitespace when comparing lines")
+	f.BoolVar(&d.ignoreAllSpace, "ignore-all-space", false, "ignore whitespace when comparing lines")
+	f.BoolVar(&d.nameOnly, "name-only", false, "show only names of changed files")
+	f.BoolVar(&d.nameStatus, "name-status", false, "show only names and statuses of changed files")
+	f.BoolVar(&d.stat, "stat", false, "show a diffstat")
+	f.BoolVar(&d.numstat, "numstat", false, "show numbers of added and deleted lines in decimal")
+	f.BoolVar(&d.summary, "summary", false, "show creations, deletions, renames and mode changes after the diffstat")
+	f.Var(&d.color, "color", "color the output: always, never or auto")
+	f.Var(&d.findRenames, "M", "detect renames, optionally with the minimum similarity as in -M90%")
+	f.Var(&d.findRenames, "find-renames", "detect renames, optionally with the minimum similarity")
+	f.Var(&d.findCopies, "C", "detect copies as well as renames, optionally with the minimum similarity")
+	f.Var(&d.findCopies, "find-copies", "detect copies as well as renames, optionally with the minimum similarity")
+	f.BoolVar(&d.noRenames, "no-renames", false, "do not detect renames")
+}
+
+// renameOptions returns how to detect renames, or nil if they are not detected. Unless -M or -C
+// is given, renames are detected following diff.renames if byDefault, as git diff does.
+func (d *diffFlags) renameOptions(r *git.Repo, byDefault bool) *git.RenameOptions {
+	switch {
+	case d.noRenames:
+		return nil
+	case d.findCopies.set:
+		return &git.RenameOptions{Copies: true, MinScore: d.findCopies.score}
+	case d.findRenames.set:
+		return &git.RenameOptions{MinScore: d.findRenames.score}
+	case !byDefault:
+		return nil
+	}
+	conf := ""
+	if r != nil {
+		conf = git.Config(r, "diff", "renames")
+	}
+	switch conf {
+	case "false", "no", "off", "0":
+		return nil
+	case "copies", "copy":
+		return &git.RenameOptions{Copies: true}
+	}
+	return &git.RenameOptions{}
+}
+
+func (d *diffFlags) options() (*diff.Options, error) {
+	alg, err := diff.ParseAlgorithm(d.algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if d.context < 0 {
+		return nil, fmt.Errorf("invalid context length %d", d.context)
+	}
+	return &diff.Options{
+		Context:           d.context,
+		Algorithm:         alg,
+		IgnoreSpaceChange: d.ignoreSpaceChange,
+		IgnoreAllSpace:    d.ignoreAllSpace,
+	}, nil
+}
+
+// The colors git uses by default.
+const (
+	colorReset = "\033[m"
+	colorMeta  = "\033[1m"
+	colorFrag  = "\033[36m"
+	colorOld   = "\033[31m"
+	colorNew   = "\033[32m"
+	colorWS    = "\033[41m"
+)
+
+// diffPrinter prints changes in the formats chosen by diffFlags.
+type diffPrinter struct {
+	r     *git.Repo
+	flags *diffFlags
+	opts  *diff.Options
+	color bool
+	// patch prints patches after a diffstat.
+	patch bool
+	// raw prints the changes in the raw format if no other format is chosen, instead of patches.
+	raw bool
+	// renames detects renames if not nil.
+	renames *git.RenameOptions
+	// noIndex names the missing side of an addition or a deletion /dev/null as git diff --no-index does.
+	noIndex bool
+	// readOld and readNew read the contents of the old and the new sides of changes.
+	readOld, readNew func(*git.TreeLeaf) ([]byte, error)
+}
+
+func newDiffPrinter(r *git.Repo, f *diffFlags) (*diffPrinter, error) {
+	opts, err := f.options()
+	if err != nil {
+		return nil, err
+	}
+	p := &diffPrinter{r: r, flags: f, opts: opts, color: f.color.enabled(r)}
+	p.readOld = p.readBlob
+	p.readNew = p.readBlob
+	return p, nil
+}
+
+func (p *diffPrinter) readBlob(l *git.TreeLeaf) ([]byte, error) {
+	return leafContent(p.r, l)
+}
+
+// readWorktree reads the content of the leaf from the worktree.
+func (p *diffPrinter) readWorktree(l *git.TreeLeaf) ([]byte, error) {
+	if l == nil || l.Mode == "160000" {
+		return leafContent(p.r, l)
+	}
+	return git.ReadWorktreeFile(p.r, l.Path)
+}
+
+// leafContent returns the content of the file the leaf represents. A gitlink is shown as
+// the commit it points at, as git does.
+func leafContent(r *git.Repo, l *git.TreeLeaf) ([]byte, error) {
+	if l == nil {
+		return nil, nil
+	}
+	if l.Mode == "160000" {
+		return []byte("Subproject commit " + l.SHA + "\n"), nil
+	}
+	o, err := git.ReadObject(r, l.SHA)
+	if err != nil {
+		return nil, err
+	}
+	if o.Type != "blob" {
+		return nil, fmt.Errorf("%s is not a blob", l.SHA)
+	}
+	return o.Blob, nil
+}
+
+// paint wraps s in the color if the output is colored.
+func (p *diffPrinter) paint(color, s string) string {
+	if !p.color || s == "" {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// oldPath and newPath return the paths of the sides of the change. The missing side of an
+// addition or a deletion has the path of the other side.
+func oldPath(c *git.Change) string {
+	if c.From != nil {
+		return c.From.Path
+	}
+	return c.To.Path
+}
+
+func newPath(c *git.Change) string {
+	if c.To != nil {
+		return c.To.Path
+	}
+	return c.From.Path
+}
+
+// statName returns the name of the change in diffstats.
+func (p *diffPrinter) statName(c *git.Change) string {
+	switch {
+	case p.noIndex && c.From == nil:
+		return "/dev/null => " + c.To.Path
+	case p.noIndex && c.To == nil:
+		return c.From.Path + " => /dev/null"
+	case oldPath(c) != newPath(c):
+		return pprintRename(oldPath(c), newPath(c))
+	}
+	return c.Path()
+}
+
+// pprintRename returns "a => b" abbreviating the common leading and trailing directories of
+// the paths as in "dir/{a => b}/file".
+func pprintRename(a, b string) string {
+	at := func(s string, i int) byte {
+		if i < len(s) {
+			return s[i]
+		}
+		return 0
+	}
+	pfx := 0
+	for i := 0; i < len(a) && i < len(b) && a[i] == b[i]; i++ {
+		if a[i] == '/' {
+			pfx = i + 1
+		}
+	}
+	// If there is a common prefix, it ends with a slash, which the suffix may share.
+	adjust := 0
+	if pfx > 0 {
+		adjust = 1
+	}
+	sfx := 0
+	for i, j := len(a), len(b); pfx-adjust <= i && pfx-adjust <= j && at(a, i) == at(b, j); i, j = i-1, j-1 {
+		if at(a, i) == '/' {
+			sfx = len(a) - i
+		}
+	}
+	amid, bmid := len(a)-pfx-sfx, len(b)-pfx-sfx
+	if amid < 0 {
+		amid = 0
+	}
+	if bmid < 0 {
+		bmid = 0
+	}
+	mid := a[pfx:pfx+amid] + " => " + b[pfx:pfx+bmid]
+	if pfx+sfx == 0 {
+		return mid
+	}
+	return a[:pfx] + "{" + mid + "}" + a[len(a)-sfx:]
+}
+
+// print prints the changes. The name formats take precedence over the diffstats, which are
+// followed by patches only if p.patch. Otherwise patches are printed, or the raw format if p.raw.
+func (p *diffPrinter) print(w io.Writer, changes []*git.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	if p.renames != nil {
+		p.renames.ReadOld, p.renames.ReadNew = p.readOld, p.readNew
+		var err error
+		if changes, err = git.DetectRenames(p.r, changes, p.renames); err != nil {
+			return err
+		}
+	}
+	f := p.flags
+	switch {
+	case f.nameOnly:
+		for _, c := range changes {
+			if p.noIndex && c.To == nil {
+				fmt.Fprintln(w, "/dev/null")
+			} else {
+				fmt.Fprintln(w, newPath(c))
+			}
+		}
+		return nil
+	case f.nameStatus:
+		for _, c := range changes {
+			if c.Status == 'R' || c.Status == 'C' {
+				fmt.Fprintf(w, "%c%03d\t%s\t%s\n", c.Status, similarity(c), oldPath(c), newPath(c))
+			} else {
+				fmt.Fprintf(w, "%c\t%s\n", c.Status, oldPath(c))
+			}
+		}
+		return nil
+	case f.stat || f.numstat:
+		stats, err := p.stats(changes)
+		if err != nil {
+			return err
+		}
+		if f.numstat {
+			for _, s := range stats {
+				if s.binary {
+					fmt.Fprintf(w, "-\t-\t%s\n", s.name)
+				} else {
+					fmt.Fprintf(w, "%d\t%d\t%s\n", s.added, s.deleted, s.name)
+				}
+			}
+		}
+		if f.stat {
+			p.writeStat(w, stats)
+		}
+		if f.summary {
+			writeSummary(w, changes)
+		}
+		if !p.patch {
+			return nil
+		}
+		fmt.Fprintln(w)
+	case p.raw:
+		for _, c := range changes {
+			writeRaw(w, c)
+		}
+		return nil
+	}
+	for _, c := range changes {
+		if err := p.writePatch(w, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSummary writes the creations, deletions, renames, copies and mode changes of files
+// as git diff --summary does.
+func writeSummary(w io.Writer, changes []*git.Change) {
+	for _, c := range changes {
+		switch {
+		case c.From == nil:
+			fmt.Fprintf(w, " create mode %s %s\n", c.To.Mode, c.To.Path)
+		case c.To == nil:
+			fmt.Fprintf(w, " delete mode %s %s\n", c.From.Mode, c.From.Path)
+		case c.Status == 'R' || c.Status == 'C':
+			kind := "rename"
+			if c.Status == 'C' {
+				kind = "copy"
+			}
+			fmt.Fprintf(w, " %s %s (%d%%)\n", kind, pprintRename(c.From.Path, c.To.Path), similarity(c))
+			if c.From.Mode != c.To.Mode {
+				fmt.Fprintf(w, " mode change %s => %s\n", c.From.Mode, c.To.Mode)
+			}
+		case c.From.Mode != c.To.Mode:
+			fmt.Fprintf(w, " mode change %s => %s %s\n", c.From.Mode, c.To.Mode, c.Path())
+		}
+	}
+}
+
+// similarity returns the similarity of a rename or a copy in percent.
+func similarity(c *git.Change) int {
+	return c.Score * 100 / git.MaxScore
+}
+
+// fileStat is the diffstat of a file. For binary files, added and deleted are the sizes in bytes.
+type fileStat struct {
+	name           string
+	added, deleted int
+	binary         bool
+}
+
+func (p *diffPrinter) stats(changes []*git.Change) ([]*fileStat, error) {
+	var res []*fileStat
+	for _, c := range changes {
+		a, err := p.readOld(c.From)
+		if err != nil {
+			return nil, err
+		}
+		b, err := p.readNew(c.To)
+		if err != nil {
+			return nil, err
+		}
+		s := &fileStat{name: p.statName(c)}
+		if diff.IsBinary(a) || diff.IsBinary(b) {
+			s.binary = true
+			if c.From == nil || c.To == nil || c.From.SHA != c.To.SHA {
+				s.added, s.deleted = len(b), len(a)
+			}
+		} else {
+			s.added, s.deleted = diff.Stat(diff.Diff(diff.Lines(a), diff.Lines(b), p.opts))
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// statWidth returns the width of diffstats, which is the COLUMNS environment variable or 80.
+func statWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return 80
+}
+
+// writeStat writes the diffstat, scaling the graphs to fit the width as git does.
+func (p *diffPrinter) writeStat(w io.Writer, stats []*fileStat) {
+	maxLen, maxChange, binWidth, numberWidth := 0, 0, 0, 0
+	for _, s := range stats {
+		if len(s.name) > maxLen {
+			maxLen = len(s.name)
+		}
+		if s.binary {
+			// "Bin XXX -> YYY bytes"
+			if n := 14 + len(strconv.Itoa(s.added)) + len(strconv.Itoa(s.deleted)); n > binWidth {
+				binWidth = n
+			}
+			// Align the change counts with "Bin".
+			numberWidth = 3
+			continue
+		}
+		if n := s.added + s.deleted; n > maxChange {
+			maxChange = n
+		}
+	}
+	width := statWidth()
+	if n := len(strconv.Itoa(maxChange)); n > numberWidth {
+		numberWidth = n
+	}
+	if width < 16+6+numberWidth {
+		width = 16 + 6 + numberWidth
+	}
+	graphWidth := maxChange
+	if maxChange+4 <= binWidth {
+		graphWidth = binWidth - 4
+	}
+	nameWidth := maxLen
+	if nameWidth+numberWidth+6+graphWidth > width {
+		if graphWidth > width*3/8-numberWidth-6 {
+			if graphWidth = width*3/8 - numberWidth - 6; graphWidth < 6 {
+				graphWidth = 6
+			}
+		}
+		if nameWidth > width-numberWidth-6-graphWidth {
+			nameWidth = width - numberWidth - 6 - graphWidth
+		} else {
+			graphWidth = width - numberWidth - 6 - nameWidth
+		}
+	}
+	scale := func(n int) int {
+		if n == 0 {
+			return 0
+		}
+		// At least one column for any change.
+		return 1 + n*(graphWidth-1)/maxChange
+	}
+
+	adds, dels := 0, 0
+	for _, s := range stats {
+		name, prefix := s.name, ""
+		if len(name) > nameWidth {
+			// Show "..." and the end of the name, from a slash if any.
+			prefix = "..."
+			n := nameWidth - 3
+			if n < 0 {
+				n = 0
+			}
+			name = name[len(name)-n:]
+			if i := strings.Index(name, "/"); i >= 0 {
+				name = name[i:]
+			}
+		}
+		pad := nameWidth - len(prefix) - len(name)
+		if pad < 0 {
+			pad = 0
+		}
+		line := " " + prefix + name + strings.Repeat(" ", pad) + " | "
+		if s.binary {
+			line += fmt.Sprintf("%*s", numberWidth, "Bin")
+			if s.added != 0 || s.deleted != 0 {
+				line += fmt.Sprintf(" %s -> %s bytes", p.paint(colorOld, strconv.Itoa(s.deleted)), p.paint(colorNew, strconv.Itoa(s.added)))
+			}
+			fmt.Fprintln(w, line)
+			continue
+		}
+		adds += s.added
+		dels += s.deleted
+		add, del := s.added, s.deleted
+		if graphWidth <= maxChange {
+			total := scale(add + del)
+			if total < 2 && add > 0 && del > 0 {
+				total = 2
+			}
+			if add < del {
+				add = scale(add)
+				del = total - add
+			} else {
+				del = scale(del)
+				add = total - del
+			}
+		}
+		line += fmt.Sprintf("%*d", numberWidth, s.added+s.deleted)
+		if s.added+s.deleted > 0 {
+			line += " "
+		}
+		line += p.paint(colorNew, strings.Repeat("+", add)) + p.paint(colorOld, strings.Repeat("-", del))
+		fmt.Fprintln(w, line)
+	}
+
+	plural := func(n int, one, many string) string {
+		if n == 1 {
+			return fmt.Sprintf(one, n)
+		}
+		return fmt.Sprintf(many, n)
+	}
+	summary := plural(len(stats), " %d file changed", " %d files changed")
+	if adds > 0 || dels == 0 {
+		summary += plural(adds, ", %d insertion(+)", ", %d insertions(+)")
+	}
+	if dels > 0 || adds == 0 {
+		summary += plural(dels, ", %d deletion(-)", ", %d deletions(-)")
+	}
+	fmt.Fprintln(w, summary)
+}
+
+// writePatch writes the change as a git patch. A type change is written as a deletion
+// followed by an addition.
+func (p *diffPrinter) writePatch(w io.Writer, c *git.Change) error {
+	if c.Status == 'T' {
+		if err := p.writePatch(w, &git.Change{Status: 'D', From: c.From}); err != nil {
+			return err
+		}
+		return p.writePatch(w, &git.Change{Status: 'A', To: c.To})
+	}
+	a, err := p.readOld(c.From)
+	if err != nil {
+		return err
+	}
+	b, err := p.readNew(c.To)
+	if err != nil {
+		return err
+	}
+	// Absolute paths given to --no-index are shown without the leading slash.
+	pa, pb := strings.TrimPrefix(oldPath(c), "/"), strings.TrimPrefix(newPath(c), "/")
+	meta := func(format string, args ...interface{}) {
+		fmt.Fprintln(w, p.paint(colorMeta, fmt.Sprintf(format, args...)))
+	}
+	meta("diff --git a/%s b/%s", pa, pb)
+	short := func(l *git.TreeLeaf) string {
+		if l == nil {
+			return git.ZeroSHA[:7]
+		}
+		return l.SHA[:7]
+	}
+	switch {
+	case c.From == nil:
+		meta("new file mode %06s", c.To.Mode)
+	case c.To == nil:
+		meta("deleted file mode %06s", c.From.Mode)
+	case c.From.Mode != c.To.Mode:
+		meta("old mode %06s", c.From.Mode)
+		meta("new mode %06s", c.To.Mode)
+	}
+	switch c.Status {
+	case 'R':
+		meta("similarity index %d%%", similarity(c))
+		meta("rename from %s", pa)
+		meta("rename to %s", pb)
+	case 'C':
+		meta("similarity index %d%%", similarity(c))
+		meta("copy from %s", pa)
+		meta("copy to %s", pb)
+	}
+	if c.From == nil || c.To == nil || c.From.SHA != c.To.SHA {
+		if c.From != nil && c.To != nil && c.From.Mode == c.To.Mode {
+			meta("index %s..%s %06s", short(c.From), short(c.To), c.To.Mode)
+		} else {
+			meta("index %s..%s", short(c.From), short(c.To))
+		}
+	}
+	if c.From != nil && c.To != nil && c.From.SHA == c.To.SHA {
+		return nil
+	}
+	name := func(prefix, path string, l *git.TreeLeaf) string {
+		if l == nil {
+			return "/dev/null"
+		}
+		return prefix + path
+	}
+	if diff.IsBinary(a) || diff.IsBinary(b) {
+		_, err := fmt.Fprintf(w, "Binary files %s and %s differ\n", name("a/", pa, c.From), name("b/", pb, c.To))
+		return err
+	}
+	la, lb := diff.Lines(a), diff.Lines(b)
+	hs := diff.Hunks(diff.Diff(la, lb, p.opts), p.opts.Context)
+	if len(hs) == 0 {
+		return nil
+	}
+	meta("--- %s", name("a/", pa, c.From))
+	meta("+++ %s", name("b/", pb, c.To))
+	var lw diff.LineWriter
+	if p.color {
+		lw = colorLines(a, b)
+	}
+	return diff.WriteHunks(w, la, lb, hs, lw)
+}
+
+// colorLines returns a LineWriter coloring the lines of the hunks between a and b as git does.
+// Whitespace errors on new lines are highlighted: whitespace at the end of lines, spaces
+// before tabs in indentation and blank lines added at the end of the file.
+func colorLines(a, b []byte) diff.LineWriter {
+	blankOld, blankNew := blankAtEOF(a, b)
+	// The line numbers in the old and the new text, off by one as in git.
+	var lnoOld, lnoNew int
+	// plain writes the line in a color, keeping a trailing CR out of it.
+	plain := func(color, line string) string {
+		cr := ""
+		if strings.HasSuffix(line, "\r") {
+			line, cr = line[:len(line)-1], "\r"
+		}
+		return color + line + colorReset + cr
+	}
+	return func(w io.Writer, kind diff.LineKind, line string) error {
+		var s string
+		switch kind {
+		case diff.HunkHeader:
+			fmt.Sscanf(line, "@@ -%d", &lnoOld)
+			if i := strings.Index(line, " +"); i >= 0 {
+				fmt.Sscanf(line[i+2:], "%d", &lnoNew)
+			}
+			end := strings.Index(line[2:], "@@") + 4
+			s = colorFrag + line[:end] + colorReset
+			if end < len(line) {
+				s += " " + line[end+1:] + colorReset
+			}
+		case diff.ContextLine:
+			lnoOld++
+			lnoNew++
+			s = plain("", line)
+		case diff.OldLine:
+			lnoOld++
+			s = plain(colorOld, line)
+		case diff.NewLine:
+			lnoNew++
+			if blankOld > 0 && blankOld <= lnoOld && blankNew <= lnoNew && isBlank(line[1:]) {
+				s = plain(colorWS, line)
+			} else {
+				s = colorNew + "+" + colorReset + wsHighlight(line[1:])
+			}
+		case diff.NoNewline:
+			s = line + colorReset
+		}
+		_, err := io.WriteString(w, s+"\n")
+		return err
+	}
+}
+
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	}
+	return false
+}
+
+func isBlank(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isSpace(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// wsHighlight colors the content of a new line, highlighting trailing whitespace and spaces
+// before tabs in the indentation. Other indentation is left uncolored as git does.
+func wsHighlight(line string) string {
+	trailing := len(line)
+	for trailing > 0 && isSpace(line[trailing-1]) {
+		trailing--
+	}
+	var sb strings.Builder
+	written := 0
+	for i := 0; i < trailing; i++ {
+		if line[i] == ' ' {
+			continue
+		}
+		if line[i] != '\t' {
+			break
+		}
+		if written < i {
+			sb.WriteString(colorWS + line[written:i] + colorReset + "\t")
+		} else {
+			sb.WriteString(line[written : i+1])
+		}
+		written = i + 1
+	}
+	if written < trailing {
+		sb.WriteString(colorNew + line[written:trailing] + colorReset)
+	}
+	if trailing < len(line) {
+		sb.WriteString(colorWS + line[trailing:] + colorReset)
+	}
+	return sb.String()
+}
+
+// blankAtEOF returns the 1-based line numbers from which the blank lines at the end of a and b
+// begin if b has more of them than a, or zeros otherwise.
+func blankAtEOF(a, b []byte) (int, int) {
+	l1, l2 := trailingBlanks(a), trailingBlanks(b)
+	if l2 <= l1 {
+		return 0, 0
+	}
+	return len(diff.Lines(a)) - l1 + 1, len(diff.Lines(b)) - l2 + 1
+}
+
+// trailingBlanks counts the blank lines at the end of the text. The first line is never counted,
+// which is a quirk of git kept for compatibility.
+func trailingBlanks(b []byte) int {
+	if len(b) == 0 {
+		return 0
+	}
+	n := 0
+	end := len(b) - 1
+	if b[end] == '\n' {
+		end--
+	}
+	for 0 < end {
+		prev := end
+		for prev >= 0 && b[prev] != '\n' {
+			prev--
+		}
+		if !isBlank(string(b[prev+1 : end+1])) {
+			break
+		}
+		n++
+		end = prev - 1
+	}
+	return n
+}
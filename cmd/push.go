@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&pushCmd{}, "")
+}
+
+type pushCmd struct {
+	force, quiet bool
+}
+
+func (*pushCmd) Name() string     { return "push" }
+func (*pushCmd) Synopsis() string { return "git push [-f] [-q] [remote [refspec...]]" }
+func (*pushCmd) Usage() string {
+	return `git push [-f|--force] [-q|--quiet] [remote [refspec...]]
+  Updates the refs of the remote, a configured remote or a URL, from the local refs named by
+  the refspecs [+]<src>[:<dst>], sending the objects they need. Without refspecs, the current
+  branch is pushed to its upstream branch of the same name. ":<dst>" deletes the remote ref.
+  Non fast-forward updates are rejected unless forced with + or -f.
+`
+}
+func (c *pushCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.force, "f", false, "allow non fast-forward updates")
+	f.BoolVar(&c.force, "force", false, "allow non fast-forward updates")
+	f.BoolVar(&c.quiet, "q", false, "suppress the progress messages and the updated refs")
+	f.BoolVar(&c.quiet, "quiet", false, "suppress the progress messages and the updated refs")
+}
+func (c *pushCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "push: ", err)
+		return subcommands.ExitFailure
+	}
+	opts := &git.PushOptions{Force: c.force, Progress: progress(c.quiet)}
+	if f.NArg() > 1 {
+		opts.Refspecs = f.Args()[1:]
+	}
+	res, err := git.Push(r, f.Arg(0), opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "push: ", err)
+		return subcommands.ExitFailure
+	}
+	rejected := false
+	for _, u := range res.Updates {
+		rejected = rejected || u.Status.Rejected()
+	}
+	if !c.quiet || rejected {
+		printPushUpdates(res.URL, res.Updates, c.quiet)
+	}
+	if rejected {
+		fmt.Fprintf(os.Stderr, "error: failed to push some refs to '%s'\n", res.URL)
+		branch, _, _ := git.Head(r)
+		printPushHint(branch, res.Updates)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// printPushHint prints the advice git push gives for the first kind of rejection among
+// the updates. branch is the current branch.
+func printPushHint(branch string, updates []*git.RefUpdate) {
+	var hint string
+	for _, u := range updates {
+		switch u.Status {
+		case git.UpdateRejected:
+			if u.Local == branch {
+				hint = `Updates were rejected because the tip of your current branch is behind
+its remote counterpart. Integrate the remote changes (e.g.
+'git pull ...') before pushing again.
+See the 'Note about fast-forwards' in 'git push --help' for details.`
+			} else {
+				hint = `Updates were rejected because a pushed branch tip is behind its remote
+counterpart. Check out this branch and integrate the remote changes
+(e.g. 'git pull ...') before pushing again.
+See the 'Note about fast-forwards' in 'git push --help' for details.`
+			}
+		case git.UpdateRejectedFetchFirst:
+			hint = `Updates were rejected because the remote contains work that you do
+not have locally. This is usually caused by another repository pushing
+to the same ref. You may want to first integrate the remote changes
+(e.g., 'git pull ...') before pushing again.
+See the 'Note about fast-forwards' in 'git push --help' for details.`
+		case git.UpdateRejectedTag:
+			hint = "Updates were rejected because the tag already exists in the remote."
+		}
+		if hint != "" {
+			break
+		}
+	}
+	for _, l := range strings.Split(hint, "\n") {
+		if l != "" {
+			fmt.Fprintln(os.Stderr, "hint: "+l)
+		}
+	}
+}
+
+// printPushUpdates prints the updates of the refs of url to stderr as git push does.
+// Refs which are up to date are omitted, and so are the others but rejected ones if quiet.
+func printPushUpdates(url string, updates []*git.RefUpdate, quiet bool) {
+	var shown []*git.RefUpdate
+	for _, u := range updates {
+		if u.Status != git.UpdateUpToDate && (!quiet || u.Status.Rejected()) {
+			shown = append(shown, u)
+		}
+	}
+	if len(shown) == 0 {
+		if !quiet {
+			fmt.Fprintln(os.Stderr, "Everything up-to-date")
+		}
+		return
+	}
+	fmt.Fprintln(os.Stderr, "To "+url)
+	for _, u := range shown {
+		flag, summary, reason := ' ', "", ""
+		switch u.Status {
+		case git.UpdateNew:
+			flag = '*'
+			switch {
+			case strings.HasPrefix(u.Remote, "refs/tags/"):
+				summary = "[new tag]"
+			case strings.HasPrefix(u.Remote, "refs/heads/"):
+				summary = "[new branch]"
+			default:
+				summary = "[new reference]"
+			}
+		case git.UpdateDeleted:
+			flag, summary = '-', "[deleted]"
+		case git.UpdateFastForward:
+			summary = u.Old[:7] + ".." + u.New[:7]
+		case git.UpdateForced:
+			flag, summary, reason = '+', u.Old[:7]+"..."+u.New[:7], "forced update"
+		case git.UpdateRejected:
+			flag, summary, reason = '!', "[rejected]", "non-fast-forward"
+		case git.UpdateRejectedFetchFirst:
+			flag, summary, reason = '!', "[rejected]", "fetch first"
+		case git.UpdateRejectedTag:
+			flag, summary, reason = '!', "[rejected]", "already exists"
+		case git.UpdateRemoteRejected:
+			flag, summary, reason = '!', "[remote rejected]", u.Reason
+		}
+		refs := git.ShortRefName(u.Remote)
+		if u.Status != git.UpdateDeleted {
+			src := git.ShortRefName(u.Local)
+			if src == "" {
+				src = u.New[:7]
+			}
+			refs = src + " -> " + refs
+		}
+		if reason != "" {
+			refs += " (" + reason + ")"
+		}
+		fmt.Fprintf(os.Stderr, " %c %-17s %s\n", flag, summary, refs)
+	}
+}
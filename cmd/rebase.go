@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/diff"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&rebaseCmd{}, "")
+}
+
+type rebaseCmd struct {
+	interactive       bool
+	autosquash        bool
+	onto              string
+	strategyOption    string
+	cont, skip, abort bool
+}
+
+func (*rebaseCmd) Name() string { return "rebase" }
+func (*rebaseCmd) Synopsis() string {
+	return "git rebase [-i] [--autosquash] [--onto newbase] upstream [branch]"
+}
+func (*rebaseCmd) Usage() string {
+	return `git rebase [-i] [--autosquash] [--onto newbase] [-X ours|theirs|union] upstream [branch]
+  Replays the commits of the branch, HEAD by default, which are not in upstream onto newbase,
+  upstream by default, and points the branch at the result. With -i, the todo list of the
+  commands to run is opened in the sequence editor first. Its commands are pick, reword,
+  edit, squash, fixup, drop, exec and break. With --autosquash, commits whose subjects start
+  with "fixup! " or "squash! " are moved after the commits they refer to.
+
+git rebase (--continue | --skip | --abort)
+  Commits the resolved conflicts and goes on, skips the commit which stopped, or abandons
+  the rebase checking out the branch as it was.
+`
+}
+func (c *rebaseCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.interactive, "i", false, "edit the todo list before rebasing")
+	f.BoolVar(&c.interactive, "interactive", false, "edit the todo list before rebasing")
+	f.BoolVar(&c.autosquash, "autosquash", false, "move fixup! and squash! commits after the commits they refer to")
+	f.StringVar(&c.onto, "onto", "", "replay the commits onto `newbase` instead of upstream")
+	f.StringVar(&c.strategyOption, "X", "", "resolve conflicts favoring ours, theirs or union")
+	f.StringVar(&c.strategyOption, "strategy-option", "", "resolve conflicts favoring ours, theirs or union")
+	f.BoolVar(&c.cont, "continue", false, "commit the resolved conflicts and go on")
+	f.BoolVar(&c.skip, "skip", false, "skip the commit which stopped")
+	f.BoolVar(&c.abort, "abort", false, "abandon the rebase and check out the branch as it was")
+}
+func (c *rebaseCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	n := 0
+	for _, b := range []bool{c.cont, c.skip, c.abort} {
+		if b {
+			n++
+		}
+	}
+	if n > 1 || n == 1 && f.NArg() > 0 || n == 0 && (f.NArg() < 1 || f.NArg() > 2) {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	r, err := git.NewRepo("", false)
+	var out *git.RebaseOutcome
+	if err == nil {
+		out, err = c.rebase(r, f.Args())
+	}
+	stopped := out != nil && printRebased(os.Stdout, r, out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "rebase: ", err)
+		return subcommands.ExitFailure
+	}
+	if stopped {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+func (c *rebaseCmd) rebase(r *git.Repo, args []string) (*git.RebaseOutcome, error) {
+	opts := &git.RebaseOptions{
+		Interactive: c.interactive,
+		Autosquash:  c.autosquash,
+		EditTodo:    func(path string) error { return runEditor(r, path, true) },
+		EditMessage: func(path string) error { return runEditor(r, path, false) },
+		Exec: func(command string) error {
+			fmt.Fprintln(os.Stderr, "Executing: "+command)
+			cmd := exec.Command("sh", "-c", command)
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+			return cmd.Run()
+		},
+	}
+	var err error
+	if opts.Tree.Style, err = diff.ParseMergeStyle(git.Config(r, "merge", "conflictStyle")); err != nil {
+		return nil, err
+	}
+	switch {
+	case c.abort:
+		return nil, git.AbortRebase(r)
+	case c.cont:
+		return git.ContinueRebase(r, opts)
+	case c.skip:
+		return git.SkipRebase(r, opts)
+	}
+	switch c.strategyOption {
+	case "":
+	case "ours":
+		opts.Tree.Favor = diff.FavorOurs
+	case "theirs":
+		opts.Tree.Favor = diff.FavorTheirs
+	case "union":
+		opts.Tree.Favor = diff.FavorUnion
+	default:
+		return nil, fmt.Errorf("unknown strategy option: -X%s", c.strategyOption)
+	}
+	if opts.Upstream, err = git.ResolveRevision(r, args[0], "commit"); err != nil {
+		return nil, err
+	}
+	opts.OntoName = args[0]
+	if c.onto != "" {
+		if opts.Onto, err = git.ResolveRevision(r, c.onto, "commit"); err != nil {
+			return nil, err
+		}
+		opts.OntoName = c.onto
+	}
+	if len(args) == 2 {
+		opts.Branch = "refs/heads/" + args[1]
+		if _, err := git.ReadRef(r, opts.Branch); err != nil {
+			return nil, fmt.Errorf("no such branch: %s", args[1])
+		}
+	}
+	return git.Rebase(r, opts)
+}
+
+// printRebased prints the merge messages and where the rebase stopped or that it finished,
+// reporting whether the command should fail.
+func printRebased(w io.Writer, r *git.Repo, o *git.RebaseOutcome) bool {
+	for _, c := range o.Committed {
+		// Commits are made on a detached HEAD during a rebase.
+		printCommittedOn(w, r, "", c.SHA, c.AuthorDate)
+	}
+	for _, m := range o.Messages {
+		fmt.Fprintln(w, m)
+	}
+	name := o.Branch
+	if name == "" {
+		name = "detached HEAD"
+	}
+	switch o.Status {
+	case git.RebaseUpToDate:
+		if o.Branch == "" {
+			fmt.Fprintln(w, "HEAD is up to date.")
+		} else {
+			fmt.Fprintf(w, "Current branch %s is up to date.\n", strings.TrimPrefix(o.Branch, "refs/heads/"))
+		}
+	case git.RebaseFinished:
+		fmt.Fprintf(os.Stderr, "Successfully rebased and updated %s.\n", name)
+	case git.RebaseConflicted:
+		fmt.Fprintf(os.Stderr, `error: could not apply %s... %s
+hint: Resolve all conflicts manually, mark them as resolved with
+hint: "git add/rm <conflicted_files>", then run "git rebase --continue".
+hint: You can instead skip this commit: run "git rebase --skip".
+hint: To abort and get back to the state before "git rebase", run "git rebase --abort".
+Could not apply %[1]s... %[2]s
+`, o.Commit[:7], subject(r, o.Commit))
+		return true
+	case git.RebaseStoppedForEdit:
+		fmt.Fprintf(os.Stderr, `Stopped at %s...  %s
+You can amend the commit now, with
+
+  git commit --amend 
+
+Once you are satisfied with your changes, run
+
+  git rebase --continue
+`, o.Commit[:7], subject(r, o.Commit))
+	case git.RebaseExecFailed:
+		fmt.Fprintf(os.Stderr, `warning: execution failed: %s
+You can fix the problem, and then run
+
+  git rebase --continue
+
+
+`, o.Exec)
+		return true
+	case git.RebaseStoppedAtBreak:
+		if _, head, err := git.Head(r); err == nil {
+			fmt.Fprintf(os.Stderr, "Stopped at %s (%s)\n", head[:7], subject(r, head))
+		}
+	}
+	return false
+}
+
+// runEditor lets the user edit the file with the editor configured as git does, the sequence
+// editor for todo lists if sequence is true.
+func runEditor(r *git.Repo, path string, sequence bool) error {
+	var editors []string
+	if sequence {
+		editors = append(editors, os.Getenv("GIT_SEQUENCE_EDITOR"), git.Config(r, "sequence", "editor"))
+	}
+	editors = append(editors, os.Getenv("GIT_EDITOR"), git.Config(r, "core", "editor"), os.Getenv("VISUAL"), os.Getenv("EDITOR"), "vi")
+	var editor string
+	for _, e := range editors {
+		if e != "" {
+			editor = e
+			break
+		}
+	}
+	cmd := exec.Command("sh", "-c", editor+` "$@"`, editor, path)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("there was a problem with the editor '%s'", editor)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&receivePackCmd{}, "")
+}
+
+type receivePackCmd struct {
+	statelessRPC, advertiseRefs bool
+}
+
+func (*receivePackCmd) Name() string { return "receive-pack" }
+func (*receivePackCmd) Synopsis() string {
+	return "git receive-pack [--stateless-rpc] [--advertise-refs] <directory>"
+}
+func (*receivePackCmd) Usage() string {
+	return `git receive-pack [--stateless-rpc] [--advertise-refs] <directory>
+  Receives the objects and the ref updates a client pushes to the repository, speaking the
+  pack protocol on stdin and stdout. GIT_PROTOCOL=version=1 selects protocol version 1.
+`
+}
+func (c *receivePackCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.statelessRPC, "stateless-rpc", false, "serve a single request of the smart HTTP protocol")
+	f.BoolVar(&c.advertiseRefs, "advertise-refs", false, "only advertise the refs")
+}
+func (c *receivePackCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	r, err := openServedRepo(f.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "receive-pack: ", err)
+		return subcommands.ExitFailure
+	}
+	opts := &git.ReceivePackOptions{
+		StatelessRPC:  c.statelessRPC,
+		AdvertiseRefs: c.advertiseRefs,
+		Version:       git.ProtocolVersion(os.Getenv("GIT_PROTOCOL")),
+	}
+	if err := git.ReceivePack(r, os.Stdin, os.Stdout, opts); err != nil {
+		fmt.Fprintln(os.Stderr, "receive-pack: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&resetCmd{}, "")
+}
+
+type resetCmd struct {
+	soft, mixed, hard bool
+}
+
+func (*resetCmd) Name() string     { return "reset" }
+func (*resetCmd) Synopsis() string { return "git reset [--soft|--mixed|--hard] [commit]" }
+func (*resetCmd) Usage() string {
+	return `git reset [--soft|--mixed|--hard] [commit]
+  Points the current branch at the commit (HEAD by default), saving the previous HEAD in ORIG_HEAD.
+  --soft leaves the index and the worktree, --mixed (default) resets the index,
+  and --hard resets both the index and the worktree.
+
+git reset [commit] [--] paths...
+  Resets the index entries for the paths to the commit.
+`
+}
+func (c *resetCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.soft, "soft", false, "update only HEAD")
+	f.BoolVar(&c.mixed, "mixed", false, "update HEAD and the index")
+	f.BoolVar(&c.hard, "hard", false, "update HEAD, the index and the worktree")
+}
+func (c *resetCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if err := c.reset(f.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "reset: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+func (c *resetCmd) reset(args []string) error {
+	mode := git.ResetMixed
+	n := 0
+	for _, b := range []bool{c.soft, c.mixed, c.hard} {
+		if b {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("--soft, --mixed and --hard are mutually exclusive")
+	}
+	if c.soft {
+		mode = git.ResetSoft
+	} else if c.hard {
+		mode = git.ResetHard
+	}
+
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return err
+	}
+	rev, paths := splitRevPaths(r, args)
+	if rev == "" {
+		rev = "HEAD"
+	}
+	if len(paths) > 0 {
+		if c.soft || c.hard {
+			return errors.New("cannot do soft or hard reset with paths")
+		}
+		tree := ""
+		if _, sha, err := git.Head(r); err != nil {
+			return err
+		} else if rev != "HEAD" || sha != "" {
+			if tree, err = git.ResolveRevision(r, rev, "tree"); err != nil {
+				return err
+			}
+		}
+		return git.ResetIndex(r, tree, paths)
+	}
+
+	sha, err := git.ResolveRevision(r, rev, "commit")
+	if err != nil {
+		return err
+	}
+	if err := git.Reset(r, sha, mode, "reset: moving to "+rev); err != nil {
+		return err
+	}
+	if mode == git.ResetHard {
+		fmt.Printf("HEAD is now at %s %s\n", sha[:7], subject(r, sha))
+	}
+	return nil
+}
+
+// splitRevPaths splits the arguments into a revision and paths.
+// The revision may be omitted, in which case rev is "". Arguments after "--" are always paths.
+// Since the flag package consumes a leading "--", a single argument is taken as a revision
+// only if it resolves to one.
+func splitRevPaths(r *git.Repo, args []string) (rev string, paths []string) {
+	for i, a := range args {
+		if a == "--" {
+			if i == 0 {
+				return "", args[1:]
+			}
+			return args[0], append(args[1:i:i], args[i+1:]...)
+		}
+	}
+	if len(args) == 0 {
+		return "", nil
+	}
+	if _, err := git.ResolveRevision(r, args[0], ""); err == nil {
+		return args[0], args[1:]
+	}
+	return "", args
+}
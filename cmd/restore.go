@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&restoreCmd{}, "")
+}
+
+type restoreCmd struct {
+	source           string
+	staged, worktree bool
+}
+
+func (*restoreCmd) Name() string { return "restore" }
+func (*restoreCmd) Synopsis() string {
+	return "git restore [--source=tree] [--staged] [--worktree] pathspec..."
+}
+func (*restoreCmd) Usage() string {
+	return `git restore [--source=tree] [--staged] [--worktree] pathspec...
+  Restores the files matching the pathspecs. By default the worktree is restored from the index.
+  With --staged the index is restored from HEAD. --source specifies another tree-ish to restore from.
+  Pathspecs may contain wildcards, which also match slashes, e.g. '*.go'.
+`
+}
+func (c *restoreCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.source, "source", "", "tree-ish to restore from")
+	f.StringVar(&c.source, "s", "", "shorthand for --source")
+	f.BoolVar(&c.staged, "staged", false, "restore the index")
+	f.BoolVar(&c.staged, "S", false, "shorthand for --staged")
+	f.BoolVar(&c.worktree, "worktree", false, "restore the worktree (default)")
+	f.BoolVar(&c.worktree, "W", false, "shorthand for --worktree")
+}
+func (c *restoreCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() < 1 {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitFailure
+	}
+	if err := c.restore(f.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "restore: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+func (c *restoreCmd) restore(paths []string) error {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return err
+	}
+	opts := git.RestoreOptions{Staged: c.staged, Worktree: c.worktree || !c.staged}
+	source := c.source
+	if source == "" && c.staged {
+		source = "HEAD"
+	}
+	if source != "" {
+		if opts.Source, err = resolveTree(r, source); err != nil {
+			return err
+		}
+	}
+	return git.Restore(r, paths, opts)
+}
+
+// resolveTree resolves the tree-ish to a tree SHA. HEAD on an unborn branch is the empty tree.
+func resolveTree(r *git.Repo, rev string) (string, error) {
+	if rev == "HEAD" {
+		if _, sha, err := git.Head(r); err != nil {
+			return "", err
+		} else if sha == "" {
+			return git.EmptyTreeSHA, nil
+		}
+	}
+	return git.ResolveRevision(r, rev, "tree")
+}
+
+// checkoutPaths restores the paths in the worktree from the index, or both in the index
+// and the worktree from the tree-ish rev if it is not "". Unlike restore, files missing
+// in rev are left as they are.
+func checkoutPaths(rev string, paths []string) error {
+	if len(paths) == 0 {
+		return errors.New("no paths given")
+	}
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return err
+	}
+	opts := git.RestoreOptions{Worktree: true, Overlay: true}
+	if rev != "" {
+		if opts.Source, err = resolveTree(r, rev); err != nil {
+			return err
+		}
+		opts.Staged = true
+	}
+	return git.Restore(r, paths, opts)
+}
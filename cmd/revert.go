@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"flag"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&revertCmd{cherryPickCmd{action: git.ActionRevert}}, "")
+}
+
+// revertCmd shares the implementation with cherry-pick.
+type revertCmd struct {
+	cherryPickCmd
+}
+
+func (*revertCmd) Name() string { return "revert" }
+func (*revertCmd) Synopsis() string {
+	return "git revert [-n] [-m parent-number] commit..."
+}
+func (*revertCmd) Usage() string {
+	return `git revert [-n] [-m parent-number] [-X ours|theirs|union] commit...
+  Applies the inverse of the changes made by the commits onto HEAD by merging, committing
+  each of them with the message "Revert "<subject>"". If a commit conflicts, the conflicts
+  are left in the index and the worktree to be resolved and concluded with --continue.
+
+git revert (--continue | --skip | --abort)
+  Commits the resolved conflicts and goes on, skips the commit which stopped, or abandons
+  the revert resetting HEAD to where it was.
+`
+}
+func (c *revertCmd) SetFlags(f *flag.FlagSet) { c.cherryPickCmd.SetFlags(f) }
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/smarthttp"
+)
+
+func init() {
+	subcommands.Register(&serveCmd{}, "")
+}
+
+type serveCmd struct {
+	addr     string
+	readOnly bool
+}
+
+func (*serveCmd) Name() string     { return "serve" }
+func (*serveCmd) Synopsis() string { return "git serve [--addr host:port] [--read-only] [dir]" }
+func (*serveCmd) Usage() string {
+	return `git serve [--addr host:port] [--read-only] [dir]
+  Serves the repositories under dir, the current directory by default, over the smart HTTP
+  protocol: the repository at dir/<path> is at http://<addr>/<path>. Pushing is allowed unless
+  --read-only is given; http.uploadpack and http.receivepack of a repository override it.
+`
+}
+func (c *serveCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.addr, "addr", "localhost:8080", "the address to listen on")
+	f.BoolVar(&c.readOnly, "read-only", false, "refuse pushes")
+}
+func (c *serveCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() > 1 {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	dir := f.Arg(0)
+	if dir == "" {
+		dir = "."
+	}
+	l, err := net.Listen("tcp", c.addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "serve: ", err)
+		return subcommands.ExitFailure
+	}
+	fmt.Fprintf(os.Stderr, "Serving %s at http://%s/\n", dir, l.Addr())
+	if err := http.Serve(l, &smarthttp.Handler{Root: dir, ReceivePack: !c.readOnly}); err != nil {
+		fmt.Fprintln(os.Stderr, "serve: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,411 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/diff"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&showCmd{}, "")
+}
+
+type showCmd struct {
+	patch bool
+	diffFlags
+}
+
+func (*showCmd) Name() string { return "show" }
+func (*showCmd) Synopsis() string {
+	return "git show [options] [objects...]"
+}
+func (*showCmd) Usage() string {
+	return `git show [options] [objects...]
+  Shows the objects, HEAD by default. A commit is shown with its log message and its
+  changes from the first parent, or the combined diff of the paths differing from all
+  the parents for a merge. A tag is shown with its message followed by the tagged
+  object, a tree by the names of its entries and a blob by its content.
+
+Options are the same as git diff: -U n, --diff-algorithm alg, -b, -w, --stat, --numstat,
+--name-only, --name-status, --color[=when], -M[=n], -C[=n] and --no-renames.
+With --stat or --numstat, -p also prints the patches.
+`
+}
+func (c *showCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.patch, "p", false, "show patches in addition to --stat or --numstat")
+	f.BoolVar(&c.patch, "patch", false, "show patches in addition to --stat or --numstat")
+	c.diffFlags.setFlags(f)
+}
+func (c *showCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	args, err := parseInterspersed(f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "show: ", err)
+		return subcommands.ExitUsageError
+	}
+	if err := c.show(os.Stdout, args); err != nil {
+		fmt.Fprintln(os.Stderr, "show: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// shower shows objects, separating them as git show does.
+type shower struct {
+	r *git.Repo
+	p *diffPrinter
+	w io.Writer
+	// shownOne is set once something other than a blob is shown.
+	shownOne bool
+	shown    map[string]bool
+}
+
+func (c *showCmd) show(w io.Writer, args []string) error {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return err
+	}
+	p, err := newDiffPrinter(r, &c.diffFlags)
+	if err != nil {
+		return err
+	}
+	p.patch = c.patch
+	p.renames = c.renameOptions(r, true)
+	if len(args) > 0 && args[len(args)-1] == "--" {
+		args = args[:len(args)-1]
+	}
+	if len(args) == 0 {
+		args = []string{"HEAD"}
+	}
+	s := &shower{r: r, p: p, w: w, shown: make(map[string]bool)}
+	for _, name := range args {
+		sha, err := git.ResolveRevision(r, name, "")
+		if err != nil {
+			return err
+		}
+		if err := s.object(name, sha); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shower) object(name, sha string) error {
+	o, err := git.ReadObject(s.r, sha)
+	if err != nil {
+		return err
+	}
+	switch o.Type {
+	case "blob":
+		_, err := s.w.Write(o.Blob)
+		return err
+	case "tree":
+		if s.shownOne {
+			fmt.Fprintln(s.w)
+		}
+		s.shownOne = true
+		fmt.Fprintf(s.w, "tree %s\n\n", name)
+		for _, l := range o.Tree {
+			if l.Mode == "40000" || l.Mode == "040000" {
+				fmt.Fprintf(s.w, "%s/\n", l.Path)
+			} else {
+				fmt.Fprintln(s.w, l.Path)
+			}
+		}
+		return nil
+	case "tag":
+		if s.shownOne {
+			fmt.Fprintln(s.w)
+		}
+		s.shownOne = true
+		fmt.Fprintf(s.w, "tag %s\n", first(o.KVLM.Get("tag")))
+		if t := o.KVLM.Get("tagger"); len(t) > 0 {
+			id, err := git.ParseIdent(t[0])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(s.w, "Tagger: %s\nDate:   %s\n", id, formatDate(id))
+		}
+		fmt.Fprintf(s.w, "\n%s", first(o.KVLM.Get("")))
+		return s.object(name, first(o.KVLM.Get("object")))
+	case "commit":
+		if s.shown[sha] {
+			return nil
+		}
+		s.shown[sha] = true
+		if s.shownOne {
+			fmt.Fprintln(s.w)
+		}
+		s.shownOne = true
+		return s.commit(sha, o)
+	}
+	return fmt.Errorf("unknown object type %s", o.Type)
+}
+
+func first(vs []string) string {
+	if len(vs) == 0 {
+		return ""
+	}
+	return vs[0]
+}
+
+// formatDate formats the time of the identity in its own time zone as git's default date format.
+func formatDate(id *git.Ident) string {
+	return id.When.Format("Mon Jan 2 15:04:05 2006 -0700")
+}
+
+func (s *shower) commit(sha string, o *git.Object) error {
+	w := s.w
+	fmt.Fprintln(w, s.p.paint("\033[33m", "commit "+sha))
+	parents := o.KVLM.Get("parent")
+	if len(parents) > 1 {
+		fmt.Fprint(w, "Merge:")
+		for _, p := range parents {
+			fmt.Fprint(w, " ", p[:7])
+		}
+		fmt.Fprintln(w)
+	}
+	id, err := git.ParseIdent(first(o.KVLM.Get("author")))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Author: %s\nDate:   %s\n\n", id, formatDate(id))
+	writeMessage(w, first(o.KVLM.Get("")))
+
+	tree := first(o.KVLM.Get("tree"))
+	if len(parents) > 1 {
+		fmt.Fprintln(w)
+		return s.merge(parents, tree)
+	}
+	base := ""
+	if len(parents) == 1 {
+		if base, err = git.TreeSHA(s.r, parents[0]); err != nil {
+			return err
+		}
+	}
+	changes, err := git.DiffTrees(s.r, base, tree, &git.DiffTreeOptions{Recursive: true})
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+	s.separate()
+	return s.p.print(w, changes)
+}
+
+// separate writes the line between the log message and the diff, which is "---" between
+// a diffstat and patches.
+func (s *shower) separate() {
+	if s.p.patch && s.p.flags.stat {
+		fmt.Fprintln(s.w, "---")
+	} else {
+		fmt.Fprintln(s.w)
+	}
+}
+
+// writeMessage writes the log message indented by four spaces as git log does, with the
+// leading blank lines and the trailing whitespace removed and the tabs expanded.
+func writeMessage(w io.Writer, msg string) {
+	lines := strings.Split(strings.TrimRight(msg, "\n"), "\n")
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for _, l := range lines {
+		fmt.Fprintln(w, "    "+expandTabs(strings.TrimRight(l, " \t\r\n\v\f")))
+	}
+}
+
+// expandTabs replaces the tabs with spaces up to the next multiple of 8 columns.
+func expandTabs(s string) string {
+	var sb strings.Builder
+	col := 0
+	for _, r := range s {
+		if r == '\t' {
+			n := 8 - col%8
+			sb.WriteString(strings.Repeat(" ", n))
+			col += n
+			continue
+		}
+		sb.WriteRune(r)
+		col++
+	}
+	return sb.String()
+}
+
+// merge writes the diff of a merge. The diffstats compare the merge with the first parent,
+// and the other formats show the paths which differ from all the parents.
+func (s *shower) merge(parents []string, tree string) error {
+	var trees []string
+	for _, p := range parents {
+		t, err := git.TreeSHA(s.r, p)
+		if err != nil {
+			return err
+		}
+		trees = append(trees, t)
+	}
+	f := s.p.flags
+	if !f.nameOnly && !f.nameStatus && (f.stat || f.numstat) {
+		changes, err := git.DiffTrees(s.r, trees[0], tree, &git.DiffTreeOptions{Recursive: true})
+		if err != nil {
+			return err
+		}
+		p := *s.p
+		p.patch = false
+		if err := p.print(s.w, changes); err != nil {
+			return err
+		}
+		if !s.p.patch {
+			return nil
+		}
+		fmt.Fprintln(s.w)
+	}
+	ccs, err := git.DiffCombined(s.r, trees, tree, nil)
+	if err != nil {
+		return err
+	}
+	return s.p.printCombined(s.w, ccs)
+}
+
+// printCombined prints the combined diff of a merge in the name formats or as patches.
+func (p *diffPrinter) printCombined(w io.Writer, ccs []*git.CombinedChange) error {
+	for _, cc := range ccs {
+		switch {
+		case p.flags.nameOnly:
+			fmt.Fprintln(w, cc.Path)
+		case p.flags.nameStatus:
+			fmt.Fprintf(w, "%s\t%s\n", cc.Statuses, cc.Path)
+		default:
+			if err := p.writeCombined(w, cc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeCombined writes the dense combined diff of the path, which is omitted if no hunk
+// is interesting and the modes are the same.
+func (p *diffPrinter) writeCombined(w io.Writer, cc *git.CombinedChange) error {
+	result, err := p.readNew(cc.To)
+	if err != nil {
+		return err
+	}
+	binary := diff.IsBinary(result)
+	var parents [][]byte
+	modeDiffers := false
+	for _, l := range cc.Parents {
+		b, err := p.readOld(l)
+		if err != nil {
+			return err
+		}
+		binary = binary || diff.IsBinary(b)
+		parents = append(parents, b)
+		if l == nil || cc.To == nil || l.Mode != cc.To.Mode {
+			modeDiffers = true
+		}
+	}
+	var comb *diff.Combined
+	if !binary {
+		if comb = diff.NewCombined(parents, result, p.opts, true); comb.Empty() && !modeDiffers {
+			return nil
+		}
+	}
+
+	meta := func(format string, args ...interface{}) {
+		fmt.Fprintln(w, p.paint(colorMeta, fmt.Sprintf(format, args...)))
+	}
+	short := func(l *git.TreeLeaf) string {
+		if l == nil {
+			return git.ZeroSHA[:7]
+		}
+		return l.SHA[:7]
+	}
+	mode := func(l *git.TreeLeaf) string {
+		if l == nil {
+			return "000000"
+		}
+		return fmt.Sprintf("%06s", l.Mode)
+	}
+	var shas, modes []string
+	added := true
+	for _, l := range cc.Parents {
+		shas = append(shas, short(l))
+		modes = append(modes, mode(l))
+		added = added && l == nil
+	}
+	meta("diff --cc %s", cc.Path)
+	meta("index %s..%s", strings.Join(shas, ","), short(cc.To))
+	switch {
+	case cc.To == nil:
+		meta("deleted file mode %s", strings.Join(modes, ","))
+	case added:
+		meta("new file mode %s", mode(cc.To))
+	case modeDiffers:
+		// git colors the meta part of this line only at its end.
+		line := fmt.Sprintf("mode %s..%s", strings.Join(modes, ","), mode(cc.To))
+		if p.color {
+			line += colorReset
+		}
+		fmt.Fprintln(w, line)
+	}
+	if binary {
+		_, err := fmt.Fprintln(w, "Binary files differ")
+		return err
+	}
+	oldName := "a/" + cc.Path
+	if added {
+		oldName = "/dev/null"
+	}
+	newName := "b/" + cc.Path
+	if cc.To == nil {
+		newName = "/dev/null"
+	}
+	meta("--- %s", oldName)
+	meta("+++ %s", newName)
+	var lw diff.LineWriter
+	if p.color {
+		lw = colorCombined
+	}
+	return comb.Write(w, lw)
+}
+
+// colorCombined colors the lines of combined diffs as git does, without highlighting whitespace errors.
+func colorCombined(w io.Writer, kind diff.LineKind, line string) error {
+	var s string
+	switch kind {
+	case diff.HunkHeader:
+		end := hunkHeaderEnd(line)
+		s = colorFrag + line[:end] + colorReset
+		if end < len(line) {
+			s += " " + colorReset + line[end+1:] + colorReset
+		}
+	case diff.OldLine:
+		s = colorOld + line + colorReset
+	case diff.NewLine:
+		s = colorNew + line + colorReset
+	default:
+		s = line + colorReset
+	}
+	if kind != diff.HunkHeader && strings.HasSuffix(line, "\r") {
+		// The CR at the end of the line is written after the reset.
+		s = strings.Replace(s, "\r"+colorReset, colorReset+"\r", 1)
+	}
+	_, err := io.WriteString(w, s+"\n")
+	return err
+}
+
+// hunkHeaderEnd returns the end of the "@@ ... @@" part of the hunk header, which has as many
+// @s as the sides of the diff.
+func hunkHeaderEnd(line string) int {
+	n := len(line) - len(strings.TrimLeft(line, "@"))
+	marker := line[:n]
+	i := strings.Index(line[n:], " "+marker)
+	if i < 0 {
+		return len(line)
+	}
+	return n + i + 1 + n
+}
@@ -34,17 +34,17 @@ func showRef() error {
 	if err != nil {
 		return err
 	}
-	m, err := git.Refs(r)
+	m, err := git.AllRefs(r)
 	if err != nil {
 		return err
 	}
-	var ps []string
-	for p := range m {
-		ps = append(ps, p)
+	var names []string
+	for n := range m {
+		names = append(names, n)
 	}
-	sort.Strings(ps)
-	for _, path := range ps {
-		fmt.Printf("%s %s\n", m[path], path[len(".git/"):])
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Printf("%s %s\n", m[n], n)
 	}
 	return nil
 }
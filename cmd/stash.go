@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/diff"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&stashCmd{}, "")
+}
+
+type stashCmd struct {
+	push git.StashOptions
+}
+
+func (*stashCmd) Name() string { return "stash" }
+func (*stashCmd) Synopsis() string {
+	return "git stash [push [-u] [-k] [-m msg] | apply [--index] [stash] | pop [--index] [stash] | list | drop [stash]]"
+}
+func (*stashCmd) Usage() string {
+	return `git stash [push] [-u|--include-untracked] [-k|--keep-index] [-m msg]
+  Saves the local changes as a new stash entry and resets the index and the worktree to HEAD.
+  With -u, untracked files are stashed and removed too. With -k, the changes in the index
+  are kept.
+
+git stash apply [--index] [stash]
+git stash pop [--index] [stash]
+  Merges the changes of the stash entry, stash@{0} by default, into the worktree. With
+  --index, the changes in the index are restored too. pop drops the entry unless it conflicts.
+
+git stash list
+  Lists the stash entries.
+
+git stash drop [stash]
+  Removes the stash entry, stash@{0} by default.
+`
+}
+func (c *stashCmd) SetFlags(f *flag.FlagSet) {
+	c.pushFlags(f)
+}
+
+func (c *stashCmd) pushFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.push.IncludeUntracked, "u", false, "stash untracked files too")
+	f.BoolVar(&c.push.IncludeUntracked, "include-untracked", false, "stash untracked files too")
+	f.BoolVar(&c.push.KeepIndex, "k", false, "keep the changes in the index")
+	f.BoolVar(&c.push.KeepIndex, "keep-index", false, "keep the changes in the index")
+	f.StringVar(&c.push.Message, "m", "", "describe the stash entry with `msg`")
+	f.StringVar(&c.push.Message, "message", "", "describe the stash entry with `msg`")
+}
+
+func (c *stashCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	action := "push"
+	var args []string
+	if f.NArg() > 0 {
+		action, args = f.Arg(0), f.Args()[1:]
+	}
+	fs := flag.NewFlagSet("stash "+action, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	var index bool
+	switch action {
+	case "push":
+		if f.NArg() > 0 {
+			c.pushFlags(fs)
+		}
+	case "apply", "pop":
+		fs.BoolVar(&index, "index", false, "restore the changes in the index too")
+	case "list", "drop":
+	default:
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 || fs.NArg() > 0 && (action == "push" || action == "list") {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "stash: ", err)
+		return subcommands.ExitFailure
+	}
+	rev := git.StashRevision(fs.Arg(0))
+	switch action {
+	case "push":
+		err = c.save(r)
+	case "list":
+		err = stashList(r)
+	case "drop":
+		err = stashDrop(r, rev)
+	case "apply", "pop":
+		return stashApply(r, rev, index, action == "pop")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "stash: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+func (c *stashCmd) save(r *git.Repo) error {
+	sha, err := git.StashPush(r, &c.push)
+	if err != nil {
+		return err
+	}
+	if sha == "" {
+		fmt.Println("No local changes to save")
+		return nil
+	}
+	fmt.Println("Saved working directory and index state " + subject(r, sha))
+	return nil
+}
+
+func stashList(r *git.Repo) error {
+	es, err := git.StashList(r)
+	if err != nil {
+		return err
+	}
+	for i, e := range es {
+		fmt.Printf("stash@{%d}: %s\n", i, e.Message)
+	}
+	return nil
+}
+
+func stashDrop(r *git.Repo, rev string) error {
+	sha, err := git.StashDrop(r, rev)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Dropped %s (%s)\n", rev, sha)
+	return nil
+}
+
+// stashApply applies the stash entry and drops it if pop is true and it applies cleanly.
+func stashApply(r *git.Repo, rev string, index, pop bool) subcommands.ExitStatus {
+	opts := &git.MergeOptions{}
+	var err error
+	var res *git.MergeResult
+	if opts.Style, err = diff.ParseMergeStyle(git.Config(r, "merge", "conflictStyle")); err == nil {
+		res, err = git.StashApply(r, rev, index, opts)
+	}
+	conflicted := res != nil && len(res.Conflicts) > 0
+	if res != nil {
+		for _, m := range res.Messages {
+			fmt.Println(m)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "stash: ", err)
+	}
+	if _, ok := err.(*git.LocalChangesError); index && (ok || conflicted) {
+		fmt.Fprintln(os.Stderr, "Index was not unstashed.")
+	}
+	if err == nil && !conflicted && pop {
+		err = stashDrop(r, rev)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "stash: ", err)
+		}
+	}
+	if err != nil || conflicted {
+		if pop {
+			fmt.Println("The stash entry is kept in case you need it again.")
+		}
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&switchCmd{}, "")
+}
+
+type switchCmd struct {
+	create string
+	detach bool
+	force  bool
+}
+
+func (*switchCmd) Name() string     { return "switch" }
+func (*switchCmd) Synopsis() string { return "git switch [-c new_branch] [--detach] [branch]" }
+func (*switchCmd) Usage() string {
+	return `git switch [-f] branch
+git switch [-f] -c new_branch [start_point]
+git switch [-f] --detach commit
+`
+}
+func (c *switchCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.create, "c", "", "create a new branch at start_point and switch to it")
+	f.BoolVar(&c.detach, "detach", false, "detach HEAD at the commit")
+	f.BoolVar(&c.force, "f", false, "discard local changes")
+}
+func (c *switchCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if c.create == "" && f.NArg() != 1 {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitFailure
+	}
+	if err := switchTo(f.Arg(0), c.create, c.detach, c.force, false); err != nil {
+		fmt.Fprintln(os.Stderr, "switch: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// switchTo switches to the branch name, or to a new branch create starting at name.
+// HEAD is detached at name if detach is set, or if autoDetach is set and name is not a branch.
+func switchTo(name, create string, detach, force, autoDetach bool) error {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return err
+	}
+	if create != "" {
+		branch := "refs/heads/" + create
+		if _, err := git.ReadRef(r, branch); err == nil {
+			return fmt.Errorf("a branch named '%s' already exists", create)
+		}
+		if name == "" {
+			// On an unborn branch there is nothing to check out, so just repoint HEAD.
+			if cur, sha, err := git.Head(r); err == nil && cur != "" && sha == "" {
+				if err := git.SetHead(r, branch, "", ""); err != nil {
+					return err
+				}
+				fmt.Fprintf(os.Stderr, "Switched to a new branch '%s'\n", create)
+				return nil
+			}
+			name = "HEAD"
+		}
+		sha, err := git.ResolveRevision(r, name, "commit")
+		if err != nil {
+			return err
+		}
+		if err := git.Switch(r, branch, sha, name, force); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Switched to a new branch '%s'\n", create)
+		return nil
+	}
+	if !detach {
+		branch := "refs/heads/" + name
+		if sha, err := git.ReadRef(r, branch); err == nil {
+			cur, _, err := git.Head(r)
+			if err != nil {
+				return err
+			}
+			if err := git.Switch(r, branch, sha, name, force); err != nil {
+				return err
+			}
+			if cur == branch {
+				fmt.Fprintf(os.Stderr, "Already on '%s'\n", name)
+			} else {
+				fmt.Fprintf(os.Stderr, "Switched to branch '%s'\n", name)
+			}
+			return nil
+		}
+		if !autoDetach {
+			return fmt.Errorf("a branch is expected, got '%s'", name)
+		}
+	}
+	sha, err := git.ResolveRevision(r, name, "commit")
+	if err != nil {
+		return err
+	}
+	if err := git.Switch(r, "", sha, name, force); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "HEAD is now at %s %s\n", sha[:7], subject(r, sha))
+	return nil
+}
+
+// subject returns the first line of the commit message, or "" on error.
+func subject(r *git.Repo, sha string) string {
+	o, err := git.ReadObject(r, sha)
+	if err != nil || o.Type != "commit" {
+		return ""
+	}
+	return strings.SplitN(o.KVLM.Get("")[0], "\n", 2)[0]
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&uploadPackCmd{}, "")
+}
+
+type uploadPackCmd struct {
+	statelessRPC, advertiseRefs bool
+}
+
+func (*uploadPackCmd) Name() string { return "upload-pack" }
+func (*uploadPackCmd) Synopsis() string {
+	return "git upload-pack [--stateless-rpc] [--advertise-refs] <directory>"
+}
+func (*uploadPackCmd) Usage() string {
+	return `git upload-pack [--stateless-rpc] [--advertise-refs] <directory>
+  Sends the objects a client fetching from the repository is missing, speaking the pack
+  protocol on stdin and stdout. GIT_PROTOCOL=version=1 or version=2 selects protocol
+  version 1 or 2.
+`
+}
+func (c *uploadPackCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.statelessRPC, "stateless-rpc", false, "serve a single request of the smart HTTP protocol")
+	f.BoolVar(&c.advertiseRefs, "advertise-refs", false, "only advertise the refs")
+}
+func (c *uploadPackCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		fmt.Fprint(os.Stderr, "Usage: ", c.Usage())
+		return subcommands.ExitUsageError
+	}
+	r, err := openServedRepo(f.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "upload-pack: ", err)
+		return subcommands.ExitFailure
+	}
+	opts := &git.UploadPackOptions{
+		StatelessRPC:  c.statelessRPC,
+		AdvertiseRefs: c.advertiseRefs,
+		Version:       git.ProtocolVersion(os.Getenv("GIT_PROTOCOL")),
+	}
+	if err := git.UploadPack(r, os.Stdin, os.Stdout, opts); err != nil {
+		fmt.Fprintln(os.Stderr, "upload-pack: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// openServedRepo opens the repository at dir, a worktree or a bare repository, for a
+// client.
+func openServedRepo(dir string) (*git.Repo, error) {
+	r, err := git.NewRepo(dir, false)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' does not appear to be a git repository", dir)
+	}
+	return r, nil
+}
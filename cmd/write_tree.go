@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/ogiekako/gogit/git"
+)
+
+func init() {
+	subcommands.Register(&writeTreeCmd{}, "")
+}
+
+type writeTreeCmd struct{}
+
+func (*writeTreeCmd) Name() string     { return "write-tree" }
+func (*writeTreeCmd) Synopsis() string { return "git write-tree" }
+func (*writeTreeCmd) Usage() string {
+	return "git write-tree\n  Creates a tree object from the index.\n"
+}
+func (*writeTreeCmd) SetFlags(f *flag.FlagSet) {}
+func (*writeTreeCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if err := writeTree(); err != nil {
+		fmt.Fprintln(os.Stderr, "write-tree: ", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+func writeTree() error {
+	r, err := git.NewRepo("", false)
+	if err != nil {
+		return err
+	}
+	idx, err := git.ReadIndex(r)
+	if err != nil {
+		return err
+	}
+	sha, err := git.WriteTree(r, idx)
+	if err != nil {
+		return err
+	}
+	fmt.Println(sha)
+	return nil
+}
@@ -0,0 +1,474 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Combined is a combined diff of a merge result against its parents, as shown by
+// git diff -c and --cc.
+type Combined struct {
+	// slines are the lines of the result, followed by a line holding the lines lost at
+	// the end and another holding the line numbers of the ends of the parents.
+	slines  []*sline
+	parents int
+	context int
+}
+
+// sline is a line of the result. Bit n of flag is on if parent n does not have the line,
+// and the two bits above the parents are used for painting hunks.
+type sline struct {
+	line string
+	flag uint64
+	// lost are the lines of the parents lost before the line.
+	lost []*lostLine
+	// plost are the lost lines of the parent being compared, to be coalesced into lost.
+	plost []*lostLine
+	// pLno are the line numbers in the parents at which a hunk starting at the line starts.
+	pLno []int
+}
+
+// lostLine is a line of some parents which is not in the result. Bit n of parents is on
+// if parent n has the line.
+type lostLine struct {
+	line    string
+	parents uint64
+}
+
+// NewCombined compares the result with each parent and builds the hunks of the combined diff.
+// Dense drops hunks in which the result takes one of two versions verbatim, as --cc does.
+// Lines are compared and the context length is determined by opts.
+func NewCombined(parents [][]byte, result []byte, opts *Options, dense bool) *Combined {
+	if opts == nil {
+		opts = &Options{Context: DefaultContext}
+	}
+	lines := Lines(result)
+	cnt := len(lines)
+	c := &Combined{parents: len(parents), context: opts.Context}
+	for i := 0; i < cnt+2; i++ {
+		s := &sline{pLno: make([]int, len(parents))}
+		if i < cnt {
+			s.line = strings.TrimSuffix(lines[i], "\n")
+		}
+		c.slines = append(c.slines, s)
+	}
+	for i, p := range parents {
+		reused := false
+		for j := 0; j < i; j++ {
+			if bytes.Equal(parents[j], p) {
+				c.reuse(i, j)
+				reused = true
+				break
+			}
+		}
+		if !reused {
+			c.compare(i, Lines(p), lines, opts)
+		}
+	}
+	c.makeHunks(dense)
+	return c
+}
+
+// compare records the differences between parent n and the result.
+func (c *Combined) compare(n int, p, result []string, opts *Options) {
+	nmask := uint64(1) << n
+	edits := Diff(p, result, opts)
+	for i := 0; i < len(edits); {
+		if edits[i].Op == Equal {
+			i++
+			continue
+		}
+		// Lines lost from the parent hang on the first line after them in the result.
+		bucket := c.slines[edits[i].B]
+		for ; i < len(edits) && edits[i].Op != Equal; i++ {
+			e := edits[i]
+			if e.Op == Delete {
+				bucket.plost = append(bucket.plost, &lostLine{strings.TrimSuffix(p[e.A], "\n"), nmask})
+			} else {
+				c.slines[e.B].flag |= nmask
+			}
+		}
+	}
+
+	cnt := len(c.slines) - 2
+	lno := 1
+	for i := 0; i <= cnt; i++ {
+		s := c.slines[i]
+		s.pLno[n] = lno
+		if len(s.plost) > 0 {
+			s.lost = coalesce(s.lost, s.plost, n, opts)
+			s.plost = nil
+		}
+		for _, l := range s.lost {
+			if l.parents&nmask != 0 {
+				lno++
+			}
+		}
+		if i < cnt && s.flag&nmask == 0 {
+			lno++
+		}
+	}
+	c.slines[cnt+1].pLno[n] = lno
+}
+
+// reuse copies the differences of parent j to parent i with the same content.
+func (c *Combined) reuse(i, j int) {
+	imask, jmask := uint64(1)<<i, uint64(1)<<j
+	for _, s := range c.slines {
+		s.pLno[i] = s.pLno[j]
+		for _, l := range s.lost {
+			if l.parents&jmask != 0 {
+				l.parents |= imask
+			}
+		}
+		if s.flag&jmask != 0 {
+			s.flag |= imask
+		}
+	}
+}
+
+// coalesce merges the lines lost from parent n into the lines lost from the previous parents,
+// sharing the lines in their longest common subsequence.
+func coalesce(base, lost []*lostLine, n int, opts *Options) []*lostLine {
+	if len(base) == 0 {
+		return lost
+	}
+	const (
+		match = iota
+		fromBase
+		fromLost
+	)
+	lcs := make([][]int, len(base)+1)
+	dir := make([][]int, len(base)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(lost)+1)
+		dir[i] = make([]int, len(lost)+1)
+		dir[i][0] = fromBase
+	}
+	for j := 1; j <= len(lost); j++ {
+		dir[0][j] = fromLost
+	}
+	for i := 1; i <= len(base); i++ {
+		for j := 1; j <= len(lost); j++ {
+			switch {
+			case normalize(base[i-1].line, opts) == normalize(lost[j-1].line, opts):
+				lcs[i][j], dir[i][j] = lcs[i-1][j-1]+1, match
+			case lcs[i][j-1] >= lcs[i-1][j]:
+				lcs[i][j], dir[i][j] = lcs[i][j-1], fromLost
+			default:
+				lcs[i][j], dir[i][j] = lcs[i-1][j], fromBase
+			}
+		}
+	}
+	var rev []*lostLine
+	for i, j := len(base), len(lost); i != 0 || j != 0; {
+		switch dir[i][j] {
+		case match:
+			base[i-1].parents |= uint64(1) << n
+			rev = append(rev, base[i-1])
+			i, j = i-1, j-1
+		case fromLost:
+			rev = append(rev, lost[j-1])
+			j--
+		default:
+			rev = append(rev, base[i-1])
+			i--
+		}
+	}
+	res := make([]*lostLine, len(rev))
+	for i, l := range rev {
+		res[len(rev)-1-i] = l
+	}
+	return res
+}
+
+func (c *Combined) masks() (all, mark, noPreDelete uint64) {
+	return uint64(1)<<c.parents - 1, uint64(1) << c.parents, uint64(2) << c.parents
+}
+
+// makeHunks marks the lines to show, which are the changed lines and their context.
+func (c *Combined) makeHunks(dense bool) {
+	all, mark, _ := c.masks()
+	cnt := len(c.slines) - 2
+	sl := c.slines
+	for i := 0; i <= cnt; i++ {
+		if sl[i].flag&all != 0 || len(sl[i].lost) > 0 {
+			sl[i].flag |= mark
+		} else {
+			sl[i].flag &^= mark
+		}
+	}
+	if dense {
+		// Hunks with only two versions, one of which is the result, are not interesting.
+		// The lines lost at the end are checked as well.
+		for i := 0; i <= cnt; {
+			for i <= cnt && sl[i].flag&mark == 0 {
+				i++
+			}
+			if cnt < i {
+				break
+			}
+			begin := i
+			j := i + 1
+			for ; j <= cnt; j++ {
+				if sl[j].flag&mark != 0 {
+					continue
+				}
+				// Look beyond the end for an interesting line within the context.
+				la := c.adjustTail(begin, j)
+				if la+c.context < cnt+1 {
+					la += c.context
+				} else {
+					la = cnt + 1
+				}
+				contin := false
+				for la > 0 {
+					if la--; la < j {
+						break
+					}
+					if sl[la].flag&mark != 0 {
+						contin = true
+						break
+					}
+				}
+				if !contin {
+					break
+				}
+				j = la
+			}
+			end := j
+
+			var same uint64
+			interesting := false
+			for k := i; k < end && !interesting; k++ {
+				if d := sl[k].flag & all; d != 0 {
+					if same == 0 {
+						same = d
+					} else if same != d {
+						interesting = true
+						break
+					}
+				}
+				for _, l := range sl[k].lost {
+					if same == 0 {
+						same = l.parents
+					} else if same != l.parents {
+						interesting = true
+						break
+					}
+				}
+			}
+			if !interesting && same != all {
+				for k := begin; k < end; k++ {
+					sl[k].flag &^= mark
+				}
+			}
+			i = end
+		}
+	}
+	c.giveContext()
+}
+
+// adjustTail returns the end of the hunk [begin, i) for the purpose of giving trailing context.
+// A last line interesting only because of deletions before it is shown anyway.
+func (c *Combined) adjustTail(begin, i int) int {
+	all, _, _ := c.masks()
+	if begin+1 <= i && c.slines[i-1].flag&all == 0 {
+		i--
+	}
+	return i
+}
+
+// findNext returns the first line from i which is marked, or unmarked if uninteresting.
+func (c *Combined) findNext(i int, uninteresting bool) int {
+	_, mark, _ := c.masks()
+	cnt := len(c.slines) - 2
+	for ; i <= cnt; i++ {
+		if (c.slines[i].flag&mark == 0) == uninteresting {
+			return i
+		}
+	}
+	return i
+}
+
+// giveContext marks the context lines around the marked lines, joining groups with short gaps.
+func (c *Combined) giveContext() {
+	_, mark, noPreDelete := c.masks()
+	cnt := len(c.slines) - 2
+	sl := c.slines
+	i := c.findNext(0, false)
+	for i <= cnt {
+		j := 0
+		if c.context < i {
+			j = i - c.context
+		}
+		// Paint a few lines before the first interesting line.
+		for ; j < i; j++ {
+			if sl[j].flag&mark == 0 {
+				sl[j].flag |= noPreDelete
+			}
+			sl[j].flag |= mark
+		}
+		for {
+			// Up to i is to be included. Where does the next uninteresting one start?
+			j = c.findNext(i, true)
+			if cnt < j {
+				return
+			}
+			k := c.findNext(j, false)
+			j = c.adjustTail(i, j)
+			if k < j+c.context {
+				// The gap is small.
+				for ; j < k; j++ {
+					sl[j].flag |= mark
+				}
+				i = k
+				continue
+			}
+			// Paint the trailing context.
+			i = k
+			if j+c.context < cnt+1 {
+				k = j + c.context
+			} else {
+				k = cnt + 1
+			}
+			for ; j < k; j++ {
+				sl[j].flag |= mark
+			}
+			break
+		}
+	}
+}
+
+// Empty reports whether the combined diff has no hunks.
+func (c *Combined) Empty() bool {
+	_, mark, _ := c.masks()
+	for _, s := range c.slines[:len(c.slines)-1] {
+		if s.flag&mark != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Write writes the hunks. Lost lines are written as OldLine and lines added to some parents
+// as NewLine. As in git, there are no markers for missing newlines at the end of files.
+func (c *Combined) Write(w io.Writer, lw LineWriter) error {
+	if lw == nil {
+		lw = func(w io.Writer, _ LineKind, line string) error {
+			_, err := io.WriteString(w, line+"\n")
+			return err
+		}
+	}
+	all, mark, noPreDelete := c.masks()
+	cnt := len(c.slines) - 2
+	sl := c.slines
+	marker := strings.Repeat("@", c.parents+1)
+	for lno := 0; ; {
+		comment := ""
+		for lno <= cnt && sl[lno].flag&mark == 0 {
+			if l := sl[lno].line; lno < cnt && l != "" && isFuncLine(l[0]) {
+				comment = l
+			}
+			lno++
+		}
+		if cnt < lno {
+			return nil
+		}
+		end := lno + 1
+		for end <= cnt && sl[end].flag&mark != 0 {
+			end++
+		}
+		rlines := end - lno
+		if cnt < end {
+			// pointing at the last delete hunk
+			rlines--
+		}
+		nullContext := 0
+		if c.context == 0 {
+			// All lines in the hunk are needed to show the lost lines, but the lines
+			// without changes are not shown.
+			for j := lno; j < end; j++ {
+				if sl[j].flag&all == 0 {
+					nullContext++
+				}
+			}
+			rlines -= nullContext
+		}
+
+		header := marker
+		for i := 0; i < c.parents; i++ {
+			l0, l1 := sl[lno].pLno[i], sl[end].pLno[i]
+			header += fmt.Sprintf(" -%d,%d", l0, uint64(l1-l0-nullContext))
+		}
+		// git computes the counts in unsigned integers, which wrap around when the hunk
+		// only has lines lost at the end with no context.
+		header += fmt.Sprintf(" +%d,%d %s", lno+1, uint64(rlines), marker)
+		if comment = combinedComment(comment); comment != "" {
+			header += " " + comment
+		}
+		if err := lw(w, HunkHeader, header); err != nil {
+			return err
+		}
+
+		for lno < end {
+			s := sl[lno]
+			lno++
+			if s.flag&noPreDelete == 0 {
+				for _, l := range s.lost {
+					var sb strings.Builder
+					for j := 0; j < c.parents; j++ {
+						if l.parents&(uint64(1)<<j) != 0 {
+							sb.WriteByte('-')
+						} else {
+							sb.WriteByte(' ')
+						}
+					}
+					if err := lw(w, OldLine, sb.String()+l.line); err != nil {
+						return err
+					}
+				}
+			}
+			if cnt < lno {
+				break
+			}
+			kind := NewLine
+			if s.flag&all == 0 {
+				// The line is here to hang the lost lines in front of it.
+				if c.context == 0 {
+					continue
+				}
+				kind = ContextLine
+			}
+			var sb strings.Builder
+			for j := 0; j < c.parents; j++ {
+				if s.flag&(uint64(1)<<j) != 0 {
+					sb.WriteByte('+')
+				} else {
+					sb.WriteByte(' ')
+				}
+			}
+			if err := lw(w, kind, sb.String()+s.line); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func isFuncLine(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_' || c == '$'
+}
+
+// combinedComment returns the function context shown in a combined hunk header, which git
+// takes from the first 40 bytes of the line, dropping the last non-space character.
+func combinedComment(l string) string {
+	end := 0
+	for i := 0; i < 40 && i < len(l); i++ {
+		if !isSpace(l[i]) {
+			end = i
+		}
+	}
+	return l[:end]
+}
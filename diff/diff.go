@@ -0,0 +1,473 @@
+// Package diff computes line-level differences between texts and formats them as unified diffs.
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Algorithm is a diff algorithm.
+type Algorithm int
+
+const (
+	// Myers is the classic O(ND) algorithm by Eugene W. Myers.
+	Myers Algorithm = iota
+	// Patience matches unique common lines first and diffs between them.
+	Patience
+	// Histogram extends patience to lines which are not unique, preferring rare lines.
+	Histogram
+)
+
+// ParseAlgorithm parses the algorithm name as given to --diff-algorithm.
+func ParseAlgorithm(s string) (Algorithm, error) {
+	switch s {
+	case "myers", "default":
+		return Myers, nil
+	case "patience":
+		return Patience, nil
+	case "histogram":
+		return Histogram, nil
+	}
+	return 0, fmt.Errorf("unknown diff algorithm %s", s)
+}
+
+// DefaultContext is the default number of context lines.
+const DefaultContext = 3
+
+// Options configures Diff.
+type Options struct {
+	// Context is the number of context lines around changes.
+	Context   int
+	Algorithm Algorithm
+	// IgnoreSpaceChange ignores changes in amount of whitespace and whitespace at line end.
+	IgnoreSpaceChange bool
+	// IgnoreAllSpace ignores whitespace when comparing lines.
+	IgnoreAllSpace bool
+}
+
+// Op is an edit operation.
+type Op byte
+
+const (
+	Equal  Op = ' '
+	Delete Op = '-'
+	Insert Op = '+'
+)
+
+// Edit is an operation on a line. A is the index of the line in the old text for Equal and
+// Delete, and B is the index in the new text for Equal and Insert.
+type Edit struct {
+	Op   Op
+	A, B int
+}
+
+// Lines splits the text into lines, each of which keeps its terminating newline.
+func Lines(b []byte) []string {
+	var res []string
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			res = append(res, string(b))
+			break
+		}
+		res = append(res, string(b[:i+1]))
+		b = b[i+1:]
+	}
+	return res
+}
+
+// binaryCheckSize is the number of bytes inspected by IsBinary, same as git.
+const binaryCheckSize = 8000
+
+// IsBinary reports whether the data looks binary, i.e. it has a NUL in the first 8000 bytes.
+func IsBinary(b []byte) bool {
+	if len(b) > binaryCheckSize {
+		b = b[:binaryCheckSize]
+	}
+	return bytes.IndexByte(b, 0) >= 0
+}
+
+// Diff computes the edit script transforming the lines a into the lines b.
+// Deletions come before insertions within a run of changes. The algorithms and the placement
+// of ambiguous changes follow git's xdiff, so that the same hunks as git's are produced.
+func Diff(a, b []string, opts *Options) []Edit {
+	if opts == nil {
+		opts = &Options{Context: DefaultContext}
+	}
+	d := newDiffer(a, b, opts)
+	switch opts.Algorithm {
+	case Patience:
+		d.patience(0, len(a), 0, len(b))
+	case Histogram:
+		d.histogram(0, len(a), 0, len(b))
+	default:
+		d.classic(0, len(a), 0, len(b))
+	}
+	compact(&d.fa, &d.fb)
+	compact(&d.fb, &d.fa)
+
+	var res []Edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && d.fa.chg[i]:
+			res = append(res, Edit{Delete, i, j})
+			i++
+		case j < len(b) && d.fb.chg[j]:
+			res = append(res, Edit{Insert, i, j})
+			j++
+		default:
+			res = append(res, Edit{Equal, i, j})
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+// file is one side of a diff.
+type file struct {
+	lines []string
+	// ids identifies the lines; lines equal under the options have the same id.
+	ids []int
+	// chg marks the changed lines.
+	chg []bool
+}
+
+// changed reports whether the line i is changed. Lines out of range are not.
+func (f *file) changed(i int) bool {
+	return 0 <= i && i < len(f.chg) && f.chg[i]
+}
+
+// differ holds the two sides of a diff. The algorithms mark changed lines in fa.chg and fb.chg.
+type differ struct {
+	fa, fb file
+	a, b   []int
+}
+
+func newDiffer(a, b []string, opts *Options) *differ {
+	ids := make(map[string]int)
+	id := func(l string) int {
+		l = normalize(l, opts)
+		if v, ok := ids[l]; ok {
+			return v
+		}
+		ids[l] = len(ids)
+		return ids[l]
+	}
+	d := &differ{
+		fa: file{lines: a, ids: make([]int, len(a)), chg: make([]bool, len(a))},
+		fb: file{lines: b, ids: make([]int, len(b)), chg: make([]bool, len(b))},
+	}
+	for i, l := range a {
+		d.fa.ids[i] = id(l)
+	}
+	for i, l := range b {
+		d.fb.ids[i] = id(l)
+	}
+	d.a, d.b = d.fa.ids, d.fb.ids
+	return d
+}
+
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '\f', '\v':
+		return true
+	}
+	return false
+}
+
+// normalize returns the key under which lines are compared.
+func normalize(l string, opts *Options) string {
+	if !opts.IgnoreAllSpace && !opts.IgnoreSpaceChange {
+		return l
+	}
+	var sb strings.Builder
+	for i := 0; i < len(l); i++ {
+		if !isSpace(l[i]) {
+			sb.WriteByte(l[i])
+			continue
+		}
+		for i+1 < len(l) && isSpace(l[i+1]) {
+			i++
+		}
+		// Whitespace at the end of the line is ignored with either option.
+		if opts.IgnoreSpaceChange && !opts.IgnoreAllSpace && i+1 < len(l) {
+			sb.WriteByte(' ')
+		}
+	}
+	return sb.String()
+}
+
+// mark marks the lines [a0, a1) of a and [b0, b1) of b changed.
+func (d *differ) mark(a0, a1, b0, b1 int) {
+	for i := a0; i < a1; i++ {
+		d.fa.chg[i] = true
+	}
+	for j := b0; j < b1; j++ {
+		d.fb.chg[j] = true
+	}
+}
+
+// group is a run [start, end) of changed lines, possibly empty.
+type group struct{ start, end int }
+
+func firstGroup(f *file) group {
+	g := group{}
+	for f.changed(g.end) {
+		g.end++
+	}
+	return g
+}
+
+// next moves g to the next group. It returns false if g is the last group.
+func (g *group) next(f *file) bool {
+	if g.end == len(f.chg) {
+		return false
+	}
+	g.start = g.end + 1
+	for g.end = g.start; f.changed(g.end); g.end++ {
+	}
+	return true
+}
+
+// previous moves g to the previous group. It returns false if g is the first group.
+func (g *group) previous(f *file) bool {
+	if g.start == 0 {
+		return false
+	}
+	g.end = g.start - 1
+	for g.start = g.end; f.changed(g.start - 1); g.start-- {
+	}
+	return true
+}
+
+// slideDown shifts the group down by a line if the lines allow, merging it with the
+// following group if they touch.
+func (g *group) slideDown(f *file) bool {
+	if g.end < len(f.chg) && f.ids[g.start] == f.ids[g.end] {
+		f.chg[g.start], f.chg[g.end] = false, true
+		g.start++
+		g.end++
+		for f.changed(g.end) {
+			g.end++
+		}
+		return true
+	}
+	return false
+}
+
+// slideUp is the opposite of slideDown.
+func (g *group) slideUp(f *file) bool {
+	if g.start > 0 && f.ids[g.start-1] == f.ids[g.end-1] {
+		g.start--
+		g.end--
+		f.chg[g.start], f.chg[g.end] = true, false
+		for f.changed(g.start - 1) {
+			g.start--
+		}
+		return true
+	}
+	return false
+}
+
+// maxSliding bounds the shifts tried by the indent heuristic.
+const maxSliding = 100
+
+// compact moves the groups of changed lines in f to where they read best, as git's
+// xdl_change_compact does with the indent heuristic: groups are merged with neighbours where
+// possible, aligned with changes in the other file o, or otherwise placed at the shift with the
+// best indentation score.
+func compact(f, o *file) {
+	g, og := firstGroup(f), firstGroup(o)
+	for {
+		if g.end != g.start {
+			var size, earliestEnd int
+			endMatchingOther := -1
+			for {
+				size = g.end - g.start
+				endMatchingOther = -1
+				for g.slideUp(f) {
+					og.previous(o)
+				}
+				earliestEnd = g.end
+				if og.end > og.start {
+					endMatchingOther = g.end
+				}
+				for g.slideDown(f) {
+					og.next(o)
+					if og.end > og.start {
+						endMatchingOther = g.end
+					}
+				}
+				if size == g.end-g.start {
+					break
+				}
+			}
+			switch {
+			case g.end == earliestEnd:
+				// no shifting was possible
+			case endMatchingOther != -1:
+				for og.end == og.start {
+					g.slideUp(f)
+					og.previous(o)
+				}
+			default:
+				shift := earliestEnd
+				if g.end-size-1 > shift {
+					shift = g.end - size - 1
+				}
+				if g.end-maxSliding > shift {
+					shift = g.end - maxSliding
+				}
+				best, bestShift := splitScore{}, -1
+				for ; shift <= g.end; shift++ {
+					var s splitScore
+					s.add(measureSplit(f, shift))
+					s.add(measureSplit(f, shift-size))
+					if bestShift == -1 || s.cmp(best) <= 0 {
+						best, bestShift = s, shift
+					}
+				}
+				for g.end > bestShift {
+					g.slideUp(f)
+					og.previous(o)
+				}
+			}
+		}
+		if !g.next(f) {
+			return
+		}
+		og.next(o)
+	}
+}
+
+const (
+	maxIndent = 200
+	maxBlanks = 20
+)
+
+// indent returns the indentation width of the line, or -1 if it is blank.
+func indent(l string) int {
+	n := 0
+	for i := 0; i < len(l); i++ {
+		c := l[i]
+		if !isSpace(c) {
+			return n
+		}
+		if c == ' ' {
+			n++
+		} else if c == '\t' {
+			n += 8 - n%8
+		}
+		if n >= maxIndent {
+			return maxIndent
+		}
+	}
+	return -1
+}
+
+// splitMeasurement describes the surroundings of a split between lines.
+type splitMeasurement struct {
+	endOfFile                                          bool
+	indent, preBlank, preIndent, postBlank, postIndent int
+}
+
+// measureSplit measures the split just before the line split.
+func measureSplit(f *file, split int) splitMeasurement {
+	var m splitMeasurement
+	if split >= len(f.lines) {
+		m.endOfFile = true
+		m.indent = -1
+	} else {
+		m.indent = indent(f.lines[split])
+	}
+	m.preIndent = -1
+	for i := split - 1; i >= 0; i-- {
+		if m.preIndent = indent(f.lines[i]); m.preIndent != -1 {
+			break
+		}
+		if m.preBlank++; m.preBlank == maxBlanks {
+			m.preIndent = 0
+			break
+		}
+	}
+	m.postIndent = -1
+	for i := split + 1; i < len(f.lines); i++ {
+		if m.postIndent = indent(f.lines[i]); m.postIndent != -1 {
+			break
+		}
+		if m.postBlank++; m.postBlank == maxBlanks {
+			m.postIndent = 0
+			break
+		}
+	}
+	return m
+}
+
+// The weights of the indent heuristic, tuned by git on a corpus of human-made diffs.
+const (
+	startOfFilePenalty              = 1
+	endOfFilePenalty                = 21
+	totalBlankWeight                = -30
+	postBlankWeight                 = 6
+	relativeIndentPenalty           = -4
+	relativeIndentWithBlankPenalty  = 10
+	relativeOutdentPenalty          = 24
+	relativeOutdentWithBlankPenalty = 17
+	relativeDedentPenalty           = 23
+	relativeDedentWithBlankPenalty  = 17
+	indentWeight                    = 60
+)
+
+type splitScore struct{ effectiveIndent, penalty int }
+
+func (s *splitScore) add(m splitMeasurement) {
+	if m.preIndent == -1 && m.preBlank == 0 {
+		s.penalty += startOfFilePenalty
+	}
+	if m.endOfFile {
+		s.penalty += endOfFilePenalty
+	}
+	postBlank := 0
+	if m.indent == -1 {
+		postBlank = 1 + m.postBlank
+	}
+	totalBlank := m.preBlank + postBlank
+	s.penalty += totalBlankWeight*totalBlank + postBlankWeight*postBlank
+
+	ind := m.indent
+	if ind == -1 {
+		ind = m.postIndent
+	}
+	anyBlanks := totalBlank != 0
+	s.effectiveIndent += ind
+
+	pick := func(withBlank, without int) int {
+		if anyBlanks {
+			return withBlank
+		}
+		return without
+	}
+	switch {
+	case ind == -1 || m.preIndent == -1 || ind == m.preIndent:
+	case ind > m.preIndent:
+		s.penalty += pick(relativeIndentWithBlankPenalty, relativeIndentPenalty)
+	case m.postIndent != -1 && m.postIndent > ind:
+		s.penalty += pick(relativeOutdentWithBlankPenalty, relativeOutdentPenalty)
+	default:
+		s.penalty += pick(relativeDedentWithBlankPenalty, relativeDedentPenalty)
+	}
+}
+
+// cmp returns a negative value if s is better than t, 0 if they are even.
+func (s splitScore) cmp(t splitScore) int {
+	c := 0
+	if s.effectiveIndent > t.effectiveIndent {
+		c = 1
+	} else if s.effectiveIndent < t.effectiveIndent {
+		c = -1
+	}
+	return indentWeight*c + s.penalty - t.penalty
+}
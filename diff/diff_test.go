@@ -0,0 +1,399 @@
+package diff
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestUnified(t *testing.T) {
+	const (
+		funcs1 = "}\n\nfunc c() {\n}\n\nfunc d() {\n\tq\n}\n"
+		funcs2 = "}\n\nfunc d() {\n\tq\n}\n\nfunc e() {\n\tq\n}\n"
+		lines1 = "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+		lines2 = "a\nB\nc\nd\ne\nf\ng\nh\nI\nj"
+	)
+	for _, tc := range []struct {
+		name string
+		a, b string
+		opts *Options
+		want string
+	}{
+		{
+			name: "myers",
+			a:    funcs1,
+			b:    funcs2,
+			want: `@@ -1,8 +1,9 @@
+ }
+ 
+-func c() {
++func d() {
++	q
+ }
+ 
+-func d() {
++func e() {
+ 	q
+ }
+`,
+		},
+		{
+			name: "patience",
+			a:    funcs1,
+			b:    funcs2,
+			opts: &Options{Context: 3, Algorithm: Patience},
+			want: `@@ -1,8 +1,9 @@
+ }
+ 
+-func c() {
+-}
+-
+ func d() {
+ 	q
+ }
++
++func e() {
++	q
++}
+`,
+		},
+		{
+			name: "histogram",
+			a:    "a\nb\nc\na\nb\nc\nx\n",
+			b:    "x\na\nb\nc\nz\n",
+			opts: &Options{Context: 3, Algorithm: Histogram},
+			want: `@@ -1,7 +1,5 @@
+-a
+-b
+-c
+-a
+-b
+-c
+ x
++a
++b
++c
++z
+`,
+		},
+		{
+			name: "indent heuristic",
+			a:    "func a() {\n\tx := 1\n\treturn x\n}\n\nfunc b() {\n\ty := 2\n\treturn y\n}\n",
+			b:    "func a() {\n\tx := 1\n\treturn x\n}\n\nfunc c() {\n\tz := 3\n\treturn z\n}\n\nfunc b() {\n\ty := 2\n\treturn y\n}\n",
+			want: `@@ -3,6 +3,11 @@ func a() {
+ 	return x
+ }
+ 
++func c() {
++	z := 3
++	return z
++}
++
+ func b() {
+ 	y := 2
+ 	return y
+`,
+		},
+		{
+			name: "no context",
+			a:    lines1,
+			b:    lines2,
+			opts: &Options{Context: 0},
+			want: `@@ -2 +2 @@ a
+-b
++B
+@@ -9,2 +9,2 @@ h
+-i
+-j
++I
++j
+\ No newline at end of file
+`,
+		},
+		{
+			name: "one context line",
+			a:    lines1,
+			b:    lines2,
+			opts: &Options{Context: 1},
+			want: `@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+@@ -8,3 +8,3 @@ g
+ h
+-i
+-j
++I
++j
+\ No newline at end of file
+`,
+		},
+		{
+			name: "whitespace",
+			a:    "if  x {\n  y\n}\n",
+			b:    "if x {\n\ty \n}\n",
+			want: `@@ -1,3 +1,3 @@
+-if  x {
+-  y
++if x {
++	y 
+ }
+`,
+		},
+		{
+			name: "ignore space change",
+			a:    "if  x {\n  y\n}\n",
+			b:    "if x {\n\ty \n}\n",
+			opts: &Options{Context: 3, IgnoreSpaceChange: true},
+		},
+		{
+			name: "ignore space change keeps added space",
+			a:    "if x {\n",
+			b:    "if x{\n",
+			opts: &Options{Context: 3, IgnoreSpaceChange: true},
+			want: "@@ -1 +1 @@\n-if x {\n+if x{\n",
+		},
+		{
+			name: "ignore all space",
+			a:    "if x {\n",
+			b:    "ifx{\n",
+			opts: &Options{Context: 3, IgnoreAllSpace: true},
+		},
+		{
+			name: "binary",
+			a:    "a\x00b",
+			b:    "a\x00c",
+			want: "Binary files differ\n",
+		},
+		{
+			name: "same binary",
+			a:    "a\x00b",
+			b:    "a\x00b",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			changed, err := Unified(&b, []byte(tc.a), []byte(tc.b), tc.opts, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != (tc.want != "") {
+				t.Errorf("changed = %v", changed)
+			}
+			if diff := cmp.Diff(b.String(), tc.want); diff != "" {
+				t.Errorf("(-got +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+// TestDiffApplies checks that the edit scripts of all the algorithms transform a into b.
+func TestDiffApplies(t *testing.T) {
+	a := Lines([]byte("a\nb\nc\na\nb\nb\nc\na\nd\n\n}\nx"))
+	b := Lines([]byte("c\nb\na\nb\na\nc\n}\n\nd\ne\nx\n"))
+	for _, alg := range []Algorithm{Myers, Patience, Histogram} {
+		var got []string
+		for _, e := range Diff(a, b, &Options{Algorithm: alg}) {
+			switch e.Op {
+			case Equal:
+				if a[e.A] != b[e.B] {
+					t.Errorf("algorithm %d: line %d and %d are not equal", alg, e.A, e.B)
+				}
+				got = append(got, a[e.A])
+			case Insert:
+				got = append(got, b[e.B])
+			}
+		}
+		if diff := cmp.Diff(got, b); diff != "" {
+			t.Errorf("algorithm %d: (-got +want)\n%s", alg, diff)
+		}
+	}
+}
+
+func TestIsBinary(t *testing.T) {
+	if IsBinary([]byte("text\n")) {
+		t.Error("text is binary")
+	}
+	if !IsBinary([]byte("a\x00")) {
+		t.Error("NUL is not binary")
+	}
+	late := append(bytes.Repeat([]byte("a"), binaryCheckSize), 0)
+	if IsBinary(late) {
+		t.Error("NUL after the first 8000 bytes is binary")
+	}
+}
+
+func TestCombined(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		parents []string
+		result  string
+		context int
+		want    string
+	}{
+		{
+			name:    "conflict resolved",
+			parents: []string{"1\n2\n3\n4\n5\n6\n7\neight\n9\n10\n", "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n"},
+			result:  "1\n2\nthree\n4\nfive\n6\n7\neight\n9\n10\n",
+			context: 3,
+			want: `@@@ -1,10 -1,10 +1,10 @@@
+  1
+  2
+- 3
++ three
+  4
+--5
+++five
+  6
+  7
+ -8
+ +eight
+  9
+  10
+`,
+		},
+		{
+			name:    "one side taken",
+			parents: []string{"a\nb\n", "a\nc\n"},
+			result:  "a\nc\n",
+			context: 3,
+		},
+		{
+			name:    "lost lines at both ends",
+			parents: []string{"c0\n", "{2\nc0\n"},
+			result:  "{2\n",
+			context: 3,
+			want: `@@@ -1,1 -1,2 +1,1 @@@
+- c0
++ {2
+ -c0
+`,
+		},
+		{
+			name:    "uninteresting lines lost at the end",
+			parents: []string{"z0\nint f()1\nz2\n}0\n", "z0\nint f()1\nz2\n}0\nz2\n", "int f()1\nz2\n}0\n"},
+			result:  "  y2\nz0\nint f()1\n  y\n}0\n",
+			context: 1,
+			want: `@@@@ -1,4 -1,4 -1,3 +1,5 @@@@
++++  y2
+  +z0
+   int f()1
+---z2
++++  y
+   }0
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var ps [][]byte
+			for _, p := range tc.parents {
+				ps = append(ps, []byte(p))
+			}
+			c := NewCombined(ps, []byte(tc.result), &Options{Context: tc.context}, true)
+			if c.Empty() != (tc.want == "") {
+				t.Errorf("Empty() = %v", c.Empty())
+			}
+			var b bytes.Buffer
+			if err := c.Write(&b, nil); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(b.String(), tc.want); diff != "" {
+				t.Errorf("(-got +want)\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMerge3(t *testing.T) {
+	const (
+		base   = "a\nb\nc\n"
+		ours   = "a\nx\ny\nz\nc\n"
+		theirs = "a\nx\nY\nz\nc\n"
+	)
+	labels := MergeOptions{OursLabel: "ours", BaseLabel: "base", TheirsLabel: "theirs"}
+	withStyle := func(s MergeStyle) *MergeOptions {
+		opts := labels
+		opts.Style = s
+		return &opts
+	}
+	withFavor := func(f Favor) *MergeOptions {
+		opts := labels
+		opts.Favor = f
+		return &opts
+	}
+	for _, tc := range []struct {
+		name               string
+		base, ours, theirs string
+		opts               *MergeOptions
+		want               string
+		wantConflicts      int
+	}{
+		{
+			name:   "clean",
+			base:   "1\n2\n3\n4\n5\n6\n",
+			ours:   "1\ntwo\n3\n4\n5\n6\n",
+			theirs: "1\n2\n3\n4\n5\nsix\n",
+			want:   "1\ntwo\n3\n4\n5\nsix\n",
+		},
+		{
+			name:   "identical changes",
+			base:   "1\n2\n3\n",
+			ours:   "1\ntwo\n3\n",
+			theirs: "1\ntwo\n3\n",
+			want:   "1\ntwo\n3\n",
+		},
+		{
+			name: "merge",
+			base: base, ours: ours, theirs: theirs,
+			opts:          &labels,
+			want:          "a\nx\n<<<<<<< ours\ny\n=======\nY\n>>>>>>> theirs\nz\nc\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "diff3",
+			base: base, ours: ours, theirs: theirs,
+			opts:          withStyle(StyleDiff3),
+			want:          "a\n<<<<<<< ours\nx\ny\nz\n||||||| base\nb\n=======\nx\nY\nz\n>>>>>>> theirs\nc\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "zdiff3",
+			base: base, ours: ours, theirs: theirs,
+			opts:          withStyle(StyleZDiff3),
+			want:          "a\nx\n<<<<<<< ours\ny\n||||||| base\nb\n=======\nY\n>>>>>>> theirs\nz\nc\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "ours",
+			base: base, ours: ours, theirs: theirs,
+			opts: withFavor(FavorOurs),
+			want: "a\nx\ny\nz\nc\n",
+		},
+		{
+			name: "union",
+			base: base, ours: ours, theirs: theirs,
+			opts: withFavor(FavorUnion),
+			want: "a\nx\ny\nY\nz\nc\n",
+		},
+		{
+			name:          "missing newlines and CRLF",
+			base:          "a\r\nb\r\n",
+			ours:          "a\r\nx",
+			theirs:        "a\r\ny",
+			want:          "a\r\n<<<<<<<\r\nx\r\n=======\r\ny\r\n>>>>>>>\r\n",
+			wantConflicts: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, n := Merge3([]byte(tc.base), []byte(tc.ours), []byte(tc.theirs), tc.opts)
+			if diff := cmp.Diff(string(got), tc.want); diff != "" {
+				t.Errorf("(-got +want)\n%s", diff)
+			}
+			if n != tc.wantConflicts {
+				t.Errorf("conflicts = %d; want %d", n, tc.wantConflicts)
+			}
+		})
+	}
+}
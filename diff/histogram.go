@@ -0,0 +1,107 @@
+package diff
+
+// maxChain is the occurrence count above which histogram does not use a line to split at,
+// the same as git's.
+const maxChain = 64
+
+// histogram diffs the ranges [a0, a1) and [b0, b1) by splitting them at the longest common
+// region containing the lines with the lowest occurrence count, falling back to the classic
+// algorithm if all the common lines are too common.
+func (d *differ) histogram(a0, a1, b0, b1 int) {
+	for {
+		if a0 == a1 || b0 == b1 {
+			d.mark(a0, a1, b0, b1)
+			return
+		}
+		r, ok, fallback := d.findLCS(a0, a1, b0, b1)
+		if fallback {
+			d.classic(a0, a1, b0, b1)
+			return
+		}
+		if !ok {
+			d.mark(a0, a1, b0, b1)
+			return
+		}
+		d.histogram(a0, r.a0, b0, r.b0)
+		a0, b0 = r.a1, r.b1
+	}
+}
+
+// region is a pair of ranges [a0, a1) and [b0, b1).
+type region struct{ a0, a1, b0, b1 int }
+
+// occurrences records the occurrences of a line in the range of a.
+type occurrences struct {
+	first, cnt int
+}
+
+// findLCS finds the region to split at. ok is false if there is none, and fallback is true
+// if lines are common in both ranges but all of them occur too often.
+func (d *differ) findLCS(a0, a1, b0, b1 int) (lcs region, ok, fallback bool) {
+	recs := make(map[int]*occurrences)
+	next := make([]int, a1-a0) // the next occurrence of the same line
+	lineMap := make([]*occurrences, a1-a0)
+	for i := a1 - 1; i >= a0; i-- {
+		r := recs[d.a[i]]
+		if r == nil {
+			r = &occurrences{first: i}
+			recs[d.a[i]] = r
+			next[i-a0] = -1
+		} else {
+			next[i-a0] = r.first
+			r.first = i
+		}
+		r.cnt++
+		lineMap[i-a0] = r
+	}
+
+	cnt := maxChain + 1
+	hasCommon := false
+	for bPtr := b0; bPtr < b1; {
+		bNext := bPtr + 1
+		r := recs[d.b[bPtr]]
+		if r != nil && r.cnt > cnt {
+			hasCommon = true
+		} else if r != nil {
+			hasCommon = true
+			for as := r.first; ; {
+				np := next[as-a0]
+				bs, ae, be, rc := bPtr, as, bPtr, r.cnt
+				for a0 < as && b0 < bs && d.a[as-1] == d.b[bs-1] {
+					as--
+					bs--
+					if 1 < rc && lineMap[as-a0].cnt < rc {
+						rc = lineMap[as-a0].cnt
+					}
+				}
+				for ae < a1-1 && be < b1-1 && d.a[ae+1] == d.b[be+1] {
+					ae++
+					be++
+					if 1 < rc && lineMap[ae-a0].cnt < rc {
+						rc = lineMap[ae-a0].cnt
+					}
+				}
+				if bNext <= be {
+					bNext = be + 1
+				}
+				if lcs.a1-1-lcs.a0 < ae-as || rc < cnt {
+					lcs = region{as, ae + 1, bs, be + 1}
+					ok = true
+					cnt = rc
+				}
+				for np >= 0 && np <= ae {
+					np = next[np-a0]
+				}
+				if np < 0 {
+					break
+				}
+				as = np
+			}
+		}
+		bPtr = bNext
+	}
+	if hasCommon && maxChain < cnt {
+		return region{}, false, true
+	}
+	return lcs, ok, false
+}
@@ -0,0 +1,389 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// MergeStyle is the style of the conflict markers written by Merge3.
+type MergeStyle int
+
+const (
+	// StyleMerge shows our and their versions of conflicts.
+	StyleMerge MergeStyle = iota
+	// StyleDiff3 also shows the base version.
+	StyleDiff3
+	// StyleZDiff3 is StyleDiff3 with the lines common to both sides at the beginning and
+	// the end of conflicts moved out of them.
+	StyleZDiff3
+)
+
+// ParseMergeStyle parses the style as given to merge.conflictStyle.
+func ParseMergeStyle(s string) (MergeStyle, error) {
+	switch s {
+	case "merge", "":
+		return StyleMerge, nil
+	case "diff3":
+		return StyleDiff3, nil
+	case "zdiff3":
+		return StyleZDiff3, nil
+	}
+	return 0, fmt.Errorf("unknown conflict style %s", s)
+}
+
+// Favor resolves conflicts in favor of a side instead of writing conflict markers.
+type Favor int
+
+const (
+	FavorNone Favor = iota
+	FavorOurs
+	FavorTheirs
+	// FavorUnion takes the lines of both sides.
+	FavorUnion
+)
+
+// DefaultMarkerSize is the default length of conflict markers.
+const DefaultMarkerSize = 7
+
+// MergeOptions configures Merge3. Options configures the diffs from the base.
+type MergeOptions struct {
+	Options
+	Style MergeStyle
+	Favor Favor
+	// MarkerSize is the length of the conflict markers. 0 means DefaultMarkerSize.
+	MarkerSize int
+	// The labels written after the conflict markers, which are omitted if empty.
+	OursLabel, BaseLabel, TheirsLabel string
+}
+
+// change is a run of changed lines: [i1, i1+chg1) of the old text is replaced with
+// [i2, i2+chg2) of the new text.
+type change struct{ i1, chg1, i2, chg2 int }
+
+// script returns the changes between a and b.
+func script(a, b []string, opts *Options) []change {
+	var res []change
+	edits := Diff(a, b, opts)
+	for i := 0; i < len(edits); {
+		if edits[i].Op == Equal {
+			i++
+			continue
+		}
+		c := change{i1: edits[i].A, i2: edits[i].B}
+		for ; i < len(edits) && edits[i].Op != Equal; i++ {
+			if edits[i].Op == Delete {
+				c.chg1++
+			} else {
+				c.chg2++
+			}
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// The modes of mergeHunks.
+const (
+	mergeConflict  = 0
+	mergeOurs      = 1
+	mergeTheirs    = 2
+	mergeUnion     = 3
+	mergeIdentical = 4
+)
+
+// mergeHunk is a region changed by either side: [i0, i0+chg0) of the base, [i1, i1+chg1) of
+// ours and [i2, i2+chg2) of theirs.
+type mergeHunk struct {
+	mode                         int
+	i0, chg0, i1, chg1, i2, chg2 int
+}
+
+// Merge3 merges the changes from base to ours and from base to theirs line by line as git does,
+// returning the result and the number of conflicts, which are written with conflict markers.
+// Overlapping changes conflict unless they are identical, and conflicts are narrowed down to
+// the lines where the sides differ, except in StyleDiff3.
+func Merge3(base, ours, theirs []byte, opts *MergeOptions) ([]byte, int) {
+	if opts == nil {
+		opts = &MergeOptions{}
+	}
+	l0, l1, l2 := Lines(base), Lines(ours), Lines(theirs)
+	do := &opts.Options
+	x1, x2 := script(l0, l1, do), script(l0, l2, do)
+	if len(x1) == 0 {
+		return theirs, 0
+	}
+	if len(x2) == 0 {
+		return ours, 0
+	}
+	m := &merger{base: l0, ours: l1, theirs: l2, opts: opts}
+	m.collect(x1, x2)
+	switch {
+	case opts.Style == StyleMerge:
+		m.refine()
+		m.simplify()
+	case opts.Style == StyleZDiff3:
+		m.shrink()
+	}
+	return m.write()
+}
+
+type merger struct {
+	base, ours, theirs []string
+	opts               *MergeOptions
+	hunks              []*mergeHunk
+}
+
+func (m *merger) equal(a, b string) bool {
+	return normalize(a, &m.opts.Options) == normalize(b, &m.opts.Options)
+}
+
+// add appends a hunk, joining it with the last one if they touch.
+func (m *merger) add(mode, i0, chg0, i1, chg1, i2, chg2 int) {
+	if n := len(m.hunks); n > 0 {
+		h := m.hunks[n-1]
+		if i1 <= h.i1+h.chg1 || i2 <= h.i2+h.chg2 {
+			if mode != h.mode {
+				h.mode = mergeConflict
+			}
+			h.chg0 = i0 + chg0 - h.i0
+			h.chg1 = i1 + chg1 - h.i1
+			h.chg2 = i2 + chg2 - h.i2
+			return
+		}
+	}
+	m.hunks = append(m.hunks, &mergeHunk{mode, i0, chg0, i1, chg1, i2, chg2})
+}
+
+// collect builds the hunks from the changes of both sides, which are in base coordinates in
+// their i1 and chg1.
+func (m *merger) collect(x1, x2 []change) {
+	for len(x1) > 0 && len(x2) > 0 {
+		c1, c2 := x1[0], x2[0]
+		switch {
+		case c1.i1+c1.chg1 < c2.i1:
+			m.add(mergeOurs, c1.i1, c1.chg1, c1.i2, c1.chg2, c2.i2-c2.i1+c1.i1, c1.chg1)
+			x1 = x1[1:]
+			continue
+		case c2.i1+c2.chg1 < c1.i1:
+			m.add(mergeTheirs, c2.i1, c2.chg1, c1.i2-c1.i1+c2.i1, c2.chg1, c2.i2, c2.chg2)
+			x2 = x2[1:]
+			continue
+		}
+		if c1.i1 != c2.i1 || c1.chg1 != c2.chg1 || c1.chg2 != c2.chg2 || !m.sameLines(c1.i2, c2.i2, c1.chg2) {
+			off := c1.i1 - c2.i1
+			ffo := off + c1.chg1 - c2.chg1
+			i0, i1, i2 := c1.i1, c1.i2, c2.i2
+			if off > 0 {
+				i0 -= off
+				i1 -= off
+			} else {
+				i2 += off
+			}
+			chg0 := c1.i1 + c1.chg1 - i0
+			chg1 := c1.i2 + c1.chg2 - i1
+			chg2 := c2.i2 + c2.chg2 - i2
+			if ffo < 0 {
+				chg0 -= ffo
+				chg1 -= ffo
+			} else {
+				chg2 += ffo
+			}
+			m.add(mergeConflict, i0, chg0, i1, chg1, i2, chg2)
+		}
+		e1, e2 := c1.i1+c1.chg1, c2.i1+c2.chg1
+		if e1 >= e2 {
+			x2 = x2[1:]
+		}
+		if e2 >= e1 {
+			x1 = x1[1:]
+		}
+	}
+	for _, c := range x1 {
+		m.add(mergeOurs, c.i1, c.chg1, c.i2, c.chg2, c.i1+len(m.theirs)-len(m.base), c.chg1)
+	}
+	for _, c := range x2 {
+		m.add(mergeTheirs, c.i1, c.chg1, c.i1+len(m.ours)-len(m.base), c.chg1, c.i2, c.chg2)
+	}
+}
+
+func (m *merger) sameLines(i1, i2, n int) bool {
+	for k := 0; k < n; k++ {
+		if !m.equal(m.ours[i1+k], m.theirs[i2+k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// refine narrows each conflict down to the changes between our and their lines in it, splitting
+// it into several conflicts. Conflicts whose sides are identical are resolved.
+func (m *merger) refine() {
+	var res []*mergeHunk
+	for _, h := range m.hunks {
+		if h.mode != mergeConflict || h.chg1 == 0 || h.chg2 == 0 {
+			res = append(res, h)
+			continue
+		}
+		cs := script(m.ours[h.i1:h.i1+h.chg1], m.theirs[h.i2:h.i2+h.chg2], &m.opts.Options)
+		if len(cs) == 0 {
+			h.mode = mergeIdentical
+			res = append(res, h)
+			continue
+		}
+		for k, c := range cs {
+			n := &mergeHunk{mode: mergeConflict, i1: h.i1 + c.i1, chg1: c.chg1, i2: h.i2 + c.i2, chg2: c.chg2}
+			if k == 0 {
+				// Like git, only the first conflict keeps the base lines, which are not shown
+				// in this style anyway.
+				n.i0, n.chg0 = h.i0, h.chg0
+			}
+			res = append(res, n)
+		}
+	}
+	m.hunks = res
+}
+
+// simplify joins conflicts separated by at most 3 lines, which takes no more lines than
+// showing them separately.
+func (m *merger) simplify() {
+	var res []*mergeHunk
+	for _, h := range m.hunks {
+		if n := len(res); n > 0 {
+			p := res[n-1]
+			if p.mode == mergeConflict && h.mode == mergeConflict && h.i1-(p.i1+p.chg1) <= 3 {
+				p.chg1 = h.i1 + h.chg1 - p.i1
+				p.chg2 = h.i2 + h.chg2 - p.i2
+				continue
+			}
+		}
+		res = append(res, h)
+	}
+	m.hunks = res
+}
+
+// shrink moves the lines common to both sides at the beginning and the end of conflicts out
+// of them, keeping the base lines intact.
+func (m *merger) shrink() {
+	for _, h := range m.hunks {
+		if h.mode != mergeConflict {
+			continue
+		}
+		for h.chg1 > 0 && h.chg2 > 0 && m.equal(m.ours[h.i1], m.theirs[h.i2]) {
+			h.i1++
+			h.i2++
+			h.chg1--
+			h.chg2--
+		}
+		for h.chg1 > 0 && h.chg2 > 0 && m.equal(m.ours[h.i1+h.chg1-1], m.theirs[h.i2+h.chg2-1]) {
+			h.chg1--
+			h.chg2--
+		}
+	}
+}
+
+// write writes the result, taking the unchanged lines from ours.
+func (m *merger) write() ([]byte, int) {
+	var b bytes.Buffer
+	copyLines := func(lines []string, i, n int, cr, nl bool) {
+		for _, l := range lines[i : i+n] {
+			b.WriteString(l)
+		}
+		if nl && n > 0 && !strings.HasSuffix(lines[i+n-1], "\n") {
+			if cr {
+				b.WriteByte('\r')
+			}
+			b.WriteByte('\n')
+		}
+	}
+	size := m.opts.MarkerSize
+	if size <= 0 {
+		size = DefaultMarkerSize
+	}
+	marker := func(c byte, label string, cr bool) {
+		b.WriteString(strings.Repeat(string(c), size))
+		if label != "" {
+			b.WriteString(" " + label)
+		}
+		if cr {
+			b.WriteByte('\r')
+		}
+		b.WriteByte('\n')
+	}
+
+	conflicts, i := 0, 0
+	for _, h := range m.hunks {
+		if m.opts.Favor != FavorNone && h.mode == mergeConflict {
+			h.mode = int(m.opts.Favor)
+		}
+		switch h.mode {
+		case mergeConflict:
+			conflicts++
+			cr := m.needsCR(h)
+			copyLines(m.ours, i, h.i1-i, false, false)
+			marker('<', m.opts.OursLabel, cr)
+			copyLines(m.ours, h.i1, h.chg1, cr, true)
+			if m.opts.Style != StyleMerge {
+				marker('|', m.opts.BaseLabel, cr)
+				copyLines(m.base, h.i0, h.chg0, cr, true)
+			}
+			marker('=', "", cr)
+			copyLines(m.theirs, h.i2, h.chg2, cr, true)
+			marker('>', m.opts.TheirsLabel, cr)
+		case mergeOurs, mergeTheirs, mergeUnion:
+			copyLines(m.ours, i, h.i1-i, false, false)
+			if h.mode&mergeOurs != 0 {
+				copyLines(m.ours, h.i1, h.chg1, m.needsCR(h), h.mode&mergeTheirs != 0)
+			}
+			if h.mode&mergeTheirs != 0 {
+				copyLines(m.theirs, h.i2, h.chg2, false, false)
+			}
+		default:
+			// Identical changes are copied from ours with the following lines.
+			continue
+		}
+		i = h.i1 + h.chg1
+	}
+	copyLines(m.ours, i, len(m.ours)-i, false, false)
+	return b.Bytes(), conflicts
+}
+
+// needsCR reports whether the lines added around the hunk end with CRLF, which is the case if
+// the lines before it in both sides and the first line of the base do.
+func (m *merger) needsCR(h *mergeHunk) bool {
+	at := func(i int) int {
+		if i > 0 {
+			return i - 1
+		}
+		return 0
+	}
+	r := isEOLCRLF(m.ours, at(h.i1))
+	if r != 0 {
+		r = isEOLCRLF(m.theirs, at(h.i2))
+	}
+	if r != 0 {
+		r = isEOLCRLF(m.base, 0)
+	}
+	return r > 0
+}
+
+// isEOLCRLF returns 1 if the line i ends with CRLF, 0 if with LF and -1 if it cannot be told.
+func isEOLCRLF(lines []string, i int) int {
+	crlf := func(l string) int {
+		if strings.HasSuffix(l, "\r\n") {
+			return 1
+		}
+		return 0
+	}
+	switch {
+	case i < len(lines)-1:
+		return crlf(lines[i])
+	case len(lines) == 0:
+		return -1
+	case strings.HasSuffix(lines[i], "\n"):
+		return crlf(lines[i])
+	case i == 0:
+		return -1
+	}
+	return crlf(lines[i-1])
+}
@@ -0,0 +1,340 @@
+package diff
+
+import "math"
+
+// Tuning parameters of the classic algorithm, the same as xdiff's.
+const (
+	maxEqLimit  = 1024
+	simscanWin  = 100
+	kpdisRun    = 4
+	maxCostMin  = 256
+	heurMinCost = 256
+	snakeCnt    = 20
+	kHeur       = 4
+)
+
+// bogosqrt returns a rough square root of n.
+func bogosqrt(n int) int {
+	i := 1
+	for ; n > 0; n >>= 2 {
+		i <<= 1
+	}
+	return i
+}
+
+// classic diffs the ranges with Myers' algorithm as xdiff does: after the common prefix and
+// suffix are stripped, lines without any match on the other side and lines with too many
+// matches amid such lines are marked changed up front, and the remaining lines are diffed
+// by the linear space divide and conquer, cutting expensive searches short with heuristics.
+func (d *differ) classic(a0, a1, b0, b1 int) {
+	n1, n2 := a1-a0, b1-b0
+	cnt1, cnt2 := make(map[int]int), make(map[int]int)
+	for i := a0; i < a1; i++ {
+		cnt1[d.a[i]]++
+	}
+	for j := b0; j < b1; j++ {
+		cnt2[d.b[j]]++
+	}
+	for a0 < a1 && b0 < b1 && d.a[a0] == d.b[b0] {
+		a0++
+		b0++
+	}
+	for a0 < a1 && b0 < b1 && d.a[a1-1] == d.b[b1-1] {
+		a1--
+		b1--
+	}
+
+	s := &splitter{}
+	s.ha1, s.idx1 = d.discard(d.a[a0:a1], cnt2, n1, d.fa.chg[a0:a1], a0)
+	s.ha2, s.idx2 = d.discard(d.b[b0:b1], cnt1, n2, d.fb.chg[b0:b1], b0)
+	s.chg1, s.chg2 = d.fa.chg, d.fb.chg
+	ndiags := len(s.ha1) + len(s.ha2) + 3
+	s.off = len(s.ha2) + 1
+	s.kvdf = make([]int, ndiags)
+	s.kvdb = make([]int, ndiags)
+	if s.mxcost = bogosqrt(ndiags); s.mxcost < maxCostMin {
+		s.mxcost = maxCostMin
+	}
+	s.compare(0, len(s.ha1), 0, len(s.ha2), false)
+}
+
+// discard marks the lines which cannot or had better not match changed, and returns the ids
+// and the indices of the other lines. cnt counts the lines of the other side and n is the
+// number of lines of this side before trimming.
+func (d *differ) discard(ids []int, cnt map[int]int, n int, chg []bool, base int) (ha, idx []int) {
+	mlim := bogosqrt(n)
+	if mlim > maxEqLimit {
+		mlim = maxEqLimit
+	}
+	dis := make([]int, len(ids))
+	for i, id := range ids {
+		switch nm := cnt[id]; {
+		case nm == 0:
+			dis[i] = 0
+		case nm >= mlim:
+			dis[i] = 2
+		default:
+			dis[i] = 1
+		}
+	}
+	for i, id := range ids {
+		if dis[i] == 1 || dis[i] == 2 && !cleanMmatch(dis, i, 0, len(ids)-1) {
+			ha = append(ha, id)
+			idx = append(idx, base+i)
+		} else {
+			chg[i] = true
+		}
+	}
+	return ha, idx
+}
+
+// cleanMmatch reports whether the line i with many matches is in the middle of a run of
+// lines without matches, so that it is better discarded.
+func cleanMmatch(dis []int, i, s, e int) bool {
+	if i-s > simscanWin {
+		s = i - simscanWin
+	}
+	if e-i > simscanWin {
+		e = i + simscanWin
+	}
+	rdis0, rpdis0 := 0, 1
+	for r := 1; i-r >= s; r++ {
+		if dis[i-r] == 0 {
+			rdis0++
+		} else if dis[i-r] == 2 {
+			rpdis0++
+		} else {
+			break
+		}
+	}
+	if rdis0 == 0 {
+		return false
+	}
+	rdis1, rpdis1 := 0, 1
+	for r := 1; i+r <= e; r++ {
+		if dis[i+r] == 0 {
+			rdis1++
+		} else if dis[i+r] == 2 {
+			rpdis1++
+		} else {
+			break
+		}
+	}
+	if rdis1 == 0 {
+		return false
+	}
+	rdis1 += rdis0
+	rpdis1 += rpdis0
+	return rpdis1*kpdisRun < rpdis1+rdis1
+}
+
+// splitter runs the divide and conquer on the lines left by discard.
+type splitter struct {
+	ha1, ha2   []int
+	idx1, idx2 []int
+	chg1, chg2 []bool
+	// kvdf and kvdb are the furthest reaching forward and backward paths by diagonal,
+	// offset by off.
+	kvdf, kvdb []int
+	off        int
+	mxcost     int
+}
+
+func (s *splitter) compare(off1, lim1, off2, lim2 int, needMin bool) {
+	for off1 < lim1 && off2 < lim2 && s.ha1[off1] == s.ha2[off2] {
+		off1++
+		off2++
+	}
+	for off1 < lim1 && off2 < lim2 && s.ha1[lim1-1] == s.ha2[lim2-1] {
+		lim1--
+		lim2--
+	}
+	switch {
+	case off1 == lim1:
+		for ; off2 < lim2; off2++ {
+			s.chg2[s.idx2[off2]] = true
+		}
+	case off2 == lim2:
+		for ; off1 < lim1; off1++ {
+			s.chg1[s.idx1[off1]] = true
+		}
+	default:
+		i1, i2, minLo, minHi := s.split(off1, lim1, off2, lim2, needMin)
+		s.compare(off1, i1, off2, i2, minLo)
+		s.compare(i1, lim1, i2, lim2, minHi)
+	}
+}
+
+// split finds the point to split the box at, which is on an optimal path unless the search
+// gets too expensive. minLo and minHi tell whether the halves need minimal diffs.
+func (s *splitter) split(off1, lim1, off2, lim2 int, needMin bool) (i1, i2 int, minLo, minHi bool) {
+	ha1, ha2 := s.ha1, s.ha2
+	kvdf := func(d int) *int { return &s.kvdf[s.off+d] }
+	kvdb := func(d int) *int { return &s.kvdb[s.off+d] }
+	dmin, dmax := off1-lim2, lim1-off2
+	fmid, bmid := off1-off2, lim1-lim2
+	odd := (fmid-bmid)&1 != 0
+	fmin, fmax := fmid, fmid
+	bmin, bmax := bmid, bmid
+
+	*kvdf(fmid) = off1
+	*kvdb(bmid) = lim1
+
+	for ec := 1; ; ec++ {
+		gotSnake := false
+
+		// Extend the diagonal domain by one, initializing the outer values so that the
+		// core loop needs no boundary checks.
+		if fmin > dmin {
+			fmin--
+			*kvdf(fmin - 1) = -1
+		} else {
+			fmin++
+		}
+		if fmax < dmax {
+			fmax++
+			*kvdf(fmax + 1) = -1
+		} else {
+			fmax--
+		}
+		for d := fmax; d >= fmin; d -= 2 {
+			if *kvdf(d - 1) >= *kvdf(d + 1) {
+				i1 = *kvdf(d - 1) + 1
+			} else {
+				i1 = *kvdf(d + 1)
+			}
+			prev1 := i1
+			i2 = i1 - d
+			for i1 < lim1 && i2 < lim2 && ha1[i1] == ha2[i2] {
+				i1++
+				i2++
+			}
+			if i1-prev1 > snakeCnt {
+				gotSnake = true
+			}
+			*kvdf(d) = i1
+			if odd && bmin <= d && d <= bmax && *kvdb(d) <= i1 {
+				return i1, i2, true, true
+			}
+		}
+
+		if bmin > dmin {
+			bmin--
+			*kvdb(bmin - 1) = math.MaxInt32
+		} else {
+			bmin++
+		}
+		if bmax < dmax {
+			bmax++
+			*kvdb(bmax + 1) = math.MaxInt32
+		} else {
+			bmax--
+		}
+		for d := bmax; d >= bmin; d -= 2 {
+			if *kvdb(d - 1) < *kvdb(d + 1) {
+				i1 = *kvdb(d - 1)
+			} else {
+				i1 = *kvdb(d + 1) - 1
+			}
+			prev1 := i1
+			i2 = i1 - d
+			for i1 > off1 && i2 > off2 && ha1[i1-1] == ha2[i2-1] {
+				i1--
+				i2--
+			}
+			if prev1-i1 > snakeCnt {
+				gotSnake = true
+			}
+			*kvdb(d) = i1
+			if !odd && fmin <= d && d <= fmax && i1 <= *kvdf(d) {
+				return i1, i2, true, true
+			}
+		}
+
+		if needMin {
+			continue
+		}
+
+		// If the cost is high and a long snake was found, take a diagonal which has gone far
+		// from the corner without straying from the middle, if any.
+		if gotSnake && ec > heurMinCost {
+			best := 0
+			for d := fmax; d >= fmin; d -= 2 {
+				dd := d - fmid
+				if dd < 0 {
+					dd = -dd
+				}
+				x := *kvdf(d)
+				y := x - d
+				v := (x - off1) + (y - off2) - dd
+				if v > kHeur*ec && v > best && off1+snakeCnt <= x && x < lim1 && off2+snakeCnt <= y && y < lim2 {
+					for k := 1; ha1[x-k] == ha2[y-k]; k++ {
+						if k == snakeCnt {
+							best, i1, i2 = v, x, y
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return i1, i2, true, false
+			}
+			for d := bmax; d >= bmin; d -= 2 {
+				dd := d - bmid
+				if dd < 0 {
+					dd = -dd
+				}
+				x := *kvdb(d)
+				y := x - d
+				v := (lim1 - x) + (lim2 - y) - dd
+				if v > kHeur*ec && v > best && off1 < x && x <= lim1-snakeCnt && off2 < y && y <= lim2-snakeCnt {
+					for k := 0; ha1[x+k] == ha2[y+k]; k++ {
+						if k == snakeCnt-1 {
+							best, i1, i2 = v, x, y
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return i1, i2, false, true
+			}
+		}
+
+		// Enough is enough: take the furthest reaching path.
+		if ec >= s.mxcost {
+			fbest, fbest1 := -1, -1
+			for d := fmax; d >= fmin; d -= 2 {
+				x := *kvdf(d)
+				if x > lim1 {
+					x = lim1
+				}
+				y := x - d
+				if lim2 < y {
+					x, y = lim2+d, lim2
+				}
+				if fbest < x+y {
+					fbest, fbest1 = x+y, x
+				}
+			}
+			bbest, bbest1 := math.MaxInt32, math.MaxInt32
+			for d := bmax; d >= bmin; d -= 2 {
+				x := *kvdb(d)
+				if x < off1 {
+					x = off1
+				}
+				y := x - d
+				if y < off2 {
+					x, y = off2+d, off2
+				}
+				if x+y < bbest {
+					bbest, bbest1 = x+y, x
+				}
+			}
+			if (lim1+lim2)-bbest < fbest-(off1+off2) {
+				return fbest1, fbest - fbest1, true, false
+			}
+			return bbest1, bbest - bbest1, false, true
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package diff
+
+// patience diffs the ranges [a0, a1) and [b0, b1) by matching the lines unique in both ranges
+// first, diffing between them recursively and falling back to the classic algorithm if no
+// line is unique.
+func (d *differ) patience(a0, a1, b0, b1 int) {
+	if a0 == a1 || b0 == b1 {
+		d.mark(a0, a1, b0, b1)
+		return
+	}
+	const (
+		none      = -1
+		nonUnique = -2
+	)
+	type entry struct{ line1, line2 int }
+	m := make(map[int]*entry)
+	var entries []*entry // in the order of the first occurrences in a
+	for i := a0; i < a1; i++ {
+		if e := m[d.a[i]]; e != nil {
+			e.line2 = nonUnique
+			continue
+		}
+		e := &entry{i, none}
+		m[d.a[i]] = e
+		entries = append(entries, e)
+	}
+	hasMatches := false
+	for j := b0; j < b1; j++ {
+		e := m[d.b[j]]
+		if e == nil {
+			continue
+		}
+		hasMatches = true
+		if e.line2 == none {
+			e.line2 = j
+		} else {
+			e.line2 = nonUnique
+		}
+	}
+	if !hasMatches {
+		d.mark(a0, a1, b0, b1)
+		return
+	}
+	var as, bs []int
+	for _, e := range entries {
+		if e.line2 >= 0 {
+			as = append(as, e.line1)
+			bs = append(bs, e.line2)
+		}
+	}
+	anchors := lis(bs)
+	if len(anchors) == 0 {
+		d.classic(a0, a1, b0, b1)
+		return
+	}
+
+	line1, line2 := a0, b0
+	for k := 0; ; k++ {
+		// Grow the common lines around the anchor backward, and those after the previous one forward.
+		next1, next2 := a1, b1
+		if k < len(anchors) {
+			next1, next2 = as[anchors[k]], bs[anchors[k]]
+			for next1 > line1 && next2 > line2 && d.a[next1-1] == d.b[next2-1] {
+				next1--
+				next2--
+			}
+		}
+		for line1 < next1 && line2 < next2 && d.a[line1] == d.b[line2] {
+			line1++
+			line2++
+		}
+		if next1 > line1 || next2 > line2 {
+			d.patience(line1, next1, line2, next2)
+		}
+		if k == len(anchors) {
+			return
+		}
+		for k+1 < len(anchors) && as[anchors[k+1]] == as[anchors[k]]+1 && bs[anchors[k+1]] == bs[anchors[k]]+1 {
+			k++
+		}
+		line1, line2 = as[anchors[k]]+1, bs[anchors[k]]+1
+	}
+}
+
+// lis returns the indices of a longest increasing subsequence of xs by patience sorting.
+func lis(xs []int) []int {
+	var tops []int // indices into xs of the top card of each pile
+	prev := make([]int, len(xs))
+	for i, x := range xs {
+		lo, hi := 0, len(tops)
+		for lo < hi {
+			mid := (lo + hi) / 2
+			if xs[tops[mid]] < x {
+				lo = mid + 1
+			} else {
+				hi = mid
+			}
+		}
+		prev[i] = -1
+		if lo > 0 {
+			prev[i] = tops[lo-1]
+		}
+		if lo == len(tops) {
+			tops = append(tops, i)
+		} else {
+			tops[lo] = i
+		}
+	}
+	if len(tops) == 0 {
+		return nil
+	}
+	res := make([]int, len(tops))
+	for i, k := len(tops)-1, tops[len(tops)-1]; i >= 0; i, k = i-1, prev[k] {
+		res[i] = k
+	}
+	return res
+}
@@ -0,0 +1,182 @@
+package diff
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Hunk is a group of edits with surrounding context lines.
+type Hunk struct {
+	// AStart and BStart are the 0-based indices of the first lines of the hunk in the old
+	// and the new text, and ALen and BLen the numbers of the lines.
+	AStart, ALen, BStart, BLen int
+	Edits                      []Edit
+}
+
+// Hunks groups the edits into hunks with context lines of context. Changes separated by at
+// most 2*context equal lines are put in the same hunk, as git does.
+func Hunks(edits []Edit, context int) []*Hunk {
+	var res []*Hunk
+	for i := 0; i < len(edits); {
+		if edits[i].Op == Equal {
+			i++
+			continue
+		}
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		// extend to the last change which is close enough
+		end := i
+		for j := i; j < len(edits); j++ {
+			if edits[j].Op != Equal {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+		stop := end + context
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+		h := &Hunk{Edits: edits[start:stop]}
+		h.AStart, h.BStart = edits[start].A, edits[start].B
+		for _, e := range h.Edits {
+			if e.Op != Insert {
+				h.ALen++
+			}
+			if e.Op != Delete {
+				h.BLen++
+			}
+		}
+		res = append(res, h)
+		i = stop
+	}
+	return res
+}
+
+// Header returns the hunk header line without the trailing newline, e.g. "@@ -1,3 +1,4 @@".
+func (h *Hunk) Header() string {
+	return fmt.Sprintf("@@ -%s +%s @@", hunkRange(h.AStart, h.ALen), hunkRange(h.BStart, h.BLen))
+}
+
+func hunkRange(start, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// funcName returns the function context for a hunk starting at the line start of a, using
+// git's default rule: the nearest preceding line starting with a letter, '_' or '$'.
+func funcName(a []string, start int) string {
+	for i := start - 1; i >= 0; i-- {
+		l := a[i]
+		if l == "" {
+			continue
+		}
+		if c := l[0]; 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_' || c == '$' {
+			if len(l) > 80 {
+				l = l[:80]
+			}
+			return strings.TrimRight(l, " \t\r\n\v\f")
+		}
+	}
+	return ""
+}
+
+// Stat counts the inserted and deleted lines of the edits.
+func Stat(edits []Edit) (ins, del int) {
+	for _, e := range edits {
+		switch e.Op {
+		case Insert:
+			ins++
+		case Delete:
+			del++
+		}
+	}
+	return ins, del
+}
+
+// LineKind classifies the lines of hunks.
+type LineKind int
+
+const (
+	// HunkHeader is a "@@ -a,b +c,d @@" line, possibly followed by the function context.
+	HunkHeader LineKind = iota
+	// ContextLine is an unchanged line, starting with ' '.
+	ContextLine
+	// OldLine is a deleted line, starting with '-'.
+	OldLine
+	// NewLine is an inserted line, starting with '+'.
+	NewLine
+	// NoNewline is the "\ No newline at end of file" marker.
+	NoNewline
+)
+
+// LineWriter writes a line of hunks. line does not have the trailing newline.
+type LineWriter func(w io.Writer, kind LineKind, line string) error
+
+// Unified writes the differences between a and b as unified diff hunks, without file
+// headers. If either text is binary, it writes "Binary files differ" instead if they differ.
+// It returns whether any difference is written. lw may be nil to write lines as they are.
+func Unified(w io.Writer, a, b []byte, opts *Options, lw LineWriter) (bool, error) {
+	if IsBinary(a) || IsBinary(b) {
+		if string(a) == string(b) {
+			return false, nil
+		}
+		_, err := fmt.Fprintln(w, "Binary files differ")
+		return true, err
+	}
+	if opts == nil {
+		opts = &Options{Context: DefaultContext}
+	}
+	la, lb := Lines(a), Lines(b)
+	hs := Hunks(Diff(la, lb, opts), opts.Context)
+	return len(hs) > 0, WriteHunks(w, la, lb, hs, lw)
+}
+
+// WriteHunks writes the hunks of the lines a and b.
+func WriteHunks(w io.Writer, a, b []string, hs []*Hunk, lw LineWriter) error {
+	if lw == nil {
+		lw = func(w io.Writer, _ LineKind, line string) error {
+			_, err := io.WriteString(w, line+"\n")
+			return err
+		}
+	}
+	for _, h := range hs {
+		header := h.Header()
+		if f := funcName(a, h.AStart); f != "" {
+			header += " " + f
+		}
+		if err := lw(w, HunkHeader, header); err != nil {
+			return err
+		}
+		for _, e := range h.Edits {
+			var kind LineKind
+			var l string
+			switch e.Op {
+			case Equal:
+				// Like git, context lines are taken from the new text.
+				kind, l = ContextLine, b[e.B]
+			case Delete:
+				kind, l = OldLine, a[e.A]
+			case Insert:
+				kind, l = NewLine, b[e.B]
+			}
+			if err := lw(w, kind, string(e.Op)+strings.TrimSuffix(l, "\n")); err != nil {
+				return err
+			}
+			if !strings.HasSuffix(l, "\n") {
+				if err := lw(w, NoNewline, "\\ No newline at end of file"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+package git
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ArchiveOptions are options of Archive.
+type ArchiveOptions struct {
+	// Format is tar, tar.gz (or tgz) or zip, tar if empty.
+	Format string
+	// Prefix is prepended to the paths in the archive, e.g. "project/".
+	Prefix string
+	// Paths limit the archive to the paths matching them and the directories leading to
+	// them.
+	Paths []string
+}
+
+// ArchiveFormat returns the format of an archive file with the name, or "" if its
+// extension is of none.
+func ArchiveFormat(name string) string {
+	for _, f := range []string{"tar.gz", "tgz", "tar", "zip"} {
+		if strings.HasSuffix(name, "."+f) {
+			return f
+		}
+	}
+	return ""
+}
+
+// Archive writes an archive of the tree-ish to w as git archive does. The files have the
+// time of the commit, or the current time if a tree is given, and its ID is recorded in
+// the pax global header of a tar archive or the comment of a zip archive. The paths with
+// the export-ignore attribute are left out, and the $Format:<format>$ placeholders in the
+// files with the export-subst attribute are expanded with the commit. The attributes are
+// read from the .gitattributes files in the tree and $GIT_DIR/info/attributes.
+func Archive(repo *Repo, w io.Writer, treeish string, opts *ArchiveOptions) error {
+	sha, err := ResolveRevision(repo, treeish, "")
+	if err != nil {
+		return err
+	}
+	commit, mtime := "", time.Now()
+	if c, err := peelTag(repo, sha); err == nil {
+		if typ, _, err := ReadRawObject(repo, c); err == nil && typ == "commit" {
+			t, err := commitTime(repo, c)
+			if err != nil {
+				return err
+			}
+			commit, mtime = c, time.Unix(t, 0)
+		}
+	}
+	tree, err := ResolveRevision(repo, sha, "tree")
+	if err != nil {
+		return err
+	}
+	info, err := infoAttributes(repo)
+	if err != nil {
+		return err
+	}
+
+	var aw archiveWriter
+	switch opts.Format {
+	case "", "tar":
+		aw, err = newTarArchiver(repo, w, commit, mtime)
+	case "tar.gz", "tgz":
+		zw := gzip.NewWriter(w)
+		aw, err = newTarArchiver(repo, zw, commit, mtime)
+		aw = &gzipArchiver{aw, zw}
+	case "zip":
+		aw = newZipArchiver(w, commit, mtime)
+	default:
+		return fmt.Errorf("Unknown archive format '%s'", opts.Format)
+	}
+	if err != nil {
+		return err
+	}
+	a := &archiver{repo: repo, w: aw, commit: commit, prefix: opts.Prefix, paths: opts.Paths, info: info}
+	if strings.HasSuffix(opts.Prefix, "/") {
+		if err := aw.write(opts.Prefix, "40000", nil); err != nil {
+			return err
+		}
+	}
+	if err := a.walk(tree, "", nil, len(opts.Paths) == 0, func() error { return nil }); err != nil {
+		return err
+	}
+	for _, s := range opts.Paths {
+		matched := false
+		for _, p := range a.written {
+			if matched = MatchPathspec([]string{s}, p); matched {
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("pathspec '%s' did not match any files", s)
+		}
+	}
+	return aw.close()
+}
+
+// archiver walks a tree writing its entries to an archive.
+type archiver struct {
+	repo   *Repo
+	w      archiveWriter
+	commit string
+	prefix string
+	paths  []string
+	info   attributes
+	// written are the paths written.
+	written []string
+}
+
+// walk writes the entries of the tree at dir. attrs are the rules of the .gitattributes
+// files in the directories above. matched is true if all the entries are in the archive;
+// otherwise only those matching the paths are. writeDir writes the entry of the directory
+// and those above it if they are not written yet.
+func (a *archiver) walk(tree, dir string, attrs attributes, matched bool, writeDir func() error) error {
+	_, data, err := ReadRawObject(a.repo, tree)
+	if err != nil {
+		return err
+	}
+	t, err := parseTree(data)
+	if err != nil {
+		return err
+	}
+	for _, l := range t {
+		if l.Path == ".gitattributes" && l.Mode != "40000" {
+			_, b, err := ReadRawObject(a.repo, l.SHA)
+			if err != nil {
+				return err
+			}
+			attrs = append(attrs[:len(attrs):len(attrs)], parseAttributes(b, dir)...)
+		}
+	}
+	all := append(attrs[:len(attrs):len(attrs)], a.info...)
+	for _, l := range t {
+		p := path.Join(dir, l.Path)
+		if all.get(p, "export-ignore") == "set" {
+			continue
+		}
+		m := matched || MatchPathspec(a.paths, p)
+		if l.Mode == "40000" {
+			written := false
+			writeSubdir := func() error {
+				if written {
+					return nil
+				}
+				written = true
+				if err := writeDir(); err != nil {
+					return err
+				}
+				return a.write(p, l.Mode, nil)
+			}
+			if m {
+				if err := writeSubdir(); err != nil {
+					return err
+				}
+			}
+			if err := a.walk(l.SHA, p, attrs, m, writeSubdir); err != nil {
+				return err
+			}
+			continue
+		}
+		if !m {
+			continue
+		}
+		if err := writeDir(); err != nil {
+			return err
+		}
+		var b []byte
+		if l.Mode != "160000" {
+			if _, b, err = ReadRawObject(a.repo, l.SHA); err != nil {
+				return err
+			}
+		}
+		if a.commit != "" && all.get(p, "export-subst") == "set" {
+			if b, err = expandSubst(a.repo, a.commit, b); err != nil {
+				return err
+			}
+		}
+		if err := a.write(p, l.Mode, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *archiver) write(p, mode string, data []byte) error {
+	a.written = append(a.written, p)
+	if mode == "40000" || mode == "160000" {
+		p += "/"
+	}
+	return a.w.write(a.prefix+p, mode, data)
+}
+
+var substRE = regexp.MustCompile(`\$Format:([^$\n]*)\$`)
+
+// expandSubst expands the $Format:<format>$ placeholders in the data with the commit.
+func expandSubst(repo *Repo, commit string, data []byte) ([]byte, error) {
+	var err error
+	res := substRE.ReplaceAllFunc(data, func(m []byte) []byte {
+		s, ferr := FormatCommit(repo, commit, string(substRE.FindSubmatch(m)[1]))
+		if ferr != nil {
+			err = ferr
+		}
+		return []byte(s)
+	})
+	return res, err
+}
+
+// FormatCommit formats the commit as git log --format does, for the placeholders %H, %h,
+// %T, %t, %P, %p, %an, %ae, %ad, %aD, %at, %ai, %aI, the same with c for the committer,
+// %s, %b, %B, %n and %%. Other placeholders are left as they are.
+func FormatCommit(repo *Repo, sha, format string) (string, error) {
+	o, err := ReadObject(repo, sha)
+	if err != nil {
+		return "", err
+	}
+	if o.Type != "commit" {
+		return "", fmt.Errorf("%s is a %s, not a commit", sha, o.Type)
+	}
+	get := func(k string) string {
+		if vs := o.KVLM.Get(k); len(vs) > 0 {
+			return vs[0]
+		}
+		return ""
+	}
+	idents := make(map[byte]*Ident)
+	for c, k := range map[byte]string{'a': "author", 'c': "committer"} {
+		if idents[c], err = ParseIdent(get(k)); err != nil {
+			return "", err
+		}
+	}
+	msg := get("")
+	subject, body := msg, ""
+	if i := strings.Index(msg, "\n\n"); i >= 0 {
+		subject, body = msg[:i], strings.TrimLeft(msg[i+2:], "\n")
+	}
+	subject = strings.Join(strings.Fields(subject), " ")
+	var parents, short []string
+	for _, p := range o.KVLM.Get("parent") {
+		parents, short = append(parents, p), append(short, p[:7])
+	}
+	tree := get("tree")
+
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+		n := 2
+		switch c := format[i+1]; c {
+		case 'H':
+			b.WriteString(sha)
+		case 'h':
+			b.WriteString(sha[:7])
+		case 'T':
+			b.WriteString(tree)
+		case 't':
+			b.WriteString(tree[:7])
+		case 'P':
+			b.WriteString(strings.Join(parents, " "))
+		case 'p':
+			b.WriteString(strings.Join(short, " "))
+		case 's':
+			b.WriteString(subject)
+		case 'b':
+			b.WriteString(body)
+		case 'B':
+			b.WriteString(msg)
+		case 'n':
+			b.WriteByte('\n')
+		case '%':
+			b.WriteByte('%')
+		case 'a', 'c':
+			id := idents[c]
+			if i+2 == len(format) {
+				n = 0
+				break
+			}
+			n = 3
+			switch format[i+2] {
+			case 'n':
+				b.WriteString(id.Name)
+			case 'e':
+				b.WriteString(id.Email)
+			case 'd':
+				b.WriteString(id.When.Format("Mon Jan 2 15:04:05 2006 -0700"))
+			case 'D':
+				b.WriteString(id.When.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+			case 't':
+				b.WriteString(strconv.FormatInt(id.When.Unix(), 10))
+			case 'i':
+				b.WriteString(id.When.Format("2006-01-02 15:04:05 -0700"))
+			case 'I':
+				b.WriteString(id.When.Format("2006-01-02T15:04:05-07:00"))
+			default:
+				n = 0
+			}
+		default:
+			n = 0
+		}
+		if n == 0 {
+			b.WriteByte('%')
+			continue
+		}
+		i += n - 1
+	}
+	return b.String(), nil
+}
+
+// archiveWriter writes the entries of an archive.
+type archiveWriter interface {
+	// write writes the entry with the mode of a tree entry. The names of directories end
+	// with a slash, and the data of a symbolic link is its target.
+	write(name, mode string, data []byte) error
+	close() error
+}
+
+// tarArchiver writes a tar archive as git does: owned by root, with the permissions
+// tar.umask, 002 by default, allows.
+type tarArchiver struct {
+	tw    *tar.Writer
+	mtime time.Time
+	umask int64
+}
+
+func newTarArchiver(repo *Repo, w io.Writer, commit string, mtime time.Time) (*tarArchiver, error) {
+	a := &tarArchiver{tw: tar.NewWriter(w), mtime: mtime, umask: 002}
+	if v := Config(repo, "tar", "umask"); v != "" && v != "user" {
+		n, err := strconv.ParseInt(v, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad tar.umask %s", v)
+		}
+		a.umask = n
+	}
+	if commit != "" {
+		hdr := &tar.Header{
+			Typeflag:   tar.TypeXGlobalHeader,
+			Name:       "pax_global_header",
+			PAXRecords: map[string]string{"comment": commit},
+		}
+		if err := a.tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (a *tarArchiver) write(name, mode string, data []byte) error {
+	hdr := &tar.Header{Name: name, ModTime: a.mtime, Uname: "root", Gname: "root"}
+	switch mode {
+	case "40000", "160000":
+		hdr.Typeflag, hdr.Mode = tar.TypeDir, 0777&^a.umask
+	case "120000":
+		hdr.Typeflag, hdr.Mode, hdr.Linkname = tar.TypeSymlink, 0777, string(data)
+		data = nil
+	case "100755":
+		hdr.Typeflag, hdr.Mode = tar.TypeReg, 0777&^a.umask
+	default:
+		hdr.Typeflag, hdr.Mode = tar.TypeReg, 0666&^a.umask
+	}
+	hdr.Size = int64(len(data))
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := a.tw.Write(data)
+	return err
+}
+
+func (a *tarArchiver) close() error {
+	return a.tw.Close()
+}
+
+// gzipArchiver compresses the archive written by an archiveWriter.
+type gzipArchiver struct {
+	archiveWriter
+	zw *gzip.Writer
+}
+
+func (a *gzipArchiver) close() error {
+	if err := a.archiveWriter.close(); err != nil {
+		return err
+	}
+	return a.zw.Close()
+}
+
+// zipArchiver writes a zip archive with the commit ID as its comment.
+type zipArchiver struct {
+	zw    *zip.Writer
+	mtime time.Time
+}
+
+func newZipArchiver(w io.Writer, commit string, mtime time.Time) *zipArchiver {
+	zw := zip.NewWriter(w)
+	if commit != "" {
+		zw.SetComment(commit)
+	}
+	return &zipArchiver{zw: zw, mtime: mtime.Local()}
+}
+
+func (a *zipArchiver) write(name, mode string, data []byte) error {
+	fh := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: a.mtime}
+	switch mode {
+	case "40000", "160000":
+		fh.Method = zip.Store
+		fh.SetMode(os.ModeDir | 0755)
+	case "120000":
+		fh.Method = zip.Store
+		fh.SetMode(os.ModeSymlink | 0777)
+	case "100755":
+		fh.SetMode(0755)
+	default:
+		fh.SetMode(0644)
+	}
+	f, err := a.zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+func (a *zipArchiver) close() error {
+	return a.zw.Close()
+}
@@ -0,0 +1,143 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// attrRule is a line of a .gitattributes file: a pattern and the attributes of the paths
+// it matches.
+type attrRule struct {
+	// dir is the directory of the .gitattributes file, "" for the root.
+	dir string
+	re  *regexp.Regexp
+	// base is true if the pattern has no slash and is matched against the base name.
+	base bool
+	// attrs are the names and the values of the attributes, "set" for attr, "unset" for
+	// -attr and "" for !attr.
+	attrs [][2]string
+}
+
+// attributes are the rules of .gitattributes files from the lowest precedence to the
+// highest.
+type attributes []*attrRule
+
+// parseAttributes parses the .gitattributes file of the directory.
+func parseAttributes(data []byte, dir string) attributes {
+	var res attributes
+	for _, l := range strings.Split(string(data), "\n") {
+		fs := strings.Fields(l)
+		if len(fs) == 0 || strings.HasPrefix(fs[0], "#") {
+			continue
+		}
+		pat := fs[0]
+		// Negative patterns are forbidden, and patterns of directories match nothing.
+		if strings.HasPrefix(pat, "!") || strings.HasSuffix(pat, "/") {
+			continue
+		}
+		re, err := attrPatternRegexp(strings.TrimPrefix(pat, "/"))
+		if err != nil {
+			continue
+		}
+		r := &attrRule{dir: dir, re: re, base: !strings.Contains(pat, "/")}
+		for _, a := range fs[1:] {
+			switch {
+			case strings.HasPrefix(a, "-"):
+				r.attrs = append(r.attrs, [2]string{a[1:], "unset"})
+			case strings.HasPrefix(a, "!"):
+				r.attrs = append(r.attrs, [2]string{a[1:], ""})
+			case strings.Contains(a, "="):
+				i := strings.IndexByte(a, '=')
+				r.attrs = append(r.attrs, [2]string{a[:i], a[i+1:]})
+			default:
+				r.attrs = append(r.attrs, [2]string{a, "set"})
+			}
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// attrPatternRegexp converts the pattern into a regexp in which wildcards do not match
+// slashes but ** matches any number of directories.
+func attrPatternRegexp(pat string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pat); i++ {
+		switch c := pat[i]; {
+		case strings.HasPrefix(pat[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pat[i:], "/**") && i+3 == len(pat):
+			b.WriteString("/.*")
+			i += 2
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(pat[i+1:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pat[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += j + 1
+		case c == '\\' && i+1 < len(pat):
+			i++
+			b.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// matches reports whether the rule applies to the slash separated path from the root.
+func (r *attrRule) matches(p string) bool {
+	if r.dir != "" {
+		if !strings.HasPrefix(p, r.dir+"/") {
+			return false
+		}
+		p = p[len(r.dir)+1:]
+	}
+	if r.base {
+		p = path.Base(p)
+	}
+	return r.re.MatchString(p)
+}
+
+// get returns the value of the attribute of the path: "set", "unset", a value, or "" if
+// it is unspecified.
+func (a attributes) get(p, name string) string {
+	v := ""
+	for _, r := range a {
+		if !r.matches(p) {
+			continue
+		}
+		for _, kv := range r.attrs {
+			if kv[0] == name {
+				v = kv[1]
+			}
+		}
+	}
+	return v
+}
+
+// infoAttributes returns the rules of $GIT_DIR/info/attributes, which take precedence over
+// those of .gitattributes files.
+func infoAttributes(repo *Repo) (attributes, error) {
+	b, err := ioutil.ReadFile(repo.path("info", "attributes"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return parseAttributes(b, ""), err
+}
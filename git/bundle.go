@@ -0,0 +1,388 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Bundle is the header of a bundle file, which carries refs and a pack of the objects they
+// need to a repository without a connection to the one it was created in.
+type Bundle struct {
+	// Version is 2 or 3.
+	Version int
+	// Capabilities are the capabilities of a version 3 bundle, e.g. object-format=sha1.
+	Capabilities []string
+	// Prerequisites are the commits the objects in the pack depend on, which a repository
+	// must have to fetch from the bundle.
+	Prerequisites []*BundlePrerequisite
+	// Refs are the refs in the bundle.
+	Refs []*RemoteRef
+
+	path string
+	// offset is where the pack starts in the file.
+	offset int64
+}
+
+// BundlePrerequisite is a commit a bundle requires, with the subject of its message.
+type BundlePrerequisite struct {
+	SHA, Comment string
+}
+
+// BundleOptions are options of CreateBundle.
+type BundleOptions struct {
+	// Version is the version of the bundle, 2 if 0.
+	Version int
+}
+
+const (
+	bundleSignatureV2 = "# v2 git bundle\n"
+	bundleSignatureV3 = "# v3 git bundle\n"
+)
+
+// CreateBundle writes a bundle of the commits the rev-list arguments select to w. The
+// arguments are revisions, ^<rev> excluding the history of rev, <rev1>..<rev2>, --all,
+// --branches, --tags and --remotes. The revisions which name refs are stored as refs of the
+// bundle, and the parents of the selected commits which are excluded as its prerequisites.
+func CreateBundle(repo *Repo, w io.Writer, args []string, opts *BundleOptions) error {
+	version := opts.Version
+	if version == 0 {
+		version = 2
+	}
+	if version != 2 && version != 3 {
+		return fmt.Errorf("unsupported bundle version %d", version)
+	}
+	include, exclude, refs, err := bundleRevisions(repo, args)
+	if err != nil {
+		return err
+	}
+	commits, err := RevList(repo, peelCommits(repo, include), exclude)
+	if err != nil {
+		return err
+	}
+	selected := make(map[string]bool)
+	for _, c := range commits {
+		selected[c] = true
+	}
+	// As with git, a ref whose commit is excluded is left out.
+	var kept []*RemoteRef
+	for _, r := range refs {
+		if c, err := peelTag(repo, r.SHA); err == nil && !selected[c] {
+			if typ, _, err := ReadRawObject(repo, c); err == nil && typ == "commit" {
+				continue
+			}
+		}
+		kept = append(kept, r)
+	}
+	if len(kept) == 0 {
+		return errors.New("Refusing to create empty bundle.")
+	}
+
+	var b bytes.Buffer
+	if version == 3 {
+		b.WriteString(bundleSignatureV3)
+		b.WriteString("@object-format=sha1\n")
+	} else {
+		b.WriteString(bundleSignatureV2)
+	}
+	seen := make(map[string]bool)
+	for _, c := range commits {
+		ps, err := Parents(repo, c)
+		if err != nil {
+			return err
+		}
+		for _, p := range ps {
+			if selected[p] || seen[p] {
+				continue
+			}
+			seen[p] = true
+			fmt.Fprintf(&b, "-%s %s\n", p, subjectOf(repo, p))
+		}
+	}
+	var wants []string
+	for _, r := range kept {
+		fmt.Fprintf(&b, "%s %s\n", r.SHA, r.Name)
+		wants = append(wants, r.SHA)
+	}
+	b.WriteString("\n")
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return err
+	}
+	shas, err := packObjects(repo, append(wants, include...), exclude, nil, nil)
+	if err != nil {
+		return err
+	}
+	return WritePack(repo, w, shas)
+}
+
+// bundleRevisions resolves the rev-list arguments of a bundle to the objects included, the
+// commits excluded and the refs the included revisions name.
+func bundleRevisions(repo *Repo, args []string) (include, exclude []string, refs []*RemoteRef, err error) {
+	named := make(map[string]bool)
+	addRef := func(name, sha string) {
+		if !named[name] {
+			named[name] = true
+			refs = append(refs, &RemoteRef{Name: name, SHA: sha})
+		}
+	}
+	addRefs := func(prefix string) error {
+		m, err := AllRefs(repo)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for n := range m {
+			if strings.HasPrefix(n, prefix) {
+				names = append(names, n)
+			}
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			include = append(include, m[n])
+			addRef(n, m[n])
+		}
+		return nil
+	}
+	positive := func(rev string) error {
+		sha, err := ResolveRevision(repo, rev, "")
+		if err != nil {
+			return err
+		}
+		include = append(include, sha)
+		if name := fullRefName(repo, rev); name != "" {
+			addRef(name, sha)
+		}
+		return nil
+	}
+	negative := func(rev string) error {
+		sha, err := ResolveRevision(repo, rev, "commit")
+		if err != nil {
+			return err
+		}
+		exclude = append(exclude, sha)
+		return nil
+	}
+	for _, arg := range args {
+		switch {
+		case arg == "--all":
+			if _, sha, err := Head(repo); err == nil && sha != "" {
+				include = append(include, sha)
+				addRef("HEAD", sha)
+			}
+			err = addRefs("refs/")
+		case arg == "--branches":
+			err = addRefs("refs/heads/")
+		case arg == "--tags":
+			err = addRefs("refs/tags/")
+		case arg == "--remotes":
+			err = addRefs("refs/remotes/")
+		case strings.HasPrefix(arg, "-"):
+			err = fmt.Errorf("unsupported option %s", arg)
+		case strings.HasPrefix(arg, "^"):
+			err = negative(arg[1:])
+		case strings.Contains(arg, ".."):
+			i := strings.Index(arg, "..")
+			from, to := arg[:i], arg[i+2:]
+			if from == "" {
+				from = "HEAD"
+			}
+			if to == "" {
+				to = "HEAD"
+			}
+			if err = negative(from); err == nil {
+				err = positive(to)
+			}
+		default:
+			err = positive(arg)
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return include, exclude, refs, nil
+}
+
+// fullRefName returns the full name of the ref the revision names as git rev-parse
+// --symbolic-full-name does, "HEAD" for HEAD, or "" if it names no ref.
+func fullRefName(repo *Repo, rev string) string {
+	if rev == "HEAD" {
+		return rev
+	}
+	for _, f := range refRules {
+		name := fmt.Sprintf(f, rev)
+		if !strings.HasPrefix(name, "refs/") {
+			continue
+		}
+		if _, err := ReadRef(repo, name); err == nil {
+			if target, err := SymbolicRef(repo, name); err == nil && target != "" {
+				return target
+			}
+			return name
+		}
+	}
+	return ""
+}
+
+// peelCommits returns the commits the objects peel to, leaving out the other objects.
+func peelCommits(repo *Repo, shas []string) []string {
+	var res []string
+	for _, sha := range shas {
+		c, err := peelTag(repo, sha)
+		if err != nil {
+			continue
+		}
+		if typ, _, err := ReadRawObject(repo, c); err == nil && typ == "commit" {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// OpenBundle reads the header of the bundle file.
+func OpenBundle(path string) (*Bundle, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b, err := readBundleHeader(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("'%s' does not look like a v2 or v3 bundle file: %v", path, err)
+	}
+	b.path = path
+	return b, nil
+}
+
+// isBundle reports whether the file at the path is a bundle.
+func isBundle(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sig := make([]byte, len(bundleSignatureV2))
+	if _, err := io.ReadFull(f, sig); err != nil {
+		return false
+	}
+	return string(sig) == bundleSignatureV2 || string(sig) == bundleSignatureV3
+}
+
+// readBundleHeader reads the header up to the empty line the pack follows.
+func readBundleHeader(r *bufio.Reader) (*Bundle, error) {
+	b := &Bundle{}
+	sig, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	b.offset = int64(len(sig))
+	switch sig {
+	case bundleSignatureV2:
+		b.Version = 2
+	case bundleSignatureV3:
+		b.Version = 3
+	default:
+		return nil, errors.New("bad signature")
+	}
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		b.offset += int64(len(l))
+		l = strings.TrimSuffix(l, "\n")
+		switch {
+		case l == "":
+			return b, nil
+		case strings.HasPrefix(l, "@"):
+			if b.Version != 3 || len(b.Prerequisites) > 0 || len(b.Refs) > 0 {
+				return nil, fmt.Errorf("unexpected capability %q", l)
+			}
+			switch c := l[1:]; {
+			case c == "object-format=sha1":
+			case strings.HasPrefix(c, "object-format="):
+				return nil, fmt.Errorf("unsupported object format %s", strings.TrimPrefix(c, "object-format="))
+			default:
+				return nil, fmt.Errorf("unknown capability '%s'", c)
+			}
+			b.Capabilities = append(b.Capabilities, l[1:])
+		case strings.HasPrefix(l, "-"):
+			fs := strings.SplitN(l[1:], " ", 2)
+			if len(fs[0]) != 40 {
+				return nil, fmt.Errorf("bad prerequisite %q", l)
+			}
+			p := &BundlePrerequisite{SHA: fs[0]}
+			if len(fs) == 2 {
+				p.Comment = fs[1]
+			}
+			b.Prerequisites = append(b.Prerequisites, p)
+		default:
+			fs := strings.SplitN(l, " ", 2)
+			if len(fs) != 2 || len(fs[0]) != 40 || checkRefName(fs[1]) != nil {
+				return nil, fmt.Errorf("bad ref %q", l)
+			}
+			b.Refs = append(b.Refs, &RemoteRef{Name: fs[1], SHA: fs[0]})
+		}
+	}
+}
+
+// Verify returns an error listing the prerequisites the repository lacks.
+func (b *Bundle) Verify(repo *Repo) error {
+	var missing []string
+	for _, p := range b.Prerequisites {
+		if typ, _, err := ReadRawObject(repo, p.SHA); err != nil || typ != "commit" {
+			missing = append(missing, strings.TrimSpace(p.SHA+" "+p.Comment))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Repository lacks these prerequisite commits:\n%s", strings.Join(missing, "\n"))
+	}
+	return nil
+}
+
+// Unbundle verifies the bundle and stores the objects in its pack in the repository. The
+// refs are not updated.
+func (b *Bundle) Unbundle(repo *Repo) error {
+	if err := b.Verify(repo); err != nil {
+		return err
+	}
+	f, err := os.Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(b.offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = IndexPack(repo, bufio.NewReader(f))
+	return err
+}
+
+// bundleTransport fetches from a bundle file as if it were a repository advertising the
+// refs in the bundle.
+type bundleTransport struct {
+	path   string
+	bundle *Bundle
+}
+
+func (t *bundleTransport) advertise(service string) (*advertisement, error) {
+	if service != "git-upload-pack" {
+		return nil, fmt.Errorf("cannot push to a bundle: %s", t.path)
+	}
+	b, err := OpenBundle(t.path)
+	if err != nil {
+		return nil, err
+	}
+	t.bundle = b
+	return &advertisement{refs: b.Refs}, nil
+}
+
+func (t *bundleTransport) request(service string, body []byte) (io.ReadCloser, error) {
+	return nil, errors.New("a bundle takes no requests")
+}
+
+func (t *bundleTransport) close() error { return nil }
@@ -0,0 +1,301 @@
+package git
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CloneOptions are options of Clone.
+type CloneOptions struct {
+	// Progress receives the progress messages of the remote if not nil.
+	Progress io.Writer
+	// Bare makes a bare repository with the branches of the remote as its branches.
+	Bare bool
+	// Mirror makes a bare repository with all the refs of the remote, which fetching from
+	// origin overwrites.
+	Mirror bool
+	// Depth makes a shallow clone with the number of commits of history if not 0.
+	Depth int
+	// ShallowSince makes a shallow clone with the history after the time if not zero.
+	ShallowSince time.Time
+	// ShallowExclude makes a shallow clone without the history reachable from the remote
+	// branches or tags.
+	ShallowExclude []string
+	// Filter makes a partial clone without the blobs and trees the filter spec omits,
+	// which are fetched from origin when needed: blob:none, blob:limit=<n>[kmg] or
+	// tree:<depth>.
+	Filter string
+}
+
+// CloneDir returns the directory git clone creates for the url: its last path component
+// without .git or .bundle, with .git appended for a bare repository.
+func CloneDir(url string, bare bool) string {
+	url = strings.TrimRight(url, "/")
+	url = strings.TrimSuffix(url, "/.git")
+	url = strings.TrimSuffix(url, ".git")
+	url = strings.TrimSuffix(url, ".bundle")
+	if i := strings.LastIndexAny(url, "/:"); i >= 0 {
+		url = url[i+1:]
+	}
+	if bare {
+		url += ".git"
+	}
+	return url
+}
+
+// Clone creates a repository in dir, which must not exist or be empty, fetching all the
+// branches and tags of the repository at url, which may be a local path. The branches are
+// stored as remote-tracking branches of the remote origin, and the branch the remote HEAD
+// points to is created and checked out. A bare clone stores the branches as they are and
+// a mirror clone all the refs. A shallow clone fetches only the branch HEAD points to, with
+// the tags pointing into its history. On failure, what was created is removed.
+func Clone(url, dir string, opts *CloneOptions) (repo *Repo, err error) {
+	bare := opts.Bare || opts.Mirror
+	args := &fetchArgs{depth: opts.Depth, exclude: opts.ShallowExclude, filter: opts.Filter}
+	if !opts.ShallowSince.IsZero() {
+		args.since = opts.ShallowSince.Unix()
+	}
+	if args.filter != "" {
+		if _, err := parseFilter(args.filter); err != nil {
+			return nil, err
+		}
+	}
+	if fis, err := ioutil.ReadDir(dir); err == nil && len(fis) > 0 {
+		return nil, fmt.Errorf("destination path '%s' already exists and is not an empty directory", dir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, statErr := os.Stat(dir)
+	defer func() {
+		if err == nil {
+			return
+		}
+		switch {
+		case os.IsNotExist(statErr):
+			os.RemoveAll(dir)
+		case bare:
+			fis, _ := ioutil.ReadDir(dir)
+			for _, fi := range fis {
+				os.RemoveAll(filepath.Join(dir, fi.Name()))
+			}
+		default:
+			os.RemoveAll(filepath.Join(dir, ".git"))
+		}
+	}()
+
+	if isLocalPath(url) {
+		// As in git, a local path is remembered as an absolute path.
+		if url, err = filepath.Abs(url); err != nil {
+			return nil, err
+		}
+	}
+	if bare {
+		repo, err = NewBareRepo(dir, true)
+	} else {
+		repo, err = NewRepo(dir, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	spec := &Refspec{Src: "refs/heads/*", Dst: "refs/remotes/origin/*", Force: true}
+	switch {
+	case opts.Mirror:
+		spec = &Refspec{Src: "refs/*", Dst: "refs/*", Force: true}
+	case bare:
+		spec = &Refspec{Src: "refs/heads/*", Dst: "refs/heads/*", Force: true}
+	}
+	if err := SetConfig(repo, remoteSection("origin"), "url", url); err != nil {
+		return nil, err
+	}
+	if opts.Mirror {
+		if err := SetConfig(repo, remoteSection("origin"), "mirror", "true"); err != nil {
+			return nil, err
+		}
+	}
+	if args.filter != "" {
+		if err := setPromisorRemote(repo, "origin", args.filter); err != nil {
+			return nil, err
+		}
+	}
+
+	t, err := openTransport(repo, url, clientProtocolVersion(repo))
+	if err != nil {
+		return nil, err
+	}
+	defer t.close()
+	adv, err := t.advertise("git-upload-pack")
+	if err != nil {
+		return nil, err
+	}
+	if adv.version == 2 {
+		// A mirror lists every ref.
+		var prefixes []string
+		if !opts.Mirror {
+			prefixes = []string{"HEAD", "refs/heads/", "refs/tags/"}
+		}
+		if err := lsRefs(t, adv, prefixes); err != nil {
+			return nil, err
+		}
+	}
+
+	branch := "refs/heads/master"
+	head := adv.ref("HEAD")
+	if target, ok := adv.caps.symrefs()["HEAD"]; ok {
+		branch = target
+	} else if head != nil {
+		branch = guessRemoteHead(adv.refs, head.SHA)
+	} else if head = defaultRemoteBranch(adv.refs); head != nil {
+		// A remote without HEAD, e.g. a bundle of branches, has master or its first branch
+		// checked out.
+		branch = head.Name
+	}
+	if args.deepens() && !opts.Mirror && branch != "" && head != nil {
+		// As with git, a shallow clone is a single branch clone.
+		spec = &Refspec{Src: branch, Dst: strings.Replace(spec.Dst, "*", ShortRefName(branch), 1), Force: true}
+	}
+	// A bare clone does not fetch from origin by default.
+	if !bare || opts.Mirror {
+		if err := SetConfig(repo, remoteSection("origin"), "fetch", spec.String()); err != nil {
+			return nil, err
+		}
+	}
+
+	refs := make(map[string]*RemoteRef)
+	var wants []string
+	for _, r := range adv.refs {
+		name, ok := spec.match(r.Name)
+		if !ok && strings.HasPrefix(r.Name, "refs/tags/") && !args.deepens() {
+			name, ok = r.Name, true
+		}
+		if ok {
+			refs[name] = r
+			wants = append(wants, r.SHA)
+		}
+	}
+	if err := fetchPack(repo, t, adv, wants, nil, opts.Progress, args); err != nil {
+		return nil, err
+	}
+	if args.deepens() {
+		// The tags the server sent along.
+		for _, r := range adv.refs {
+			if _, ok := refs[r.Name]; ok || !strings.HasPrefix(r.Name, "refs/tags/") {
+				continue
+			}
+			if hasObject(repo, r.SHA) && (r.Peeled == "" || hasObject(repo, r.Peeled)) {
+				refs[r.Name] = r
+			}
+		}
+	}
+	if err := writePackedRefs(repo, refs); err != nil {
+		return nil, err
+	}
+	msg := "clone: from " + url
+	if bare {
+		if branch == "" && head != nil {
+			return repo, SetHead(repo, "", head.SHA, msg)
+		}
+		return repo, SetHead(repo, branch, "", "")
+	}
+	if head == nil {
+		// An empty repository, or one whose HEAD is unborn.
+		if err := SetHead(repo, branch, "", ""); err != nil {
+			return nil, err
+		}
+		return repo, setUpstream(repo, branch)
+	}
+	if branch == "" {
+		if err := SetHead(repo, "", head.SHA, msg); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := UpdateRef(repo, branch, head.SHA, ZeroSHA, msg); err != nil {
+			return nil, err
+		}
+		remoteHead := "refs/remotes/origin/" + ShortRefName(branch)
+		if err := writeFile([]byte("ref: "+remoteHead+"\n"), repo.path("refs", "remotes", "origin", "HEAD")); err != nil {
+			return nil, err
+		}
+		if err := appendReflog(repo, "refs/remotes/origin/HEAD", ZeroSHA, head.SHA, msg); err != nil {
+			return nil, err
+		}
+		if err := setUpstream(repo, branch); err != nil {
+			return nil, err
+		}
+		if err := SetHead(repo, branch, head.SHA, msg); err != nil {
+			return nil, err
+		}
+	}
+	tree, err := TreeSHA(repo, head.SHA)
+	if err != nil {
+		return nil, err
+	}
+	if err := prefetchTree(repo, tree); err != nil {
+		return nil, err
+	}
+	return repo, CheckoutTree(repo, "", tree, true)
+}
+
+// guessRemoteHead returns the branch at sha the remote HEAD is likely to point to,
+// preferring master, or "" if there is none.
+func guessRemoteHead(refs []*RemoteRef, sha string) string {
+	for _, r := range refs {
+		if r.Name == "refs/heads/master" && r.SHA == sha {
+			return r.Name
+		}
+	}
+	for _, r := range refs {
+		if strings.HasPrefix(r.Name, "refs/heads/") && r.SHA == sha {
+			return r.Name
+		}
+	}
+	return ""
+}
+
+// defaultRemoteBranch returns refs/heads/master if it is among the refs, or otherwise the
+// first branch, or nil if there is no branch.
+func defaultRemoteBranch(refs []*RemoteRef) *RemoteRef {
+	var first *RemoteRef
+	for _, r := range refs {
+		if r.Name == "refs/heads/master" {
+			return r
+		}
+		if first == nil && strings.HasPrefix(r.Name, "refs/heads/") {
+			first = r
+		}
+	}
+	return first
+}
+
+// setUpstream configures the branch to track the branch of the same name of origin.
+func setUpstream(repo *Repo, branch string) error {
+	s := branchSection(ShortRefName(branch))
+	if err := SetConfig(repo, s, "remote", "origin"); err != nil {
+		return err
+	}
+	return SetConfig(repo, s, "merge", branch)
+}
+
+// writePackedRefs writes the refs to packed-refs, with the objects annotated tags peel to.
+func writePackedRefs(repo *Repo, refs map[string]*RemoteRef) error {
+	var names []string
+	for n := range refs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("# pack-refs with: peeled fully-peeled sorted \n")
+	for _, n := range names {
+		r := refs[n]
+		fmt.Fprintf(&b, "%s %s\n", r.SHA, n)
+		if r.Peeled != "" {
+			fmt.Fprintf(&b, "^%s\n", r.Peeled)
+		}
+	}
+	return writeFile([]byte(b.String()), repo.path("packed-refs"))
+}
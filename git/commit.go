@@ -0,0 +1,223 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/ogiekako/gogit/kvlm"
+)
+
+// CommitTree stores a commit of the tree with the parents and the message, authored and
+// committed by the identities given by Signature, and returns its SHA.
+func CommitTree(repo *Repo, tree string, parents []string, msg string) (string, error) {
+	return commitTree(repo, tree, parents, Signature(repo, "author"), msg)
+}
+
+// commitTree is CommitTree with the author line given, such as that of a commit cherry-picked.
+func commitTree(repo *Repo, tree string, parents []string, author, msg string) (string, error) {
+	o := newCommit(repo)
+	o.KVLM = kvlm.New()
+	o.KVLM.Append("tree", tree)
+	for _, p := range parents {
+		o.KVLM.Append("parent", p)
+	}
+	o.KVLM.Append("author", author)
+	o.KVLM.Append("committer", Signature(repo, "committer"))
+	o.KVLM.Append("", msg)
+	return o.HashData(true)
+}
+
+// CleanupMessage strips trailing whitespace from the lines of the commit message, collapses
+// consecutive empty lines and removes leading and trailing ones, as git commit does.
+// If stripComments is true, lines starting with '#' are removed first.
+// The result ends with a newline unless it is empty.
+func CleanupMessage(msg string, stripComments bool) string {
+	var lines []string
+	empty := 0
+	for _, l := range strings.Split(msg, "\n") {
+		if stripComments && strings.HasPrefix(l, "#") {
+			continue
+		}
+		l = strings.TrimRight(l, " \t\r")
+		if l == "" {
+			empty++
+			continue
+		}
+		if empty > 0 && len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		empty = 0
+		lines = append(lines, l)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// The files recording a merge in progress.
+const (
+	mergeHeadFile = "MERGE_HEAD"
+	mergeMsgFile  = "MERGE_MSG"
+	mergeModeFile = "MERGE_MODE"
+)
+
+// MergeHeads returns the commits being merged as recorded in MERGE_HEAD, or nil if no merge
+// is in progress.
+func MergeHeads(repo *Repo) ([]string, error) {
+	b, err := ioutil.ReadFile(repo.path(mergeHeadFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(b)), nil
+}
+
+// MergeMessage returns the message prepared for the merge in progress in MERGE_MSG, or ""
+// if there is none.
+func MergeMessage(repo *Repo) (string, error) {
+	b, err := ioutil.ReadFile(repo.path(mergeMsgFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(b), err
+}
+
+// WriteMergeState records the merge of the heads in progress with the prepared message.
+// noFF is recorded in MERGE_MODE so that committing the merge creates a merge commit even if
+// there is a single head.
+func WriteMergeState(repo *Repo, heads []string, msg string, noFF bool) error {
+	var b strings.Builder
+	for _, h := range heads {
+		b.WriteString(h + "\n")
+	}
+	if err := writeFile([]byte(b.String()), repo.path(mergeHeadFile)); err != nil {
+		return err
+	}
+	if err := writeFile([]byte(msg), repo.path(mergeMsgFile)); err != nil {
+		return err
+	}
+	mode := ""
+	if noFF {
+		mode = "no-ff"
+	}
+	return writeFile([]byte(mode), repo.path(mergeModeFile))
+}
+
+// ClearMergeState removes the files recording the merge in progress, including a
+// cherry-pick or a revert stopped for conflicts.
+func ClearMergeState(repo *Repo) error {
+	for _, f := range []string{mergeHeadFile, mergeMsgFile, mergeModeFile, cherryPickHeadFile, revertHeadFile} {
+		if err := os.Remove(repo.path(f)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// CommitOptions configures Commit.
+type CommitOptions struct {
+	// AllowEmpty allows a commit whose tree is the same as that of its only parent.
+	AllowEmpty bool
+	// Amend replaces HEAD with the new commit, which has the parents and the author of HEAD.
+	Amend bool
+}
+
+// Commit commits the index on top of HEAD, with the commits in MERGE_HEAD as additional
+// parents, points HEAD at the commit and clears the merge state. If a cherry-pick is stopped,
+// the author of the commit being picked is kept. With opts.Amend, HEAD is replaced instead.
+// msg should be cleaned up as with CleanupMessage and must not be empty. It returns the SHA
+// of the commit.
+func Commit(repo *Repo, msg string, opts *CommitOptions) (string, error) {
+	if opts == nil {
+		opts = &CommitOptions{}
+	}
+	if msg == "" {
+		return "", errors.New("aborting commit due to empty commit message")
+	}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return "", err
+	}
+	if u := idx.Unmerged(); len(u) > 0 {
+		return "", fmt.Errorf("committing is not possible because you have unmerged files: %s", strings.Join(u, ", "))
+	}
+	tree, err := WriteTree(repo, idx)
+	if err != nil {
+		return "", err
+	}
+	_, head, err := Head(repo)
+	if err != nil {
+		return "", err
+	}
+	merges, err := MergeHeads(repo)
+	if err != nil {
+		return "", err
+	}
+	var parents []string
+	if head != "" {
+		parents = append(parents, head)
+	}
+	parents = append(parents, merges...)
+	if opts.Amend {
+		if head == "" {
+			return "", errors.New("you have nothing to amend")
+		}
+		if len(merges) > 0 {
+			return "", errors.New("you are in the middle of a merge -- cannot amend")
+		}
+		if parents, err = Parents(repo, head); err != nil {
+			return "", err
+		}
+	}
+	if head != "" && len(merges) == 0 && !opts.AllowEmpty && !opts.Amend {
+		if t, err := TreeSHA(repo, head); err != nil {
+			return "", err
+		} else if t == tree {
+			return "", errors.New("nothing to commit")
+		}
+	}
+
+	author := Signature(repo, "author")
+	pick, err := readPickHead(repo, cherryPickHeadFile)
+	if err != nil {
+		return "", err
+	}
+	// The commit whose author is kept.
+	keep := pick
+	if opts.Amend {
+		keep = head
+	}
+	if keep != "" {
+		if author, err = commitAuthor(repo, keep); err != nil {
+			return "", err
+		}
+	}
+	sha, err := commitTree(repo, tree, parents, author, msg)
+	if err != nil {
+		return "", err
+	}
+	kind := "commit"
+	switch {
+	case head == "":
+		kind = "commit (initial)"
+	case opts.Amend:
+		kind = "commit (amend)"
+	case len(merges) > 0:
+		kind = "commit (merge)"
+	case pick != "":
+		kind = "commit (cherry-pick)"
+	}
+	old := head
+	if old == "" {
+		old = ZeroSHA
+	}
+	if err := UpdateRef(repo, "HEAD", sha, old, kind+": "+strings.SplitN(msg, "\n", 2)[0]); err != nil {
+		return "", err
+	}
+	return sha, ClearMergeState(repo)
+}
@@ -0,0 +1,360 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Change is a difference of an entry between two trees.
+type Change struct {
+	// Status is 'A' (added), 'D' (deleted), 'M' (modified), 'T' (type changed), or 'R' (renamed)
+	// or 'C' (copied) as detected by DetectRenames.
+	Status byte
+	// From and To are the entries in the old and the new tree, whose Path fields are the full
+	// slash separated paths. From is nil if the entry is added and To is nil if deleted.
+	From, To *TreeLeaf
+	// Score is the similarity of From and To out of MaxScore for renames and copies.
+	Score int
+}
+
+// Path returns the path of the changed entry.
+func (c *Change) Path() string {
+	if c.To != nil {
+		return c.To.Path
+	}
+	return c.From.Path
+}
+
+// DiffTreeOptions configures DiffTree.
+type DiffTreeOptions struct {
+	// Recursive descends into subtrees. Otherwise changed subtrees are reported as modified
+	// tree entries.
+	Recursive bool
+	// Pathspecs limits the changes to the matching paths as MatchPathspec does.
+	Pathspecs []string
+}
+
+// DiffTrees returns the changes from the tree a to the tree b. Either may be "" for an empty tree.
+func DiffTrees(repo *Repo, a, b string, opts *DiffTreeOptions) ([]*Change, error) {
+	var res []*Change
+	return res, DiffTree(repo, a, b, opts, func(c *Change) error {
+		res = append(res, c)
+		return nil
+	})
+}
+
+// DiffTree walks the trees a and b in lockstep and calls fn for each changed entry in the
+// order the entries appear in the trees. Either may be "" for an empty tree.
+// Subtrees with the same SHA in both trees are not read. If fn returns an error, the walk stops
+// and the error is returned.
+func DiffTree(repo *Repo, a, b string, opts *DiffTreeOptions, fn func(*Change) error) error {
+	if opts == nil {
+		opts = &DiffTreeOptions{}
+	}
+	return diffTree(repo, a, b, "", opts, fn)
+}
+
+func readTree(repo *Repo, sha string) (Tree, error) {
+	if sha == "" || sha == EmptyTreeSHA {
+		return nil, nil
+	}
+	o, err := ReadObject(repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	if o.Type != "tree" {
+		return nil, fmt.Errorf("format %s != tree", o.Type)
+	}
+	return o.Tree, nil
+}
+
+func treeKey(l *TreeLeaf) string {
+	if l.Mode == "40000" {
+		return l.Path + "/"
+	}
+	return l.Path
+}
+
+func diffTree(repo *Repo, a, b, prefix string, opts *DiffTreeOptions, fn func(*Change) error) error {
+	if a == b {
+		return nil
+	}
+	ta, err := readTree(repo, a)
+	if err != nil {
+		return err
+	}
+	tb, err := readTree(repo, b)
+	if err != nil {
+		return err
+	}
+	// git sorts tree entries, but be tolerant to trees written out of order.
+	sortTree(ta)
+	sortTree(tb)
+	full := func(l *TreeLeaf) *TreeLeaf {
+		if l == nil {
+			return nil
+		}
+		return &TreeLeaf{l.Mode, prefix + l.Path, l.SHA}
+	}
+	i, j := 0, 0
+	for i < len(ta) || j < len(tb) {
+		var la, lb *TreeLeaf
+		switch {
+		case j == len(tb) || i < len(ta) && treeKey(ta[i]) < treeKey(tb[j]):
+			la = full(ta[i])
+			i++
+		case i == len(ta) || treeKey(ta[i]) > treeKey(tb[j]):
+			lb = full(tb[j])
+			j++
+		default:
+			la, lb = full(ta[i]), full(tb[j])
+			i++
+			j++
+		}
+		if err := diffEntry(repo, la, lb, opts, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffEntry reports the change between the entries with the same path.
+func diffEntry(repo *Repo, la, lb *TreeLeaf, opts *DiffTreeOptions, fn func(*Change) error) error {
+	l := la
+	if l == nil {
+		l = lb
+	}
+	isTree := l.Mode == "40000"
+	if isTree && !pathspecMayMatchUnder(opts.Pathspecs, l.Path) || !isTree && !MatchPathspec(opts.Pathspecs, l.Path) {
+		return nil
+	}
+	if la != nil && lb != nil && la.SHA == lb.SHA && parseMode(la.Mode) == parseMode(lb.Mode) {
+		return nil
+	}
+	if isTree && opts.Recursive {
+		return diffTree(repo, leafSHA(la), leafSHA(lb), l.Path+"/", opts, fn)
+	}
+	if isTree && !MatchPathspec(opts.Pathspecs, l.Path) {
+		// Only paths under the tree match; report the tree if anything under it changes.
+		changed := false
+		err := diffTree(repo, leafSHA(la), leafSHA(lb), l.Path+"/", &DiffTreeOptions{Recursive: true, Pathspecs: opts.Pathspecs}, func(*Change) error {
+			changed = true
+			return errStopWalk
+		})
+		if err != nil && err != errStopWalk || !changed {
+			return err
+		}
+	}
+	return fn(newChange(la, lb))
+}
+
+// newChange returns the change from la to lb, either of which may be nil.
+func newChange(la, lb *TreeLeaf) *Change {
+	c := &Change{From: la, To: lb}
+	switch {
+	case la == nil:
+		c.Status = 'A'
+	case lb == nil:
+		c.Status = 'D'
+	case objectKind(la.Mode) != objectKind(lb.Mode):
+		c.Status = 'T'
+	default:
+		c.Status = 'M'
+	}
+	return c
+}
+
+var errStopWalk = errors.New("stop walk")
+
+// CombinedChange is a path of a merge result which differs from all the parents.
+type CombinedChange struct {
+	Path string
+	// Parents are the entries in the parents, nil if missing, and Statuses the statuses of
+	// the changes from them.
+	Parents  []*TreeLeaf
+	Statuses []byte
+	// To is the entry in the result, or nil if deleted.
+	To *TreeLeaf
+}
+
+// DiffCombined returns the paths of the tree which differ from all the parent trees, sorted by path.
+// Only the paths matching the pathspecs are compared.
+func DiffCombined(repo *Repo, parents []string, tree string, pathspecs []string) ([]*CombinedChange, error) {
+	var res []*CombinedChange
+	for i, p := range parents {
+		cs, err := DiffTrees(repo, p, tree, &DiffTreeOptions{Recursive: true, Pathspecs: pathspecs})
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			for _, c := range cs {
+				res = append(res, &CombinedChange{Path: c.Path(), Parents: []*TreeLeaf{c.From}, Statuses: []byte{c.Status}, To: c.To})
+			}
+			continue
+		}
+		m := make(map[string]*Change)
+		for _, c := range cs {
+			m[c.Path()] = c
+		}
+		var next []*CombinedChange
+		for _, cc := range res {
+			if c, ok := m[cc.Path]; ok {
+				cc.Parents = append(cc.Parents, c.From)
+				cc.Statuses = append(cc.Statuses, c.Status)
+				next = append(next, cc)
+			}
+		}
+		res = next
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Path < res[j].Path })
+	return res, nil
+}
+
+// DiffIndex returns the changes from the tree, which may be "" for an empty tree, to the index.
+// Only the paths matching the pathspecs are compared. Unmerged entries are ignored.
+func DiffIndex(repo *Repo, tree string, pathspecs []string) ([]*Change, error) {
+	old, err := TreeEntries(repo, tree)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return nil, err
+	}
+	cur := make(map[string]*TreeLeaf)
+	for _, e := range idx.Entries {
+		if e.Stage == 0 {
+			cur[e.Path] = &TreeLeaf{e.TreeMode(), e.Path, e.SHA}
+		}
+	}
+	return diffLeaves(old, cur, pathspecs), nil
+}
+
+// DiffFiles returns the changes from the index to the worktree. Only the files tracked in the
+// index and matching the pathspecs are compared. The To leaves of the changes have the SHAs of
+// the worktree contents, which are not stored in the repository.
+func DiffFiles(repo *Repo, pathspecs []string) ([]*Change, error) {
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return nil, err
+	}
+	old := make(map[string]*TreeLeaf)
+	for _, e := range idx.Entries {
+		if e.Stage == 0 && MatchPathspec(pathspecs, e.Path) {
+			old[e.Path] = &TreeLeaf{e.TreeMode(), e.Path, e.SHA}
+		}
+	}
+	cur, err := worktreeLeaves(repo, idx, pathspecs)
+	if err != nil {
+		return nil, err
+	}
+	return diffLeaves(old, cur, pathspecs), nil
+}
+
+// DiffWorktree returns the changes from the tree, which may be "" for an empty tree, to the
+// worktree. Like DiffFiles, only the files tracked in the index are considered to exist in the worktree.
+func DiffWorktree(repo *Repo, tree string, pathspecs []string) ([]*Change, error) {
+	old, err := TreeEntries(repo, tree)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := worktreeLeaves(repo, idx, pathspecs)
+	if err != nil {
+		return nil, err
+	}
+	return diffLeaves(old, cur, pathspecs), nil
+}
+
+// worktreeLeaves returns the leaves for the worktree files tracked in the index. Files whose stat
+// data match the index are not hashed, and missing files are left out.
+func worktreeLeaves(repo *Repo, idx *Index, pathspecs []string) (map[string]*TreeLeaf, error) {
+	m := make(map[string]*TreeLeaf)
+	for _, e := range idx.Entries {
+		if e.Stage != 0 || !MatchPathspec(pathspecs, e.Path) {
+			continue
+		}
+		if ok, err := worktreeMatches(repo, e); err != nil {
+			return nil, err
+		} else if ok {
+			m[e.Path] = &TreeLeaf{e.TreeMode(), e.Path, e.SHA}
+			continue
+		}
+		fi, err := os.Lstat(repo.wtPath(e.Path))
+		if os.IsNotExist(err) || err == nil && fi.IsDir() && e.Mode != modeGitlink {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		sha, mode, err := hashFile(repo, e.Path, e, false)
+		if err != nil {
+			return nil, err
+		}
+		m[e.Path] = &TreeLeaf{fmt.Sprintf("%o", mode), e.Path, sha}
+	}
+	return m, nil
+}
+
+// diffLeaves returns the changes between the leaves keyed by their paths, sorted by path.
+func diffLeaves(old, cur map[string]*TreeLeaf, pathspecs []string) []*Change {
+	var paths []string
+	for p := range old {
+		paths = append(paths, p)
+	}
+	for p := range cur {
+		if old[p] == nil {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	var res []*Change
+	for _, p := range paths {
+		la, lb := old[p], cur[p]
+		if !MatchPathspec(pathspecs, p) || sameLeaf(la, lb) {
+			continue
+		}
+		res = append(res, newChange(la, lb))
+	}
+	return res
+}
+
+func leafSHA(l *TreeLeaf) string {
+	if l == nil {
+		return ""
+	}
+	return l.SHA
+}
+
+// objectKind classifies the mode into tree, blob (regular files), symlink or gitlink.
+func objectKind(mode string) string {
+	switch parseMode(mode) {
+	case 040000:
+		return "tree"
+	case modeSymlink:
+		return "symlink"
+	case modeGitlink:
+		return "gitlink"
+	}
+	return "blob"
+}
+
+// pathspecMayMatchUnder reports whether any of the pathspecs may match the directory dir
+// or a path under it.
+func pathspecMayMatchUnder(pathspecs []string, dir string) bool {
+	if len(pathspecs) == 0 {
+		return true
+	}
+	for _, s := range pathspecs {
+		s = strings.TrimPrefix(strings.TrimSuffix(s, "/"), "./")
+		if matchPathspec(s, dir) || strings.HasPrefix(s, dir+"/") || strings.ContainsAny(s, "*?[") {
+			return true
+		}
+	}
+	return false
+}
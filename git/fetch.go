@@ -0,0 +1,702 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FetchOptions are options of Fetch.
+type FetchOptions struct {
+	// Refspecs are fetched instead of the remote.<name>.fetch refspec if not empty.
+	Refspecs []string
+	// Progress receives the progress messages of the remote if not nil.
+	Progress io.Writer
+	// ReflogAction is the prefix of the reflog messages, "fetch" if empty.
+	ReflogAction string
+	// Depth limits the history to the number of commits from the fetched refs if not 0,
+	// deepening or shortening the history of a shallow repository.
+	Depth int
+	// ShallowSince limits the history to the commits after the time if not zero.
+	ShallowSince time.Time
+	// ShallowExclude limits the history to the commits not reachable from the remote
+	// branches or tags.
+	ShallowExclude []string
+	// Unshallow fetches the whole history of a shallow repository.
+	Unshallow bool
+	// Filter is the filter spec of a partial fetch. remote.<name>.partialclonefilter is
+	// used for the promisor remote of a partial clone if it is empty.
+	Filter string
+}
+
+// RefUpdateStatus is the result of updating a local ref.
+type RefUpdateStatus int
+
+const (
+	// UpdateNone means no local ref is updated; the remote ref is only stored in FETCH_HEAD.
+	UpdateNone RefUpdateStatus = iota
+	UpdateUpToDate
+	UpdateNew
+	UpdateFastForward
+	UpdateForced
+	// UpdateTag means an existing tag was forced to point to another object.
+	UpdateTag
+	// UpdateRejected means a non fast-forward update was refused.
+	UpdateRejected
+	// UpdateRejectedTag means an existing tag was not overwritten.
+	UpdateRejectedTag
+	// UpdateDeleted means a remote ref was deleted by a push.
+	UpdateDeleted
+	// UpdateRejectedFetchFirst means a push was refused because the remote ref points to
+	// an object which does not exist locally.
+	UpdateRejectedFetchFirst
+	// UpdateRemoteRejected means the remote refused to update the ref pushed to it.
+	UpdateRemoteRejected
+)
+
+// Rejected returns whether the update was refused.
+func (s RefUpdateStatus) Rejected() bool {
+	switch s {
+	case UpdateRejected, UpdateRejectedTag, UpdateRejectedFetchFirst, UpdateRemoteRejected:
+		return true
+	}
+	return false
+}
+
+// RefUpdate is an update of a local ref from a remote ref, or of a remote ref from a
+// local ref by a push.
+type RefUpdate struct {
+	// Remote and Local are the full names of the remote and the local ref.
+	// Local is "" if the remote ref is only stored in FETCH_HEAD or deleted by a push.
+	Remote, Local string
+	// Old is ZeroSHA if the updated ref did not exist.
+	Old, New string
+	Status   RefUpdateStatus
+	// Reason is why the remote refused the update for UpdateRemoteRejected.
+	Reason string
+}
+
+// FetchResult is the result of Fetch.
+type FetchResult struct {
+	// URL is the URL fetched from, shortened for display as in FETCH_HEAD.
+	URL     string
+	Updates []*RefUpdate
+}
+
+// fetchEntry is a remote ref to fetch.
+type fetchEntry struct {
+	ref   *RemoteRef
+	local string
+	force bool
+	// fetchHead is true if the ref is to be written to FETCH_HEAD, merge if it is to be
+	// merged by git pull.
+	fetchHead, merge bool
+}
+
+func (e *fetchEntry) rank() int {
+	switch {
+	case e.merge:
+		return 0
+	case e.fetchHead:
+		return 1
+	}
+	return 2
+}
+
+func remoteSection(name string) string {
+	return `remote "` + name + `"`
+}
+
+func branchSection(name string) string {
+	return `branch "` + name + `"`
+}
+
+// isURL returns whether the remote is given as a URL or the path of a directory or a bundle
+// rather than a name.
+func isURL(remote string) bool {
+	if !isLocalPath(remote) {
+		return true
+	}
+	fi, err := os.Stat(remote)
+	return err == nil && fi.IsDir() || isBundle(remote)
+}
+
+// displayURL returns the url without trailing slashes and .git as git shows it.
+func displayURL(url string) string {
+	url = strings.TrimRight(url, "/")
+	return strings.TrimSuffix(url, ".git")
+}
+
+// Fetch fetches the refs from the remote, which is the name of a configured remote or a
+// URL, updating the local refs the refspecs map them to. remote.<name>.fetch is used if no
+// refspecs are given, and then the tags pointing to the fetched objects are fetched too.
+// FETCH_HEAD is written with the fetched refs, marking those for git pull to merge.
+// Non fast-forward updates without force are rejected, reported in the result.
+func Fetch(repo *Repo, remote string, opts *FetchOptions) (*FetchResult, error) {
+	branch, _, err := Head(repo)
+	if err != nil {
+		return nil, err
+	}
+	if remote == "" {
+		remote = "origin"
+		if r := Config(repo, branchSection(ShortRefName(branch)), "remote"); branch != "" && r != "" {
+			remote = r
+		}
+	}
+	url := Config(repo, remoteSection(remote), "url")
+	var configured []*Refspec
+	if url != "" {
+		if s := Config(repo, remoteSection(remote), "fetch"); s != "" {
+			rs, err := ParseRefspec(s)
+			if err != nil {
+				return nil, err
+			}
+			configured = append(configured, rs)
+		}
+	} else if isURL(remote) {
+		url = remote
+	} else {
+		return nil, fmt.Errorf("'%s' does not appear to be a git repository", remote)
+	}
+	var specs []*Refspec
+	for _, s := range opts.Refspecs {
+		rs, err := ParseRefspec(s)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, rs)
+	}
+	cmdline := len(specs) > 0
+	if !cmdline {
+		specs = configured
+	}
+	if len(specs) == 0 {
+		// The remote HEAD is fetched for git pull to merge, as if given on the command line.
+		specs, cmdline = []*Refspec{{Src: "HEAD"}}, true
+	}
+	// The ref git pull merges when fetching with the configured refspecs.
+	var mergeRef string
+	if !cmdline && branch != "" && Config(repo, branchSection(ShortRefName(branch)), "remote") == remote {
+		mergeRef = Config(repo, branchSection(ShortRefName(branch)), "merge")
+	}
+
+	args := &fetchArgs{depth: opts.Depth, exclude: opts.ShallowExclude, filter: opts.Filter}
+	if !opts.ShallowSince.IsZero() {
+		args.since = opts.ShallowSince.Unix()
+	}
+	if opts.Unshallow {
+		if shallow, err := IsShallow(repo); err != nil {
+			return nil, err
+		} else if !shallow {
+			return nil, errors.New("--unshallow on a complete repository does not make sense")
+		}
+		args.depth = infiniteDepth
+	}
+	if args.filter == "" && remote == promisorRemote(repo) {
+		args.filter = Config(repo, remoteSection(remote), "partialclonefilter")
+	}
+	if args.filter != "" {
+		if _, err := parseFilter(args.filter); err != nil {
+			return nil, err
+		}
+	}
+
+	// Tags are followed when they point to what is fetched if a refspec stores refs;
+	// include-tag makes the server send them along.
+	autoTags := false
+	for _, s := range specs {
+		autoTags = autoTags || s.Dst != ""
+	}
+
+	t, err := openTransport(repo, url, clientProtocolVersion(repo))
+	if err != nil {
+		return nil, err
+	}
+	defer t.close()
+	adv, err := t.advertise("git-upload-pack")
+	if err != nil {
+		return nil, err
+	}
+	if adv.version == 2 {
+		if err := lsRefs(t, adv, refPrefixes(specs, autoTags)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writeFile(nil, repo.path("FETCH_HEAD")); err != nil {
+		return nil, err
+	}
+
+	var entries []*fetchEntry
+	locals := make(map[string]bool)
+	add := func(e *fetchEntry) {
+		if e.local != "" {
+			if locals[e.local] {
+				return
+			}
+			locals[e.local] = true
+		}
+		entries = append(entries, e)
+	}
+	for _, s := range specs {
+		if s.Src == "" {
+			return nil, fmt.Errorf("invalid refspec '%s'", s)
+		}
+		if s.glob() {
+			for _, r := range adv.refs {
+				if dst, ok := s.match(r.Name); ok {
+					add(&fetchEntry{ref: r, local: dst, force: s.Force, fetchHead: true, merge: cmdline || r.Name == mergeRef})
+				}
+			}
+			continue
+		}
+		r := expandRemoteRef(adv.refs, s.Src)
+		if r == nil {
+			return nil, fmt.Errorf("couldn't find remote ref %s", s.Src)
+		}
+		dst := s.Dst
+		if dst != "" && !strings.HasPrefix(dst, "refs/") {
+			if strings.HasPrefix(r.Name, "refs/tags/") {
+				dst = "refs/tags/" + dst
+			} else {
+				dst = "refs/heads/" + dst
+			}
+		}
+		add(&fetchEntry{ref: r, local: dst, force: s.Force, fetchHead: true, merge: cmdline || r.Name == mergeRef})
+	}
+	// Refs fetched by name also update their remote-tracking refs.
+	if cmdline {
+		for _, e := range entries {
+			for _, s := range configured {
+				if !s.glob() {
+					continue
+				}
+				if dst, ok := s.match(e.ref.Name); ok && dst != "" {
+					add(&fetchEntry{ref: e.ref, local: dst, force: s.Force})
+				}
+			}
+		}
+	}
+
+	if !repo.Bare() && branch != "" {
+		for _, e := range entries {
+			if e.local == branch {
+				wt, err := filepath.Abs(repo.worktree)
+				if err != nil {
+					return nil, err
+				}
+				return nil, fmt.Errorf("refusing to fetch into branch '%s' checked out at '%s'", branch, wt)
+			}
+		}
+	}
+
+	var wants []string
+	for _, e := range entries {
+		wants = append(wants, e.ref.SHA)
+	}
+	var tags []*RemoteRef
+	if autoTags {
+		for _, r := range adv.refs {
+			if !strings.HasPrefix(r.Name, "refs/tags/") || locals[r.Name] {
+				continue
+			}
+			if _, err := ReadRef(repo, r.Name); err != nil {
+				tags = append(tags, r)
+			}
+		}
+	}
+	haves, err := localCommits(repo)
+	if err != nil {
+		return nil, err
+	}
+	if err := fetchPack(repo, t, adv, wants, haves, opts.Progress, args); err != nil {
+		return nil, err
+	}
+	for _, r := range tags {
+		peeled := r.SHA
+		if r.Peeled != "" {
+			peeled = r.Peeled
+		}
+		if hasObject(repo, r.SHA) && hasObject(repo, peeled) {
+			add(&fetchEntry{ref: r, local: r.Name, fetchHead: true})
+		}
+	}
+	// As in git, the refs to be merged come first, then the others stored in FETCH_HEAD.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].rank() < entries[j].rank()
+	})
+
+	res := &FetchResult{URL: displayURL(url)}
+	rla := opts.ReflogAction
+	if rla == "" {
+		rla = "fetch"
+	}
+	for _, e := range entries {
+		u, err := updateLocalRef(repo, e, rla)
+		if err != nil {
+			return nil, err
+		}
+		res.Updates = append(res.Updates, u)
+	}
+	if err := writeFetchHead(repo, entries, res.URL); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// hasObject returns whether sha is a full hash of an object in the repository. Objects
+// missing in a partial clone are not fetched.
+func hasObject(repo *Repo, sha string) bool {
+	if len(sha) != 40 || !shortHashRE.MatchString(sha) {
+		return false
+	}
+	_, _, err := readRawObject(repo, sha)
+	return err == nil
+}
+
+// maxHaves is the maximum number of commits told to the server as what the client has.
+const maxHaves = 256
+
+// localCommits returns the newest commits reachable from the local refs.
+func localCommits(repo *Repo) ([]string, error) {
+	refs, err := AllRefs(repo)
+	if err != nil {
+		return nil, err
+	}
+	if _, sha, err := Head(repo); err == nil && sha != "" {
+		refs["HEAD"] = sha
+	}
+	var names []string
+	for n := range refs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var tips []string
+	seen := make(map[string]bool)
+	for _, n := range names {
+		sha := refs[n]
+		if sha, err := peelTag(repo, sha); err == nil && !seen[sha] {
+			seen[sha] = true
+			if typ, _, err := ReadRawObject(repo, sha); err == nil && typ == "commit" {
+				tips = append(tips, sha)
+			}
+		}
+	}
+	commits, err := RevList(repo, tips, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(commits) > maxHaves {
+		commits = commits[:maxHaves]
+	}
+	return commits, nil
+}
+
+// fetchArgs are what a fetch asks for besides the objects: a limit of the history for a
+// shallow clone and a filter for a partial clone.
+type fetchArgs struct {
+	// depth limits the history to the number of commits from the wants if not 0.
+	depth int
+	// since limits the history to the commits made at or after the Unix time if not 0.
+	since int64
+	// exclude limits the history to the commits not reachable from the remote refs.
+	exclude []string
+	// filter is the filter spec of a partial clone, or "".
+	filter string
+}
+
+// deepens reports whether the history is limited.
+func (a *fetchArgs) deepens() bool {
+	return a != nil && (a.depth > 0 || a.since != 0 || len(a.exclude) > 0)
+}
+
+// checkServer returns an error if the server cannot serve the arguments. A filter the
+// server does not support is dropped with a warning written to progress.
+func (a *fetchArgs) checkServer(adv *advertisement, progress io.Writer) error {
+	has := adv.caps.has
+	if adv.version == 2 {
+		has = func(f string) bool { return adv.caps.hasFeature("fetch", f) }
+	}
+	switch {
+	case !has("shallow") && a.deepens():
+		return errors.New("Server does not support shallow clients")
+	case !has("deepen-since") && a.since != 0 && adv.version != 2:
+		return errors.New("Server does not support --shallow-since")
+	case !has("deepen-not") && len(a.exclude) > 0 && adv.version != 2:
+		return errors.New("Server does not support --shallow-exclude")
+	}
+	if a.filter != "" && !has("filter") {
+		if progress != nil {
+			fmt.Fprintln(progress, "warning: filtering not recognized by server, ignoring")
+		}
+		a.filter = ""
+	}
+	return nil
+}
+
+// writeLines writes the shallow commits of the repository and the arguments as the lines
+// of a request.
+func (a *fetchArgs) writeLines(w io.Writer, shallow []string) {
+	for _, c := range shallow {
+		writePkt(w, "shallow %s\n", c)
+	}
+	if a.depth > 0 {
+		writePkt(w, "deepen %d\n", a.depth)
+	}
+	if a.since != 0 {
+		writePkt(w, "deepen-since %d\n", a.since)
+	}
+	for _, r := range a.exclude {
+		writePkt(w, "deepen-not %s\n", r)
+	}
+	if a.filter != "" {
+		writePkt(w, "filter %s\n", a.filter)
+	}
+}
+
+// fetchPack asks the server for the objects wants, telling it the commits in haves,
+// and indexes the pack it sends. Objects which already exist locally are not asked for
+// unless the history is deepened from them. The shallow file is updated as the server
+// tells.
+func fetchPack(repo *Repo, t transport, adv *advertisement, wants, haves []string, progress io.Writer, args *fetchArgs) error {
+	if args == nil {
+		args = &fetchArgs{}
+	}
+	var missing []string
+	seen := make(map[string]bool)
+	for _, sha := range wants {
+		if !seen[sha] && (args.deepens() || !hasObject(repo, sha)) {
+			missing = append(missing, sha)
+		}
+		seen[sha] = true
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if t, ok := t.(*bundleTransport); ok {
+		// A bundle has a single pack with all its objects.
+		if args.deepens() || args.filter != "" {
+			return errors.New("shallow and partial fetches from a bundle are not supported")
+		}
+		return t.bundle.Unbundle(repo)
+	}
+	shallowSet, err := repo.shallowCommits()
+	if err != nil {
+		return err
+	}
+	var shallow []string
+	for c := range shallowSet {
+		shallow = append(shallow, c)
+	}
+	sort.Strings(shallow)
+	if len(shallow) > 0 && !adv.caps.has("shallow") && !adv.caps.hasFeature("fetch", "shallow") {
+		return errors.New("Server does not support shallow clients")
+	}
+	if err := args.checkServer(adv, progress); err != nil {
+		return err
+	}
+	if adv.version == 2 {
+		return fetchPackV2(repo, t, adv, missing, haves, shallow, progress, args)
+	}
+
+	var caps []string
+	sideband := ""
+	for _, c := range []string{"side-band-64k", "side-band"} {
+		if adv.caps.has(c) {
+			sideband = c
+			caps = append(caps, c)
+			break
+		}
+	}
+	for _, c := range []string{"ofs-delta", "thin-pack", "include-tag"} {
+		if adv.caps.has(c) {
+			caps = append(caps, c)
+		}
+	}
+	if progress == nil && adv.caps.has("no-progress") {
+		caps = append(caps, "no-progress")
+	}
+	if args.filter != "" {
+		caps = append(caps, "filter")
+	}
+	if adv.caps.has("agent") {
+		caps = append(caps, "agent="+agent)
+	}
+
+	var b bytes.Buffer
+	for i, sha := range missing {
+		if i == 0 {
+			writePkt(&b, "want %s %s\n", sha, strings.Join(caps, " "))
+		} else {
+			writePkt(&b, "want %s\n", sha)
+		}
+	}
+	args.writeLines(&b, shallow)
+	writeFlush(&b)
+	for _, sha := range haves {
+		writePkt(&b, "have %s\n", sha)
+	}
+	writePkt(&b, "done\n")
+
+	resp, err := t.request("git-upload-pack", b.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	p := newPktReader(resp)
+	update := &shallowUpdate{}
+	if len(shallow) > 0 || args.deepens() {
+		if update, err = readShallowUpdate(p); err != nil {
+			return err
+		}
+	}
+	l, flush, err := p.readLine()
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(l, "ERR "):
+		return fmt.Errorf("remote error: %s", l[len("ERR "):])
+	case flush || l != "NAK" && !strings.HasPrefix(l, "ACK "):
+		return fmt.Errorf("protocol error: expected ACK/NAK, got %q", l)
+	}
+	// A server without multi_ack acknowledges haves whose ancestors were acknowledged too.
+	for {
+		if b, err := p.r.Peek(4); err == nil && string(b) == "PACK" {
+			break
+		}
+		kind, data, err := p.peek()
+		if err != nil {
+			return err
+		}
+		if kind != pktData || !bytes.HasPrefix(data, []byte("ACK ")) {
+			break
+		}
+		p.next()
+	}
+	var r io.Reader = p.r
+	if sideband != "" {
+		r = &sidebandReader{p: p, progress: progress}
+	}
+	if err := indexFetchedPack(repo, r); err != nil {
+		return err
+	}
+	return updateShallow(repo, update)
+}
+
+// indexFetchedPack indexes the pack a server sends. A pack from the promisor remote of a
+// partial clone is marked with a .promisor file, as the objects it omits are known to be
+// there.
+func indexFetchedPack(repo *Repo, r io.Reader) error {
+	sha, err := IndexPack(repo, r)
+	if err != nil || sha == "" || promisorRemote(repo) == "" {
+		return err
+	}
+	return writeFile(nil, repo.path("objects", "pack", "pack-"+sha+".promisor"))
+}
+
+// refPrefixes returns the prefixes of the names of the remote refs the refspecs may match,
+// and refs/tags/ if tags are followed, for a protocol version 2 server to list only those.
+func refPrefixes(specs []*Refspec, tags bool) []string {
+	var res []string
+	for _, s := range specs {
+		if s.glob() {
+			res = append(res, s.Src[:strings.IndexByte(s.Src, '*')])
+			continue
+		}
+		for _, f := range refRules {
+			res = append(res, fmt.Sprintf(f, s.Src))
+		}
+	}
+	if tags {
+		res = append(res, "refs/tags/")
+	}
+	return res
+}
+
+// updateLocalRef updates the local ref of the entry unless it would lose commits without
+// force, logging the update with the reflog action rla.
+func updateLocalRef(repo *Repo, e *fetchEntry, rla string) (*RefUpdate, error) {
+	u := &RefUpdate{Remote: e.ref.Name, Local: e.local, Old: ZeroSHA, New: e.ref.SHA}
+	if e.local == "" {
+		return u, nil
+	}
+	if sha, err := ReadRef(repo, e.local); err == nil {
+		u.Old = sha
+	}
+	var msg string
+	switch {
+	case u.Old == u.New:
+		u.Status = UpdateUpToDate
+		return u, nil
+	case u.Old == ZeroSHA:
+		u.Status = UpdateNew
+		switch {
+		case strings.HasPrefix(e.ref.Name, "refs/tags/"):
+			msg = "storing tag"
+		case strings.HasPrefix(e.ref.Name, "refs/heads/"):
+			msg = "storing head"
+		default:
+			msg = "storing ref"
+		}
+	case strings.HasPrefix(e.local, "refs/tags/"):
+		if !e.force {
+			u.Status = UpdateRejectedTag
+			return u, nil
+		}
+		u.Status, msg = UpdateTag, "updating tag"
+	default:
+		if ok, err := IsAncestor(repo, u.Old, u.New); err == nil && ok {
+			u.Status, msg = UpdateFastForward, "fast-forward"
+		} else if e.force {
+			u.Status, msg = UpdateForced, "forced-update"
+		} else {
+			u.Status = UpdateRejected
+			return u, nil
+		}
+	}
+	return u, UpdateRef(repo, e.local, u.New, u.Old, rla+": "+msg)
+}
+
+// writeFetchHead writes FETCH_HEAD with the entries to be written there.
+func writeFetchHead(repo *Repo, entries []*fetchEntry, url string) error {
+	var b strings.Builder
+	for _, e := range entries {
+		if !e.fetchHead {
+			continue
+		}
+		status := ""
+		if !e.merge {
+			status = "not-for-merge"
+		}
+		desc := url
+		if kind, what := refKind(e.ref.Name); e.ref.Name != "HEAD" {
+			if kind != "" {
+				kind += " "
+			}
+			desc = fmt.Sprintf("%s'%s' of %s", kind, what, url)
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%s\n", e.ref.SHA, status, desc)
+	}
+	return writeFile([]byte(b.String()), repo.path("FETCH_HEAD"))
+}
+
+// refKind returns the kind of the remote ref as git describes it and its short name,
+// e.g. "branch" and "main" for refs/heads/main.
+func refKind(name string) (kind, short string) {
+	switch {
+	case strings.HasPrefix(name, "refs/heads/"):
+		return "branch", ShortRefName(name)
+	case strings.HasPrefix(name, "refs/tags/"):
+		return "tag", ShortRefName(name)
+	case strings.HasPrefix(name, "refs/remotes/"):
+		return "remote-tracking branch", ShortRefName(name)
+	}
+	return "", name
+}
@@ -13,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -65,21 +66,39 @@ func (e *nameResolutionError) Error() string {
 // FindObject finds the matching object.
 // If typ is not the zero value chases until an object with the type if found.
 func FindObject(repo *Repo, name, typ string) (*Object, error) {
-	ss, err := findSHA(repo, name)
+	sha, err := ResolveRevision(repo, name, typ)
 	if err != nil {
 		return nil, err
 	}
-	if len(ss) != 1 {
-		return nil, &nameResolutionError{name, ss}
+	return ReadObject(repo, sha)
+}
+
+// ResolveRevision returns the SHA of the object FindObject finds.
+// Besides names of refs and (short) SHAs, name can have suffixes as in git rev-parse:
+// ^{type}, ^{}, ^<n> and ~<n>. "<ref>@{<n>}" names the n-th prior value of the ref in its
+// reflog. "<rev>:<path>" names the object at the path in the tree-ish, and ":<path>" or
+// ":<n>:<path>" the index entry at the stage n.
+func ResolveRevision(repo *Repo, name, typ string) (string, error) {
+	sha, err := resolveRevision(repo, name)
+	if err != nil {
+		return "", err
 	}
-	sha := ss[0]
+	return peel(repo, sha, typ, name)
+}
+
+// peel chases sha until an object with the type is found.
+// If typ is "" sha is returned as is.
+func peel(repo *Repo, sha, typ, name string) (string, error) {
 	for {
+		if typ == "" {
+			return sha, nil
+		}
 		o, err := ReadObject(repo, sha)
 		if err != nil {
-			return nil, err
+			return "", err
 		}
-		if typ == "" || o.Type == typ {
-			return o, nil
+		if o.Type == typ {
+			return sha, nil
 		}
 		switch o.Type {
 		case "tag":
@@ -87,85 +106,175 @@ func FindObject(repo *Repo, name, typ string) (*Object, error) {
 		case "commit":
 			sha = o.KVLM.Get("tree")[0]
 		default:
-			return nil, fmt.Errorf("found no object of type %s for %s", typ, name)
+			return "", fmt.Errorf("found no object of type %s for %s", typ, name)
 		}
 	}
 }
 
-var shortHashRE = regexp.MustCompile("^[0-9A-Fa-f]{4,16}$")
+var shortHashRE = regexp.MustCompile("^[0-9A-Fa-f]{4,40}$")
 
 func findSHA(repo *Repo, name string) ([]string, error) {
-	if name == "HEAD" {
-		sha, err := resolveRef(repo, repo.path("HEAD"))
-		if err != nil {
+	if len(name) == 40 && shortHashRE.MatchString(name) {
+		return []string{strings.ToLower(name)}, nil
+	}
+	if name == "HEAD" || strings.HasPrefix(name, "refs/") || strings.HasSuffix(name, "_HEAD") {
+		if sha, err := ReadRef(repo, name); err == nil {
+			return []string{sha}, nil
+		} else if name == "HEAD" {
 			return nil, err
 		}
-		return []string{sha}, nil
 	}
-	if shortHashRE.MatchString(name) {
-		fs, err := filepath.Glob(fmt.Sprintf("%s/%s*", name[0:2], name[2:]))
+	var res []string
+	for _, p := range []string{"refs/heads/", "refs/tags/"} {
+		if sha, err := ReadRef(repo, p+name); err == nil {
+			res = append(res, sha)
+		}
+	}
+	if len(res) == 0 {
+		for _, p := range []string{"refs/%s", "refs/remotes/%s", "refs/remotes/%s/HEAD"} {
+			if sha, err := ReadRef(repo, fmt.Sprintf(p, name)); err == nil {
+				return []string{sha}, nil
+			}
+		}
+	}
+	if len(res) == 0 && shortHashRE.MatchString(name) {
+		name = strings.ToLower(name)
+		fs, err := filepath.Glob(repo.path("objects", name[0:2], name[2:]+"*"))
 		if err != nil {
 			return nil, err
 		}
-		var res []string
 		for _, f := range fs {
-			d := filepath.Dir(f)
-			res = append(res, d[len(d)-2:]+f[len(f)-18:])
+			res = append(res, name[0:2]+filepath.Base(f))
 		}
-		return res, nil
-	}
-	var res []string
-	s, err := resolveRef(repo, repo.path("refs", "heads", name))
-	if err == nil {
-		res = append(res, s)
-	}
-	s, err = resolveRef(repo, repo.path("refs", "tags", name))
-	if err == nil {
-		res = append(res, s)
+		packed, err := packedSHAs(repo)
+		if err != nil {
+			return nil, err
+		}
+		for _, sha := range packed {
+			if strings.HasPrefix(sha, name) {
+				res = append(res, sha)
+			}
+		}
+		sort.Strings(res)
+		res = dedupSorted(res)
 	}
 	return res, nil
 }
 
 // ReadObject reads object for the hash.
 func ReadObject(repo *Repo, sha string) (*Object, error) {
+	typ, data, err := ReadRawObject(repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case "commit":
+		return newCommit(repo).Decode(data)
+	case "tree":
+		return newTree(repo).Decode(data)
+	case "tag":
+		return newTag(repo).Decode(data)
+	case "blob":
+		return newBlob(repo).Decode(data)
+	default:
+		return nil, fmt.Errorf("Unknown type %s for object %s", typ, sha)
+	}
+}
+
+// ReadRawObject reads the type and the content of the object for the hash without decoding it.
+// In a partial clone, an object missing locally is fetched from the promisor remote if sha
+// is a full hash; other names are not sent to the remote.
+func ReadRawObject(repo *Repo, sha string) (string, []byte, error) {
+	typ, data, err := readRawObject(repo, sha)
+	if os.IsNotExist(err) && len(sha) == 40 && shortHashRE.MatchString(sha) && promisorRemote(repo) != "" && !repo.fetchingPromised {
+		if err := fetchPromisedObjects(repo, []string{sha}); err != nil {
+			return "", nil, fmt.Errorf("could not fetch %s from promisor remote: %v", sha, err)
+		}
+		return readRawObject(repo, sha)
+	}
+	return typ, data, err
+}
+
+// readRawObject is ReadRawObject which does not fetch missing objects.
+func readRawObject(repo *Repo, sha string) (string, []byte, error) {
+	if len(sha) < 3 {
+		return "", nil, fmt.Errorf("invalid object name %s", sha)
+	}
 	path := repo.path("objects", sha[0:2], sha[2:])
 
 	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		if typ, data, ok, perr := readPackedObject(repo, sha); perr != nil {
+			return "", nil, perr
+		} else if ok {
+			return typ, data, nil
+		}
+	}
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
+	defer f.Close()
 	rc, err := zlib.NewReader(f)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 	defer rc.Close()
 	b, err := ioutil.ReadAll(rc)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 	x := bytes.IndexByte(b, ' ')
+	y := bytes.IndexByte(b, '\x00')
+	if x < 0 || y < x {
+		return "", nil, fmt.Errorf("Malformed object %s: bad header", sha)
+	}
 	typ := string(b[0:x])
-
-	y := bytes.IndexByte(b[x:], '\x00') + x
 	size, err := strconv.Atoi(string(b[x+1 : y]))
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 	if size != len(b)-y-1 {
-		return nil, fmt.Errorf("Malformed object %s: bad length", sha)
+		return "", nil, fmt.Errorf("Malformed object %s: bad length", sha)
 	}
-	switch typ {
-	case "commit":
-		return newCommit(repo).Decode(b[y+1:])
-	case "tree":
-		return newTree(repo).Decode(b[y+1:])
-	case "tag":
-		return newTag(repo).Decode(b[y+1:])
-	case "blob":
-		return newBlob(repo).Decode(b[y+1:])
-	default:
-		return nil, fmt.Errorf("Unknown type %s for object %s", typ, sha)
+	return typ, b[y+1:], nil
+}
+
+// ObjectSHAs returns the SHAs of all the objects in the repository in sorted order.
+func ObjectSHAs(repo *Repo) ([]string, error) {
+	dirs, err := filepath.Glob(repo.path("objects", "[0-9a-f][0-9a-f]"))
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, d := range dirs {
+		fs, err := ioutil.ReadDir(d)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fs {
+			if sha := filepath.Base(d) + f.Name(); len(sha) == 40 && shortHashRE.MatchString(sha) {
+				res = append(res, sha)
+			}
+		}
+	}
+	packed, err := packedSHAs(repo)
+	if err != nil {
+		return nil, err
+	}
+	res = append(res, packed...)
+	sort.Strings(res)
+	return dedupSorted(res), nil
+}
+
+// dedupSorted removes the duplicates from the sorted strings.
+func dedupSorted(ss []string) []string {
+	var res []string
+	for i, s := range ss {
+		if i == 0 || s != ss[i-1] {
+			res = append(res, s)
+		}
 	}
+	return res
 }
 
 // ObjectHash computes object hash from the data, if repo is not nil stores the object into repo.
@@ -322,6 +431,14 @@ func findRepo(path string) (string, error) {
 type Repo struct {
 	worktree, gitDir string
 	conf             *ini.File
+	// bare is true if gitDir is the repository itself, with no worktree.
+	bare bool
+	// packs are the packs in objects/pack, nil until read.
+	packs []*packFile
+	// shallow are the commits in the shallow file, nil until read.
+	shallow map[string]bool
+	// fetchingPromised is true while missing objects are fetched from the promisor remote.
+	fetchingPromised bool
 }
 
 // NewRepo reads or creates a repository.
@@ -330,47 +447,103 @@ func NewRepo(path string, create bool) (*Repo, error) {
 		worktree: path,
 		gitDir:   filepath.Join(path, ".git"),
 	}
-
 	if create {
-		var err error
-		mkdir := func(elem ...string) {
-			if err != nil {
-				return
-			}
-			err = os.MkdirAll(r.path(elem...), 0755)
-		}
-		mkdir()
-		mkdir("objects")
-		mkdir("refs", "tags")
-		mkdir("refs", "heads")
-		if err != nil {
+		if err := r.init(); err != nil {
 			return nil, err
 		}
-		if err := ioutil.WriteFile(r.path("description"), []byte("Unnamed repository; edit this file 'description' to name the repository.\n"), 0644); err != nil {
-			return nil, err
-		}
-		if err := ioutil.WriteFile(r.path("HEAD"), []byte("ref: refs/heads/master\n"), 0644); err != nil {
-			return nil, err
+	}
+	if _, err := os.Stat(r.gitDir); os.IsNotExist(err) && !create && isGitDir(path) {
+		if filepath.Base(filepath.Clean(path)) == ".git" {
+			// The git directory of a worktree.
+			r.worktree, r.gitDir = filepath.Dir(filepath.Clean(path)), path
+		} else {
+			r.worktree, r.gitDir, r.bare = "", path, true
 		}
-		if err := defaultConfig().SaveTo(r.path("config")); err != nil {
+	} else if err != nil {
+		return nil, err
+	}
+	return r, r.loadConfig()
+}
+
+// NewBareRepo reads or creates a bare repository, which has no worktree, at path.
+func NewBareRepo(path string, create bool) (*Repo, error) {
+	r := &Repo{gitDir: path, bare: true}
+	if create {
+		if err := r.init(); err != nil {
 			return nil, err
 		}
+	} else if !isGitDir(path) {
+		return nil, fmt.Errorf("not a git repository: %s", path)
 	}
+	return r, r.loadConfig()
+}
 
-	if _, err := os.Stat(r.gitDir); err != nil {
-		return nil, err
+// init creates the git directory.
+func (r *Repo) init() error {
+	var err error
+	mkdir := func(elem ...string) {
+		if err != nil {
+			return
+		}
+		err = os.MkdirAll(r.path(elem...), 0755)
+	}
+	mkdir()
+	mkdir("objects")
+	mkdir("refs", "tags")
+	mkdir("refs", "heads")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(r.path("description"), []byte("Unnamed repository; edit this file 'description' to name the repository.\n"), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(r.path("HEAD"), []byte("ref: refs/heads/master\n"), 0644); err != nil {
+		return err
+	}
+	conf := defaultConfig()
+	if r.bare {
+		conf.Section("core").Key("bare").SetValue("true")
 	}
-	cf := filepath.Join(r.gitDir, "config")
+	return conf.SaveTo(r.path("config"))
+}
+
+func (r *Repo) loadConfig() error {
 	var err error
-	r.conf, err = ini.Load(cf)
+	r.conf, err = ini.Load(r.path("config"))
 	if err != nil {
-		return nil, err
+		return err
+	}
+	switch vers := r.conf.Section("core").Key("repositoryformatversion").MustInt(); vers {
+	case 0:
+	case 1:
+		// Version 1 lists the extensions the repository needs.
+		for _, k := range r.conf.Section("extensions").Keys() {
+			if !knownExtensions[strings.ToLower(k.Name())] {
+				return fmt.Errorf("unknown repository extension found: %s", k.Name())
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported repositoryformatversion %d", vers)
 	}
-	if vers := r.conf.Section("core").Key("repositoryformatversion").MustInt(); vers != 0 {
-		return nil, fmt.Errorf("Unsupported repositoryformatversion %d", vers)
+	return nil
+}
+
+// knownExtensions are the repository extensions supported, in lower case.
+var knownExtensions = map[string]bool{"partialclone": true, "noop": true}
+
+// isGitDir reports whether dir looks like a git directory.
+func isGitDir(dir string) bool {
+	for _, f := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err != nil {
+			return false
+		}
 	}
+	return true
+}
 
-	return r, nil
+// Bare reports whether the repository has no worktree.
+func (r *Repo) Bare() bool {
+	return r.bare
 }
 
 func (r *Repo) path(elem ...string) string {
@@ -2,6 +2,13 @@ package git
 
 import (
 	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -38,3 +45,533 @@ func TestEncodeTree(t *testing.T) {
 		t.Errorf("(-got +want)\n%s", diff)
 	}
 }
+
+func TestIndex(t *testing.T) {
+	b, err := ioutil.ReadFile("../cmd/testdata/gitdir2/index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := parseIndex(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range idx.Entries {
+		got = append(got, fmt.Sprintf("%o %s %d %s", e.Mode, e.SHA, e.Size, e.Path))
+	}
+	want := []string{
+		"100644 2262de0c121f22df8e78f5a37d6e114fd322c0b0 5 a",
+		"100644 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 0 b",
+		"100644 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 0 c",
+		"100644 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 0 d/a",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("(-got +want)\n%s", diff)
+	}
+
+	idx2, err := parseIndex(encodeIndex(idx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(idx2, idx); diff != "" {
+		t.Errorf("(-got +want)\n%s", diff)
+	}
+}
+
+func TestMatchPathspec(t *testing.T) {
+	for _, tc := range []struct {
+		spec, path string
+		want       bool
+	}{
+		{"a", "a", true},
+		{"d", "d/a", true},
+		{"d/", "d/a", true},
+		{"d", "da", false},
+		{".", "d/a", true},
+		{"*.go", "cmd/main.go", true},
+		{"*.go", "main.go.txt", false},
+		{"cmd/*", "cmd/d/x", true},
+		{"[bc]", "b", true},
+		{"[!bc]", "b", false},
+		{"?", "d/a", true},
+		{"x?", "d/a", false},
+	} {
+		if got := MatchPathspec([]string{tc.spec}, tc.path); got != tc.want {
+			t.Errorf("MatchPathspec(%q, %q) = %v; want %v", tc.spec, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestParseRenameScore(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want int
+	}{
+		{"", DefaultRenameScore},
+		{"90%", MaxScore * 9 / 10},
+		{"5", MaxScore / 2},
+		{"0.75", MaxScore * 3 / 4},
+		{".3", MaxScore * 3 / 10},
+		{"100%", MaxScore},
+		{"150%", MaxScore},
+	} {
+		got, err := ParseRenameScore(tc.s)
+		if err != nil {
+			t.Errorf("ParseRenameScore(%q): %v", tc.s, err)
+		} else if got != tc.want {
+			t.Errorf("ParseRenameScore(%q) = %d; want %d", tc.s, got, tc.want)
+		}
+	}
+	if _, err := ParseRenameScore("5x"); err == nil {
+		t.Error("ParseRenameScore(\"5x\") succeeded unexpectedly")
+	}
+}
+
+func TestDetectRenames(t *testing.T) {
+	lines := func(from, to int, extra string) string {
+		var b strings.Builder
+		for i := from; i <= to; i++ {
+			fmt.Fprintln(&b, i)
+		}
+		return b.String() + extra
+	}
+	contents := map[string]string{
+		"a":  "same\n",
+		"c":  lines(1, 20, ""),
+		"d":  lines(1, 19, "x\n"),
+		"e":  lines(1, 10, ""),
+		"e2": lines(1, 10, "y\n"),
+		"e'": lines(1, 10, "y\n"),
+		"f":  "unrelated\n",
+	}
+	leaf := func(p, content string) *TreeLeaf {
+		sha, err := ObjectHash([]byte(contents[content]), "blob", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &TreeLeaf{"100644", p, sha}
+	}
+	changes := []*Change{
+		{Status: 'D', From: leaf("a", "a")},
+		{Status: 'A', To: leaf("b/a", "a")},
+		{Status: 'D', From: leaf("c", "c")},
+		{Status: 'A', To: leaf("d", "d")},
+		{Status: 'M', From: leaf("e", "e"), To: leaf("e", "e'")},
+		{Status: 'A', To: leaf("e2", "e2")},
+		{Status: 'A', To: leaf("f", "f")},
+	}
+	read := func(l *TreeLeaf) ([]byte, error) {
+		for k, v := range contents {
+			if l.SHA == leaf("", k).SHA {
+				return []byte(v), nil
+			}
+		}
+		return nil, fmt.Errorf("unknown blob %s", l.SHA)
+	}
+	format := func(cs []*Change) []string {
+		var res []string
+		for _, c := range cs {
+			s := fmt.Sprintf("%c", c.Status)
+			if c.Status == 'R' || c.Status == 'C' {
+				s += fmt.Sprintf("%03d %s", c.Score*100/MaxScore, c.From.Path)
+			}
+			res = append(res, s+" "+c.Path())
+		}
+		return res
+	}
+
+	got, err := DetectRenames(nil, changes, &RenameOptions{ReadOld: read, ReadNew: read})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"R100 a b/a", "R094 c d", "M e", "A e2", "A f"}
+	if diff := cmp.Diff(format(got), want); diff != "" {
+		t.Errorf("renames: (-got +want)\n%s", diff)
+	}
+
+	got, err = DetectRenames(nil, changes, &RenameOptions{Copies: true, ReadOld: read, ReadNew: read})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"R100 a b/a", "R094 c d", "M e", "C091 e e2", "A f"}
+	if diff := cmp.Diff(format(got), want); diff != "" {
+		t.Errorf("copies: (-got +want)\n%s", diff)
+	}
+
+	got, err = DetectRenames(nil, changes, &RenameOptions{MinScore: MaxScore * 95 / 100, ReadOld: read, ReadNew: read})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"R100 a b/a", "D c", "A d", "M e", "A e2", "A f"}
+	if diff := cmp.Diff(format(got), want); diff != "" {
+		t.Errorf("-M95%%: (-got +want)\n%s", diff)
+	}
+}
+
+func TestMergeTrees(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	r, err := NewRepo(td, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := func(from, to int, extra string) string {
+		var b strings.Builder
+		for i := from; i <= to; i++ {
+			fmt.Fprintln(&b, i)
+		}
+		return b.String() + extra
+	}
+	tree := func(files map[string]string) string {
+		leaves := make(map[string]*TreeLeaf)
+		for p, c := range files {
+			sha, err := ObjectHash([]byte(c), "blob", r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaves[p] = &TreeLeaf{"100644", p, sha}
+		}
+		sha, err := BuildTree(r, leaves)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sha
+	}
+	base := tree(map[string]string{"a": "1\n2\n3\n", "b": "b\n", "r": lines(1, 20, ""), "f": "f\n"})
+	ours := tree(map[string]string{"a": "1\ntwo\n3\n", "r2": lines(1, 20, "ours\n"), "f": "f2\n"})
+	theirs := tree(map[string]string{"a": "1\nTWO\n3\n", "b": "b2\n", "r": lines(0, 20, ""), "f/g": "g\n"})
+
+	res, err := MergeTrees(r, base, ours, theirs, &MergeOptions{OursLabel: "HEAD", TheirsLabel: "topic"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range res.Conflicts {
+		got = append(got, c.Kind+" "+c.Path)
+	}
+	want := []string{"content a", "modify/delete b", "file/directory f~HEAD", "modify/delete f~HEAD"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("conflicts: (-got +want)\n%s", diff)
+	}
+	wantMsgs := []string{
+		"Auto-merging a",
+		"CONFLICT (content): Merge conflict in a",
+		"CONFLICT (modify/delete): b deleted in HEAD and modified in topic.  Version topic of b left in tree.",
+		"CONFLICT (file/directory): directory in the way of f from HEAD; moving it to f~HEAD instead.",
+		"CONFLICT (modify/delete): f~HEAD deleted in topic and modified in HEAD.  Version HEAD of f~HEAD left in tree.",
+		"Auto-merging r2",
+	}
+	if diff := cmp.Diff(res.Messages, wantMsgs); diff != "" {
+		t.Errorf("messages: (-got +want)\n%s", diff)
+	}
+
+	entries, err := TreeEntries(r, res.Tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string]string)
+	for p, l := range entries {
+		o, err := ReadObject(r, l.SHA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[p] = string(o.Blob)
+	}
+	wantContents := map[string]string{
+		"a":      "1\n<<<<<<< HEAD\ntwo\n=======\nTWO\n>>>>>>> topic\n3\n",
+		"b":      "b2\n",
+		"f/g":    "g\n",
+		"f~HEAD": "f2\n",
+		"r2":     lines(0, 20, "ours\n"),
+	}
+	if diff := cmp.Diff(contents, wantContents); diff != "" {
+		t.Errorf("contents: (-got +want)\n%s", diff)
+	}
+}
+
+func TestMergeBases(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	r, err := NewRepo(td, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := BuildTree(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(msg string, parents ...string) string {
+		sha, err := CommitTree(r, tree, parents, msg+"\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sha
+	}
+	// A criss-cross merge.
+	root := commit("root")
+	a1, b1 := commit("a1", root), commit("b1", root)
+	a3 := commit("a3", commit("a2", a1, b1))
+	b3 := commit("b3", commit("b2", b1, a1))
+	c := commit("c", root)
+
+	got, err := MergeBases(r, a3, b3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	want := []string{a1, b1}
+	sort.Strings(want)
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("MergeBases: (-got +want)\n%s", diff)
+	}
+	if got, err := MergeBase(r, a3, c); err != nil || got != root {
+		t.Errorf("MergeBase(a3, c) = %q, %v; want %q", got, err, root)
+	}
+	if got, err := OctopusMergeBases(r, []string{a3, b3, c}); err != nil || !cmp.Equal(got, []string{root}) {
+		t.Errorf("OctopusMergeBases = %q, %v; want [%q]", got, err, root)
+	}
+	for _, tc := range []struct {
+		a, b string
+		want bool
+	}{{root, a3, true}, {a3, a3, true}, {a1, b3, true}, {a3, b3, false}, {c, a3, false}} {
+		if got, err := IsAncestor(r, tc.a, tc.b); err != nil || got != tc.want {
+			t.Errorf("IsAncestor(%s, %s) = %v, %v; want %v", tc.a, tc.b, got, err, tc.want)
+		}
+	}
+
+	// Long histories forking long ago.
+	x, y := a3, b3
+	for i := 0; i < 1000; i++ {
+		x, y = commit(fmt.Sprint("x", i), x), commit(fmt.Sprint("y", i), y)
+	}
+	if got, err := MergeBases(r, x, y); err != nil || len(got) != 2 {
+		t.Errorf("MergeBases(x, y) = %q, %v; want [a1 b1]", got, err)
+	}
+	if got, err := MergeBase(r, x, commit("z", c)); err != nil || got != root {
+		t.Errorf("MergeBase(x, z) = %q, %v; want %q", got, err, root)
+	}
+}
+
+func TestRefspec(t *testing.T) {
+	for _, tc := range []struct {
+		spec, name, want string
+		ok               bool
+	}{
+		{"+refs/heads/*:refs/remotes/origin/*", "refs/heads/a/b", "refs/remotes/origin/a/b", true},
+		{"+refs/heads/*:refs/remotes/origin/*", "refs/tags/v1", "", false},
+		{"refs/heads/*-x:refs/x/*", "refs/heads/a-x", "refs/x/a", true},
+		{"refs/heads/*-x:refs/x/*", "refs/heads/-", "", false},
+		{"+refs/heads/main:refs/remotes/origin/main", "refs/heads/main", "refs/remotes/origin/main", true},
+		{"+refs/heads/main:refs/remotes/origin/main", "refs/heads/mainline", "", false},
+	} {
+		rs, err := ParseRefspec(tc.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := rs.match(tc.name); got != tc.want || ok != tc.ok {
+			t.Errorf("%s.match(%s) = %q, %v; want %q, %v", tc.spec, tc.name, got, ok, tc.want, tc.ok)
+		}
+		if got := rs.String(); got != tc.spec {
+			t.Errorf("String() = %q; want %q", got, tc.spec)
+		}
+	}
+	for _, s := range []string{"", "+", "refs/*/*:refs/*", "refs/heads/*:refs/x", "a:b*"} {
+		if _, err := ParseRefspec(s); err == nil {
+			t.Errorf("ParseRefspec(%q) succeeded", s)
+		}
+	}
+}
+
+func TestCheckRefName(t *testing.T) {
+	for _, name := range []string{"HEAD", "refs/heads/master", "refs/tags/v1.0", "refs/heads/a-b_c/d"} {
+		if err := checkRefName(name); err != nil {
+			t.Errorf("checkRefName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "master", "refs/heads/../x", "refs//x", "refs/heads/", "refs/heads/.x", "refs/heads/x.lock", "refs/heads/x.", "refs/heads/a\x01", "refs/heads/a b", "refs/heads/a~1", "refs/heads/a:b", "refs/heads/*", "refs/heads/a@{1}"} {
+		if err := checkRefName(name); err == nil {
+			t.Errorf("checkRefName(%q) succeeded", name)
+		}
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want objectFilter
+	}{
+		{"blob:none", objectFilter{blobLimit: 0, treeDepth: -1}},
+		{"blob:limit=100", objectFilter{blobLimit: 100, treeDepth: -1}},
+		{"blob:limit=2k", objectFilter{blobLimit: 2 << 10, treeDepth: -1}},
+		{"blob:limit=1M", objectFilter{blobLimit: 1 << 20, treeDepth: -1}},
+		{"tree:0", objectFilter{blobLimit: -1, treeDepth: 0}},
+		{"tree:3", objectFilter{blobLimit: -1, treeDepth: 3}},
+	} {
+		f, err := parseFilter(tc.spec)
+		if err != nil {
+			t.Errorf("parseFilter(%q): %v", tc.spec, err)
+			continue
+		}
+		if *f != tc.want {
+			t.Errorf("parseFilter(%q) = %+v; want %+v", tc.spec, *f, tc.want)
+		}
+	}
+	for _, s := range []string{"", "blob:limit=", "blob:limit=-1", "blob:limit=1x", "tree:", "tree:-1", "sparse:oid=x"} {
+		if _, err := parseFilter(s); err == nil {
+			t.Errorf("parseFilter(%q) succeeded", s)
+		}
+	}
+}
+
+func TestPromisedObjectNames(t *testing.T) {
+	td, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+	repo, err := NewRepo(td, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetConfig(repo, remoteSection("origin"), "url", "file://"+td+"/nope"); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPromisorRemote(repo, "origin", "tree:0"); err != nil {
+		t.Fatal(err)
+	}
+	// Only full hashes are fetched from the promisor remote.
+	for _, name := range []string{"HEAD", "refs/heads/master", "0123456"} {
+		if _, _, err := ReadRawObject(repo, name); !os.IsNotExist(err) {
+			t.Errorf("ReadRawObject(%q) = %v; want not found", name, err)
+		}
+	}
+	if _, _, err := ReadRawObject(repo, strings.Repeat("0", 40)); err == nil || !strings.Contains(err.Error(), "promisor remote") {
+		t.Errorf("ReadRawObject of a full hash = %v; want a failed fetch", err)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	attrs := parseAttributes([]byte("# comment\n*.txt text\n/root.txt -text\nsub/*.c export-ignore\ndocs/** export-ignore\n!neg x\ndir/ x\n"), "")
+	attrs = append(attrs, parseAttributes([]byte("*.txt !text\nx* v=1\n"), "d")...)
+	for _, tc := range []struct {
+		path, name, want string
+	}{
+		{"a.txt", "text", "set"},
+		{"e/a.txt", "text", "set"},
+		{"root.txt", "text", "unset"},
+		{"e/root.txt", "text", "set"},
+		{"sub/a.c", "export-ignore", "set"},
+		{"sub/e/a.c", "export-ignore", ""},
+		{"e/sub/a.c", "export-ignore", ""},
+		{"docs", "export-ignore", ""},
+		{"docs/a/b", "export-ignore", "set"},
+		{"d/a.txt", "text", ""},
+		{"d/e/xy", "v", "1"},
+		{"xy", "v", ""},
+		{"dir", "x", ""},
+	} {
+		if got := attrs.get(tc.path, tc.name); got != tc.want {
+			t.Errorf("attribute %s of %s = %q; want %q", tc.name, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestPack(t *testing.T) {
+	var repos []*Repo
+	for i := 0; i < 2; i++ {
+		td, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(td)
+		r, err := NewRepo(td, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repos = append(repos, r)
+	}
+	src, dst := repos[0], repos[1]
+	blob, err := ObjectHash([]byte("hello\n"), "blob", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := BuildTree(src, map[string]*TreeLeaf{"d/a": {"100644", "d/a", blob}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := CommitTree(src, tree, nil, "one\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shas, err := packObjects(src, []string{commit}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shas) != 4 {
+		t.Errorf("packObjects = %q; want 4 objects", shas)
+	}
+
+	var b bytes.Buffer
+	if err := WritePack(src, &b, shas); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IndexPack(dst, &b); err != nil {
+		t.Fatal(err)
+	}
+	for _, sha := range shas {
+		typ, data, err := ReadRawObject(dst, sha)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hashObject(typ, data); got != sha {
+			t.Errorf("object %s read from the pack hashes to %s", sha, got)
+		}
+	}
+
+	for _, name := range []string{"", ".", "..", ".git", ".GIT", "a/b"} {
+		tree := encodeTree(Tree{{"100644", name, blob}})
+		if err := checkObject("tree", tree); err == nil {
+			t.Errorf("checkObject accepts a tree entry named %q", name)
+		}
+	}
+
+	// A delta copying "hello" and inserting "!\n".
+	delta := []byte{6, 7, 0x90, 5, 2, '!', '\n'}
+	if got, err := applyDelta([]byte("hello\n"), delta); err != nil || string(got) != "hello!\n" {
+		t.Errorf("applyDelta = %q, %v; want %q", got, err, "hello!\n")
+	}
+	if _, err := applyDelta([]byte("hello\n"), []byte{6, 0xff, 0xff, 0xff, 0xff, 0x0f, 0x90, 5}); err == nil {
+		t.Errorf("applyDelta accepts a result size larger than the result")
+	}
+
+	// Malformed packs are refused without looping or allocating what their headers claim.
+	pack := func(count uint32, entry []byte) *bytes.Buffer {
+		var b bytes.Buffer
+		b.WriteString("PACK\x00\x00\x00\x02")
+		b.Write([]byte{byte(count >> 24), byte(count >> 16), byte(count >> 8), byte(count)})
+		b.Write(entry)
+		sum := sha1.Sum(b.Bytes())
+		b.Write(sum[:])
+		return &b
+	}
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(delta)
+	zw.Close()
+	// An ofs-delta of 7 bytes whose base is 0 bytes before it, i.e. itself.
+	selfDelta := append([]byte{6<<4 | 7, 0}, z.Bytes()...)
+	for name, b := range map[string]*bytes.Buffer{
+		"self-referential delta": pack(1, selfDelta),
+		"huge object count":      pack(0xffffffff, nil),
+	} {
+		if _, err := IndexPack(dst, b); err == nil {
+			t.Errorf("IndexPack accepts a pack with a %s", name)
+		}
+	}
+}
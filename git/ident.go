@@ -0,0 +1,173 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+// Config returns the value of the configuration section.key looking at the repository
+// config and then ~/.gitconfig, or "" if it is not set.
+// Subsections are written as in the config file, e.g. `remote "origin"`.
+func Config(repo *Repo, section, key string) string {
+	files := []*ini.File{repo.conf}
+	if home, err := os.UserHomeDir(); err == nil {
+		if f, err := ini.Load(filepath.Join(home, ".gitconfig")); err == nil {
+			files = append(files, f)
+		}
+	}
+	for _, f := range files {
+		if f == nil {
+			continue
+		}
+		s, err := f.GetSection(section)
+		if err != nil {
+			continue
+		}
+		// git config keys are case insensitive.
+		for _, k := range s.Keys() {
+			if strings.EqualFold(k.Name(), key) {
+				return k.String()
+			}
+		}
+	}
+	return ""
+}
+
+// SetConfig sets the configuration section.key in the repository config file.
+// Subsections are written as in the config file, e.g. `remote "origin"`.
+func SetConfig(repo *Repo, section, key, value string) error {
+	s := repo.conf.Section(section)
+	for _, k := range s.Keys() {
+		if strings.EqualFold(k.Name(), key) {
+			key = k.Name()
+		}
+	}
+	s.Key(key).SetValue(value)
+	return repo.conf.SaveToIndent(repo.path("config"), "\t")
+}
+
+// configBool returns the boolean value of the configuration section.key, or def if it is not set.
+func configBool(repo *Repo, section, key string, def bool) bool {
+	switch strings.ToLower(Config(repo, section, key)) {
+	case "true", "yes", "on", "1":
+		return true
+	case "false", "no", "off", "0":
+		return false
+	}
+	return def
+}
+
+// Signature returns the identity of the author or the committer with the current time
+// in the format used in commit objects, e.g. "A U Thor <author@example.com> 1584773498 +0900".
+// kind is either "author" or "committer". GIT_AUTHOR_{NAME,EMAIL,DATE} and
+// GIT_COMMITTER_{NAME,EMAIL,DATE} environment variables take precedence over user.name and user.email.
+func Signature(repo *Repo, kind string) string {
+	env := func(k string) string { return os.Getenv("GIT_" + strings.ToUpper(kind) + "_" + k) }
+	name, email := env("NAME"), env("EMAIL")
+	if name == "" {
+		name = Config(repo, "user", "name")
+	}
+	if email == "" {
+		email = Config(repo, "user", "email")
+	}
+	if name == "" || email == "" {
+		u, host := "unknown", "localhost"
+		if cu, err := user.Current(); err == nil {
+			u = cu.Username
+		}
+		if h, err := os.Hostname(); err == nil {
+			host = h
+		}
+		if name == "" {
+			name = u
+		}
+		if email == "" {
+			email = u + "@" + host
+		}
+	}
+	return fmt.Sprintf("%s <%s> %s", name, email, gitDate(env("DATE")))
+}
+
+// gitDate converts the date given in "<unix> <tz>" or "@<unix> <tz>" format into
+// the format used in commit objects. It returns the current time if date is empty or malformed.
+func gitDate(date string) string {
+	f := strings.Fields(strings.TrimPrefix(date, "@"))
+	if len(f) == 2 {
+		if _, err := strconv.ParseInt(f[0], 10, 64); err == nil {
+			return f[0] + " " + f[1]
+		}
+	}
+	return formatTime(time.Now())
+}
+
+// ParseDate parses a date given to an option: a Unix time, optionally prefixed with @,
+// an RFC 3339 date, or "YYYY-MM-DD[ HH:MM[:SS]][ -0700]" in the local time zone unless the
+// zone is given.
+func ParseDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(strings.TrimPrefix(s, "@"), 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05 -0700", "2006-01-02 15:04 -0700", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date '%s'", s)
+}
+
+func formatTime(t time.Time) string {
+	return fmt.Sprintf("%d %s", t.Unix(), t.Format("-0700"))
+}
+
+// Ident is an identity with a time, as in the author and committer lines of commits.
+type Ident struct {
+	Name, Email string
+	// When is in the time zone recorded with the identity.
+	When time.Time
+}
+
+// ParseIdent parses an identity in the format used in commit objects,
+// e.g. "A U Thor <author@example.com> 1584773498 +0900". A missing time is taken as
+// the Unix epoch in UTC as git does.
+func ParseIdent(s string) (*Ident, error) {
+	lt, gt := strings.Index(s, "<"), strings.LastIndex(s, ">")
+	if lt < 0 || gt < lt {
+		return nil, fmt.Errorf("malformed identity %q", s)
+	}
+	id := &Ident{Name: strings.TrimSpace(s[:lt]), Email: s[lt+1 : gt]}
+	f := strings.Fields(s[gt+1:])
+	if len(f) == 0 {
+		id.When = time.Unix(0, 0).UTC()
+		return id, nil
+	}
+	if len(f) != 2 {
+		return nil, fmt.Errorf("malformed identity %q", s)
+	}
+	sec, err := strconv.ParseInt(f[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed identity %q", s)
+	}
+	tz, err := strconv.Atoi(f[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed identity %q", s)
+	}
+	offset := (tz/100*60 + tz%100) * 60
+	id.When = time.Unix(sec, 0).In(time.FixedZone(f[1], offset))
+	return id, nil
+}
+
+// String returns the identity without the time, as in "A U Thor <author@example.com>".
+func (id *Ident) String() string {
+	return fmt.Sprintf("%s <%s>", id.Name, id.Email)
+}
@@ -0,0 +1,311 @@
+package git
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Index represents the git index file (a.k.a. the staging area).
+type Index struct {
+	Version uint32
+	Entries []*IndexEntry
+}
+
+// IndexEntry is an entry of Index.
+type IndexEntry struct {
+	CTime, MTime time.Time
+	Dev, Ino     uint32
+	// Mode is the file mode, e.g. 0100644, 0100755, 0120000 or 0160000.
+	Mode     uint32
+	UID, GID uint32
+	Size     uint32
+	SHA      string
+	// Stage is 0 for normal entries and 1 (base), 2 (ours) or 3 (theirs) for conflicted ones.
+	Stage int
+	Path  string
+}
+
+// TreeMode returns the mode of the entry as written in tree objects.
+func (e *IndexEntry) TreeMode() string {
+	return strconv.FormatUint(uint64(e.Mode), 8)
+}
+
+const (
+	indexFlagExtended = 0x4000
+	indexFlagStage    = 0x3000
+	indexNameMask     = 0xfff
+)
+
+// ReadIndex reads the index of the repository.
+// It returns an empty index if the index file does not exist.
+func ReadIndex(repo *Repo) (*Index, error) {
+	b, err := ioutil.ReadFile(repo.path("index"))
+	if os.IsNotExist(err) {
+		return &Index{Version: 2}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseIndex(b)
+}
+
+func parseIndex(b []byte) (*Index, error) {
+	if len(b) < 12+sha1.Size || string(b[0:4]) != "DIRC" {
+		return nil, errors.New("malformed index: bad signature")
+	}
+	sum := sha1.Sum(b[:len(b)-sha1.Size])
+	if !bytes.Equal(sum[:], b[len(b)-sha1.Size:]) {
+		return nil, errors.New("malformed index: bad checksum")
+	}
+	idx := &Index{Version: binary.BigEndian.Uint32(b[4:8])}
+	if idx.Version != 2 && idx.Version != 3 {
+		return nil, fmt.Errorf("unsupported index version %d", idx.Version)
+	}
+	n := int(binary.BigEndian.Uint32(b[8:12]))
+	pos := 12
+	for i := 0; i < n; i++ {
+		if pos+62 > len(b) {
+			return nil, errors.New("malformed index: truncated entry")
+		}
+		u32 := func(off int) uint32 { return binary.BigEndian.Uint32(b[pos+off:]) }
+		e := &IndexEntry{
+			CTime: time.Unix(int64(u32(0)), int64(u32(4))),
+			MTime: time.Unix(int64(u32(8)), int64(u32(12))),
+			Dev:   u32(16),
+			Ino:   u32(20),
+			Mode:  u32(24),
+			UID:   u32(28),
+			GID:   u32(32),
+			Size:  u32(36),
+			SHA:   hex.EncodeToString(b[pos+40 : pos+60]),
+		}
+		flags := binary.BigEndian.Uint16(b[pos+60:])
+		e.Stage = int(flags&indexFlagStage) >> 12
+		start := pos + 62
+		if flags&indexFlagExtended != 0 {
+			start += 2
+		}
+		end := bytes.IndexByte(b[start:], 0)
+		if end < 0 {
+			return nil, errors.New("malformed index: unterminated path")
+		}
+		e.Path = string(b[start : start+end])
+		idx.Entries = append(idx.Entries, e)
+		// Entries are padded with 1-8 NULs to a multiple of 8 bytes.
+		pos += (start + end - pos + 8) &^ 7
+	}
+	// Extensions follow the entries. Optional ones (starting with an upper case letter)
+	// are cache data git can rebuild, so they are dropped.
+	for pos < len(b)-sha1.Size {
+		sig := b[pos : pos+4]
+		size := int(binary.BigEndian.Uint32(b[pos+4:]))
+		if sig[0] < 'A' || sig[0] > 'Z' {
+			return nil, fmt.Errorf("unsupported index extension %s", sig)
+		}
+		pos += 8 + size
+	}
+	return idx, nil
+}
+
+// WriteIndex writes the index to the repository, sorting its entries.
+func WriteIndex(repo *Repo, idx *Index) error {
+	return writeFile(encodeIndex(idx), repo.path("index"))
+}
+
+func encodeIndex(idx *Index) []byte {
+	idx.sort()
+	version := uint32(2)
+	var b bytes.Buffer
+	b.WriteString("DIRC")
+	binary.Write(&b, binary.BigEndian, version)
+	binary.Write(&b, binary.BigEndian, uint32(len(idx.Entries)))
+	for _, e := range idx.Entries {
+		start := b.Len()
+		for _, v := range []uint32{
+			uint32(e.CTime.Unix()), uint32(e.CTime.Nanosecond()),
+			uint32(e.MTime.Unix()), uint32(e.MTime.Nanosecond()),
+			e.Dev, e.Ino, e.Mode, e.UID, e.GID, e.Size,
+		} {
+			binary.Write(&b, binary.BigEndian, v)
+		}
+		sha, _ := hex.DecodeString(e.SHA)
+		b.Write(sha)
+		n := len(e.Path)
+		if n > indexNameMask {
+			n = indexNameMask
+		}
+		binary.Write(&b, binary.BigEndian, uint16(e.Stage<<12|n))
+		b.WriteString(e.Path)
+		b.Write(make([]byte, 8-(b.Len()-start)%8))
+	}
+	idx.Version = version
+	sum := sha1.Sum(b.Bytes())
+	b.Write(sum[:])
+	return b.Bytes()
+}
+
+func (idx *Index) sort() {
+	sort.SliceStable(idx.Entries, func(i, j int) bool {
+		a, b := idx.Entries[i], idx.Entries[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Stage < b.Stage
+	})
+}
+
+// Entry returns the stage 0 entry for the path, or nil if it does not exist.
+// Entries must be sorted.
+func (idx *Index) Entry(path string) *IndexEntry {
+	if es := idx.entries(path); len(es) > 0 && es[0].Stage == 0 {
+		return es[0]
+	}
+	return nil
+}
+
+// entries returns all the entries for the path, ordered by stage.
+func (idx *Index) entries(path string) []*IndexEntry {
+	i := sort.Search(len(idx.Entries), func(i int) bool { return idx.Entries[i].Path >= path })
+	j := i
+	for j < len(idx.Entries) && idx.Entries[j].Path == path {
+		j++
+	}
+	return idx.Entries[i:j]
+}
+
+// Add adds the entry to the index, replacing all the existing entries for the same path.
+func (idx *Index) Add(e *IndexEntry) {
+	idx.Remove(e.Path)
+	idx.Entries = append(idx.Entries, e)
+	idx.sort()
+}
+
+// Remove removes all the entries for the path.
+func (idx *Index) Remove(path string) {
+	var es []*IndexEntry
+	for _, e := range idx.Entries {
+		if e.Path != path {
+			es = append(es, e)
+		}
+	}
+	idx.Entries = es
+}
+
+// update replaces all the entries for the paths in m with the entry in m,
+// or removes them if the entry is nil.
+func (idx *Index) update(m map[string]*IndexEntry) {
+	var es []*IndexEntry
+	for _, e := range idx.Entries {
+		if _, ok := m[e.Path]; !ok {
+			es = append(es, e)
+		}
+	}
+	for _, e := range m {
+		if e != nil {
+			es = append(es, e)
+		}
+	}
+	idx.Entries = es
+	idx.sort()
+}
+
+// Unmerged returns the paths having conflicted entries, sorted.
+func (idx *Index) Unmerged() []string {
+	var res []string
+	for _, e := range idx.Entries {
+		if e.Stage != 0 && (len(res) == 0 || res[len(res)-1] != e.Path) {
+			res = append(res, e.Path)
+		}
+	}
+	return res
+}
+
+// WriteTree stores the trees for the index and returns the SHA of the root tree.
+func WriteTree(repo *Repo, idx *Index) (string, error) {
+	if u := idx.Unmerged(); len(u) > 0 {
+		return "", fmt.Errorf("%s: unmerged entry", u[0])
+	}
+	leaves := make(map[string]*TreeLeaf)
+	for _, e := range idx.Entries {
+		leaves[e.Path] = &TreeLeaf{e.TreeMode(), e.Path, e.SHA}
+	}
+	return BuildTree(repo, leaves)
+}
+
+// BuildTree stores the trees containing the non-tree entries keyed by their full slash
+// separated path, as returned by TreeEntries, and returns the SHA of the root tree.
+func BuildTree(repo *Repo, leaves map[string]*TreeLeaf) (string, error) {
+	// dirs maps a directory path ("" for the root) to its direct entries.
+	dirs := map[string]Tree{"": nil}
+	var addDir func(d string)
+	addDir = func(d string) {
+		if _, ok := dirs[d]; ok {
+			return
+		}
+		dirs[d] = nil
+		parent, name := splitPath(d)
+		addDir(parent)
+		dirs[parent] = append(dirs[parent], &TreeLeaf{"40000", name, ""})
+	}
+	for p, l := range leaves {
+		d, name := splitPath(p)
+		addDir(d)
+		dirs[d] = append(dirs[d], &TreeLeaf{l.Mode, name, l.SHA})
+	}
+	var write func(d string) (string, error)
+	write = func(d string) (string, error) {
+		t := dirs[d]
+		for _, l := range t {
+			if l.Mode != "40000" {
+				continue
+			}
+			sha, err := write(joinPath(d, l.Path))
+			if err != nil {
+				return "", err
+			}
+			l.SHA = sha
+		}
+		sortTree(t)
+		o := newTree(repo)
+		o.Tree = t
+		return o.HashData(true)
+	}
+	return write("")
+}
+
+// splitPath splits the slash separated path into its directory ("" for the root) and name.
+func splitPath(p string) (dir, name string) {
+	i := strings.LastIndexByte(p, '/')
+	if i < 0 {
+		return "", p
+	}
+	return p[:i], p[i+1:]
+}
+
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// sortTree sorts the tree entries in the git order, where directories are compared
+// as if their names had a trailing slash.
+func sortTree(t Tree) {
+	key := func(l *TreeLeaf) string {
+		if l.Mode == "40000" {
+			return l.Path + "/"
+		}
+		return l.Path
+	}
+	sort.Slice(t, func(i, j int) bool { return key(t[i]) < key(t[j]) })
+}
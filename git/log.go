@@ -0,0 +1,244 @@
+package git
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+)
+
+// LogPath calls fn for each commit reachable from the commit sha which changes the file at the
+// path, newest first by committer date, with the path of the file in the commit. As in git log,
+// a merge which has the same file as one of its parents is not reported, and only that parent
+// is followed. With follow, the file is followed across renames detected by DetectRenames, so
+// the path passed to fn changes to the old name when the commit renaming the file is reached.
+func LogPath(repo *Repo, sha, path string, follow bool, fn func(commit, path string) error) error {
+	q := &commitQueue{}
+	paths := map[string]string{sha: path}
+	push := func(sha string) error {
+		t, err := commitTime(repo, sha)
+		if err != nil {
+			return err
+		}
+		heap.Push(q, &queuedCommit{sha, t, len(paths)})
+		return nil
+	}
+	if err := push(sha); err != nil {
+		return err
+	}
+	seen := map[string]bool{sha: true}
+	for q.Len() > 0 {
+		c := heap.Pop(q).(*queuedCommit).sha
+		p := paths[c]
+		parents, next, changed, err := followParents(repo, c, p, follow)
+		if err != nil {
+			return err
+		}
+		if changed {
+			if err := fn(c, p); err != nil {
+				return err
+			}
+		}
+		for i, pa := range parents {
+			if seen[pa] {
+				continue
+			}
+			seen[pa] = true
+			paths[pa] = next[i]
+			if err := push(pa); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RevList returns the commits reachable from any of include but not from any of exclude,
+// newest first by committer date, as git rev-list include... ^exclude... does.
+func RevList(repo *Repo, include, exclude []string) ([]string, error) {
+	return revList(repo, include, exclude, nil)
+}
+
+// revList is RevList which does not walk the parents of the shallow commits.
+func revList(repo *Repo, include, exclude []string, shallow map[string]bool) ([]string, error) {
+	g := newCommitGraph(repo)
+	g.shallow = shallow
+	uninteresting := make(map[string]bool)
+	seen := make(map[string]bool)
+	var q commitQueue
+	push := func(sha string) error {
+		if err := g.load(sha); err != nil {
+			return err
+		}
+		seen[sha] = true
+		heap.Push(&q, &queuedCommit{sha, g.times[sha], len(seen)})
+		return nil
+	}
+	for _, c := range exclude {
+		uninteresting[c] = true
+		if !seen[c] {
+			if err := push(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, c := range include {
+		if !seen[c] {
+			if err := push(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	interesting := func() bool {
+		for _, c := range q {
+			if !uninteresting[c.sha] {
+				return true
+			}
+		}
+		return false
+	}
+	var res []string
+	// The walk goes on while commits as old as those listed are left, which may be found
+	// uninteresting through commits not walked yet.
+	oldest := int64(math.MaxInt64)
+	for interesting() || len(q) > 0 && q[0].time >= oldest {
+		c := heap.Pop(&q).(*queuedCommit).sha
+		if !uninteresting[c] {
+			res = append(res, c)
+			if g.times[c] < oldest {
+				oldest = g.times[c]
+			}
+		}
+		for _, p := range g.parents[c] {
+			if uninteresting[c] {
+				uninteresting[p] = true
+			}
+			if !seen[p] {
+				if err := push(p); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	// A commit older than its ancestors may be found uninteresting after it is listed.
+	var out []string
+	for _, c := range res {
+		if !uninteresting[c] {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// followParents returns the parents of the commit in which the file at the path is to be followed
+// with its paths in them, and whether the commit changes the file.
+func followParents(repo *Repo, sha, path string, follow bool) (parents, paths []string, changed bool, err error) {
+	tree, err := TreeSHA(repo, sha)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	ps, err := Parents(repo, sha)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if len(ps) == 0 {
+		m, err := TreeEntries(repo, tree)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		_, ok := m[path]
+		return nil, nil, ok, nil
+	}
+	opts := &DiffTreeOptions{Recursive: true, Pathspecs: []string{path}}
+	for _, p := range ps {
+		pt, err := TreeSHA(repo, p)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		cs, err := DiffTrees(repo, pt, tree, opts)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if len(cs) == 0 {
+			// The commit has the same file as the parent.
+			return []string{p}, []string{path}, false, nil
+		}
+		from := path
+		if added := len(cs) == 1 && cs[0].Status == 'A'; added {
+			if from, err = renameSource(repo, pt, tree, path, follow); err != nil {
+				return nil, nil, false, err
+			}
+		}
+		if from != "" {
+			parents = append(parents, p)
+			paths = append(paths, from)
+		}
+	}
+	return parents, paths, true, nil
+}
+
+// renameSource returns the path from which the file at the path in the tree b is renamed in
+// the tree a, or "" if it is not renamed or follow is false.
+func renameSource(repo *Repo, a, b, path string, follow bool) (string, error) {
+	if !follow {
+		return "", nil
+	}
+	cs, err := DiffTrees(repo, a, b, &DiffTreeOptions{Recursive: true})
+	if err != nil {
+		return "", err
+	}
+	if cs, err = DetectRenames(repo, cs, nil); err != nil {
+		return "", err
+	}
+	for _, c := range cs {
+		if c.Status == 'R' && c.To.Path == path {
+			return c.From.Path, nil
+		}
+	}
+	return "", nil
+}
+
+// commitTime returns the committer time of the commit in Unix seconds.
+func commitTime(repo *Repo, sha string) (int64, error) {
+	o, err := ReadObject(repo, sha)
+	if err != nil {
+		return 0, err
+	}
+	if o.Type != "commit" {
+		return 0, fmt.Errorf("%s is a %s, not a commit", sha, o.Type)
+	}
+	cs := o.KVLM.Get("committer")
+	if len(cs) == 0 {
+		return 0, fmt.Errorf("commit %s has no committer", sha)
+	}
+	id, err := ParseIdent(cs[0])
+	if err != nil {
+		return 0, err
+	}
+	return id.When.Unix(), nil
+}
+
+type queuedCommit struct {
+	sha  string
+	time int64
+	// seq orders the commits of the same time by when they are queued.
+	seq int
+}
+
+// commitQueue is a priority queue of commits, the newest first.
+type commitQueue []*queuedCommit
+
+func (q commitQueue) Len() int { return len(q) }
+func (q commitQueue) Less(i, j int) bool {
+	if q[i].time != q[j].time {
+		return q[i].time > q[j].time
+	}
+	return q[i].seq < q[j].seq
+}
+func (q commitQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x interface{}) { *q = append(*q, x.(*queuedCommit)) }
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
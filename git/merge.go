@@ -0,0 +1,934 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ogiekako/gogit/diff"
+)
+
+// MergeOptions configures MergeTrees.
+type MergeOptions struct {
+	// OursLabel and TheirsLabel name the sides in conflict markers and messages, as in "HEAD"
+	// and a branch name. BaseLabel names the base in the diff3 and zdiff3 styles.
+	OursLabel, BaseLabel, TheirsLabel string
+	// Style and Favor configure the line-level merge of contents.
+	Style diff.MergeStyle
+	Favor diff.Favor
+	// Diff configures the diffs of the line-level merge.
+	Diff diff.Options
+	// NoRenames disables rename detection. Otherwise renames are detected on both sides with
+	// Renames, which may be nil for the defaults. Copies are not detected.
+	NoRenames bool
+	Renames   *RenameOptions
+}
+
+// Conflict kinds.
+const (
+	ConflictContent       = "content"
+	ConflictAddAdd        = "add/add"
+	ConflictModifyDelete  = "modify/delete"
+	ConflictRenameRename  = "rename/rename"
+	ConflictRenameDelete  = "rename/delete"
+	ConflictFileDirectory = "file/directory"
+)
+
+// Conflict is a path MergeTrees could not merge cleanly.
+type Conflict struct {
+	// Kind is one of the Conflict* constants.
+	Kind string
+	// Path is the path of the conflicted entry in the merged tree.
+	Path string
+	// Base, Ours and Theirs are the versions of the entry to be recorded as the index stages
+	// 1, 2 and 3 at their Path, which differ from each other for renames. They are nil if
+	// the entry does not exist on the side.
+	Base, Ours, Theirs *TreeLeaf
+	// Message is the message reported for the conflict, as in
+	// "CONFLICT (content): Merge conflict in a".
+	Message string
+}
+
+// MergeResult is the result of MergeTrees.
+type MergeResult struct {
+	// Tree is the SHA of the merged tree. Conflicted files are stored with conflict markers,
+	// or as our version if they cannot be merged line by line.
+	Tree string
+	// Conflicts are sorted by Path. The merge is clean if there are none.
+	Conflicts []*Conflict
+	// Messages are the messages of the merge, sorted by path, as in "Auto-merging a".
+	Messages []string
+}
+
+// MergeTrees merges the changes from the tree base to the trees ours and theirs, any of which
+// may be "" for an empty tree, as git's ort strategy does for a single merge base.
+// Files changed on both sides are merged line by line with diff.Merge3. Renames are followed
+// on both sides, but directory renames are not detected. A file in the way of a directory
+// from the other side is moved to path~label.
+func MergeTrees(repo *Repo, base, ours, theirs string, opts *MergeOptions) (*MergeResult, error) {
+	if opts == nil {
+		opts = &MergeOptions{}
+	}
+	m := &treeMerger{repo: repo, opts: opts, res: make(map[string]*TreeLeaf), msgs: make(map[string][]string)}
+	var err error
+	if m.base, err = TreeEntries(repo, base); err != nil {
+		return nil, err
+	}
+	if m.ours, err = TreeEntries(repo, ours); err != nil {
+		return nil, err
+	}
+	if m.theirs, err = TreeEntries(repo, theirs); err != nil {
+		return nil, err
+	}
+	if err := m.merge(); err != nil {
+		return nil, err
+	}
+	if err := m.fileDirectory(); err != nil {
+		return nil, err
+	}
+
+	tree, err := BuildTree(repo, m.res)
+	if err != nil {
+		return nil, err
+	}
+	res := &MergeResult{Tree: tree, Conflicts: m.conflicts}
+	sort.SliceStable(res.Conflicts, func(i, j int) bool { return res.Conflicts[i].Path < res.Conflicts[j].Path })
+	var paths []string
+	for p := range m.msgs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		res.Messages = append(res.Messages, m.msgs[p]...)
+	}
+	return res, nil
+}
+
+type treeMerger struct {
+	repo               *Repo
+	opts               *MergeOptions
+	base, ours, theirs map[string]*TreeLeaf
+
+	// res are the entries of the merged tree.
+	res       map[string]*TreeLeaf
+	conflicts []*Conflict
+	// msgs are the messages keyed by the path they are sorted by.
+	msgs map[string][]string
+}
+
+func (m *treeMerger) message(path, format string, args ...interface{}) string {
+	s := fmt.Sprintf(format, args...)
+	m.msgs[path] = append(m.msgs[path], s)
+	return s
+}
+
+func (m *treeMerger) conflict(kind, path string, b, o, t *TreeLeaf, format string, args ...interface{}) {
+	m.conflicts = append(m.conflicts, &Conflict{kind, path, b, o, t, m.message(path, format, args...)})
+}
+
+// renames returns the renames from the base to the side, mapping the old paths to the new ones.
+func (m *treeMerger) renames(side map[string]*TreeLeaf) (map[string]string, error) {
+	res := make(map[string]string)
+	if m.opts.NoRenames {
+		return res, nil
+	}
+	ropts := RenameOptions{}
+	if m.opts.Renames != nil {
+		ropts = *m.opts.Renames
+	}
+	ropts.Copies = false
+	cs, err := DetectRenames(m.repo, diffLeaves(m.base, side, nil), &ropts)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cs {
+		if c.Status == 'R' {
+			res[c.From.Path] = c.To.Path
+		}
+	}
+	return res, nil
+}
+
+// merge merges the entries of the three trees into res.
+func (m *treeMerger) merge() error {
+	ro, err := m.renames(m.ours)
+	if err != nil {
+		return err
+	}
+	rt, err := m.renames(m.theirs)
+	if err != nil {
+		return err
+	}
+	newPath := func(p string, side map[string]*TreeLeaf, rs map[string]string) string {
+		if q, ok := rs[p]; ok {
+			return q
+		}
+		if side[p] != nil {
+			return p
+		}
+		return ""
+	}
+	// Entries of the sides which are merged with the base or the other side.
+	usedOurs, usedTheirs := make(map[string]bool), make(map[string]bool)
+	var paths []string
+	for p := range m.base {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		b := m.base[p]
+		op, tp := newPath(p, m.ours, ro), newPath(p, m.theirs, rt)
+		o, t := m.ours[op], m.theirs[tp]
+		usedOurs[op], usedTheirs[tp] = true, true
+		_, renamedO := ro[p]
+		_, renamedT := rt[p]
+		switch {
+		case op == "" && tp == "":
+		case op == "" && renamedT, tp == "" && renamedO:
+			if err := m.renameDelete(b, o, t); err != nil {
+				return err
+			}
+		case op == "" || tp == "":
+			if err := m.mergeEntry(p, b, o, t); err != nil {
+				return err
+			}
+		case op == tp, !renamedO:
+			if err := m.mergeEntry(tp, b, o, t); err != nil {
+				return err
+			}
+		case !renamedT:
+			if err := m.mergeEntry(op, b, o, t); err != nil {
+				return err
+			}
+		default:
+			if err := m.renameRename(b, o, t); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Entries added on either side.
+	added := make(map[string]bool)
+	for p := range m.ours {
+		if !usedOurs[p] {
+			added[p] = true
+		}
+	}
+	for p := range m.theirs {
+		if !usedTheirs[p] {
+			added[p] = true
+		}
+	}
+	paths = paths[:0]
+	for p := range added {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		var o, t *TreeLeaf
+		if !usedOurs[p] {
+			o = m.ours[p]
+		}
+		if !usedTheirs[p] {
+			t = m.theirs[p]
+		}
+		if prev := m.res[p]; prev != nil {
+			// Added where the other side renamed a file to. The stages of the rename are
+			// replaced with those of the add/add.
+			m.dropConflicts(p)
+			if o == nil {
+				o = &TreeLeaf{prev.Mode, p, prev.SHA}
+			} else {
+				t = &TreeLeaf{prev.Mode, p, prev.SHA}
+			}
+		}
+		if err := m.mergeEntry(p, nil, o, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropConflicts removes the conflicts at the path, leaving their messages.
+func (m *treeMerger) dropConflicts(path string) []*Conflict {
+	var dropped []*Conflict
+	cs := m.conflicts[:0]
+	for _, c := range m.conflicts {
+		if c.Path == path {
+			dropped = append(dropped, c)
+		} else {
+			cs = append(cs, c)
+		}
+	}
+	m.conflicts = cs
+	return dropped
+}
+
+// at returns a copy of the leaf at the path, or nil if l is nil.
+func at(l *TreeLeaf, path string) *TreeLeaf {
+	if l == nil {
+		return nil
+	}
+	return &TreeLeaf{l.Mode, path, l.SHA}
+}
+
+// mergeEntry merges the versions of an entry into res at the path. Any of them may be nil.
+func (m *treeMerger) mergeEntry(path string, b, o, t *TreeLeaf) error {
+	switch {
+	case sameLeaf(o, t):
+		m.put(path, o)
+		return nil
+	case sameLeaf(b, o):
+		m.put(path, t)
+		return nil
+	case sameLeaf(b, t):
+		m.put(path, o)
+		return nil
+	case o == nil || t == nil:
+		// Deleted on one side and modified on the other.
+		deleted, modified, kept := m.opts.OursLabel, m.opts.TheirsLabel, t
+		if t == nil {
+			deleted, modified, kept = m.opts.TheirsLabel, m.opts.OursLabel, o
+		}
+		m.put(path, kept)
+		m.conflict(ConflictModifyDelete, path, at(b, path), at(o, path), at(t, path),
+			"CONFLICT (modify/delete): %s deleted in %s and modified in %s.  Version %s of %s left in tree.",
+			path, deleted, modified, modified, path)
+		return nil
+	}
+	l, clean, err := m.mergeContents(path, b, o, t)
+	if err != nil {
+		return err
+	}
+	m.put(path, l)
+	if !clean {
+		kind := ConflictContent
+		if b == nil {
+			kind = ConflictAddAdd
+		}
+		m.conflict(kind, path, at(b, path), at(o, path), at(t, path), "CONFLICT (%s): Merge conflict in %s", kind, path)
+	}
+	return nil
+}
+
+// mergeContents merges the files o and t, which both exist and differ, with the base b, which
+// may be nil. It reports whether the merge is clean. If the files cannot be merged line by
+// line, the result is o.
+func (m *treeMerger) mergeContents(path string, b, o, t *TreeLeaf) (*TreeLeaf, bool, error) {
+	mode, clean := o.Mode, true
+	switch {
+	case parseMode(o.Mode) == parseMode(t.Mode):
+	case b != nil && parseMode(b.Mode) == parseMode(o.Mode):
+		mode = t.Mode
+	case b == nil || parseMode(b.Mode) != parseMode(t.Mode):
+		clean = false
+	}
+	switch {
+	case o.SHA == t.SHA:
+		return &TreeLeaf{mode, path, o.SHA}, clean, nil
+	case b != nil && b.SHA == o.SHA:
+		return &TreeLeaf{mode, path, t.SHA}, clean, nil
+	case b != nil && b.SHA == t.SHA:
+		return &TreeLeaf{mode, path, o.SHA}, clean, nil
+	}
+	if objectKind(o.Mode) != "blob" || objectKind(t.Mode) != "blob" || b != nil && objectKind(b.Mode) != "blob" {
+		m.message(path, "Auto-merging %s", path)
+		return &TreeLeaf{o.Mode, path, o.SHA}, false, nil
+	}
+	var bc []byte
+	if b != nil {
+		ob, err := ReadObject(m.repo, b.SHA)
+		if err != nil {
+			return nil, false, err
+		}
+		bc = ob.Blob
+	}
+	oo, err := ReadObject(m.repo, o.SHA)
+	if err != nil {
+		return nil, false, err
+	}
+	ot, err := ReadObject(m.repo, t.SHA)
+	if err != nil {
+		return nil, false, err
+	}
+	if diff.IsBinary(bc) || diff.IsBinary(oo.Blob) || diff.IsBinary(ot.Blob) {
+		m.message(path, "warning: Cannot merge binary files: %s (%s vs. %s)", path, m.opts.OursLabel, m.opts.TheirsLabel)
+		m.message(path, "Auto-merging %s", path)
+		return &TreeLeaf{mode, path, o.SHA}, false, nil
+	}
+	m.message(path, "Auto-merging %s", path)
+
+	bl, ol, tl := m.opts.BaseLabel, m.opts.OursLabel, m.opts.TheirsLabel
+	if b != nil && b.Path != path || o.Path != path || t.Path != path {
+		if b != nil {
+			bl += ":" + b.Path
+		}
+		ol += ":" + o.Path
+		tl += ":" + t.Path
+	}
+	merged, n := diff.Merge3(bc, oo.Blob, ot.Blob, &diff.MergeOptions{
+		Options:     m.opts.Diff,
+		Style:       m.opts.Style,
+		Favor:       m.opts.Favor,
+		OursLabel:   ol,
+		BaseLabel:   bl,
+		TheirsLabel: tl,
+	})
+	sha, err := ObjectHash(merged, "blob", m.repo)
+	if err != nil {
+		return nil, false, err
+	}
+	return &TreeLeaf{mode, path, sha}, clean && n == 0, nil
+}
+
+// renameDelete handles a file renamed on one side and deleted on the other, keeping the
+// renamed file.
+func (m *treeMerger) renameDelete(b, o, t *TreeLeaf) error {
+	renamed, renamer, deleter := o, m.opts.OursLabel, m.opts.TheirsLabel
+	if o == nil {
+		renamed, renamer, deleter = t, m.opts.TheirsLabel, m.opts.OursLabel
+	}
+	m.put(renamed.Path, renamed)
+	m.conflict(ConflictRenameDelete, renamed.Path, at(b, renamed.Path), at(o, renamed.Path), at(t, renamed.Path),
+		"CONFLICT (rename/delete): %s renamed to %s in %s, but deleted in %s.", b.Path, renamed.Path, renamer, deleter)
+	return nil
+}
+
+// renameRename handles a file renamed to different paths on the sides. The merged contents
+// are written to both paths.
+func (m *treeMerger) renameRename(b, o, t *TreeLeaf) error {
+	l, clean, err := m.mergeContents(o.Path, b, o, t)
+	if err != nil {
+		return err
+	}
+	m.put(o.Path, l)
+	m.put(t.Path, &TreeLeaf{l.Mode, t.Path, l.SHA})
+	if !clean {
+		m.message(o.Path, "CONFLICT (content): Merge conflict in %s", o.Path)
+	}
+	m.conflict(ConflictRenameRename, b.Path, b, o, t, "CONFLICT (rename/rename): %s renamed to %s in %s and to %s in %s.",
+		b.Path, o.Path, m.opts.OursLabel, t.Path, m.opts.TheirsLabel)
+	return nil
+}
+
+func (m *treeMerger) put(path string, l *TreeLeaf) {
+	if l == nil {
+		delete(m.res, path)
+		return
+	}
+	m.res[path] = &TreeLeaf{l.Mode, path, l.SHA}
+}
+
+// fileDirectory moves the files in the way of directories of the merged tree to path~label,
+// where label names the side the file comes from.
+func (m *treeMerger) fileDirectory() error {
+	dirs := make(map[string]bool)
+	for p := range m.res {
+		for d, _ := splitPath(p); d != ""; d, _ = splitPath(d) {
+			dirs[d] = true
+		}
+	}
+	var paths []string
+	for p := range m.res {
+		if dirs[p] {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		l := m.res[p]
+		label := m.opts.OursLabel
+		if o := m.ours[p]; o == nil || o.SHA != l.SHA && m.theirs[p] != nil && m.theirs[p].SHA == l.SHA {
+			label = m.opts.TheirsLabel
+		}
+		np := p + "~" + strings.ReplaceAll(label, "/", "_")
+		for i := 0; m.res[np] != nil || dirs[np]; i++ {
+			np = fmt.Sprintf("%s~%s_%d", p, strings.ReplaceAll(label, "/", "_"), i)
+		}
+		delete(m.res, p)
+		m.put(np, l)
+
+		// The conflicts at the path are moved with the file, and the message of the move
+		// precedes theirs.
+		moved := m.dropConflicts(p)
+		var b, o, t *TreeLeaf
+		if len(moved) == 0 {
+			if label == m.opts.OursLabel {
+				o = at(l, np)
+			} else {
+				t = at(l, np)
+			}
+		}
+		m.conflict(ConflictFileDirectory, np, b, o, t,
+			"CONFLICT (file/directory): directory in the way of %s from %s; moving it to %s instead.", p, label, np)
+		for _, c := range moved {
+			m.removeMessage(p, c.Message)
+			words := strings.Split(c.Message, " ")
+			for i, w := range words {
+				if strings.TrimSuffix(w, ".") == p {
+					words[i] = np + w[len(p):]
+				}
+			}
+			c.Path, c.Message = np, m.message(np, "%s", strings.Join(words, " "))
+			for _, cl := range []*TreeLeaf{c.Base, c.Ours, c.Theirs} {
+				if cl != nil && cl.Path == p {
+					cl.Path = np
+				}
+			}
+			m.conflicts = append(m.conflicts, c)
+		}
+	}
+	return nil
+}
+
+func (m *treeMerger) removeMessage(path, msg string) {
+	for i, s := range m.msgs[path] {
+		if s == msg {
+			m.msgs[path] = append(m.msgs[path][:i], m.msgs[path][i+1:]...)
+			return
+		}
+	}
+}
+
+// CheckoutMerge updates the index and the worktree from the tree from to the merged tree of
+// res as CheckoutTree does, and records the conflicts of res as index stages 1 to 3, leaving
+// the conflicted files with conflict markers in the worktree. Local changes which would be
+// overwritten are reported as *LocalChangesError with the action.
+func CheckoutMerge(repo *Repo, from string, res *MergeResult, action string) error {
+	if err := CheckoutTree(repo, from, res.Tree, false); err != nil {
+		if lce, ok := err.(*LocalChangesError); ok {
+			lce.Action = action
+		}
+		return err
+	}
+	if len(res.Conflicts) == 0 {
+		return nil
+	}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return err
+	}
+	var stages []*IndexEntry
+	for _, c := range res.Conflicts {
+		for stage, l := range []*TreeLeaf{c.Base, c.Ours, c.Theirs} {
+			if l != nil {
+				stages = append(stages, &IndexEntry{Mode: parseMode(l.Mode), SHA: l.SHA, Stage: stage + 1, Path: l.Path})
+			}
+		}
+	}
+	for _, e := range stages {
+		idx.Remove(e.Path)
+	}
+	idx.Entries = append(idx.Entries, stages...)
+	idx.sort()
+	return WriteIndex(repo, idx)
+}
+
+// MergeMode is how Merge fast-forwards.
+type MergeMode int
+
+const (
+	// MergeFF fast-forwards if possible and creates a merge commit otherwise.
+	MergeFF MergeMode = iota
+	// MergeFFOnly refuses to merge unless fast-forwarding.
+	MergeFFOnly
+	// MergeNoFF creates a merge commit even if fast-forwarding is possible.
+	MergeNoFF
+)
+
+// MergeHead is a commit to merge and the name it is given by, such as a branch name.
+type MergeHead struct {
+	SHA, Name string
+}
+
+// MergeCommitOptions configures Merge.
+type MergeCommitOptions struct {
+	Mode MergeMode
+	// Message is the message of the merge commit. "" means the message git would make,
+	// as in "Merge branch 'topic'".
+	Message string
+	// Tree configures the merge of the trees. The labels are set by Merge.
+	Tree MergeOptions
+}
+
+// MergeStatus is the outcome of Merge.
+type MergeStatus int
+
+const (
+	// MergeUpToDate means the heads are already merged into HEAD.
+	MergeUpToDate MergeStatus = iota
+	// MergeFastForwarded means HEAD is fast-forwarded to the head.
+	MergeFastForwarded
+	// MergeCommitted means a merge commit is created.
+	MergeCommitted
+	// MergeConflicted means the merge stopped with conflicts to be resolved and committed.
+	MergeConflicted
+)
+
+// MergeOutcome is the result of Merge.
+type MergeOutcome struct {
+	Status MergeStatus
+	// Old and New are HEAD before and after the merge.
+	Old, New string
+	// Strategy is "ort" for merges of a single head and "octopus" for more heads.
+	Strategy string
+	// Tree is the result of merging the trees, or nil if they are not merged.
+	Tree *MergeResult
+}
+
+// Merge merges the heads into HEAD, updating the index and the worktree. Heads already merged
+// are ignored. A single head is fast-forwarded to unless opts.Mode is MergeNoFF. Otherwise
+// the trees are merged with MergeTrees and a commit whose parents are HEAD and the heads is
+// created. If the merge conflicts, it stops with the conflicts recorded in the index, and
+// MERGE_HEAD and MERGE_MSG are written for Commit to conclude the merge. Merges of several
+// heads (octopus merges) fail without touching anything if they conflict.
+func Merge(repo *Repo, heads []*MergeHead, opts *MergeCommitOptions) (*MergeOutcome, error) {
+	if opts == nil {
+		opts = &MergeCommitOptions{}
+	}
+	if mh, err := MergeHeads(repo); err != nil {
+		return nil, err
+	} else if mh != nil {
+		return nil, errors.New("you have not concluded your merge (MERGE_HEAD exists)")
+	}
+	branch, head, err := Head(repo)
+	if err != nil {
+		return nil, err
+	}
+	if head == "" {
+		return nil, errors.New("cannot merge into an unborn branch")
+	}
+	out := &MergeOutcome{Status: MergeUpToDate, Old: head, New: head, Strategy: "ort"}
+
+	var todo []*MergeHead
+	for _, h := range heads {
+		if ok, err := IsAncestor(repo, h.SHA, head); err != nil {
+			return nil, err
+		} else if !ok {
+			todo = append(todo, h)
+		}
+	}
+	if len(todo) == 0 {
+		return out, nil
+	}
+	if len(todo) > 1 {
+		out.Strategy = "octopus"
+	}
+	reflog := "merge " + mergeHeadNames(heads) + ": "
+	if len(todo) == 1 && opts.Mode != MergeNoFF {
+		if ok, err := IsAncestor(repo, head, todo[0].SHA); err != nil {
+			return nil, err
+		} else if ok {
+			if err := fastForward(repo, head, todo[0].SHA, reflog+"Fast-forward"); err != nil {
+				return nil, err
+			}
+			out.Status, out.New = MergeFastForwarded, todo[0].SHA
+			return out, nil
+		}
+	}
+	if opts.Mode == MergeFFOnly {
+		return nil, errors.New("not possible to fast-forward, aborting")
+	}
+
+	headTree, err := TreeSHA(repo, head)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return nil, err
+	}
+	headLeaves, err := TreeEntries(repo, headTree)
+	if err != nil {
+		return nil, err
+	}
+	if staged := diffLeaves(headLeaves, indexLeaves(idx), nil); len(staged) > 0 {
+		lce := &LocalChangesError{Action: "merge"}
+		for _, c := range staged {
+			lce.Modified = append(lce.Modified, c.Path())
+		}
+		return nil, lce
+	}
+
+	tree := headTree
+	topts := opts.Tree
+	for _, h := range todo {
+		bases, err := MergeBases(repo, head, h.SHA)
+		if err != nil {
+			return nil, err
+		}
+		baseTree, err := mergeBasesTree(repo, bases, &opts.Tree)
+		if err != nil {
+			return nil, err
+		}
+		theirs, err := TreeSHA(repo, h.SHA)
+		if err != nil {
+			return nil, err
+		}
+		topts.OursLabel, topts.TheirsLabel = "HEAD", h.Name
+		if opts.Tree.BaseLabel == "" {
+			switch len(bases) {
+			case 0:
+			case 1:
+				topts.BaseLabel = bases[0][:7]
+			default:
+				topts.BaseLabel = "merged common ancestors"
+			}
+		}
+		res, err := MergeTrees(repo, baseTree, tree, theirs, &topts)
+		if err != nil {
+			return nil, err
+		}
+		if out.Strategy == "octopus" {
+			res.Messages = append([]string{"Trying simple merge with " + h.Name}, res.Messages...)
+		}
+		if out.Tree == nil {
+			out.Tree = res
+		} else {
+			out.Tree.Tree = res.Tree
+			out.Tree.Conflicts = append(out.Tree.Conflicts, res.Conflicts...)
+			out.Tree.Messages = append(out.Tree.Messages, res.Messages...)
+		}
+		if len(res.Conflicts) > 0 && len(todo) > 1 {
+			return nil, errors.New("merge with strategy octopus failed")
+		}
+		tree = res.Tree
+	}
+	if err := CheckoutMerge(repo, headTree, out.Tree, "merge"); err != nil {
+		return nil, err
+	}
+	if err := writeFile([]byte(head+"\n"), repo.path("ORIG_HEAD")); err != nil {
+		return nil, err
+	}
+
+	msg := opts.Message
+	if msg == "" {
+		msg = mergeMessage(repo, branch, todo)
+	}
+	msg = CleanupMessage(msg, false)
+	if len(out.Tree.Conflicts) > 0 {
+		idx, err := ReadIndex(repo)
+		if err != nil {
+			return nil, err
+		}
+		msg += "\n# Conflicts:\n"
+		for _, p := range idx.Unmerged() {
+			msg += "#\t" + p + "\n"
+		}
+		var shas []string
+		for _, h := range todo {
+			shas = append(shas, h.SHA)
+		}
+		if err := WriteMergeState(repo, shas, msg, opts.Mode == MergeNoFF); err != nil {
+			return nil, err
+		}
+		out.Status = MergeConflicted
+		return out, nil
+	}
+
+	parents := []string{head}
+	for _, h := range todo {
+		parents = append(parents, h.SHA)
+	}
+	sha, err := CommitTree(repo, tree, parents, msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := UpdateRef(repo, "HEAD", sha, head, reflog+"Merge made by the '"+out.Strategy+"' strategy."); err != nil {
+		return nil, err
+	}
+	out.Status, out.New = MergeCommitted, sha
+	return out, nil
+}
+
+// indexLeaves returns the stage 0 entries of the index as leaves keyed by their paths.
+func indexLeaves(idx *Index) map[string]*TreeLeaf {
+	m := make(map[string]*TreeLeaf)
+	for _, e := range idx.Entries {
+		if e.Stage == 0 {
+			m[e.Path] = &TreeLeaf{e.TreeMode(), e.Path, e.SHA}
+		}
+	}
+	return m
+}
+
+// fastForward checks out the commit to from the commit from and points HEAD at it.
+func fastForward(repo *Repo, from, to, msg string) error {
+	ft, err := TreeSHA(repo, from)
+	if err != nil {
+		return err
+	}
+	tt, err := TreeSHA(repo, to)
+	if err != nil {
+		return err
+	}
+	if err := CheckoutTree(repo, ft, tt, false); err != nil {
+		if lce, ok := err.(*LocalChangesError); ok {
+			lce.Action = "merge"
+		}
+		return err
+	}
+	if err := writeFile([]byte(from+"\n"), repo.path("ORIG_HEAD")); err != nil {
+		return err
+	}
+	return UpdateRef(repo, "HEAD", to, from, msg)
+}
+
+func mergeHeadNames(heads []*MergeHead) string {
+	var names []string
+	for _, h := range heads {
+		names = append(names, h.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+// mergeMessage returns the default message of merging the heads into the branch, which is
+// "" if HEAD is detached, as git fmt-merge-msg makes it.
+func mergeMessage(repo *Repo, branch string, heads []*MergeHead) string {
+	var kinds []string
+	names := make(map[string][]string)
+	for _, h := range heads {
+		kind := "commit"
+		for _, k := range []struct{ prefix, kind string }{
+			{"refs/heads/", "branch"},
+			{"refs/tags/", "tag"},
+			{"refs/remotes/", "remote-tracking branch"},
+		} {
+			if _, err := ReadRef(repo, k.prefix+strings.TrimPrefix(h.Name, k.prefix)); err == nil {
+				kind = k.kind
+				break
+			}
+		}
+		if names[kind] == nil {
+			kinds = append(kinds, kind)
+		}
+		names[kind] = append(names[kind], "'"+h.Name+"'")
+	}
+	var groups []string
+	for _, k := range kinds {
+		ns := names[k]
+		if len(ns) == 1 {
+			groups = append(groups, k+" "+ns[0])
+			continue
+		}
+		plural := k + "s"
+		if k == "branch" || k == "remote-tracking branch" {
+			plural = k + "es"
+		}
+		groups = append(groups, plural+" "+strings.Join(ns[:len(ns)-1], ", ")+" and "+ns[len(ns)-1])
+	}
+	msg := "Merge " + strings.Join(groups, ", ")
+	switch b := strings.TrimPrefix(branch, "refs/heads/"); b {
+	case "master", "main":
+	case "":
+		msg += " into HEAD"
+	default:
+		msg += " into " + b
+	}
+	return msg + "\n"
+}
+
+// AbortMerge abandons the merge in progress, resetting the index entries which differ from
+// HEAD and the corresponding worktree files to HEAD, and clears the merge state.
+func AbortMerge(repo *Repo) error {
+	if mh, err := MergeHeads(repo); err != nil {
+		return err
+	} else if mh == nil {
+		return errors.New("there is no merge to abort (MERGE_HEAD missing)")
+	}
+	if err := resetMerge(repo); err != nil {
+		return err
+	}
+	return ClearMergeState(repo)
+}
+
+// resetMerge resets the index entries which differ from HEAD, including unmerged ones, and
+// the corresponding worktree files to HEAD, keeping the other local changes.
+func resetMerge(repo *Repo) error {
+	_, head, err := Head(repo)
+	if err != nil {
+		return err
+	}
+	tree, err := TreeSHA(repo, head)
+	if err != nil {
+		return err
+	}
+	leaves, err := TreeEntries(repo, tree)
+	if err != nil {
+		return err
+	}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return err
+	}
+	paths := make(map[string]bool)
+	for _, e := range idx.Entries {
+		if e.Stage != 0 || !entryIs(e, leaves[e.Path]) {
+			paths[e.Path] = true
+		}
+	}
+	for p := range leaves {
+		if idx.Entry(p) == nil {
+			paths[p] = true
+		}
+	}
+	updates := make(map[string]*IndexEntry)
+	for p := range paths {
+		if l := leaves[p]; l != nil {
+			e, err := writeWorktreeFile(repo, l)
+			if err != nil {
+				return err
+			}
+			updates[p] = e
+			continue
+		}
+		if err := removeWorktreeFile(repo, p); err != nil {
+			return err
+		}
+		updates[p] = nil
+	}
+	idx.update(updates)
+	return WriteIndex(repo, idx)
+}
+
+// mergeBasesTree returns the tree to merge against when the commits to merge have the bases
+// as their best common ancestors, or "" if there is none. Several bases are merged into a
+// virtual one, oldest first, each merged against the merge bases of it and those merged
+// before. Conflicts
+// in the virtual base are left as they are, with the markers in the contents.
+func mergeBasesTree(repo *Repo, bases []string, opts *MergeOptions) (string, error) {
+	if len(bases) == 0 {
+		return "", nil
+	}
+	tree, err := TreeSHA(repo, bases[len(bases)-1])
+	if err != nil {
+		return "", err
+	}
+	merged := bases[len(bases)-1:]
+	for i := len(bases) - 2; i >= 0; i-- {
+		next := bases[i]
+		bs, err := MergeBases(repo, next, merged...)
+		if err != nil {
+			return "", err
+		}
+		base, err := mergeBasesTree(repo, bs, opts)
+		if err != nil {
+			return "", err
+		}
+		theirs, err := TreeSHA(repo, next)
+		if err != nil {
+			return "", err
+		}
+		o := *opts
+		o.Favor = diff.FavorNone
+		o.OursLabel, o.BaseLabel, o.TheirsLabel = "Temporary merge branch 1", "merged common ancestors", "Temporary merge branch 2"
+		res, err := MergeTrees(repo, base, tree, theirs, &o)
+		if err != nil {
+			return "", err
+		}
+		tree = res.Tree
+		merged = append(merged, next)
+	}
+	return tree, nil
+}
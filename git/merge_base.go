@@ -0,0 +1,311 @@
+package git
+
+import (
+	"container/heap"
+	"sort"
+	"strings"
+)
+
+// Flags of commits painted by paintDownToCommon.
+const (
+	paintParent1 = 1 << iota
+	paintParent2
+	paintStale
+	paintResult
+)
+
+// commitGraph caches the parents and the committer times of commits, so that walking the
+// history reads each commit once.
+type commitGraph struct {
+	repo    *Repo
+	parents map[string][]string
+	times   map[string]int64
+	// shallow are commits whose parents are not walked, besides those of a shallow clone.
+	shallow map[string]bool
+}
+
+func newCommitGraph(repo *Repo) *commitGraph {
+	return &commitGraph{repo: repo, parents: make(map[string][]string), times: make(map[string]int64)}
+}
+
+func (g *commitGraph) load(sha string) error {
+	if _, ok := g.times[sha]; ok {
+		return nil
+	}
+	ps, err := Parents(g.repo, sha)
+	if err != nil {
+		return err
+	}
+	if g.shallow[sha] {
+		ps = nil
+	}
+	t, err := commitTime(g.repo, sha)
+	if err != nil {
+		return err
+	}
+	g.parents[sha], g.times[sha] = ps, t
+	return nil
+}
+
+// paintDownToCommon walks the history from one and twos, newest first, painting the commits
+// reachable from one and from any of twos, until the commits reachable from both are found.
+// It returns the common commits found first, which include all the merge bases, newest first,
+// and the flags painted.
+func (g *commitGraph) paintDownToCommon(one string, twos []string) ([]string, map[string]int, error) {
+	flags := make(map[string]int)
+	var q commitQueue
+	seq := 0
+	push := func(sha string) error {
+		if err := g.load(sha); err != nil {
+			return err
+		}
+		heap.Push(&q, &queuedCommit{sha: sha, time: g.times[sha], seq: seq})
+		seq++
+		return nil
+	}
+	flags[one] |= paintParent1
+	if err := push(one); err != nil {
+		return nil, nil, err
+	}
+	for _, two := range twos {
+		flags[two] |= paintParent2
+		if err := push(two); err != nil {
+			return nil, nil, err
+		}
+	}
+	nonStale := func() bool {
+		for _, c := range q {
+			if flags[c.sha]&paintStale == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	var res []string
+	for nonStale() {
+		c := heap.Pop(&q).(*queuedCommit).sha
+		f := flags[c] & (paintParent1 | paintParent2 | paintStale)
+		if f == paintParent1|paintParent2 {
+			if flags[c]&paintResult == 0 {
+				flags[c] |= paintResult
+				res = append(res, c)
+			}
+			f |= paintStale
+		}
+		for _, p := range g.parents[c] {
+			if flags[p]&f == f {
+				continue
+			}
+			flags[p] |= f
+			if err := push(p); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return res, flags, nil
+}
+
+// mergeBases returns the merge bases of one and any of twos, newest first. Unless reduce is
+// false, those reachable from others are removed, leaving the best common ancestors only.
+func (g *commitGraph) mergeBases(one string, twos []string, reduce bool) ([]string, error) {
+	for _, two := range twos {
+		if one == two {
+			return []string{one}, nil
+		}
+	}
+	common, flags, err := g.paintDownToCommon(one, twos)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, c := range common {
+		if flags[c]&paintStale == 0 {
+			res = append(res, c)
+		}
+	}
+	if !reduce || len(res) <= 1 {
+		return res, nil
+	}
+	if res, err = g.removeRedundant(res); err != nil {
+		return nil, err
+	}
+	return res, g.sortByTime(res)
+}
+
+// removeRedundant removes the commits reachable from others.
+func (g *commitGraph) removeRedundant(cs []string) ([]string, error) {
+	redundant := make([]bool, len(cs))
+	for i, c := range cs {
+		if redundant[i] {
+			continue
+		}
+		var others []string
+		var idx []int
+		for j, o := range cs {
+			if j != i && !redundant[j] {
+				others = append(others, o)
+				idx = append(idx, j)
+			}
+		}
+		_, flags, err := g.paintDownToCommon(c, others)
+		if err != nil {
+			return nil, err
+		}
+		if flags[c]&paintParent2 != 0 {
+			redundant[i] = true
+		}
+		for k, o := range others {
+			if flags[o]&paintParent1 != 0 {
+				redundant[idx[k]] = true
+			}
+		}
+	}
+	var res []string
+	for i, c := range cs {
+		if !redundant[i] {
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+// MergeBases returns all the best common ancestors of the commit one and a hypothetical merge
+// of the commits twos, newest first, as git merge-base --all does. A best common ancestor is
+// a common ancestor not reachable from other common ancestors.
+// The history is walked newest first, stopping as soon as the remaining commits are known
+// to be reachable from common ancestors.
+func MergeBases(repo *Repo, one string, twos ...string) ([]string, error) {
+	return newCommitGraph(repo).mergeBases(one, twos, true)
+}
+
+// MergeBase returns a best common ancestor of the commits as git merge-base does, or "" if
+// they have none.
+func MergeBase(repo *Repo, one string, twos ...string) (string, error) {
+	bs, err := newCommitGraph(repo).mergeBases(one, twos, true)
+	if err != nil || len(bs) == 0 {
+		return "", err
+	}
+	return bs[0], nil
+}
+
+// OctopusMergeBases returns the best common ancestors of all the commits, as needed to merge
+// them at once.
+func OctopusMergeBases(repo *Repo, commits []string) ([]string, error) {
+	if len(commits) == 0 {
+		return nil, nil
+	}
+	g := newCommitGraph(repo)
+	res := commits[:1]
+	for _, c := range commits[1:] {
+		var next []string
+		seen := make(map[string]bool)
+		for _, r := range res {
+			bs, err := g.mergeBases(c, []string{r}, true)
+			if err != nil {
+				return nil, err
+			}
+			for _, b := range bs {
+				if !seen[b] {
+					seen[b] = true
+					next = append(next, b)
+				}
+			}
+		}
+		res = next
+	}
+	return g.removeRedundant(res)
+}
+
+// IsAncestor reports whether the commit a is reachable from the commit b, including a == b.
+func IsAncestor(repo *Repo, a, b string) (bool, error) {
+	bs, err := newCommitGraph(repo).mergeBases(a, []string{b}, false)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range bs {
+		if c == a {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ForkPoint returns the commit at which the commit forked from the ref, taking the past tips
+// of the ref recorded in its reflog into account as git merge-base --fork-point does, or ""
+// if it cannot be determined. name is a ref name such as "origin/master".
+func ForkPoint(repo *Repo, name, commit string) (string, error) {
+	ref := dwimRef(repo, name)
+	if ref == "" {
+		return "", &nameResolutionError{name, nil}
+	}
+	tip, err := ReadRef(repo, ref)
+	if err != nil {
+		return "", err
+	}
+	entries, err := Reflog(repo, ref)
+	if err != nil {
+		return "", err
+	}
+	var revs []string
+	seen := make(map[string]bool)
+	add := func(sha string) {
+		if sha != ZeroSHA && !seen[sha] {
+			seen[sha] = true
+			revs = append(revs, sha)
+		}
+	}
+	for i, e := range entries {
+		if i == 0 {
+			add(e.Old)
+		}
+		add(e.New)
+	}
+	if len(revs) == 0 {
+		add(tip)
+	}
+	// Reflogs may name commits which are gone.
+	var valid []string
+	for _, r := range revs {
+		if o, err := ReadObject(repo, r); err == nil && o.Type == "commit" {
+			valid = append(valid, r)
+		}
+	}
+	bs, err := newCommitGraph(repo).mergeBases(commit, valid, false)
+	if err != nil || len(bs) != 1 {
+		return "", err
+	}
+	if !seen[bs[0]] {
+		return "", nil
+	}
+	return bs[0], nil
+}
+
+// dwimRef returns the full name of the ref given by the short name as git does, trying
+// refs/, refs/tags/, refs/heads/ and refs/remotes/, or "" if there is no such ref.
+func dwimRef(repo *Repo, name string) string {
+	if name == "HEAD" || strings.HasPrefix(name, "refs/") {
+		if _, err := ReadRef(repo, name); err == nil {
+			return name
+		}
+	}
+	for _, p := range []string{"refs/", "refs/tags/", "refs/heads/", "refs/remotes/"} {
+		if _, err := ReadRef(repo, p+name); err == nil {
+			return p + name
+		}
+	}
+	if _, err := ReadRef(repo, "refs/remotes/"+name+"/HEAD"); err == nil {
+		return "refs/remotes/" + name + "/HEAD"
+	}
+	return ""
+}
+
+// sortByTime sorts the commits newest first.
+func (g *commitGraph) sortByTime(cs []string) error {
+	for _, c := range cs {
+		if err := g.load(c); err != nil {
+			return err
+		}
+	}
+	sort.SliceStable(cs, func(i, j int) bool { return g.times[cs[i]] > g.times[cs[j]] })
+	return nil
+}
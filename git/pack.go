@@ -0,0 +1,689 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Object types as encoded in packs.
+const (
+	packCommit   = 1
+	packTree     = 2
+	packBlob     = 3
+	packTag      = 4
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+var packTypes = map[int]string{packCommit: "commit", packTree: "tree", packBlob: "blob", packTag: "tag"}
+
+func packType(typ string) int {
+	for t, s := range packTypes {
+		if s == typ {
+			return t
+		}
+	}
+	return 0
+}
+
+// packFile is a pack in objects/pack with its version 2 index.
+type packFile struct {
+	path string
+	// shas are the SHAs of the objects in the pack, sorted.
+	shas    []string
+	offsets map[string]int64
+	// data is the content of the pack, read on demand.
+	data []byte
+}
+
+// hashObject returns the SHA of the object with the type and the content.
+func hashObject(typ string, data []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", typ, len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// packFiles returns the packs of the repository, reading their indexes on the first call.
+func (r *Repo) packFiles() ([]*packFile, error) {
+	if r.packs != nil {
+		return r.packs, nil
+	}
+	r.packs = []*packFile{}
+	idxs, err := filepath.Glob(r.path("objects", "pack", "pack-*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	for _, idx := range idxs {
+		p, err := readPackIndex(strings.TrimSuffix(idx, ".idx") + ".pack")
+		if err != nil {
+			return nil, err
+		}
+		r.packs = append(r.packs, p)
+	}
+	return r.packs, nil
+}
+
+// readPackIndex reads the version 2 index of the pack at path.
+func readPackIndex(path string) (*packFile, error) {
+	idx := strings.TrimSuffix(path, ".pack") + ".idx"
+	b, err := ioutil.ReadFile(idx)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 8+256*4+2*sha1.Size || !bytes.Equal(b[:8], []byte{0xff, 't', 'O', 'c', 0, 0, 0, 2}) {
+		return nil, fmt.Errorf("%s: unsupported pack index", idx)
+	}
+	n := int(binary.BigEndian.Uint32(b[8+255*4:]))
+	shaPos := 8 + 256*4
+	offPos := shaPos + n*(sha1.Size+4)
+	largePos := offPos + n*4
+	if len(b) < largePos+2*sha1.Size {
+		return nil, fmt.Errorf("%s: truncated pack index", idx)
+	}
+	p := &packFile{path: path, offsets: make(map[string]int64, n)}
+	for i := 0; i < n; i++ {
+		sha := hex.EncodeToString(b[shaPos+i*sha1.Size : shaPos+(i+1)*sha1.Size])
+		off := int64(binary.BigEndian.Uint32(b[offPos+i*4:]))
+		if off&0x80000000 != 0 {
+			at := largePos + int(off&0x7fffffff)*8
+			if at+8 > len(b) {
+				return nil, fmt.Errorf("%s: bad offset", idx)
+			}
+			off = int64(binary.BigEndian.Uint64(b[at:]))
+		}
+		p.shas = append(p.shas, sha)
+		p.offsets[sha] = off
+	}
+	return p, nil
+}
+
+// readPackedObject reads the object from the packs of the repository. ok is false if no pack
+// has it.
+func readPackedObject(repo *Repo, sha string) (typ string, data []byte, ok bool, err error) {
+	packs, err := repo.packFiles()
+	if err != nil {
+		return "", nil, false, err
+	}
+	for _, p := range packs {
+		off, found := p.offsets[sha]
+		if !found {
+			continue
+		}
+		if p.data == nil {
+			if p.data, err = ioutil.ReadFile(p.path); err != nil {
+				return "", nil, false, err
+			}
+		}
+		typ, data, err := p.object(repo, off)
+		if err != nil {
+			return "", nil, false, fmt.Errorf("%s: object %s: %v", filepath.Base(p.path), sha, err)
+		}
+		return typ, data, true, nil
+	}
+	return "", nil, false, nil
+}
+
+// packedSHAs returns the SHAs of the objects in the packs.
+func packedSHAs(repo *Repo) ([]string, error) {
+	packs, err := repo.packFiles()
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, p := range packs {
+		res = append(res, p.shas...)
+	}
+	return res, nil
+}
+
+// object reads the object at the offset, resolving deltas.
+func (p *packFile) object(repo *Repo, off int64) (string, []byte, error) {
+	if off < 12 || off >= int64(len(p.data)) {
+		return "", nil, fmt.Errorf("bad offset %d", off)
+	}
+	r := bytes.NewReader(p.data[off:])
+	typ, size, err := readPackEntryHeader(r)
+	if err != nil {
+		return "", nil, err
+	}
+	var baseTyp string
+	var base []byte
+	switch typ {
+	case packOfsDelta:
+		rel, err := readOfsDeltaOffset(r)
+		if err != nil {
+			return "", nil, err
+		}
+		if rel <= 0 || rel >= off {
+			return "", nil, fmt.Errorf("bad delta base offset at offset %d", off)
+		}
+		if baseTyp, base, err = p.object(repo, off-rel); err != nil {
+			return "", nil, err
+		}
+	case packRefDelta:
+		sha := make([]byte, sha1.Size)
+		if _, err := io.ReadFull(r, sha); err != nil {
+			return "", nil, err
+		}
+		if baseTyp, base, err = ReadRawObject(repo, hex.EncodeToString(sha)); err != nil {
+			return "", nil, err
+		}
+	}
+	data, err := inflate(r, size)
+	if err != nil {
+		return "", nil, err
+	}
+	if base == nil {
+		t, ok := packTypes[typ]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown object type %d", typ)
+		}
+		return t, data, nil
+	}
+	data, err = applyDelta(base, data)
+	return baseTyp, data, err
+}
+
+// readPackEntryHeader reads the type and the size of a pack entry.
+func readPackEntryHeader(r io.ByteReader) (typ int, size int64, err error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	typ = int(c>>4) & 7
+	size = int64(c & 15)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, 0, err
+		}
+		size |= int64(c&0x7f) << shift
+	}
+	return typ, size, nil
+}
+
+// readOfsDeltaOffset reads how far before an ofs-delta entry its base is.
+func readOfsDeltaOffset(r io.ByteReader) (int64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	off := int64(c & 0x7f)
+	for c&0x80 != 0 {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+		off = (off+1)<<7 | int64(c&0x7f)
+	}
+	return off, nil
+}
+
+// inflate decompresses a zlib stream of size bytes from r. If r is an io.ByteReader, no more
+// than the stream is read from it. A stream inflating to more than size bytes is not read
+// further.
+func inflate(r io.Reader, size int64) ([]byte, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(zr, size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) != size {
+		return nil, fmt.Errorf("inflated to %d bytes instead of %d", len(b), size)
+	}
+	return b, nil
+}
+
+// applyDelta applies the delta to the base.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	r := bytes.NewReader(delta)
+	varint := func() (int, error) {
+		n, shift := 0, uint(0)
+		for {
+			c, err := r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			n |= int(c&0x7f) << shift
+			shift += 7
+			if c&0x80 == 0 {
+				return n, nil
+			}
+		}
+	}
+	srcSize, err := varint()
+	if err != nil {
+		return nil, err
+	}
+	if srcSize != len(base) {
+		return nil, errors.New("delta base size mismatch")
+	}
+	dstSize, err := varint()
+	if err != nil {
+		return nil, err
+	}
+	if dstSize < 0 {
+		return nil, errors.New("bad delta result size")
+	}
+	// The declared size is not trusted for the allocation; the result grows as it is built.
+	capacity := dstSize
+	if n := len(base) + len(delta); capacity > n {
+		capacity = n
+	}
+	res := make([]byte, 0, capacity)
+	for r.Len() > 0 {
+		if len(res) > dstSize {
+			return nil, errors.New("delta result size mismatch")
+		}
+		op, _ := r.ReadByte()
+		switch {
+		case op&0x80 != 0:
+			var off, n int
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				c, err := r.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+				if i < 4 {
+					off |= int(c) << (8 * i)
+				} else {
+					n |= int(c) << (8 * (i - 4))
+				}
+			}
+			if n == 0 {
+				n = 0x10000
+			}
+			if off+n > len(base) {
+				return nil, errors.New("delta copies out of the base")
+			}
+			res = append(res, base[off:off+n]...)
+		case op != 0:
+			b := make([]byte, op)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return nil, err
+			}
+			res = append(res, b...)
+		default:
+			return nil, errors.New("bad delta opcode 0")
+		}
+	}
+	if len(res) != dstSize {
+		return nil, errors.New("delta result size mismatch")
+	}
+	return res, nil
+}
+
+// packReader reads a pack stream, hashing and counting what it reads and copying it to w.
+type packReader struct {
+	r   *bufio.Reader
+	w   io.Writer
+	sum hash.Hash
+	crc hash.Hash32
+	n   int64
+}
+
+func (p *packReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.consumed(b[:n])
+	return n, err
+}
+
+func (p *packReader) ReadByte() (byte, error) {
+	c, err := p.r.ReadByte()
+	if err == nil {
+		p.consumed([]byte{c})
+	}
+	return c, err
+}
+
+func (p *packReader) consumed(b []byte) {
+	p.sum.Write(b)
+	p.crc.Write(b)
+	p.w.Write(b)
+	p.n += int64(len(b))
+}
+
+// packEntry is an object in a pack being indexed.
+type packEntry struct {
+	offset int64
+	crc    uint32
+	typ    int
+	// data is the content of the object, or the delta for deltified objects.
+	data []byte
+	// baseOffset or baseSHA is the base of a delta.
+	baseOffset int64
+	baseSHA    string
+
+	sha      string
+	resolved string
+}
+
+// IndexPack reads a pack from r, stores it in the objects/pack directory of the repository
+// with an index, and returns the SHA of the pack, or "" if the pack has no objects. The
+// objects are checked to be consistent. A thin pack, whose deltas have bases in the
+// repository, is completed with those bases first.
+func IndexPack(repo *Repo, r io.Reader) (string, error) {
+	dir := repo.path("objects", "pack")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(dir, "tmp_pack_")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	pr := &packReader{r: bufio.NewReader(r), w: tmp, sum: sha1.New(), crc: crc32.NewIEEE()}
+
+	var hdr [12]byte
+	if _, err := io.ReadFull(pr, hdr[:]); err != nil {
+		return "", fmt.Errorf("reading pack header: %v", err)
+	}
+	if string(hdr[:4]) != "PACK" {
+		return "", errors.New("not a pack")
+	}
+	if v := binary.BigEndian.Uint32(hdr[4:]); v != 2 && v != 3 {
+		return "", fmt.Errorf("unsupported pack version %d", v)
+	}
+	// The number of objects is not trusted for allocations; the entries grow as they are read.
+	n := int(binary.BigEndian.Uint32(hdr[8:]))
+	var entries []*packEntry
+	byOffset := make(map[int64]*packEntry)
+	for i := 0; i < n; i++ {
+		e := &packEntry{offset: pr.n}
+		pr.crc.Reset()
+		var size int64
+		if e.typ, size, err = readPackEntryHeader(pr); err != nil {
+			return "", err
+		}
+		switch e.typ {
+		case packCommit, packTree, packBlob, packTag:
+		case packOfsDelta:
+			rel, err := readOfsDeltaOffset(pr)
+			if err != nil {
+				return "", err
+			}
+			// The base precedes the delta; an offset of 0 would make it its own base.
+			if rel <= 0 || rel >= e.offset {
+				return "", fmt.Errorf("bad delta base offset at offset %d", e.offset)
+			}
+			e.baseOffset = e.offset - rel
+		case packRefDelta:
+			sha := make([]byte, sha1.Size)
+			if _, err := io.ReadFull(pr, sha); err != nil {
+				return "", err
+			}
+			e.baseSHA = hex.EncodeToString(sha)
+		default:
+			return "", fmt.Errorf("unknown object type %d at offset %d", e.typ, e.offset)
+		}
+		if e.data, err = inflate(pr, size); err != nil {
+			return "", fmt.Errorf("object at offset %d: %v", e.offset, err)
+		}
+		e.crc = pr.crc.Sum32()
+		entries = append(entries, e)
+		byOffset[e.offset] = e
+	}
+	sum := pr.sum.Sum(nil)
+	trailer := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(pr.r, trailer); err != nil {
+		return "", fmt.Errorf("reading pack trailer: %v", err)
+	}
+	if !bytes.Equal(sum, trailer) {
+		return "", errors.New("pack checksum mismatch")
+	}
+	if _, err := tmp.Write(trailer); err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "", nil
+	}
+
+	// Resolve the objects. Bases of ref-deltas missing in the pack are looked up in the
+	// repository and appended to the pack.
+	bySHA := make(map[string]*packEntry, len(entries))
+	for _, e := range entries {
+		if e.baseOffset == 0 && e.baseSHA == "" {
+			e.sha, e.resolved = hashObject(packTypes[e.typ], e.data), packTypes[e.typ]
+			bySHA[e.sha] = e
+		}
+	}
+	var resolve func(e *packEntry) (string, []byte, error)
+	resolve = func(e *packEntry) (string, []byte, error) {
+		if e.resolved != "" {
+			return e.resolved, e.data, nil
+		}
+		var typ string
+		var base []byte
+		var err error
+		if e.baseOffset != 0 {
+			b, ok := byOffset[e.baseOffset]
+			if !ok {
+				return "", nil, fmt.Errorf("bad delta base offset at offset %d", e.offset)
+			}
+			typ, base, err = resolve(b)
+		} else if b, ok := bySHA[e.baseSHA]; ok {
+			typ, base, err = resolve(b)
+		} else {
+			typ, base, err = ReadRawObject(repo, e.baseSHA)
+			if err == nil {
+				b := &packEntry{typ: packType(typ), data: base, sha: e.baseSHA, resolved: typ}
+				bySHA[b.sha] = b
+				entries = append(entries, b)
+			}
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if e.data, err = applyDelta(base, e.data); err != nil {
+			return "", nil, fmt.Errorf("object at offset %d: %v", e.offset, err)
+		}
+		e.sha, e.resolved = hashObject(typ, e.data), typ
+		bySHA[e.sha] = e
+		return typ, e.data, nil
+	}
+	for _, e := range entries[:n] {
+		if _, _, err := resolve(e); err != nil {
+			return "", err
+		}
+	}
+	if len(entries) > n {
+		if trailer, err = completePack(tmp, entries[n:], len(entries)); err != nil {
+			return "", err
+		}
+	}
+	for _, e := range entries {
+		if err := checkObject(e.resolved, e.data); err != nil {
+			return "", fmt.Errorf("object %s: %v", e.sha, err)
+		}
+	}
+
+	packSHA := hex.EncodeToString(trailer)
+	base := filepath.Join(dir, "pack-"+packSHA)
+	if err := writePackIndex(base+".idx", entries, trailer); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), base+".pack"); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(base+".pack", 0444); err != nil {
+		return "", err
+	}
+	repo.packs = nil
+	return packSHA, nil
+}
+
+// completePack appends the entries to the pack file f holding total objects with them,
+// updating its header and trailer, and returns the new trailer.
+func completePack(f *os.File, entries []*packEntry, total int) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := fi.Size() - sha1.Size
+	for _, e := range entries {
+		var b bytes.Buffer
+		if err := writePackEntry(&b, e.resolved, e.data); err != nil {
+			return nil, err
+		}
+		e.offset, e.crc = end, crc32.ChecksumIEEE(b.Bytes())
+		if _, err := f.WriteAt(b.Bytes(), end); err != nil {
+			return nil, err
+		}
+		end += int64(b.Len())
+	}
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], uint32(total))
+	if _, err := f.WriteAt(count[:], 8); err != nil {
+		return nil, err
+	}
+	h := sha1.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, end)); err != nil {
+		return nil, err
+	}
+	trailer := h.Sum(nil)
+	if _, err := f.WriteAt(trailer, end); err != nil {
+		return nil, err
+	}
+	return trailer, f.Truncate(end + sha1.Size)
+}
+
+// checkObject checks that the content of the object can be parsed as its type. As with
+// git fsck, a tree entry whose name would be written outside the worktree or into .git on
+// checkout is refused.
+func checkObject(typ string, data []byte) error {
+	switch typ {
+	case "tree":
+		t, err := parseTree(data)
+		if err != nil {
+			return err
+		}
+		for _, l := range t {
+			if strings.Contains(l.Path, "/") || VerifyPath(l.Path) != nil {
+				return fmt.Errorf("invalid tree entry name %q", l.Path)
+			}
+		}
+		return nil
+	case "commit", "tag":
+		_, err := newCommit(nil).Decode(data)
+		return err
+	}
+	return nil
+}
+
+// writePackIndex writes the version 2 index of the pack entries.
+func writePackIndex(path string, entries []*packEntry, packSum []byte) error {
+	sorted := append([]*packEntry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].sha < sorted[j].sha })
+	var b bytes.Buffer
+	b.Write([]byte{0xff, 't', 'O', 'c', 0, 0, 0, 2})
+	u32 := func(v uint32) {
+		var x [4]byte
+		binary.BigEndian.PutUint32(x[:], v)
+		b.Write(x[:])
+	}
+	var fanout [256]uint32
+	for _, e := range sorted {
+		c, _ := strconv.ParseUint(e.sha[:2], 16, 8)
+		fanout[c]++
+	}
+	for i, total := 0, uint32(0); i < 256; i++ {
+		total += fanout[i]
+		u32(total)
+	}
+	for _, e := range sorted {
+		sha, _ := hex.DecodeString(e.sha)
+		b.Write(sha)
+	}
+	for _, e := range sorted {
+		u32(e.crc)
+	}
+	var large []int64
+	for _, e := range sorted {
+		if e.offset < 0x80000000 {
+			u32(uint32(e.offset))
+			continue
+		}
+		u32(0x80000000 | uint32(len(large)))
+		large = append(large, e.offset)
+	}
+	for _, off := range large {
+		var x [8]byte
+		binary.BigEndian.PutUint64(x[:], uint64(off))
+		b.Write(x[:])
+	}
+	b.Write(packSum)
+	sum := sha1.Sum(b.Bytes())
+	b.Write(sum[:])
+	return ioutil.WriteFile(path, b.Bytes(), 0444)
+}
+
+// writePackEntry writes the object as an undeltified pack entry.
+func writePackEntry(w io.Writer, typ string, data []byte) error {
+	t := packType(typ)
+	if t == 0 {
+		return fmt.Errorf("cannot pack an object of type %s", typ)
+	}
+	size := len(data)
+	hdr := []byte{byte(t<<4 | size&15)}
+	for size >>= 4; size > 0; size >>= 7 {
+		hdr[len(hdr)-1] |= 0x80
+		hdr = append(hdr, byte(size&0x7f))
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	zw := zlib.NewWriter(w)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// WritePack writes a pack of the objects to w. Objects are stored whole, without deltas.
+func WritePack(repo *Repo, w io.Writer, shas []string) error {
+	h := sha1.New()
+	mw := io.MultiWriter(w, h)
+	hdr := []byte{'P', 'A', 'C', 'K', 0, 0, 0, 2, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(hdr[8:], uint32(len(shas)))
+	if _, err := mw.Write(hdr); err != nil {
+		return err
+	}
+	for _, sha := range shas {
+		typ, data, err := ReadRawObject(repo, sha)
+		if err != nil {
+			return err
+		}
+		if err := writePackEntry(mw, typ, data); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(h.Sum(nil))
+	return err
+}
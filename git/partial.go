@@ -0,0 +1,193 @@
+package git
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// objectFilter is the filter of a partial clone, which omits blobs and trees from the
+// packs a server sends. Objects the client asks for by name are always sent.
+type objectFilter struct {
+	// blobLimit omits the blobs of at least the size if not negative.
+	blobLimit int64
+	// treeDepth omits the trees and blobs at least the depth below the root trees if not
+	// negative.
+	treeDepth int
+}
+
+// parseFilter parses a filter spec: blob:none, blob:limit=<n>[kmg] or tree:<depth>.
+func parseFilter(spec string) (*objectFilter, error) {
+	f := &objectFilter{blobLimit: -1, treeDepth: -1}
+	switch {
+	case spec == "blob:none":
+		f.blobLimit = 0
+	case strings.HasPrefix(spec, "blob:limit="):
+		s := strings.TrimPrefix(spec, "blob:limit=")
+		unit := int64(1)
+		if n := len(s); n > 0 {
+			switch strings.ToLower(s[n-1:]) {
+			case "k":
+				unit = 1 << 10
+			case "m":
+				unit = 1 << 20
+			case "g":
+				unit = 1 << 30
+			}
+			if unit > 1 {
+				s = s[:n-1]
+			}
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid filter-spec '%s'", spec)
+		}
+		f.blobLimit = n * unit
+	case strings.HasPrefix(spec, "tree:"):
+		n, err := strconv.Atoi(strings.TrimPrefix(spec, "tree:"))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid filter-spec '%s'", spec)
+		}
+		f.treeDepth = n
+	default:
+		return nil, fmt.Errorf("invalid filter-spec '%s'", spec)
+	}
+	return f, nil
+}
+
+// allowsTree reports whether a tree at the depth below a root tree, 0 for the root tree
+// itself, is sent.
+func (f *objectFilter) allowsTree(depth int) bool {
+	return f == nil || f.treeDepth < 0 || depth < f.treeDepth
+}
+
+// allowsBlob reports whether the blob at the depth below a root tree is sent.
+func (f *objectFilter) allowsBlob(repo *Repo, sha string, depth int) (bool, error) {
+	if f == nil {
+		return true, nil
+	}
+	if f.treeDepth >= 0 && depth >= f.treeDepth {
+		return false, nil
+	}
+	if f.blobLimit < 0 {
+		return true, nil
+	}
+	if f.blobLimit == 0 {
+		return false, nil
+	}
+	_, data, err := ReadRawObject(repo, sha)
+	if err != nil {
+		return false, err
+	}
+	return int64(len(data)) < f.blobLimit, nil
+}
+
+// packLimits limit the objects packObjects lists for a shallow or a partial clone.
+type packLimits struct {
+	// shallow are the commits whose parents are not walked.
+	shallow map[string]bool
+	// filter omits blobs and trees if not nil.
+	filter *objectFilter
+}
+
+// walkTreeFiltered calls add with the tree and, if add returns true, with the objects in
+// it the filter allows, recursing into subtrees. depth is the depth of the tree below its
+// root tree.
+func walkTreeFiltered(repo *Repo, tree string, depth int, f *objectFilter, add func(sha string) bool) error {
+	if !add(tree) {
+		return nil
+	}
+	_, data, err := ReadRawObject(repo, tree)
+	if err != nil {
+		return err
+	}
+	t, err := parseTree(data)
+	if err != nil {
+		return err
+	}
+	for _, l := range t {
+		switch l.Mode {
+		case "160000":
+		case "40000":
+			if !f.allowsTree(depth + 1) {
+				continue
+			}
+			if err := walkTreeFiltered(repo, l.SHA, depth+1, f, add); err != nil {
+				return err
+			}
+		default:
+			ok, err := f.allowsBlob(repo, l.SHA, depth+1)
+			if err != nil {
+				return err
+			}
+			if ok {
+				add(l.SHA)
+			}
+		}
+	}
+	return nil
+}
+
+// promisorRemote returns the remote a partial clone fetches missing objects from, or "" if
+// the repository is not a partial clone.
+func promisorRemote(repo *Repo) string {
+	return Config(repo, "extensions", "partialClone")
+}
+
+// setPromisorRemote makes the repository a partial clone of the remote with the filter
+// spec, from which the objects it omits are fetched when needed.
+func setPromisorRemote(repo *Repo, remote, filter string) error {
+	for _, kv := range [][3]string{
+		{"core", "repositoryformatversion", "1"},
+		{"extensions", "partialClone", remote},
+		{remoteSection(remote), "promisor", "true"},
+		{remoteSection(remote), "partialclonefilter", filter},
+	} {
+		if err := SetConfig(repo, kv[0], kv[1], kv[2]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchPromisedObjects fetches the objects from the promisor remote with the blob:none
+// filter, as git does when a partial clone misses them.
+func fetchPromisedObjects(repo *Repo, shas []string) error {
+	repo.fetchingPromised = true
+	defer func() { repo.fetchingPromised = false }()
+	url := Config(repo, remoteSection(promisorRemote(repo)), "url")
+	if url == "" {
+		return fmt.Errorf("no URL for promisor remote %s", promisorRemote(repo))
+	}
+	t, err := openTransport(repo, url, clientProtocolVersion(repo))
+	if err != nil {
+		return err
+	}
+	defer t.close()
+	adv, err := t.advertise("git-upload-pack")
+	if err != nil {
+		return err
+	}
+	return fetchPack(repo, t, adv, shas, nil, nil, &fetchArgs{filter: "blob:none"})
+}
+
+// prefetchTree fetches the blobs of the tree a partial clone misses in one request, so
+// that checking the tree out does not fetch them one by one.
+func prefetchTree(repo *Repo, tree string) error {
+	if promisorRemote(repo) == "" {
+		return nil
+	}
+	var missing []string
+	if err := walkTree(repo, tree, func(sha string) bool {
+		if !hasObject(repo, sha) {
+			missing = append(missing, sha)
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fetchPromisedObjects(repo, missing)
+}
@@ -0,0 +1,83 @@
+package git
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// MatchPathspec reports whether the slash separated path p matches any of the pathspecs.
+// A pathspec matches the path itself and the paths under it. A pathspec containing
+// wildcards (*, ? or [...]) is matched against the whole path as git does without the
+// glob magic, so that * also matches slashes. An empty pathspecs matches everything.
+func MatchPathspec(pathspecs []string, p string) bool {
+	if len(pathspecs) == 0 {
+		return true
+	}
+	for _, s := range pathspecs {
+		if matchPathspec(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPathspec(s, p string) bool {
+	s = strings.TrimPrefix(strings.TrimSuffix(s, "/"), "./")
+	if s == "" || s == "." || p == s || strings.HasPrefix(p, s+"/") {
+		return true
+	}
+	if !strings.ContainsAny(s, "*?[") {
+		return false
+	}
+	re, err := globRegexp(s)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(p)
+}
+
+var globCache sync.Map // pattern -> *regexp.Regexp
+
+// globRegexp converts the wildcard pattern into an anchored regexp.
+func globRegexp(pat string) (*regexp.Regexp, error) {
+	if re, ok := globCache.Load(pat); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pat); i++ {
+		switch c := pat[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			j := strings.IndexByte(pat[i+1:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pat[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += j + 1
+		case '\\':
+			if i+1 < len(pat) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("(/.*)?$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, err
+	}
+	globCache.Store(pat, re)
+	return re, nil
+}
@@ -0,0 +1,239 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// pktMax is the maximum length of a pkt-line including its 4 byte length header.
+const pktMax = 65520
+
+// pktKind is the kind of a pkt-line.
+type pktKind int
+
+const (
+	pktData pktKind = iota
+	// pktFlush ("0000") ends a list of lines.
+	pktFlush
+	// pktDelim ("0001") separates sections in protocol v2.
+	pktDelim
+	// pktEnd ("0002") ends a response in stateless protocol v2.
+	pktEnd
+)
+
+// writePkt writes the formatted line as a pkt-line.
+func writePkt(w io.Writer, format string, a ...interface{}) error {
+	return writePktData(w, []byte(fmt.Sprintf(format, a...)))
+}
+
+// writePktData writes b as a pkt-line.
+func writePktData(w io.Writer, b []byte) error {
+	if len(b)+4 > pktMax {
+		return fmt.Errorf("pkt-line too long: %d bytes", len(b))
+	}
+	if _, err := fmt.Fprintf(w, "%04x", len(b)+4); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// writeFlush writes a flush-pkt.
+func writeFlush(w io.Writer) error {
+	_, err := io.WriteString(w, "0000")
+	return err
+}
+
+// writeDelim writes a delim-pkt.
+func writeDelim(w io.Writer) error {
+	_, err := io.WriteString(w, "0001")
+	return err
+}
+
+// pktReader reads pkt-lines.
+type pktReader struct {
+	r *bufio.Reader
+	// peeked is the line returned by peek, to be returned by the next call of next.
+	peeked *pktLine
+}
+
+type pktLine struct {
+	kind pktKind
+	data []byte
+}
+
+func newPktReader(r io.Reader) *pktReader {
+	switch br := r.(type) {
+	case *bufio.Reader:
+		return &pktReader{r: br}
+	case bufferedBody:
+		return &pktReader{r: br.Reader}
+	}
+	return &pktReader{r: bufio.NewReader(r)}
+}
+
+// next returns the next pkt-line. data is nil unless kind is pktData.
+func (p *pktReader) next() (kind pktKind, data []byte, err error) {
+	if l := p.peeked; l != nil {
+		p.peeked = nil
+		return l.kind, l.data, nil
+	}
+	var hdr [4]byte
+	if _, err := io.ReadFull(p.r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n, err := strconv.ParseUint(string(hdr[:]), 16, 16)
+	if err != nil {
+		return 0, nil, fmt.Errorf("bad pkt-line length %q", hdr)
+	}
+	switch n {
+	case 0:
+		return pktFlush, nil, nil
+	case 1:
+		return pktDelim, nil, nil
+	case 2:
+		return pktEnd, nil, nil
+	case 3:
+		return 0, nil, fmt.Errorf("bad pkt-line length %q", hdr)
+	}
+	data = make([]byte, n-4)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return pktData, data, nil
+}
+
+// peek returns the next pkt-line without consuming it.
+func (p *pktReader) peek() (pktKind, []byte, error) {
+	kind, data, err := p.next()
+	if err != nil {
+		return 0, nil, err
+	}
+	p.peeked = &pktLine{kind, data}
+	return kind, data, nil
+}
+
+// readLine returns the next data line without the trailing newline, or flush set to true
+// for a flush-pkt. Other special packets are errors.
+func (p *pktReader) readLine() (line string, flush bool, err error) {
+	kind, data, err := p.next()
+	if err != nil {
+		return "", false, err
+	}
+	switch kind {
+	case pktFlush:
+		return "", true, nil
+	case pktData:
+		return string(bytes.TrimSuffix(data, []byte("\n"))), false, nil
+	}
+	return "", false, errors.New("unexpected special pkt-line")
+}
+
+// Side-band channels.
+const (
+	bandData     = 1
+	bandProgress = 2
+	bandError    = 3
+)
+
+// sidebandReader reads the data sent over side-band channel 1 up to a flush-pkt,
+// writing the progress messages to progress if it is not nil. A message on the error
+// channel is returned as an error.
+type sidebandReader struct {
+	p        *pktReader
+	progress io.Writer
+	buf      []byte
+	// midLine is true if the last progress message did not end a line.
+	midLine bool
+	err     error
+}
+
+func (s *sidebandReader) Read(b []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		kind, data, err := s.p.next()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			s.err = err
+			continue
+		}
+		if kind != pktData {
+			s.err = io.EOF
+			continue
+		}
+		if len(data) == 0 {
+			continue
+		}
+		switch data[0] {
+		case bandData:
+			s.buf = data[1:]
+		case bandProgress:
+			s.writeProgress(data[1:])
+		case bandError:
+			s.err = fmt.Errorf("remote error: %s", bytes.TrimSpace(data[1:]))
+		default:
+			s.err = fmt.Errorf("bad side-band channel %d", data[0])
+		}
+	}
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// writeProgress writes the progress message prefixing each line with "remote: ".
+func (s *sidebandReader) writeProgress(msg []byte) {
+	if s.progress == nil {
+		return
+	}
+	var b bytes.Buffer
+	for len(msg) > 0 {
+		if !s.midLine {
+			b.WriteString("remote: ")
+		}
+		i := bytes.IndexAny(msg, "\r\n")
+		if i < 0 {
+			b.Write(msg)
+			s.midLine = true
+			break
+		}
+		b.Write(msg[:i+1])
+		msg = msg[i+1:]
+		s.midLine = false
+	}
+	s.progress.Write(b.Bytes())
+}
+
+// sidebandWriter writes data to a side-band channel in pkt-lines of at most max bytes,
+// which is pktMax for side-band-64k and 1000 for side-band.
+type sidebandWriter struct {
+	w    io.Writer
+	band byte
+	max  int
+}
+
+func (s *sidebandWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		c := len(b)
+		if c > s.max-5 {
+			c = s.max - 5
+		}
+		if err := writePktData(s.w, append([]byte{s.band}, b[:c]...)); err != nil {
+			return n, err
+		}
+		n += c
+		b = b[c:]
+	}
+	return n, nil
+}
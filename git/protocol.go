@@ -0,0 +1,234 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// agent is sent to the other side in the agent capability.
+const agent = "gogit"
+
+// RemoteRef is a ref advertised by a remote repository.
+type RemoteRef struct {
+	Name, SHA string
+	// Peeled is the object an annotated tag points to, or "" for other refs.
+	Peeled string
+}
+
+// capabilities are the capabilities sent along with a ref advertisement or the first want.
+// Each one is either a name or name=value.
+type capabilities []string
+
+func (c capabilities) has(name string) bool {
+	_, ok := c.value(name)
+	return ok
+}
+
+// value returns the value of the first capability with the name.
+func (c capabilities) value(name string) (string, bool) {
+	for _, s := range c {
+		if s == name {
+			return "", true
+		}
+		if strings.HasPrefix(s, name+"=") {
+			return s[len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
+// symrefs returns the symbolic refs advertised with the symref capability, e.g.
+// HEAD -> refs/heads/master. Those with invalid targets are left out.
+func (c capabilities) symrefs() map[string]string {
+	m := make(map[string]string)
+	for _, s := range c {
+		if !strings.HasPrefix(s, "symref=") {
+			continue
+		}
+		if kv := strings.SplitN(s[len("symref="):], ":", 2); len(kv) == 2 && checkRefName(kv[1]) == nil {
+			m[kv[0]] = kv[1]
+		}
+	}
+	return m
+}
+
+// advertisement is the list of refs and the capabilities a server sends first. A
+// protocol version 2 server sends only the capabilities; the refs are added by lsRefs.
+type advertisement struct {
+	refs    []*RemoteRef
+	caps    capabilities
+	version int
+}
+
+// ref returns the advertised ref with the name, or nil.
+func (a *advertisement) ref(name string) *RemoteRef {
+	for _, r := range a.refs {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// readAdvertisement reads a protocol v0 or v1 ref advertisement, or the capabilities of
+// a protocol v2 server, up to its flush-pkt.
+func readAdvertisement(p *pktReader) (*advertisement, error) {
+	a := &advertisement{}
+	first := true
+	for {
+		l, flush, err := p.readLine()
+		if err == io.EOF {
+			return nil, errors.New("the remote end hung up unexpectedly")
+		} else if err != nil {
+			return nil, err
+		}
+		if flush {
+			return a, nil
+		}
+		if strings.HasPrefix(l, "ERR ") {
+			return nil, fmt.Errorf("remote error: %s", l[len("ERR "):])
+		}
+		if first && l == "version 1" {
+			continue
+		}
+		if first && l == "version 2" {
+			a.version = 2
+		}
+		if a.version == 2 {
+			if !first {
+				a.caps = append(a.caps, l)
+			}
+			first = false
+			continue
+		}
+		if i := strings.IndexByte(l, 0); i >= 0 {
+			if first {
+				a.caps = strings.Fields(l[i+1:])
+			}
+			l = l[:i]
+		}
+		first = false
+		fs := strings.Fields(l)
+		if len(fs) != 2 || len(fs[0]) != 40 {
+			if strings.HasPrefix(l, "shallow ") {
+				continue
+			}
+			return nil, fmt.Errorf("protocol error: unexpected %q", l)
+		}
+		sha, name := fs[0], fs[1]
+		switch {
+		case name == "capabilities^{}":
+		case strings.HasSuffix(name, "^{}"):
+			if n := len(a.refs); n > 0 && a.refs[n-1].Name == strings.TrimSuffix(name, "^{}") {
+				a.refs[n-1].Peeled = sha
+			}
+		case checkRefName(name) != nil:
+			// As with git, refs with invalid names are ignored.
+		default:
+			a.refs = append(a.refs, &RemoteRef{Name: name, SHA: sha})
+		}
+	}
+}
+
+// ProtocolVersion returns the protocol version requested by the value of GIT_PROTOCOL or
+// the Git-Protocol header, a colon separated list of key[=value], or 0 if none is.
+func ProtocolVersion(s string) int {
+	v := 0
+	for _, kv := range strings.Split(s, ":") {
+		if strings.HasPrefix(kv, "version=") {
+			if n, err := strconv.Atoi(kv[len("version="):]); err == nil && n > v {
+				v = n
+			}
+		}
+	}
+	return v
+}
+
+// writeVersion writes the "version 1" line which starts a protocol version 1 response.
+func writeVersion(w io.Writer, version int) error {
+	if version != 1 {
+		return nil
+	}
+	return writePkt(w, "version 1\n")
+}
+
+// writeAdvertisement writes the refs of the repository as a protocol v0 ref advertisement
+// with the capabilities: HEAD first, and then the refs sorted by name, each annotated tag
+// followed by the object it peels to.
+func writeAdvertisement(w io.Writer, refs []*RemoteRef, caps capabilities) error {
+	if len(refs) == 0 {
+		refs = []*RemoteRef{{Name: "capabilities^{}", SHA: ZeroSHA}}
+	}
+	for i, r := range refs {
+		var err error
+		if i == 0 {
+			err = writePkt(w, "%s %s\x00%s\n", r.SHA, r.Name, strings.Join(caps, " "))
+		} else {
+			err = writePkt(w, "%s %s\n", r.SHA, r.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if r.Peeled != "" {
+			if err := writePkt(w, "%s %s^{}\n", r.Peeled, r.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return writeFlush(w)
+}
+
+// advertisedRefs returns HEAD, if it points to a commit, and the refs of the repository
+// sorted by name, with annotated tags peeled.
+func advertisedRefs(repo *Repo) ([]*RemoteRef, error) {
+	m, err := AllRefs(repo)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var res []*RemoteRef
+	if _, sha, err := Head(repo); err == nil && sha != "" {
+		res = append(res, &RemoteRef{Name: "HEAD", SHA: sha})
+	}
+	for _, n := range names {
+		r := &RemoteRef{Name: n, SHA: m[n]}
+		if strings.HasPrefix(n, "refs/tags/") {
+			p, err := peelTag(repo, r.SHA)
+			if err != nil {
+				return nil, err
+			}
+			if p != r.SHA {
+				r.Peeled = p
+			}
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// peelTag returns the object the chain of tags starting at sha points to, or sha if it is
+// not a tag.
+func peelTag(repo *Repo, sha string) (string, error) {
+	for {
+		typ, data, err := ReadRawObject(repo, sha)
+		if err != nil {
+			return "", err
+		}
+		if typ != "tag" {
+			return sha, nil
+		}
+		o, err := newTag(repo).Decode(data)
+		if err != nil {
+			return "", err
+		}
+		sha = o.KVLM.Get("object")[0]
+	}
+}
@@ -0,0 +1,612 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Protocol version 2 replaces the ref advertisement with a list of capabilities, after
+// which the client sends commands: ls-refs lists the refs it asks for, fetch negotiates
+// and sends a pack, and object-info tells the sizes of objects. Each request is
+// "command=<name>", capabilities, a delim-pkt and arguments up to a flush-pkt.
+
+// uploadPackV2Caps are the capabilities UploadPack advertises for protocol version 2.
+var uploadPackV2Caps = capabilities{"agent=" + agent, "ls-refs=unborn", "fetch=shallow wait-for-done filter", "object-format=sha1", "object-info"}
+
+// uploadPackV2 serves UploadPack for protocol version 2. A stateless request is a single
+// command; otherwise commands are served until the client sends a flush-pkt or hangs up.
+func uploadPackV2(repo *Repo, r io.Reader, w io.Writer, opts *UploadPackOptions) error {
+	if !opts.StatelessRPC {
+		if err := writePkt(w, "version 2\n"); err != nil {
+			return err
+		}
+		for _, c := range uploadPackV2Caps {
+			if err := writePkt(w, "%s\n", c); err != nil {
+				return err
+			}
+		}
+		if err := writeFlush(w); err != nil {
+			return err
+		}
+	}
+	if opts.AdvertiseRefs {
+		return nil
+	}
+	p := newPktReader(r)
+	for {
+		cmd, args, err := readCommand(p)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch cmd {
+		case "ls-refs":
+			err = serveLsRefs(repo, w, args)
+		case "fetch":
+			err = serveFetch(repo, w, args)
+		case "object-info":
+			err = serveObjectInfo(repo, w, args)
+		default:
+			writePkt(w, "ERR invalid command '%s'\n", cmd)
+			err = fmt.Errorf("invalid command '%s'", cmd)
+		}
+		if err != nil || opts.StatelessRPC {
+			return err
+		}
+	}
+}
+
+// readCommand reads a request of protocol version 2, returning the command and its
+// arguments. The capabilities sent with the command are skipped. io.EOF is returned if
+// the client hangs up or sends a flush-pkt instead.
+func readCommand(p *pktReader) (cmd string, args []string, err error) {
+	kind, data, err := p.next()
+	if err != nil {
+		return "", nil, err
+	}
+	if kind == pktFlush {
+		return "", nil, io.EOF
+	}
+	l := strings.TrimSuffix(string(data), "\n")
+	if kind != pktData || !strings.HasPrefix(l, "command=") {
+		return "", nil, fmt.Errorf("protocol error: expected command, got %q", l)
+	}
+	cmd = strings.TrimPrefix(l, "command=")
+	inArgs := false
+	for {
+		kind, data, err := p.next()
+		if err == io.EOF {
+			return "", nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return "", nil, err
+		}
+		switch {
+		case kind == pktFlush:
+			return cmd, args, nil
+		case kind == pktDelim && !inArgs:
+			inArgs = true
+		case kind == pktData && inArgs:
+			args = append(args, strings.TrimSuffix(string(data), "\n"))
+		case kind != pktData:
+			return "", nil, errors.New("protocol error: unexpected special pkt-line")
+		}
+	}
+}
+
+// serveLsRefs answers ls-refs with the refs whose names start with one of the ref-prefix
+// arguments, HEAD first.
+func serveLsRefs(repo *Repo, w io.Writer, args []string) error {
+	var symrefs, peel, unborn bool
+	var prefixes []string
+	for _, a := range args {
+		switch {
+		case a == "symrefs":
+			symrefs = true
+		case a == "peel":
+			peel = true
+		case a == "unborn":
+			unborn = true
+		case strings.HasPrefix(a, "ref-prefix "):
+			prefixes = append(prefixes, strings.TrimPrefix(a, "ref-prefix "))
+		default:
+			return fmt.Errorf("protocol error: unexpected line %q", a)
+		}
+	}
+	match := func(name string) bool {
+		if len(prefixes) == 0 {
+			return true
+		}
+		for _, p := range prefixes {
+			if strings.HasPrefix(name, p) {
+				return true
+			}
+		}
+		return false
+	}
+
+	branch, sha, err := Head(repo)
+	if err != nil {
+		return err
+	}
+	if unborn && branch != "" && sha == "" && match("HEAD") {
+		l := "unborn HEAD"
+		if symrefs {
+			l += " symref-target:" + branch
+		}
+		if err := writePkt(w, "%s\n", l); err != nil {
+			return err
+		}
+	}
+	refs, err := advertisedRefs(repo)
+	if err != nil {
+		return err
+	}
+	for _, r := range refs {
+		if !match(r.Name) {
+			continue
+		}
+		l := r.SHA + " " + r.Name
+		if symrefs && r.Name == "HEAD" && branch != "" {
+			l += " symref-target:" + branch
+		}
+		if peel && r.Peeled != "" {
+			l += " peeled:" + r.Peeled
+		}
+		if err := writePkt(w, "%s\n", l); err != nil {
+			return err
+		}
+	}
+	return writeFlush(w)
+}
+
+// serveFetch answers fetch. Until the client is done, the haves the repository has are
+// acknowledged, and the pack is sent only if each want has one of them as an ancestor
+// and the client does not wait for done.
+func serveFetch(repo *Repo, w io.Writer, args []string) error {
+	var wants, haves []string
+	var done, waitForDone, includeTag, noProgress bool
+	var deepen deepenRequest
+	limits := &packLimits{}
+	for _, a := range args {
+		if ok, err := deepen.parseLine(a); err != nil {
+			return err
+		} else if ok {
+			continue
+		}
+		var err error
+		switch {
+		case strings.HasPrefix(a, "filter "):
+			if limits.filter, err = parseFilter(strings.TrimPrefix(a, "filter ")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(a, "want "):
+			wants = append(wants, strings.TrimPrefix(a, "want "))
+		case strings.HasPrefix(a, "have "):
+			haves = append(haves, strings.TrimPrefix(a, "have "))
+		case a == "done":
+			done = true
+		case a == "wait-for-done":
+			waitForDone = true
+		case a == "include-tag":
+			includeTag = true
+		case a == "no-progress":
+			noProgress = true
+		case a == "thin-pack" || a == "ofs-delta":
+		default:
+			return fmt.Errorf("protocol error: unexpected line %q", a)
+		}
+	}
+	if len(wants) == 0 {
+		return errors.New("protocol error: expected want")
+	}
+	if err := checkWants(repo, wants); err != nil {
+		writePkt(w, "ERR upload-pack: %v\n", err)
+		return err
+	}
+	var common []string
+	for _, sha := range haves {
+		if hasObject(repo, sha) {
+			common = append(common, sha)
+		}
+	}
+
+	if !done {
+		if err := writePkt(w, "acknowledgments\n"); err != nil {
+			return err
+		}
+		if len(common) == 0 {
+			if err := writePkt(w, "NAK\n"); err != nil {
+				return err
+			}
+		}
+		for _, sha := range common {
+			if err := writePkt(w, "ACK %s\n", sha); err != nil {
+				return err
+			}
+		}
+		if waitForDone || !readyToSend(repo, wants, common) {
+			return writeFlush(w)
+		}
+		if err := writePkt(w, "ready\n"); err != nil {
+			return err
+		}
+		if err := writeDelim(w); err != nil {
+			return err
+		}
+	}
+
+	if deepen.shallowInfo() {
+		if err := writePkt(w, "shallow-info\n"); err != nil {
+			return err
+		}
+		l, more, err := deepen.writeShallowInfo(repo, w, wants)
+		if err != nil {
+			return err
+		}
+		if err := writeDelim(w); err != nil {
+			return err
+		}
+		limits.shallow, wants = l.shallow, append(wants, more...)
+	}
+	if err := writePkt(w, "packfile\n"); err != nil {
+		return err
+	}
+	var tags []*RemoteRef
+	if includeTag {
+		refs, err := advertisedRefs(repo)
+		if err != nil {
+			return err
+		}
+		tags = refs
+	}
+	if err := writePackResponse(repo, w, wants, common, tags, limits, pktMax, !noProgress); err != nil {
+		return err
+	}
+	return writeFlush(w)
+}
+
+// readyToSend returns whether each of the wants has one of the common objects as an
+// ancestor, so that negotiating further would not make the pack much smaller.
+func readyToSend(repo *Repo, wants, common []string) bool {
+	for _, want := range wants {
+		if c, err := peelTag(repo, want); err == nil {
+			want = c
+		}
+		found := false
+		for _, c := range common {
+			if ok, err := IsAncestor(repo, c, want); err == nil && ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// serveObjectInfo answers object-info with the sizes of the objects if the size
+// attribute is asked for. Nothing but the name is written for a missing object.
+func serveObjectInfo(repo *Repo, w io.Writer, args []string) error {
+	size := false
+	var oids []string
+	for _, a := range args {
+		switch {
+		case a == "size":
+			size = true
+		case strings.HasPrefix(a, "oid "):
+			oids = append(oids, strings.TrimPrefix(a, "oid "))
+		default:
+			return fmt.Errorf("protocol error: unexpected line %q", a)
+		}
+	}
+	if size {
+		if err := writePkt(w, "size\n"); err != nil {
+			return err
+		}
+	}
+	for _, oid := range oids {
+		l := oid
+		if _, data, err := ReadRawObject(repo, oid); err == nil && size {
+			l += fmt.Sprintf(" %d", len(data))
+		}
+		if err := writePkt(w, "%s\n", l); err != nil {
+			return err
+		}
+	}
+	return writeFlush(w)
+}
+
+// writeCommand writes the start of a protocol version 2 request of the command up to the
+// delim-pkt before its arguments.
+func writeCommand(w io.Writer, cmd string, caps capabilities) {
+	writePkt(w, "command=%s\n", cmd)
+	if caps.has("agent") {
+		writePkt(w, "agent=%s\n", agent)
+	}
+	writeDelim(w)
+}
+
+// hasFeature returns whether the server advertises the capability with the feature in
+// its space separated value, e.g. wait-for-done of fetch=shallow wait-for-done.
+func (c capabilities) hasFeature(name, feature string) bool {
+	v, _ := c.value(name)
+	for _, f := range strings.Fields(v) {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// lsRefs asks a protocol version 2 server for the refs whose names start with one of the
+// prefixes, or all the refs if there is none, and adds them to the advertisement along
+// with the symref capability for HEAD, as a version 0 server advertises them.
+func lsRefs(t transport, adv *advertisement, prefixes []string) error {
+	var b bytes.Buffer
+	writeCommand(&b, "ls-refs", adv.caps)
+	writePkt(&b, "symrefs\n")
+	writePkt(&b, "peel\n")
+	if adv.caps.hasFeature("ls-refs", "unborn") {
+		writePkt(&b, "unborn\n")
+	}
+	for _, p := range prefixes {
+		writePkt(&b, "ref-prefix %s\n", p)
+	}
+	writeFlush(&b)
+
+	resp, err := t.request("git-upload-pack", b.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	p := newPktReader(resp)
+	for {
+		l, flush, err := p.readLine()
+		if err == io.EOF {
+			return errors.New("the remote end hung up unexpectedly")
+		} else if err != nil {
+			return err
+		}
+		if flush {
+			return nil
+		}
+		if strings.HasPrefix(l, "ERR ") {
+			return fmt.Errorf("remote error: %s", l[len("ERR "):])
+		}
+		fs := strings.Fields(l)
+		if len(fs) < 2 || len(fs[0]) != 40 && fs[0] != "unborn" {
+			return fmt.Errorf("protocol error: unexpected %q", l)
+		}
+		r := &RemoteRef{Name: fs[1], SHA: fs[0]}
+		for _, a := range fs[2:] {
+			switch {
+			case strings.HasPrefix(a, "symref-target:"):
+				adv.caps = append(adv.caps, "symref="+r.Name+":"+strings.TrimPrefix(a, "symref-target:"))
+			case strings.HasPrefix(a, "peeled:"):
+				r.Peeled = strings.TrimPrefix(a, "peeled:")
+			}
+		}
+		// As with git, refs with invalid names are ignored.
+		if r.SHA != "unborn" && checkRefName(r.Name) == nil {
+			adv.refs = append(adv.refs, r)
+		}
+	}
+}
+
+// havesPerRound is the number of haves fetchPackV2 adds in each round of negotiation.
+const havesPerRound = 32
+
+// fetchPackV2 is fetchPack for a protocol version 2 server. The haves are sent in rounds
+// until the server is ready to send the pack or they run out, and then the haves the
+// server has are sent with done.
+func fetchPackV2(repo *Repo, t transport, adv *advertisement, wants, haves, shallow []string, progress io.Writer, args *fetchArgs) error {
+	var common []string
+	acked := make(map[string]bool)
+	request := func(haves []string, done bool) (io.ReadCloser, error) {
+		var b bytes.Buffer
+		writeCommand(&b, "fetch", adv.caps)
+		writePkt(&b, "thin-pack\n")
+		writePkt(&b, "ofs-delta\n")
+		writePkt(&b, "include-tag\n")
+		if progress == nil {
+			writePkt(&b, "no-progress\n")
+		}
+		for _, sha := range wants {
+			writePkt(&b, "want %s\n", sha)
+		}
+		args.writeLines(&b, shallow)
+		for _, sha := range haves {
+			writePkt(&b, "have %s\n", sha)
+		}
+		if done {
+			writePkt(&b, "done\n")
+		}
+		writeFlush(&b)
+		return t.request("git-upload-pack", b.Bytes())
+	}
+	for len(haves) > 0 {
+		n := havesPerRound
+		if n > len(haves) {
+			n = len(haves)
+		}
+		sent := append(append([]string(nil), common...), haves[:n]...)
+		haves = haves[n:]
+		resp, err := request(sent, false)
+		if err != nil {
+			return err
+		}
+		p := newPktReader(resp)
+		acks, ready, err := readAcknowledgments(p)
+		if err == nil && ready {
+			err = readPackfile(repo, p, progress)
+		}
+		resp.Close()
+		if err != nil || ready {
+			return err
+		}
+		for _, sha := range acks {
+			if !acked[sha] {
+				acked[sha] = true
+				common = append(common, sha)
+			}
+		}
+	}
+	resp, err := request(common, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	return readPackfile(repo, newPktReader(resp), progress)
+}
+
+// readAcknowledgments reads the acknowledgments section of a fetch response, returning
+// the acknowledged objects and whether the server is ready to send the pack, which
+// follows the section then.
+func readAcknowledgments(p *pktReader) (acks []string, ready bool, err error) {
+	if err := expectSection(p, "acknowledgments"); err != nil {
+		return nil, false, err
+	}
+	for {
+		kind, data, err := p.next()
+		if err == io.EOF {
+			return nil, false, errors.New("the remote end hung up unexpectedly")
+		} else if err != nil {
+			return nil, false, err
+		}
+		l := strings.TrimSuffix(string(data), "\n")
+		switch {
+		case kind == pktFlush:
+			if ready {
+				return nil, false, errors.New("protocol error: expected packfile after ready")
+			}
+			return acks, false, nil
+		case kind == pktDelim:
+			if !ready {
+				return nil, false, errors.New("protocol error: unexpected delim-pkt before ready")
+			}
+			return acks, true, nil
+		case kind != pktData:
+			return nil, false, errors.New("protocol error: unexpected special pkt-line")
+		case l == "NAK":
+		case l == "ready":
+			ready = true
+		case strings.HasPrefix(l, "ACK "):
+			acks = append(acks, strings.TrimPrefix(l, "ACK "))
+		default:
+			return nil, false, fmt.Errorf("protocol error: unexpected %q", l)
+		}
+	}
+}
+
+// readPackfile reads the sections of a fetch response after the acknowledgments, updating
+// the shallow file as the shallow-info section tells and indexing the pack sent in the
+// packfile section over the side-band.
+func readPackfile(repo *Repo, p *pktReader, progress io.Writer) error {
+	update := &shallowUpdate{}
+	for {
+		kind, data, err := p.next()
+		if err == io.EOF {
+			return errors.New("the remote end hung up unexpectedly")
+		} else if err != nil {
+			return err
+		}
+		l := strings.TrimSuffix(string(data), "\n")
+		switch {
+		case kind != pktData:
+			return errors.New("protocol error: expected packfile")
+		case strings.HasPrefix(l, "ERR "):
+			return fmt.Errorf("remote error: %s", l[len("ERR "):])
+		case l == "packfile":
+			if err := indexFetchedPack(repo, &sidebandReader{p: p, progress: progress}); err != nil {
+				return err
+			}
+			return updateShallow(repo, update)
+		case l == "shallow-info":
+			if update, err = readShallowUpdate(p); err != nil {
+				return err
+			}
+			continue
+		}
+		// Another section, e.g. wanted-refs, up to the delim-pkt.
+		for kind == pktData {
+			if kind, _, err = p.next(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// expectSection reads the header line of a response section, which must be the name.
+func expectSection(p *pktReader, name string) error {
+	l, flush, err := p.readLine()
+	if err == io.EOF {
+		return errors.New("the remote end hung up unexpectedly")
+	} else if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(l, "ERR "):
+		return fmt.Errorf("remote error: %s", l[len("ERR "):])
+	case flush || l != name:
+		return fmt.Errorf("protocol error: expected %s, got %q", name, l)
+	}
+	return nil
+}
+
+// RemoteObjectSizes asks the protocol version 2 server at url, with the object-info
+// command, for the sizes of the objects. Objects the server does not have are missing
+// from the result. Without a repository, ext:: URLs are allowed only by GIT_ALLOW_PROTOCOL.
+func RemoteObjectSizes(url string, shas []string) (map[string]int64, error) {
+	t, err := openTransport(nil, url, 2)
+	if err != nil {
+		return nil, err
+	}
+	defer t.close()
+	adv, err := t.advertise("git-upload-pack")
+	if err != nil {
+		return nil, err
+	}
+	if adv.version != 2 || !adv.caps.has("object-info") {
+		return nil, errors.New("the server does not support object-info")
+	}
+	var b bytes.Buffer
+	writeCommand(&b, "object-info", adv.caps)
+	writePkt(&b, "size\n")
+	for _, sha := range shas {
+		writePkt(&b, "oid %s\n", sha)
+	}
+	writeFlush(&b)
+	resp, err := t.request("git-upload-pack", b.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	p := newPktReader(resp)
+	if err := expectSection(p, "size"); err != nil {
+		return nil, err
+	}
+	res := make(map[string]int64)
+	for {
+		l, flush, err := p.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if flush {
+			return res, nil
+		}
+		fs := strings.Fields(l)
+		if len(fs) == 2 {
+			var n int64
+			if _, err := fmt.Sscan(fs[1], &n); err != nil {
+				return nil, fmt.Errorf("protocol error: unexpected %q", l)
+			}
+			res[fs[0]] = n
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// PushOptions are options of Push.
+type PushOptions struct {
+	// Refspecs are pushed instead of the current branch if not empty.
+	Refspecs []string
+	// Force allows non fast-forward updates of all the refs.
+	Force bool
+	// Progress receives the progress messages of the remote if not nil.
+	Progress io.Writer
+}
+
+// PushResult is the result of Push.
+type PushResult struct {
+	// URL is the URL pushed to.
+	URL     string
+	Updates []*RefUpdate
+}
+
+// Push updates the refs of the remote, which is the name of a configured remote or a URL,
+// from the local refs the refspecs name, sending the objects the remote is missing.
+// Without refspecs, the current branch is pushed to its upstream branch, which must have
+// the same name, as with push.default=simple. A refspec without a source deletes the
+// remote ref. Non fast-forward updates without force are rejected, and so are those the
+// remote refuses; both are reported in the result. The remote-tracking refs of a configured
+// remote are updated to what was pushed.
+func Push(repo *Repo, remote string, opts *PushOptions) (*PushResult, error) {
+	branch, _, err := Head(repo)
+	if err != nil {
+		return nil, err
+	}
+	upstreamRemote := Config(repo, branchSection(ShortRefName(branch)), "remote")
+	if upstreamRemote == "" {
+		upstreamRemote = "origin"
+	}
+	if remote == "" {
+		remote = upstreamRemote
+	}
+	url := Config(repo, remoteSection(remote), "url")
+	var tracking *Refspec
+	if url != "" {
+		if s := Config(repo, remoteSection(remote), "fetch"); s != "" {
+			if tracking, err = ParseRefspec(s); err != nil {
+				return nil, err
+			}
+		}
+	} else if isURL(remote) {
+		url = remote
+	} else {
+		return nil, fmt.Errorf("'%s' does not appear to be a git repository", remote)
+	}
+
+	var specs []*Refspec
+	for _, s := range opts.Refspecs {
+		rs, err := ParseRefspec(s)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, rs)
+	}
+	if len(specs) == 0 {
+		if branch == "" {
+			return nil, errors.New("You are not currently on a branch.")
+		}
+		dst := branch
+		if remote == upstreamRemote {
+			merge := Config(repo, branchSection(ShortRefName(branch)), "merge")
+			if merge == "" {
+				return nil, fmt.Errorf("The current branch %s has no upstream branch.", ShortRefName(branch))
+			}
+			if merge != branch {
+				return nil, errors.New("The upstream branch of your current branch does not match the name of your current branch.")
+			}
+		}
+		specs = []*Refspec{{Src: branch, Dst: dst}}
+	}
+
+	t, err := openTransport(repo, url, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer t.close()
+	adv, err := t.advertise("git-receive-pack")
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []*RefUpdate
+	dsts := make(map[string]bool)
+	add := func(u *RefUpdate) {
+		if !dsts[u.Remote] {
+			dsts[u.Remote] = true
+			updates = append(updates, u)
+		}
+	}
+	for _, s := range specs {
+		force := s.Force || opts.Force
+		if s.glob() {
+			refs, err := AllRefs(repo)
+			if err != nil {
+				return nil, err
+			}
+			var names []string
+			for n := range refs {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if dst, ok := s.match(name); ok {
+					add(pushUpdate(repo, adv, name, refs[name], dst, force))
+				}
+			}
+			continue
+		}
+		if s.Src == "" {
+			r := expandRemoteRef(adv.refs, s.Dst)
+			if r == nil {
+				return nil, fmt.Errorf("unable to delete '%s': remote ref does not exist", s.Dst)
+			}
+			add(&RefUpdate{Remote: r.Name, Old: r.SHA, New: ZeroSHA, Status: UpdateDeleted})
+			continue
+		}
+		name, sha, err := pushSource(repo, s.Src)
+		if err != nil {
+			return nil, err
+		}
+		dst := s.Dst
+		if dst == "" {
+			dst = name
+		}
+		if !strings.HasPrefix(dst, "refs/") {
+			if r := expandRemoteRef(adv.refs, dst); r != nil {
+				dst = r.Name
+			} else if strings.HasPrefix(name, "refs/tags/") {
+				dst = "refs/tags/" + dst
+			} else if strings.HasPrefix(name, "refs/heads/") {
+				dst = "refs/heads/" + dst
+			} else {
+				return nil, fmt.Errorf("The destination you provided is not a full refname (i.e., starting with \"refs/\"): %s", s.Dst)
+			}
+		}
+		add(pushUpdate(repo, adv, name, sha, dst, force))
+	}
+
+	if err := sendPack(repo, t, adv, updates, opts.Progress); err != nil {
+		return nil, err
+	}
+
+	if tracking != nil {
+		for _, u := range updates {
+			local, ok := tracking.match(u.Remote)
+			if !ok || u.Status.Rejected() {
+				continue
+			}
+			if u.Status == UpdateDeleted {
+				err = DeleteRef(repo, local)
+			} else {
+				err = UpdateRef(repo, local, u.New, "", "update by push")
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &PushResult{URL: url, Updates: updates}, nil
+}
+
+// pushSource returns the full name of the local ref name refers to and the object it
+// points to. The name is "" if name is not a ref but another revision.
+func pushSource(repo *Repo, name string) (string, string, error) {
+	if name == "HEAD" {
+		branch, sha, err := Head(repo)
+		if err == nil && sha != "" {
+			return branch, sha, nil
+		}
+	}
+	for _, f := range []string{"%s", "refs/heads/%s", "refs/tags/%s", "refs/remotes/%s"} {
+		full := fmt.Sprintf(f, name)
+		if !strings.HasPrefix(full, "refs/") {
+			continue
+		}
+		if sha, err := ReadRef(repo, full); err == nil {
+			return full, sha, nil
+		}
+	}
+	sha, err := ResolveRevision(repo, name, "")
+	if err != nil {
+		return "", "", fmt.Errorf("src refspec %s does not match any", name)
+	}
+	return "", sha, nil
+}
+
+// pushUpdate returns the update of the remote ref dst to sha from the local ref name,
+// rejected if it is not a fast-forward and force is false.
+func pushUpdate(repo *Repo, adv *advertisement, name, sha, dst string, force bool) *RefUpdate {
+	u := &RefUpdate{Remote: dst, Local: name, Old: ZeroSHA, New: sha}
+	if r := adv.ref(dst); r != nil {
+		u.Old = r.SHA
+	}
+	switch {
+	case u.Old == u.New:
+		u.Status = UpdateUpToDate
+	case u.Old == ZeroSHA:
+		u.Status = UpdateNew
+	case strings.HasPrefix(dst, "refs/tags/") && !force:
+		u.Status = UpdateRejectedTag
+	default:
+		ff := false
+		if hasObject(repo, u.Old) {
+			ff, _ = IsAncestor(repo, u.Old, u.New)
+		}
+		switch {
+		case ff:
+			u.Status = UpdateFastForward
+		case force:
+			u.Status = UpdateForced
+		case !hasObject(repo, u.Old):
+			u.Status = UpdateRejectedFetchFirst
+		default:
+			u.Status = UpdateRejected
+		}
+	}
+	return u
+}
+
+// sendPack sends the updates which are neither up to date nor rejected to the remote
+// with a pack of the objects they need, and records the refusals the remote reports.
+func sendPack(repo *Repo, t transport, adv *advertisement, updates []*RefUpdate, progress io.Writer) error {
+	var sent []*RefUpdate
+	var wants, haves []string
+	for _, u := range updates {
+		if u.Status == UpdateUpToDate || u.Status.Rejected() {
+			continue
+		}
+		sent = append(sent, u)
+		if u.New != ZeroSHA {
+			wants = append(wants, u.New)
+		}
+	}
+	if len(sent) == 0 {
+		return nil
+	}
+	for _, r := range adv.refs {
+		if hasObject(repo, r.SHA) {
+			haves = append(haves, r.SHA)
+		}
+	}
+
+	caps := []string{"report-status"}
+	sideband := adv.caps.has("side-band-64k")
+	if sideband {
+		caps = append(caps, "side-band-64k")
+	}
+	if progress == nil && adv.caps.has("quiet") {
+		caps = append(caps, "quiet")
+	}
+	if adv.caps.has("agent") {
+		caps = append(caps, "agent="+agent)
+	}
+	var b bytes.Buffer
+	for i, u := range sent {
+		if i == 0 {
+			writePkt(&b, "%s %s %s\x00%s\n", u.Old, u.New, u.Remote, strings.Join(caps, " "))
+		} else {
+			writePkt(&b, "%s %s %s\n", u.Old, u.New, u.Remote)
+		}
+	}
+	writeFlush(&b)
+	if len(wants) > 0 {
+		shas, err := packObjects(repo, wants, haves, nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := WritePack(repo, &b, shas); err != nil {
+			return err
+		}
+	}
+
+	resp, err := t.request("git-receive-pack", b.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Close()
+	p := newPktReader(resp)
+	if sideband {
+		p = newPktReader(&sidebandReader{p: p, progress: progress})
+	}
+	l, _, err := p.readLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(l, "unpack ") {
+		return fmt.Errorf("protocol error: expected unpack status, got %q", l)
+	}
+	if l != "unpack ok" {
+		return fmt.Errorf("remote unpack failed: %s", strings.TrimPrefix(l, "unpack "))
+	}
+	for {
+		l, flush, err := p.readLine()
+		if err != nil {
+			return err
+		}
+		if flush {
+			return nil
+		}
+		fs := strings.SplitN(l, " ", 3)
+		if len(fs) < 2 || fs[0] != "ok" && fs[0] != "ng" {
+			return fmt.Errorf("protocol error: unexpected %q", l)
+		}
+		if fs[0] == "ok" {
+			continue
+		}
+		for _, u := range sent {
+			if u.Remote == fs[1] {
+				u.Status = UpdateRemoteRejected
+				if len(fs) == 3 {
+					u.Reason = fs[2]
+				}
+			}
+		}
+	}
+}
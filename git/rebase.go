@@ -0,0 +1,1235 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ogiekako/gogit/diff"
+)
+
+// The files recording a rebase in progress. The state is kept in the rebase-merge directory
+// in the same layout as git does, so that either can resume a rebase the other stopped.
+const (
+	rebaseMergeDir = "rebase-merge"
+	rebaseHeadFile = "REBASE_HEAD"
+	detachedHead   = "detached HEAD"
+)
+
+// RebaseCommand is a command of the todo list of a rebase.
+type RebaseCommand int
+
+const (
+	// RebasePick applies the change made by the commit.
+	RebasePick RebaseCommand = iota
+	// RebaseReword picks the commit and lets the message be edited.
+	RebaseReword
+	// RebaseEdit picks the commit and stops for amending it.
+	RebaseEdit
+	// RebaseSquash melds the change into the previous commit, combining the messages.
+	RebaseSquash
+	// RebaseFixup melds the change into the previous commit, discarding the message.
+	RebaseFixup
+	// RebaseDrop removes the commit.
+	RebaseDrop
+	// RebaseExec runs a shell command, stopping if it fails.
+	RebaseExec
+	// RebaseBreak stops the rebase.
+	RebaseBreak
+)
+
+var rebaseCommandWords = []string{"pick", "reword", "edit", "squash", "fixup", "drop", "exec", "break"}
+
+// String returns the word of the command in the todo list, such as "pick".
+func (c RebaseCommand) String() string {
+	return rebaseCommandWords[c]
+}
+
+// parseRebaseCommand parses the word of a command in the todo list, which may be abbreviated
+// to its first letter.
+func parseRebaseCommand(w string) (RebaseCommand, bool) {
+	for i, cw := range rebaseCommandWords {
+		if w == cw || w == cw[:1] || w == "x" && cw == "exec" {
+			return RebaseCommand(i), true
+		}
+	}
+	return 0, false
+}
+
+// rebaseItem is a line of the todo list of a rebase.
+type rebaseItem struct {
+	cmd RebaseCommand
+	// sha is the commit of the commands other than exec and break.
+	sha string
+	// arg is the shell command of exec, or the rest of the line after the commit, usually
+	// its subject.
+	arg string
+}
+
+// format formats the item as a line of the todo list, with the commit abbreviated if short
+// is true.
+func (it *rebaseItem) format(short bool) string {
+	switch it.cmd {
+	case RebaseExec:
+		return "exec " + it.arg
+	case RebaseBreak:
+		return "break"
+	}
+	sha := it.sha
+	if short {
+		sha = sha[:7]
+	}
+	if it.arg == "" {
+		return it.cmd.String() + " " + sha
+	}
+	return it.cmd.String() + " " + sha + " " + it.arg
+}
+
+// squashes reports whether the command melds the commit into the previous one.
+func (it *rebaseItem) squashes() bool {
+	return it.cmd == RebaseSquash || it.cmd == RebaseFixup
+}
+
+// parseRebaseTodo parses the todo list, ignoring empty lines and comments, and resolving the
+// commits to their full SHAs.
+func parseRebaseTodo(repo *Repo, s string) ([]rebaseItem, error) {
+	var todo []rebaseItem
+	for i, l := range strings.Split(s, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") || l == "noop" {
+			continue
+		}
+		f := strings.SplitN(l, " ", 2)
+		cmd, ok := parseRebaseCommand(f[0])
+		if !ok {
+			return nil, fmt.Errorf("invalid line %d of the todo list: %s", i+1, l)
+		}
+		it := rebaseItem{cmd: cmd}
+		switch {
+		case cmd == RebaseBreak:
+		case cmd == RebaseExec:
+			if len(f) < 2 {
+				return nil, fmt.Errorf("missing command on line %d of the todo list: %s", i+1, l)
+			}
+			it.arg = strings.TrimSpace(f[1])
+		case len(f) < 2:
+			return nil, fmt.Errorf("missing commit on line %d of the todo list: %s", i+1, l)
+		default:
+			rest := strings.SplitN(strings.TrimSpace(f[1]), " ", 2)
+			sha, err := ResolveRevision(repo, rest[0], "commit")
+			if err != nil {
+				return nil, fmt.Errorf("invalid line %d of the todo list: %s", i+1, l)
+			}
+			it.sha = sha
+			if len(rest) == 2 {
+				it.arg = strings.TrimSpace(rest[1])
+			}
+		}
+		todo = append(todo, it)
+	}
+	return todo, nil
+}
+
+func formatRebaseTodo(todo []rebaseItem, short bool) string {
+	var b strings.Builder
+	for i := range todo {
+		b.WriteString(todo[i].format(short) + "\n")
+	}
+	return b.String()
+}
+
+const rebaseTodoHelp = `#
+# Commands:
+# p, pick <commit> = use commit
+# r, reword <commit> = use commit, but edit the commit message
+# e, edit <commit> = use commit, but stop for amending
+# s, squash <commit> = use commit, but meld into previous commit
+# f, fixup <commit> = like "squash" but keep only the previous
+#                    commit's log message
+# x, exec <command> = run command (the rest of the line) using shell
+# b, break = stop here (continue rebase later with 'git rebase --continue')
+# d, drop <commit> = remove commit
+#
+# These lines can be re-ordered; they are executed from top to bottom.
+#
+# If you remove a line here THAT COMMIT WILL BE LOST.
+#
+# However, if you remove everything, the rebase will be aborted.
+#
+`
+
+// rebaseState is the state of a rebase in progress, as recorded in the rebase-merge directory.
+type rebaseState struct {
+	// headName is the branch rebased, or "detached HEAD".
+	headName       string
+	onto, origHead string
+	todo, done     []rebaseItem
+	favor          diff.Favor
+}
+
+// branch returns the branch rebased, or "" if HEAD was detached.
+func (st *rebaseState) branch() string {
+	if st.headName == detachedHead {
+		return ""
+	}
+	return st.headName
+}
+
+func readRebaseFile(repo *Repo, name string) (string, error) {
+	b, err := ioutil.ReadFile(repo.path(rebaseMergeDir, name))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(b), err
+}
+
+func writeRebaseFile(repo *Repo, name, content string) error {
+	return writeFile([]byte(content), repo.path(rebaseMergeDir, name))
+}
+
+func removeRebaseFiles(repo *Repo, names ...string) error {
+	for _, n := range names {
+		if err := os.Remove(repo.path(rebaseMergeDir, n)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebaseInProgress reports whether the rebase-merge directory exists.
+func rebaseInProgress(repo *Repo) (bool, error) {
+	if _, err := os.Stat(repo.path(rebaseMergeDir)); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func readRebaseState(repo *Repo) (*rebaseState, error) {
+	if ok, err := rebaseInProgress(repo); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, errors.New("no rebase in progress")
+	}
+	st := &rebaseState{}
+	for _, f := range []struct {
+		name string
+		v    *string
+	}{{"head-name", &st.headName}, {"onto", &st.onto}, {"orig-head", &st.origHead}} {
+		s, err := readRebaseFile(repo, f.name)
+		if err != nil {
+			return nil, err
+		}
+		*f.v = strings.TrimSpace(s)
+	}
+	for _, f := range []struct {
+		name string
+		v    *[]rebaseItem
+	}{{"git-rebase-todo", &st.todo}, {"done", &st.done}} {
+		s, err := readRebaseFile(repo, f.name)
+		if err != nil {
+			return nil, err
+		}
+		if *f.v, err = parseRebaseTodo(repo, s); err != nil {
+			return nil, err
+		}
+	}
+	s, err := readRebaseFile(repo, "strategy_opts")
+	if err != nil {
+		return nil, err
+	}
+	switch strings.Trim(s, " '-\n") {
+	case "ours":
+		st.favor = diff.FavorOurs
+	case "theirs":
+		st.favor = diff.FavorTheirs
+	case "union":
+		st.favor = diff.FavorUnion
+	}
+	return st, nil
+}
+
+// save records the todo list and the commands done with the progress.
+func (st *rebaseState) save(repo *Repo) error {
+	if err := writeRebaseFile(repo, "git-rebase-todo", formatRebaseTodo(st.todo, false)); err != nil {
+		return err
+	}
+	if err := writeRebaseFile(repo, "done", formatRebaseTodo(st.done, false)); err != nil {
+		return err
+	}
+	if err := writeRebaseFile(repo, "msgnum", strconv.Itoa(len(st.done))+"\n"); err != nil {
+		return err
+	}
+	return writeRebaseFile(repo, "end", strconv.Itoa(len(st.done)+len(st.todo))+"\n")
+}
+
+// RebaseOptions configures Rebase.
+type RebaseOptions struct {
+	// Upstream is the commit whose history is not replayed.
+	Upstream string
+	// Onto is the commit the commits are replayed onto, Upstream if "". OntoName is the user
+	// given name of it recorded in the reflog.
+	Onto, OntoName string
+	// Branch is the branch to switch to before rebasing, e.g. refs/heads/topic, or "" to
+	// rebase HEAD.
+	Branch string
+	// Interactive lets EditTodo edit the todo list before it is run, and disables skipping
+	// a rebase which is up to date.
+	Interactive bool
+	// Autosquash moves the commits whose subjects start with "fixup! " or "squash! " right
+	// after the commits they refer to, marking them fixup or squash. It is implied by
+	// rebase.autoSquash for interactive rebases.
+	Autosquash bool
+	// Tree configures merging the changes. The labels are set by Rebase.
+	Tree MergeOptions
+	// EditTodo edits the todo list in the file at the path.
+	EditTodo func(path string) error
+	// EditMessage edits the commit message in the file at the path, when rewording, squashing
+	// and committing resolved conflicts. The message is used as it is if EditMessage is nil.
+	EditMessage func(path string) error
+	// Exec runs the shell command of an exec line. An error stops the rebase.
+	Exec func(command string) error
+}
+
+// RebaseStatus is the result of running a rebase.
+type RebaseStatus int
+
+const (
+	// RebaseUpToDate means the branch is already based on the commit and left as it is.
+	RebaseUpToDate RebaseStatus = iota
+	// RebaseFinished means the commits are replayed and the branch is updated.
+	RebaseFinished
+	// RebaseConflicted means the rebase stopped at a commit which conflicts, leaving the
+	// conflicts to be resolved.
+	RebaseConflicted
+	// RebaseStoppedForEdit means the rebase stopped at a commit marked edit for amending it.
+	RebaseStoppedForEdit
+	// RebaseExecFailed means an exec command failed.
+	RebaseExecFailed
+	// RebaseStoppedAtBreak means the rebase stopped at a break line.
+	RebaseStoppedAtBreak
+)
+
+// RebaseOutcome describes the result of running a rebase.
+type RebaseOutcome struct {
+	Status RebaseStatus
+	// Branch is the branch rebased, or "" if HEAD is detached.
+	Branch string
+	// Commit is the commit at which the rebase stopped for conflicts or edit.
+	Commit string
+	// Exec is the command which failed.
+	Exec string
+	// Messages are the messages of merging the change which conflicts.
+	Messages []string
+	// Committed are the commits whose messages were edited and those concluding a stop,
+	// which are reported as git commit does.
+	Committed []RebaseCommitted
+}
+
+// RebaseCommitted is a commit reported in RebaseOutcome.
+type RebaseCommitted struct {
+	SHA string
+	// AuthorDate reports whether the date of the author kept is shown.
+	AuthorDate bool
+}
+
+// Stopped reports whether the rebase stopped before finishing.
+func (o *RebaseOutcome) Stopped() bool {
+	return o.Status != RebaseUpToDate && o.Status != RebaseFinished
+}
+
+// Rebase replays the commits of HEAD, or of opts.Branch, which are not reachable from
+// opts.Upstream onto opts.Onto one by one by merging their changes as Pick does, and points
+// the branch at the result. Merge commits are not replayed. With opts.Interactive the todo
+// list is given to opts.EditTodo first. The rebase stops at commits which conflict and at
+// commands such as edit and break, recording its state in the rebase-merge directory so
+// that ContinueRebase, SkipRebase and AbortRebase resume or abandon it. Commits whose
+// changes become empty are dropped.
+func Rebase(repo *Repo, opts *RebaseOptions) (*RebaseOutcome, error) {
+	if ok, err := rebaseInProgress(repo); err != nil {
+		return nil, err
+	} else if ok {
+		return nil, errors.New(`a rebase is already in progress; try "git rebase (--continue | --skip | --abort)"`)
+	}
+	branch, cur, err := Head(repo)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRebaseClean(repo, cur); err != nil {
+		return nil, err
+	}
+	head := cur
+	if opts.Branch != "" {
+		if head, err = ReadRef(repo, opts.Branch); err != nil {
+			return nil, err
+		}
+		branch = opts.Branch
+	}
+	if head == "" {
+		return nil, errors.New("cannot rebase an unborn branch")
+	}
+	onto, ontoName := opts.Onto, opts.OntoName
+	if onto == "" {
+		onto = opts.Upstream
+	}
+	if ontoName == "" {
+		ontoName = onto
+	}
+	out := &RebaseOutcome{Branch: branch}
+	if !opts.Interactive {
+		if ok, err := rebaseUpToDate(repo, opts.Upstream, onto, head); err != nil {
+			return nil, err
+		} else if ok {
+			if opts.Branch == "" {
+				return out, nil
+			}
+			if err := checkoutCommit(repo, cur, head, false); err != nil {
+				return nil, err
+			}
+			return out, SetHead(repo, branch, head, "rebase: checkout "+strings.TrimPrefix(branch, "refs/heads/"))
+		}
+	}
+
+	commits, err := rebaseCommits(repo, opts.Upstream, head)
+	if err != nil {
+		return nil, err
+	}
+	var todo []rebaseItem
+	for _, c := range commits {
+		todo = append(todo, rebaseItem{cmd: RebasePick, sha: c, arg: subjectOf(repo, c)})
+	}
+	if opts.Autosquash || opts.Interactive && configBool(repo, "rebase", "autoSquash", false) {
+		todo = autosquash(todo)
+	}
+	st := &rebaseState{headName: branch, onto: onto, origHead: head, todo: todo, favor: opts.Tree.Favor}
+	if branch == "" {
+		st.headName = detachedHead
+	}
+	for _, f := range [][2]string{{"head-name", st.headName + "\n"}, {"onto", onto + "\n"}, {"orig-head", head + "\n"}, {"interactive", ""}} {
+		if err := writeRebaseFile(repo, f[0], f[1]); err != nil {
+			return nil, err
+		}
+	}
+	if st.favor != diff.FavorNone {
+		if err := writeRebaseFile(repo, "strategy_opts", " '--"+[]string{"", "ours", "theirs", "union"}[st.favor]+"'"); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Interactive {
+		if err := editRebaseTodo(repo, st, opts); err != nil {
+			os.RemoveAll(repo.path(rebaseMergeDir))
+			return nil, err
+		}
+	}
+	if err := st.save(repo); err != nil {
+		return nil, err
+	}
+	if err := writeFile([]byte(head+"\n"), repo.path("ORIG_HEAD")); err != nil {
+		return nil, err
+	}
+	// The commits which would be picked onto their own parents are kept as they are.
+	start := onto
+	for len(st.todo) > 0 && st.todo[0].cmd == RebasePick {
+		ps, err := Parents(repo, st.todo[0].sha)
+		if err != nil {
+			return nil, err
+		}
+		if len(ps) != 1 || ps[0] != start {
+			break
+		}
+		start = st.todo[0].sha
+		st.todo, st.done = st.todo[1:], append(st.done, st.todo[0])
+	}
+	if err := st.save(repo); err != nil {
+		return nil, err
+	}
+	if err := checkoutCommit(repo, cur, start, false); err != nil {
+		os.RemoveAll(repo.path(rebaseMergeDir))
+		return nil, err
+	}
+	if err := SetHead(repo, "", start, "rebase (start): checkout "+ontoName); err != nil {
+		return nil, err
+	}
+	return runRebase(repo, st, opts, out)
+}
+
+// checkRebaseClean returns an error if the worktree or the index differs from HEAD.
+func checkRebaseClean(repo *Repo, head string) error {
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return err
+	}
+	if len(idx.Unmerged()) > 0 {
+		return errors.New("cannot rebase: you need to resolve your current index first")
+	}
+	for _, e := range idx.Entries {
+		if ok, err := worktreeMatches(repo, e); err != nil {
+			return err
+		} else if !ok {
+			return errors.New("cannot rebase: you have unstaged changes; commit or stash them")
+		}
+	}
+	tree, err := WriteTree(repo, idx)
+	if err != nil {
+		return err
+	}
+	headTree := EmptyTreeSHA
+	if head != "" {
+		if headTree, err = TreeSHA(repo, head); err != nil {
+			return err
+		}
+	}
+	if tree != headTree {
+		return errors.New("cannot rebase: your index contains uncommitted changes; commit or stash them")
+	}
+	return nil
+}
+
+// checkoutCommit checks out the tree of the commit to over that of the commit from.
+func checkoutCommit(repo *Repo, from, to string, force bool) error {
+	var err error
+	fromTree, toTree := "", ""
+	if from != "" {
+		if fromTree, err = TreeSHA(repo, from); err != nil {
+			return err
+		}
+	}
+	if toTree, err = TreeSHA(repo, to); err != nil {
+		return err
+	}
+	if err := CheckoutTree(repo, fromTree, toTree, force); err != nil {
+		if lce, ok := err.(*LocalChangesError); ok {
+			lce.Action = "rebase"
+		}
+		return err
+	}
+	return nil
+}
+
+// rebaseUpToDate reports whether head is already based on onto, so that rebasing it would
+// recreate the same commits.
+func rebaseUpToDate(repo *Repo, upstream, onto, head string) (bool, error) {
+	if mb, err := MergeBase(repo, onto, head); err != nil || mb != onto {
+		return false, err
+	}
+	if upstream != onto {
+		if mb, err := MergeBase(repo, upstream, head); err != nil || mb != onto {
+			return false, err
+		}
+	}
+	cs, err := RevList(repo, []string{head}, []string{onto})
+	if err != nil {
+		return false, err
+	}
+	for _, c := range cs {
+		if ps, err := Parents(repo, c); err != nil || len(ps) > 1 {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// rebaseCommits returns the commits reachable from head but not from upstream, excluding
+// merges, with parents before their children.
+func rebaseCommits(repo *Repo, upstream, head string) ([]string, error) {
+	cs, err := RevList(repo, []string{head}, []string{upstream})
+	if err != nil {
+		return nil, err
+	}
+	parents := make(map[string][]string)
+	for _, c := range cs {
+		if parents[c], err = Parents(repo, c); err != nil {
+			return nil, err
+		}
+	}
+	var res []string
+	done := make(map[string]bool)
+	var visit func(c string)
+	visit = func(c string) {
+		if done[c] {
+			return
+		}
+		done[c] = true
+		for _, p := range parents[c] {
+			if _, ok := parents[p]; ok {
+				visit(p)
+			}
+		}
+		if len(parents[c]) <= 1 {
+			res = append(res, c)
+		}
+	}
+	for i := len(cs) - 1; i >= 0; i-- {
+		visit(cs[i])
+	}
+	return res, nil
+}
+
+// subjectOf returns the first line of the message of the commit, or "" on error.
+func subjectOf(repo *Repo, sha string) string {
+	_, msg, err := pickMessages(repo, sha)
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(msg, "\n", 2)[0]
+}
+
+// autosquash moves the items whose subjects start with "fixup! " or "squash! " followed by
+// the subject of an earlier item, a prefix of it or a prefix of its SHA, right after that
+// item and the items moved there before, as git rebase --autosquash does.
+func autosquash(todo []rebaseItem) []rebaseItem {
+	subjects := make(map[string]int)
+	root := make([]int, len(todo))
+	after := make([][]int, len(todo))
+	for i := range todo {
+		root[i] = i
+		subj := todo[i].arg
+		cmd, p := RebasePick, subj
+		for {
+			if s := strings.TrimPrefix(p, "fixup! "); s != p {
+				p = s
+				if cmd == RebasePick {
+					cmd = RebaseFixup
+				}
+			} else if s := strings.TrimPrefix(p, "squash! "); s != p {
+				p = s
+				if cmd == RebasePick {
+					cmd = RebaseSquash
+				}
+			} else {
+				break
+			}
+		}
+		if cmd != RebasePick {
+			target, ok := subjects[p]
+			for j := 0; !ok && !strings.Contains(p, " ") && len(p) >= 4 && j < i; j++ {
+				ok = strings.HasPrefix(todo[j].sha, p)
+				target = j
+			}
+			for j := 0; !ok && j < i; j++ {
+				ok = strings.HasPrefix(todo[j].arg, p)
+				target = j
+			}
+			if ok {
+				todo[i].cmd = cmd
+				root[i] = root[target]
+				after[root[i]] = append(after[root[i]], i)
+			}
+		}
+		if _, ok := subjects[subj]; !ok {
+			subjects[subj] = i
+		}
+	}
+	var res []rebaseItem
+	for i := range todo {
+		if root[i] != i {
+			continue
+		}
+		res = append(res, todo[i])
+		for _, j := range after[i] {
+			res = append(res, todo[j])
+		}
+	}
+	return res
+}
+
+// editRebaseTodo lets opts.EditTodo edit the todo list and reads it back.
+func editRebaseTodo(repo *Repo, st *rebaseState, opts *RebaseOptions) error {
+	n := len(st.todo)
+	plural := "s"
+	if n == 1 {
+		plural = ""
+	}
+	help := fmt.Sprintf("\n# Rebase %s..%s onto %s (%d command%s)\n", st.onto[:7], st.origHead[:7], st.onto[:7], n, plural) + rebaseTodoHelp
+	if n == 0 {
+		help = "noop\n" + help
+	}
+	s := formatRebaseTodo(st.todo, true) + help
+	if err := writeRebaseFile(repo, "git-rebase-todo.backup", formatRebaseTodo(st.todo, false)+help); err != nil {
+		return err
+	}
+	if err := writeRebaseFile(repo, "git-rebase-todo", s); err != nil {
+		return err
+	}
+	if opts.EditTodo != nil {
+		if err := opts.EditTodo(repo.path(rebaseMergeDir, "git-rebase-todo")); err != nil {
+			return err
+		}
+	}
+	s, err := readRebaseFile(repo, "git-rebase-todo")
+	if err != nil {
+		return err
+	}
+	if st.todo, err = parseRebaseTodo(repo, s); err != nil {
+		return err
+	}
+	if len(st.todo) == 0 {
+		return errors.New("nothing to do")
+	}
+	for _, it := range st.todo {
+		if it.squashes() {
+			return fmt.Errorf("cannot '%s' without a previous commit", it.cmd)
+		}
+		if it.sha != "" && it.cmd != RebaseDrop {
+			break
+		}
+	}
+	return nil
+}
+
+// runRebase runs the commands left in the todo list, recording the progress, and finishes
+// the rebase when all are done.
+func runRebase(repo *Repo, st *rebaseState, opts *RebaseOptions, out *RebaseOutcome) (*RebaseOutcome, error) {
+	for len(st.todo) > 0 {
+		it := st.todo[0]
+		st.todo, st.done = st.todo[1:], append(st.done, it)
+		if err := st.save(repo); err != nil {
+			return out, err
+		}
+		switch it.cmd {
+		case RebaseDrop:
+			continue
+		case RebaseBreak:
+			out.Status = RebaseStoppedAtBreak
+			return out, nil
+		case RebaseExec:
+			if opts.Exec == nil {
+				return out, errors.New("exec is not supported")
+			}
+			if err := opts.Exec(it.arg); err != nil {
+				out.Status, out.Exec = RebaseExecFailed, it.arg
+				return out, nil
+			}
+			continue
+		}
+		stopped, err := rebasePick(repo, st, &it, opts, out)
+		if err != nil {
+			// The command is run again by ContinueRebase.
+			st.todo, st.done = append([]rebaseItem{it}, st.todo...), st.done[:len(st.done)-1]
+			if serr := st.save(repo); serr != nil {
+				return out, serr
+			}
+			return out, err
+		}
+		if stopped {
+			return out, nil
+		}
+	}
+	return out, finishRebase(repo, st, out)
+}
+
+// rebasePick replays the commit of the item onto HEAD, reporting whether the rebase stopped.
+func rebasePick(repo *Repo, st *rebaseState, it *rebaseItem, opts *RebaseOptions, out *RebaseOutcome) (bool, error) {
+	_, head, err := Head(repo)
+	if err != nil {
+		return false, err
+	}
+	if it.squashes() {
+		if err := updateSquashMessage(repo, it, head); err != nil {
+			return false, err
+		}
+	}
+	ps, err := Parents(repo, it.sha)
+	if err != nil {
+		return false, err
+	}
+	// The commit to reword, which is the commit itself if it is fast-forwarded.
+	reword := it.sha
+	switch {
+	case len(ps) == 1 && ps[0] == head && !it.squashes():
+		if err := checkoutCommit(repo, head, it.sha, false); err != nil {
+			return false, err
+		}
+		if it.cmd != RebaseReword {
+			if err := UpdateRef(repo, "HEAD", it.sha, head, "rebase: fast-forward"); err != nil {
+				return false, err
+			}
+		}
+	default:
+		popts := &PickOptions{Tree: opts.Tree}
+		popts.Tree.Favor = st.favor
+		m, err := mergePick(repo, it.sha, popts)
+		if err != nil {
+			return false, err
+		}
+		if len(m.res.Conflicts) > 0 {
+			out.Messages = append(out.Messages, m.res.Messages...)
+			out.Status, out.Commit = RebaseConflicted, it.sha
+			if !it.squashes() {
+				if err := writeFile([]byte(m.msg+conflictsComment(repo)), repo.path(mergeMsgFile)); err != nil {
+					return false, err
+				}
+				return true, writeRebaseStop(repo, it.sha, "", "")
+			}
+			// HEAD is to be amended with the combined messages.
+			msg, err := readRebaseFile(repo, "message-squash")
+			if err != nil {
+				return false, err
+			}
+			if err := writeFile([]byte(msg), repo.path(mergeMsgFile)); err != nil {
+				return false, err
+			}
+			return true, writeRebaseStop(repo, it.sha, head, msg)
+		}
+		if m.res.Tree == m.headTree && !it.squashes() {
+			return false, nil
+		}
+		author, err := commitAuthor(repo, it.sha)
+		if err != nil {
+			return false, err
+		}
+		c, err := commitRebased(repo, st, it, m.msg, author, it.cmd.String(), false, opts)
+		if err != nil {
+			return false, err
+		}
+		if c.edited {
+			out.Committed = append(out.Committed, RebaseCommitted{c.sha, true})
+		}
+		reword = c.sha
+	}
+	switch it.cmd {
+	case RebaseReword:
+		_, msg, err := pickMessages(repo, reword)
+		if err != nil {
+			return false, err
+		}
+		if msg, err = editMessage(repo, msg, opts); err != nil {
+			return false, err
+		}
+		tree, err := TreeSHA(repo, reword)
+		if err != nil {
+			return false, err
+		}
+		sha, err := amendCommit(repo, reword, tree, msg, "rebase (reword): ")
+		if err != nil {
+			return false, err
+		}
+		out.Committed = append(out.Committed, RebaseCommitted{sha, true})
+	case RebaseEdit:
+		if _, head, err = Head(repo); err != nil {
+			return false, err
+		}
+		out.Status, out.Commit = RebaseStoppedForEdit, it.sha
+		return true, writeRebaseStop(repo, it.sha, head, "")
+	}
+	return false, nil
+}
+
+// amendCommit points HEAD at a copy of the commit with the tree and the message, recording
+// the prefix followed by the subject in the reflog.
+func amendCommit(repo *Repo, sha, tree, msg, prefix string) (string, error) {
+	if msg == "" {
+		return "", errors.New("aborting commit due to empty commit message")
+	}
+	_, head, err := Head(repo)
+	if err != nil {
+		return "", err
+	}
+	ps, err := Parents(repo, sha)
+	if err != nil {
+		return "", err
+	}
+	author, err := commitAuthor(repo, sha)
+	if err != nil {
+		return "", err
+	}
+	c, err := commitTree(repo, tree, ps, author, msg)
+	if err != nil {
+		return "", err
+	}
+	return c, UpdateRef(repo, "HEAD", c, head, prefix+strings.SplitN(msg, "\n", 2)[0])
+}
+
+// rebaseCommit is a commit made by commitRebased.
+type rebaseCommit struct {
+	sha string
+	// edited reports whether the message was edited.
+	edited bool
+}
+
+// commitRebased commits the index as the commit of the item on top of HEAD with the message
+// and the author, recording "rebase (<action>)" in the reflog. The message is edited if edit
+// is true. Commits squashed or fixed up amend HEAD with the combined messages, which are
+// edited at the end of a chain of them including a squash.
+func commitRebased(repo *Repo, st *rebaseState, it *rebaseItem, msg, author, action string, edit bool, opts *RebaseOptions) (*rebaseCommit, error) {
+	_, head, err := Head(repo)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := WriteTree(repo, idx)
+	if err != nil {
+		return nil, err
+	}
+	parents := []string{head}
+	var raw string
+	endChain := false
+	if it.squashes() {
+		if parents, err = Parents(repo, head); err != nil {
+			return nil, err
+		}
+		if author, err = commitAuthor(repo, head); err != nil {
+			return nil, err
+		}
+		if raw, err = readRebaseFile(repo, "message-squash"); err != nil {
+			return nil, err
+		}
+		endChain = len(st.todo) == 0 || !st.todo[0].squashes()
+		if endChain {
+			fixups, err := readRebaseFile(repo, "current-fixups")
+			if err != nil {
+				return nil, err
+			}
+			edit = edit || strings.Contains("\n"+fixups, "\nsquash ")
+			msg = raw
+		} else if edit {
+			// The resolution of conflicts is committed with the message edited as git does.
+			msg = raw
+		} else {
+			msg = CleanupMessage(raw, false)
+		}
+	}
+	if edit {
+		if msg, err = editMessage(repo, msg, opts); err != nil {
+			return nil, err
+		}
+	} else if !it.squashes() || endChain {
+		msg = CleanupMessage(msg, endChain)
+	}
+	if msg == "" {
+		return nil, errors.New("aborting commit due to empty commit message")
+	}
+	if raw == "" || endChain || edit {
+		raw = msg
+	}
+	sha, err := commitTree(repo, tree, parents, author, msg)
+	if err != nil {
+		return nil, err
+	}
+	if err := UpdateRef(repo, "HEAD", sha, head, "rebase ("+action+"): "+strings.SplitN(raw, "\n", 2)[0]); err != nil {
+		return nil, err
+	}
+	if endChain {
+		if err := removeRebaseFiles(repo, "message-squash", "current-fixups"); err != nil {
+			return nil, err
+		}
+	}
+	return &rebaseCommit{sha, edit}, nil
+}
+
+// updateSquashMessage adds the message of the commit of the item to the combined message of
+// the chain of commits squashed into HEAD, in the format git uses.
+func updateSquashMessage(repo *Repo, it *rebaseItem, head string) error {
+	fixups, err := readRebaseFile(repo, "current-fixups")
+	if err != nil {
+		return err
+	}
+	var body string
+	if fixups == "" {
+		_, msg, err := pickMessages(repo, head)
+		if err != nil {
+			return err
+		}
+		body = "# This is the 1st commit message:\n\n" + msg
+	} else {
+		s, err := readRebaseFile(repo, "message-squash")
+		if err != nil {
+			return err
+		}
+		body = strings.SplitN(s, "\n", 2)[1]
+	}
+	n := 2
+	if fixups != "" {
+		n += strings.Count(fixups, "\n") + 1
+		fixups += "\n"
+	}
+	_, msg, err := pickMessages(repo, it.sha)
+	if err != nil {
+		return err
+	}
+	if it.cmd == RebaseSquash {
+		// The subject of a commit made by git commit --squash or --fixup is commented out.
+		for _, p := range []string{"squash! ", "fixup! ", "amend! "} {
+			if strings.HasPrefix(msg, p) {
+				msg = "# " + msg
+				break
+			}
+		}
+		body += fmt.Sprintf("\n# This is the commit message #%d:\n\n%s", n, msg)
+	} else {
+		body += fmt.Sprintf("\n# The commit message #%d will be skipped:\n\n", n)
+		for _, l := range strings.Split(strings.TrimSuffix(msg, "\n"), "\n") {
+			if l == "" {
+				body += "#\n"
+			} else {
+				body += "# " + l + "\n"
+			}
+		}
+	}
+	s := fmt.Sprintf("# This is a combination of %d commits.\n", n) + body
+	if err := writeRebaseFile(repo, "message-squash", s); err != nil {
+		return err
+	}
+	return writeRebaseFile(repo, "current-fixups", fixups+it.cmd.String()+" "+it.sha)
+}
+
+// editMessage lets opts.EditMessage edit the message in COMMIT_EDITMSG, and returns it
+// cleaned up with comments removed.
+func editMessage(repo *Repo, msg string, opts *RebaseOptions) (string, error) {
+	if opts.EditMessage == nil {
+		return CleanupMessage(msg, true), nil
+	}
+	p := repo.path("COMMIT_EDITMSG")
+	s := strings.TrimRight(msg, "\n") + "\n\n" +
+		"# Please enter the commit message for your changes. Lines starting\n" +
+		"# with '#' will be ignored, and an empty message aborts the commit.\n"
+	if err := writeFile([]byte(s), p); err != nil {
+		return "", err
+	}
+	if err := opts.EditMessage(p); err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	return CleanupMessage(string(b), true), nil
+}
+
+// writeRebaseStop records the commit at which the rebase stopped. amend is the commit to be
+// amended when stopped for edit or for conflicts of a commit squashed, or "" otherwise.
+// msg is the message of the commit to be made, that of the commit if "".
+func writeRebaseStop(repo *Repo, sha, amend, msg string) error {
+	if msg == "" {
+		var err error
+		if _, msg, err = pickMessages(repo, sha); err != nil {
+			return err
+		}
+		// As git does, the message is followed by an empty line.
+		msg += "\n"
+	}
+	author, err := commitAuthor(repo, sha)
+	if err != nil {
+		return err
+	}
+	files := [][2]string{{"message", msg}, {"author-script", authorScript(author)}, {"stopped-sha", sha + "\n"}}
+	if amend != "" {
+		files = append(files, [2]string{"amend", amend + "\n"})
+	}
+	for _, f := range files {
+		if err := writeRebaseFile(repo, f[0], f[1]); err != nil {
+			return err
+		}
+	}
+	return writeFile([]byte(sha+"\n"), repo.path(rebaseHeadFile))
+}
+
+// clearRebaseStop removes the files recording the commit at which the rebase stopped.
+func clearRebaseStop(repo *Repo) error {
+	if err := removeRebaseFiles(repo, "message", "author-script", "stopped-sha", "amend"); err != nil {
+		return err
+	}
+	if err := os.Remove(repo.path(rebaseHeadFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ClearMergeState(repo)
+}
+
+// authorScript formats the author line of a commit as shell assignments of
+// GIT_AUTHOR_NAME, GIT_AUTHOR_EMAIL and GIT_AUTHOR_DATE, as git records it.
+func authorScript(author string) string {
+	lt, gt := strings.Index(author, "<"), strings.LastIndex(author, ">")
+	if lt < 0 || gt < lt {
+		return ""
+	}
+	quote := func(s string) string { return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'" }
+	return "GIT_AUTHOR_NAME=" + quote(strings.TrimSpace(author[:lt])) + "\n" +
+		"GIT_AUTHOR_EMAIL=" + quote(author[lt+1:gt]) + "\n" +
+		"GIT_AUTHOR_DATE=" + quote("@"+strings.TrimSpace(author[gt+1:])) + "\n"
+}
+
+// parseAuthorScript parses the assignments written by authorScript into an author line.
+func parseAuthorScript(s string) (string, error) {
+	vs := make(map[string]string)
+	for _, l := range strings.Split(s, "\n") {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := kv[1]
+		if len(v) < 2 || v[0] != '\'' || v[len(v)-1] != '\'' {
+			return "", fmt.Errorf("malformed author script line %q", l)
+		}
+		vs[kv[0]] = strings.ReplaceAll(v[1:len(v)-1], `'\''`, "'")
+	}
+	name, email, date := vs["GIT_AUTHOR_NAME"], vs["GIT_AUTHOR_EMAIL"], vs["GIT_AUTHOR_DATE"]
+	if name == "" || email == "" || date == "" {
+		return "", errors.New("incomplete author script")
+	}
+	return fmt.Sprintf("%s <%s> %s", name, email, gitDate(date)), nil
+}
+
+// finishRebase points the branch rebased at HEAD and checks it out again.
+func finishRebase(repo *Repo, st *rebaseState, out *RebaseOutcome) error {
+	_, head, err := Head(repo)
+	if err != nil {
+		return err
+	}
+	if b := st.branch(); b != "" {
+		if err := UpdateRef(repo, b, head, "", "rebase (finish): "+b+" onto "+st.onto); err != nil {
+			return err
+		}
+		if err := SetHead(repo, b, head, "rebase (finish): returning to "+b); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(repo.path(rebaseHeadFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out.Status = RebaseFinished
+	return os.RemoveAll(repo.path(rebaseMergeDir))
+}
+
+// ContinueRebase resumes the rebase in progress. If it stopped for conflicts, the resolution
+// in the index is committed with the message in MERGE_MSG. If it stopped for edit, changes
+// in the index amend HEAD. Only opts.EditMessage and opts.Exec are used, and opts.Tree for
+// the style of conflicts.
+func ContinueRebase(repo *Repo, opts *RebaseOptions) (*RebaseOutcome, error) {
+	st, err := readRebaseState(repo)
+	if err != nil {
+		return nil, err
+	}
+	out := &RebaseOutcome{Branch: st.branch()}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return nil, err
+	}
+	if len(idx.Unmerged()) > 0 {
+		return nil, errors.New("you must edit all merge conflicts and then mark them as resolved using git add")
+	}
+	tree, err := WriteTree(repo, idx)
+	if err != nil {
+		return nil, err
+	}
+	_, head, err := Head(repo)
+	if err != nil {
+		return nil, err
+	}
+	headTree, err := TreeSHA(repo, head)
+	if err != nil {
+		return nil, err
+	}
+	stopped, err := readRebaseFile(repo, "stopped-sha")
+	if err != nil {
+		return nil, err
+	}
+	amend, err := readRebaseFile(repo, "amend")
+	if err != nil {
+		return nil, err
+	}
+	stopped, amend = strings.TrimSpace(stopped), strings.TrimSpace(amend)
+	var last *rebaseItem
+	if len(st.done) > 0 {
+		last = &st.done[len(st.done)-1]
+	}
+	switch {
+	case tree == headTree:
+	case stopped != "" && (amend == "" || last != nil && last.squashes()):
+		it := *last
+		msg, err := MergeMessage(repo)
+		if err != nil {
+			return nil, err
+		}
+		if msg == "" {
+			if msg, err = readRebaseFile(repo, "message"); err != nil {
+				return nil, err
+			}
+		}
+		s, err := readRebaseFile(repo, "author-script")
+		if err != nil {
+			return nil, err
+		}
+		author, err := parseAuthorScript(s)
+		if err != nil {
+			return nil, err
+		}
+		c, err := commitRebased(repo, st, &it, msg, author, "continue", true, opts)
+		if err != nil {
+			return nil, err
+		}
+		out.Committed = append(out.Committed, RebaseCommitted{c.sha, it.squashes()})
+	case amend != "":
+		if amend != head {
+			return nil, errors.New("you have uncommitted changes in your working tree; commit them first and then run 'git rebase --continue' again")
+		}
+		_, msg, err := pickMessages(repo, head)
+		if err != nil {
+			return nil, err
+		}
+		sha, err := amendCommit(repo, head, tree, msg, "rebase (continue): ")
+		if err != nil {
+			return nil, err
+		}
+		out.Committed = append(out.Committed, RebaseCommitted{sha, true})
+	default:
+		return nil, errors.New("you have staged changes in your working tree; commit them first and then run 'git rebase --continue' again")
+	}
+	if err := clearRebaseStop(repo); err != nil {
+		return nil, err
+	}
+	return runRebase(repo, st, opts, out)
+}
+
+// SkipRebase discards the changes of the commit at which the rebase stopped and resumes it.
+func SkipRebase(repo *Repo, opts *RebaseOptions) (*RebaseOutcome, error) {
+	st, err := readRebaseState(repo)
+	if err != nil {
+		return nil, err
+	}
+	if err := resetMerge(repo); err != nil {
+		return nil, err
+	}
+	if err := clearRebaseStop(repo); err != nil {
+		return nil, err
+	}
+	if len(st.done) > 0 && st.done[len(st.done)-1].squashes() && (len(st.todo) == 0 || !st.todo[0].squashes()) {
+		if err := removeRebaseFiles(repo, "message-squash", "current-fixups"); err != nil {
+			return nil, err
+		}
+	}
+	return runRebase(repo, st, opts, &RebaseOutcome{Branch: st.branch()})
+}
+
+// AbortRebase abandons the rebase in progress, checking out the branch rebased as it was
+// before the rebase started and discarding the changes in the index and the worktree.
+func AbortRebase(repo *Repo) error {
+	st, err := readRebaseState(repo)
+	if err != nil {
+		return err
+	}
+	_, head, err := Head(repo)
+	if err != nil {
+		return err
+	}
+	if err := checkoutCommit(repo, head, st.origHead, true); err != nil {
+		return err
+	}
+	to := st.branch()
+	if to == "" {
+		to = st.origHead
+	}
+	if err := SetHead(repo, st.branch(), st.origHead, "rebase (abort): returning to "+to); err != nil {
+		return err
+	}
+	if err := clearRebaseStop(repo); err != nil {
+		return err
+	}
+	return os.RemoveAll(repo.path(rebaseMergeDir))
+}
@@ -0,0 +1,202 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ReceivePackOptions are options of ReceivePack.
+type ReceivePackOptions struct {
+	// StatelessRPC serves a single request of the smart HTTP protocol: the refs are not
+	// advertised.
+	StatelessRPC bool
+	// AdvertiseRefs only advertises the refs.
+	AdvertiseRefs bool
+	// Version is the protocol version the client asked for, as in UploadPackOptions.
+	Version int
+}
+
+// refCommand is a ref update a client requests from ReceivePack.
+type refCommand struct {
+	old, new, name string
+	// err is the reason the update is refused, or "".
+	err string
+}
+
+// ReceivePack serves a push to the repository as git receive-pack does. It advertises the
+// refs to w, reads the ref updates and the pack of the objects they need from r, and
+// updates the refs, reporting the result of each update to w if the client asks for it.
+// As with the default receive.denyCurrentBranch, the branch checked out in a non-bare
+// repository is not updated unless the config is set to ignore, warn or updateInstead.
+func ReceivePack(repo *Repo, r io.Reader, w io.Writer, opts *ReceivePackOptions) error {
+	if !opts.StatelessRPC {
+		refs, err := receivedRefs(repo)
+		if err != nil {
+			return err
+		}
+		caps := capabilities{"report-status", "delete-refs", "side-band-64k", "quiet", "ofs-delta", "agent=" + agent}
+		if err := writeVersion(w, opts.Version); err != nil {
+			return err
+		}
+		if err := writeAdvertisement(w, refs, caps); err != nil {
+			return err
+		}
+	}
+	if opts.AdvertiseRefs {
+		return nil
+	}
+
+	p := newPktReader(r)
+	var cmds []*refCommand
+	var caps capabilities
+	for {
+		l, flush, err := p.readLine()
+		if err == io.EOF && len(cmds) == 0 {
+			// The client has nothing to push.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if flush {
+			break
+		}
+		if i := strings.IndexByte(l, 0); i >= 0 {
+			if len(cmds) == 0 {
+				caps = strings.Fields(l[i+1:])
+			}
+			l = l[:i]
+		}
+		fs := strings.Fields(l)
+		if len(fs) != 3 || len(fs[0]) != 40 || len(fs[1]) != 40 {
+			return fmt.Errorf("protocol error: expected old new ref, got %q", l)
+		}
+		cmds = append(cmds, &refCommand{old: fs[0], new: fs[1], name: fs[2]})
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	unpack := "ok"
+	for _, c := range cmds {
+		if c.new != ZeroSHA {
+			if _, err := IndexPack(repo, p.r); err != nil {
+				unpack = err.Error()
+			}
+			break
+		}
+	}
+	for _, c := range cmds {
+		if unpack != "ok" {
+			c.err = "unpacker error"
+			continue
+		}
+		if err := receiveRef(repo, c); err != nil {
+			c.err = err.Error()
+		}
+	}
+
+	if !caps.has("report-status") {
+		return nil
+	}
+	var b bytes.Buffer
+	writePkt(&b, "unpack %s\n", unpack)
+	for _, c := range cmds {
+		if c.err == "" {
+			writePkt(&b, "ok %s\n", c.name)
+		} else {
+			writePkt(&b, "ng %s %s\n", c.name, c.err)
+		}
+	}
+	writeFlush(&b)
+	if !caps.has("side-band-64k") {
+		_, err := w.Write(b.Bytes())
+		return err
+	}
+	if _, err := (&sidebandWriter{w, bandData, pktMax}).Write(b.Bytes()); err != nil {
+		return err
+	}
+	return writeFlush(w)
+}
+
+// receivedRefs returns the refs ReceivePack advertises: the refs of the repository
+// sorted by name, without HEAD and peeled tags.
+func receivedRefs(repo *Repo) ([]*RemoteRef, error) {
+	m, err := AllRefs(repo)
+	if err != nil {
+		return nil, err
+	}
+	var res []*RemoteRef
+	for n, sha := range m {
+		res = append(res, &RemoteRef{Name: n, SHA: sha})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+// receiveRef applies the ref update, returning the reason it is refused as an error.
+func receiveRef(repo *Repo, c *refCommand) error {
+	if !strings.HasPrefix(c.name, "refs/") || checkRefName(c.name) != nil {
+		return fmt.Errorf("funny refname")
+	}
+	if c.new != ZeroSHA && !hasObject(repo, c.new) {
+		return fmt.Errorf("missing necessary objects")
+	}
+	cur, err := ReadRef(repo, c.name)
+	if err != nil {
+		cur = ZeroSHA
+	}
+	if cur != c.old {
+		return fmt.Errorf("failed to lock")
+	}
+
+	branch := ""
+	if !repo.Bare() {
+		branch, _ = SymbolicRef(repo, "HEAD")
+	}
+	updateInstead := false
+	if c.name == branch {
+		if c.new == ZeroSHA {
+			return fmt.Errorf("deletion of the current branch prohibited")
+		}
+		switch Config(repo, "receive", "denyCurrentBranch") {
+		case "ignore", "warn", "false":
+		case "updateInstead":
+			updateInstead = true
+		default:
+			return fmt.Errorf("branch is currently checked out")
+		}
+	}
+	if c.new == ZeroSHA {
+		if err := DeleteRef(repo, c.name); err != nil {
+			return fmt.Errorf("failed to delete")
+		}
+		return nil
+	}
+	if c.old != ZeroSHA && strings.HasPrefix(c.name, "refs/heads/") && configBool(repo, "receive", "denyNonFastForwards", false) {
+		if ok, err := IsAncestor(repo, c.old, c.new); err != nil || !ok {
+			return fmt.Errorf("non-fast-forward")
+		}
+	}
+	if updateInstead {
+		from := ""
+		if c.old != ZeroSHA {
+			if from, err = TreeSHA(repo, c.old); err != nil {
+				return err
+			}
+		}
+		to, err := TreeSHA(repo, c.new)
+		if err != nil {
+			return err
+		}
+		if err := CheckoutTree(repo, from, to, false); err != nil {
+			return fmt.Errorf("Working directory has unstaged changes")
+		}
+	}
+	if err := UpdateRef(repo, c.name, c.new, c.old, "push"); err != nil {
+		return fmt.Errorf("failed to update ref")
+	}
+	return nil
+}
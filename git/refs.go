@@ -0,0 +1,312 @@
+package git
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ZeroSHA is the SHA used in reflogs for a ref which does not exist.
+const ZeroSHA = "0000000000000000000000000000000000000000"
+
+// checkRefName returns an error unless the full ref name, e.g. refs/heads/master, is valid
+// as git check-ref-format decides, or is HEAD. Names from remotes are checked since they
+// become paths in the repository.
+func checkRefName(name string) error {
+	if name == "HEAD" {
+		return nil
+	}
+	bad := name == "@" || strings.HasSuffix(name, ".") || strings.Contains(name, "..") || strings.Contains(name, "@{")
+	for _, c := range strings.Split(name, "/") {
+		if c == "" || strings.HasPrefix(c, ".") || strings.HasSuffix(c, ".lock") {
+			bad = true
+		}
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(" ~^:?*[\\", r) {
+			bad = true
+		}
+	}
+	if bad || !strings.HasPrefix(name, "refs/") {
+		return fmt.Errorf("invalid ref name %q", name)
+	}
+	return nil
+}
+
+// ReadRef returns the SHA the ref points to, following symbolic refs.
+// name is a full ref name such as HEAD or refs/heads/master.
+// Loose refs take precedence over packed-refs.
+func ReadRef(repo *Repo, name string) (string, error) {
+	for i := 0; i < 10; i++ {
+		b, err := ioutil.ReadFile(repo.path(name))
+		if os.IsNotExist(err) {
+			if sha, ok := packedRefs(repo)[name]; ok {
+				return sha, nil
+			}
+			return "", fmt.Errorf("no such ref %s", name)
+		} else if err != nil {
+			return "", err
+		}
+		s := strings.TrimSpace(string(b))
+		if !strings.HasPrefix(s, "ref: ") {
+			// FETCH_HEAD has more after the SHA of its first line.
+			if fs := strings.Fields(s); len(fs) > 0 {
+				s = fs[0]
+			}
+			return s, nil
+		}
+		name = strings.TrimPrefix(s, "ref: ")
+	}
+	return "", fmt.Errorf("too deep symbolic ref %s", name)
+}
+
+// SymbolicRef returns the ref name the symbolic ref name points to,
+// or "" if name is not a symbolic ref.
+func SymbolicRef(repo *Repo, name string) (string, error) {
+	b, err := ioutil.ReadFile(repo.path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	s := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(s, "ref: ") {
+		return "", nil
+	}
+	return strings.TrimPrefix(s, "ref: "), nil
+}
+
+// Head returns the branch HEAD points to (e.g. refs/heads/master), or "" if HEAD is detached,
+// and the commit SHA of HEAD, or "" if the branch is unborn.
+func Head(repo *Repo) (branch, sha string, err error) {
+	branch, err = SymbolicRef(repo, "HEAD")
+	if err != nil {
+		return "", "", err
+	}
+	sha, err = ReadRef(repo, "HEAD")
+	if err != nil && branch != "" {
+		// unborn branch
+		return branch, "", nil
+	}
+	return branch, sha, err
+}
+
+// packedRefs returns the refs in the packed-refs file.
+func packedRefs(repo *Repo) map[string]string {
+	m := make(map[string]string)
+	f, err := os.Open(repo.path("packed-refs"))
+	if err != nil {
+		return m
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := s.Text()
+		if l == "" || l[0] == '#' || l[0] == '^' {
+			continue
+		}
+		if fs := strings.Fields(l); len(fs) == 2 {
+			m[fs[1]] = fs[0]
+		}
+	}
+	return m
+}
+
+// UpdateRef points the ref name at sha and appends msg to its reflog.
+// If name is a symbolic ref such as HEAD, the ref it points to is updated and
+// both reflogs are appended to. A ref which already points to sha is left as is, but HEAD
+// still logs the update. Unless old is "", the update fails if the ref
+// does not point to old; ZeroSHA as old means the ref must not exist.
+func UpdateRef(repo *Repo, name, sha, old, msg string) error {
+	target := name
+	if t, err := SymbolicRef(repo, name); err != nil {
+		return err
+	} else if t != "" {
+		target = t
+	}
+	cur, err := ReadRef(repo, target)
+	if err != nil {
+		cur = ZeroSHA
+	}
+	if old != "" && old != cur {
+		return fmt.Errorf("cannot lock ref %s: is at %s but expected %s", target, cur, old)
+	}
+	// As in git, a ref which already points to sha is not logged, unless through HEAD.
+	if cur != sha {
+		if err := writeFile([]byte(sha+"\n"), repo.path(target)); err != nil {
+			return err
+		}
+		if err := appendReflog(repo, target, cur, sha, msg); err != nil {
+			return err
+		}
+	}
+	if target != name {
+		return appendReflog(repo, name, cur, sha, msg)
+	}
+	return nil
+}
+
+// DeleteRef deletes the ref and its reflog.
+func DeleteRef(repo *Repo, name string) error {
+	if err := os.Remove(repo.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(repo.path("logs", name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, ok := packedRefs(repo)[name]; !ok {
+		return nil
+	}
+	b, err := ioutil.ReadFile(repo.path("packed-refs"))
+	if err != nil {
+		return err
+	}
+	var res []string
+	skipPeeled := false
+	for _, l := range strings.SplitAfter(string(b), "\n") {
+		if skipPeeled && strings.HasPrefix(l, "^") {
+			continue
+		}
+		skipPeeled = strings.HasSuffix(strings.TrimSpace(l), " "+name)
+		if !skipPeeled {
+			res = append(res, l)
+		}
+	}
+	return ioutil.WriteFile(repo.path("packed-refs"), []byte(strings.Join(res, "")), 0644)
+}
+
+// SetHead points HEAD at the branch (e.g. refs/heads/master), or detaches it at sha
+// if branch is "". msg is appended to the HEAD reflog.
+func SetHead(repo *Repo, branch, sha, msg string) error {
+	_, cur, err := Head(repo)
+	if err != nil {
+		cur = ""
+	}
+	if cur == "" {
+		cur = ZeroSHA
+	}
+	content := sha
+	if branch != "" {
+		content = "ref: " + branch
+	}
+	if err := writeFile([]byte(content+"\n"), repo.path("HEAD")); err != nil {
+		return err
+	}
+	if sha == "" {
+		return nil
+	}
+	return appendReflog(repo, "HEAD", cur, sha, msg)
+}
+
+// appendReflog appends an entry to the reflog of the ref.
+// As with core.logAllRefUpdates=true, reflogs are written for HEAD, branches,
+// remote-tracking branches and refs which already have a reflog. refs/stash always has
+// one as git stash creates it. As in git, a bare repository only logs to existing reflogs
+// unless core.logAllRefUpdates is set.
+func appendReflog(repo *Repo, name, old, sha, msg string) error {
+	p := repo.path("logs", name)
+	if _, err := os.Stat(p); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if name != "HEAD" && name != stashRef && !strings.HasPrefix(name, "refs/heads/") && !strings.HasPrefix(name, "refs/remotes/") {
+			return nil
+		}
+		if !configBool(repo, "core", "logAllRefUpdates", !repo.bare) {
+			return nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	msg = strings.SplitN(msg, "\n", 2)[0]
+	if _, err := fmt.Fprintf(f, "%s %s %s\t%s\n", old, sha, Signature(repo, "committer"), msg); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReflogEntry is an entry of a reflog.
+type ReflogEntry struct {
+	Old, New, Committer, Message string
+}
+
+// Reflog returns the reflog of the ref, oldest first.
+func Reflog(repo *Repo, name string) ([]*ReflogEntry, error) {
+	b, err := ioutil.ReadFile(repo.path("logs", name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var res []*ReflogEntry
+	for _, l := range strings.Split(string(b), "\n") {
+		if l == "" {
+			continue
+		}
+		fs := strings.SplitN(l, "\t", 2)
+		hs := strings.SplitN(fs[0], " ", 3)
+		if len(hs) != 3 {
+			return nil, errors.New("malformed reflog " + name)
+		}
+		e := &ReflogEntry{Old: hs[0], New: hs[1], Committer: hs[2]}
+		if len(fs) == 2 {
+			e.Message = fs[1]
+		}
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+// writeReflog replaces the reflog of the ref with the entries, oldest first, removing it if
+// there are none.
+func writeReflog(repo *Repo, name string, entries []*ReflogEntry) error {
+	if len(entries) == 0 {
+		if err := os.Remove(repo.path("logs", name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var b strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%s %s %s\t%s\n", e.Old, e.New, e.Committer, e.Message)
+	}
+	return writeFile([]byte(b.String()), repo.path("logs", name))
+}
+
+// AllRefs returns the SHAs of all the refs under refs/, loose or packed, keyed by their full
+// names. Symbolic refs are resolved and dangling ones are left out.
+func AllRefs(repo *Repo) (map[string]string, error) {
+	m := packedRefs(repo)
+	err := filepath.Walk(repo.path("refs"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(repo.gitDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if sha, err := ReadRef(repo, name); err == nil {
+			m[name] = sha
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return m, err
+}
@@ -0,0 +1,92 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Refspec maps remote refs to local refs, e.g. +refs/heads/*:refs/remotes/origin/*.
+type Refspec struct {
+	// Src and Dst are the remote and the local side. Both or neither have one "*" unless
+	// Dst is "", which means the remote ref is only stored in FETCH_HEAD.
+	Src, Dst string
+	// Force allows non fast-forward updates.
+	Force bool
+}
+
+// ParseRefspec parses a refspec [+]<src>[:<dst>].
+func ParseRefspec(s string) (*Refspec, error) {
+	r := &Refspec{}
+	spec := s
+	if strings.HasPrefix(spec, "+") {
+		r.Force, spec = true, spec[1:]
+	}
+	kv := strings.SplitN(spec, ":", 2)
+	r.Src = kv[0]
+	if len(kv) == 2 {
+		r.Dst = kv[1]
+	}
+	n, m := strings.Count(r.Src, "*"), strings.Count(r.Dst, "*")
+	if r.Src == "" && r.Dst == "" || n > 1 || m > 1 || m != n && r.Dst != "" {
+		return nil, fmt.Errorf("invalid refspec '%s'", s)
+	}
+	return r, nil
+}
+
+func (r *Refspec) String() string {
+	s := r.Src
+	if r.Dst != "" {
+		s += ":" + r.Dst
+	}
+	if r.Force {
+		s = "+" + s
+	}
+	return s
+}
+
+func (r *Refspec) glob() bool {
+	return strings.Contains(r.Src, "*")
+}
+
+// match returns the local ref the remote ref name maps to if the refspec matches it.
+func (r *Refspec) match(name string) (string, bool) {
+	if !r.glob() {
+		if name != r.Src {
+			return "", false
+		}
+		return r.Dst, true
+	}
+	kv := strings.SplitN(r.Src, "*", 2)
+	if len(kv) != 2 || len(name) < len(kv[0])+len(kv[1]) || !strings.HasPrefix(name, kv[0]) || !strings.HasSuffix(name, kv[1]) {
+		return "", false
+	}
+	return strings.Replace(r.Dst, "*", name[len(kv[0]):len(name)-len(kv[1])], 1), true
+}
+
+// refRules are the full names a short ref name may stand for, in the order they are tried.
+var refRules = []string{"%s", "refs/%s", "refs/tags/%s", "refs/heads/%s", "refs/remotes/%s", "refs/remotes/%s/HEAD"}
+
+// expandRemoteRef returns the advertised ref the short name refers to, trying the names
+// in the order git rev-parse does.
+func expandRemoteRef(refs []*RemoteRef, name string) *RemoteRef {
+	for _, f := range refRules {
+		full := fmt.Sprintf(f, name)
+		for _, r := range refs {
+			if r.Name == full {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// ShortRefName returns the name of the ref without refs/heads/, refs/tags/ or
+// refs/remotes/.
+func ShortRefName(name string) string {
+	for _, p := range []string{"refs/heads/", "refs/tags/", "refs/remotes/"} {
+		if strings.HasPrefix(name, p) {
+			return name[len(p):]
+		}
+	}
+	return name
+}
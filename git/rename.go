@@ -0,0 +1,365 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// MaxScore is the similarity score of identical files.
+const MaxScore = 60000
+
+// DefaultRenameScore is the minimum similarity for renames and copies by default, which is 50%.
+const DefaultRenameScore = MaxScore / 2
+
+// DefaultRenameLimit is the default of RenameOptions.Limit.
+const DefaultRenameLimit = 1000
+
+// RenameOptions configures DetectRenames.
+type RenameOptions struct {
+	// Copies also detects copies of modified files and copies of renamed files.
+	Copies bool
+	// MinScore is the minimum similarity of the pairs, out of MaxScore. 0 means DefaultRenameScore.
+	MinScore int
+	// Limit skips the similarity scoring if there are more than Limit sources or destinations
+	// to compare, leaving only the exact renames detected. 0 means DefaultRenameLimit.
+	Limit int
+	// ReadOld and ReadNew read the contents of the old and the new sides of the changes.
+	// nil means reading blobs from the repository.
+	ReadOld, ReadNew func(*TreeLeaf) ([]byte, error)
+}
+
+// ParseRenameScore parses the similarity given to -M or -C as git does: "50%", or digits
+// meaning a decimal fraction as in "5" or "0.5" for 50%.
+func ParseRenameScore(s string) (int, error) {
+	if s == "" {
+		return DefaultRenameScore, nil
+	}
+	num, scale, dot := 0, 1, false
+	i := 0
+	for ; i < len(s); i++ {
+		c := s[i]
+		if !dot && c == '.' {
+			scale, dot = 1, true
+		} else if c == '%' {
+			if dot {
+				scale *= 100
+			} else {
+				scale = 100
+			}
+			i++
+			break
+		} else if '0' <= c && c <= '9' {
+			if scale < 100000 {
+				scale *= 10
+				num = num*10 + int(c-'0')
+			}
+		} else {
+			break
+		}
+	}
+	if i != len(s) {
+		return 0, fmt.Errorf("invalid similarity %q", s)
+	}
+	if num >= scale {
+		return MaxScore, nil
+	}
+	return MaxScore * num / scale, nil
+}
+
+// DetectRenames pairs deleted files with added files of similar contents, returning the changes
+// with the pairs replaced by renames ('R'). With opts.Copies, added files may also be paired with
+// modified files or with the sources of renames, which makes copies ('C'). The Score of renames
+// and copies is the similarity of the contents. Files with the same SHA are paired first, and
+// the other pairs are chosen in the order of their similarities, which are computed as git does
+// by hashing the chunks of the contents.
+func DetectRenames(repo *Repo, changes []*Change, opts *RenameOptions) ([]*Change, error) {
+	if opts == nil {
+		opts = &RenameOptions{}
+	}
+	minScore, limit := opts.MinScore, opts.Limit
+	if minScore == 0 {
+		minScore = DefaultRenameScore
+	}
+	if limit == 0 {
+		limit = DefaultRenameLimit
+	}
+
+	var srcs []*renameSrc
+	var dsts []*renameDst
+	srcOf := make(map[*Change]*renameSrc)
+	dstOf := make(map[*Change]*renameDst)
+	for _, c := range changes {
+		switch {
+		case c.Status == 'A':
+			d := &renameDst{change: c}
+			dsts = append(dsts, d)
+			dstOf[c] = d
+		case c.Status == 'D' || opts.Copies && c.Status == 'M':
+			s := &renameSrc{change: c, leaf: c.From}
+			srcs = append(srcs, s)
+			srcOf[c] = s
+		}
+	}
+	if len(srcs) == 0 || len(dsts) == 0 {
+		return changes, nil
+	}
+	rd := &renameReader{repo: repo, opts: opts}
+
+	// Exact renames, preferring unused sources and sources with the same base name.
+	for _, d := range dsts {
+		var best *renameSrc
+		bestScore := -1
+		for _, s := range srcs {
+			l := d.change.To
+			if s.leaf.SHA != l.SHA || (!isRegular(s.leaf.Mode) || !isRegular(l.Mode)) && s.leaf.Mode != l.Mode {
+				continue
+			}
+			if s.used > 0 && !opts.Copies {
+				continue
+			}
+			score := 0
+			if s.used == 0 {
+				score++
+			}
+			if sameBasename(s.leaf.Path, l.Path) {
+				score++
+			}
+			if score > bestScore {
+				best, bestScore = s, score
+			}
+		}
+		if best != nil {
+			d.pair(best, MaxScore)
+		}
+	}
+
+	// Inexact renames, from the most similar pairs.
+	var rest []*renameDst
+	for _, d := range dsts {
+		if d.src == nil {
+			rest = append(rest, d)
+		}
+	}
+	if len(rest) > 0 && len(rest)*len(srcs) <= limit*limit {
+		// Each destination keeps the best few candidates as git does.
+		const candidatesPerDst = 4
+		var cands []*renameCand
+		for i, d := range rest {
+			var top []*renameCand
+			for j, s := range srcs {
+				if s.used > 0 && !opts.Copies {
+					continue
+				}
+				score, err := rd.similarity(s.leaf, d.change.To, minScore)
+				if err != nil {
+					return nil, err
+				}
+				if score < minScore {
+					continue
+				}
+				top = append(top, &renameCand{d, s, score, sameBasename(s.leaf.Path, d.change.To.Path), i, j})
+			}
+			sortCands(top)
+			if len(top) > candidatesPerDst {
+				top = top[:candidatesPerDst]
+			}
+			cands = append(cands, top...)
+		}
+		sortCands(cands)
+		for _, c := range cands {
+			if c.dst.src == nil && c.src.used == 0 {
+				c.dst.pair(c.src, c.score)
+			}
+		}
+		if opts.Copies {
+			for _, c := range cands {
+				if c.dst.src == nil {
+					c.dst.pair(c.src, c.score)
+				}
+			}
+		}
+	}
+
+	// A deleted file paired with several files is renamed to the last of them and copied
+	// to the others. Deletions of paired files are dropped.
+	var res []*Change
+	for _, c := range changes {
+		if d := dstOf[c]; d != nil && d.src != nil {
+			rc := &Change{From: d.src.leaf, To: c.To, Score: d.score, Status: 'C'}
+			if d.src.change.Status == 'D' {
+				if d.src.left--; d.src.left == 0 {
+					rc.Status = 'R'
+				}
+			}
+			res = append(res, rc)
+			continue
+		}
+		if s := srcOf[c]; s != nil && s.used > 0 && c.Status == 'D' {
+			continue
+		}
+		res = append(res, c)
+	}
+	return res, nil
+}
+
+type renameSrc struct {
+	change *Change
+	leaf   *TreeLeaf
+	// used is the number of destinations paired with the source, and left the number of them
+	// yet to be output.
+	used, left int
+}
+
+type renameDst struct {
+	change *Change
+	src    *renameSrc
+	score  int
+}
+
+func (d *renameDst) pair(s *renameSrc, score int) {
+	d.src, d.score = s, score
+	s.used++
+	s.left++
+}
+
+type renameCand struct {
+	dst        *renameDst
+	src        *renameSrc
+	score      int
+	sameName   bool
+	dstI, srcI int
+}
+
+// sortCands sorts the candidates by their scores, preferring the same base names on ties.
+func sortCands(cs []*renameCand) {
+	sort.SliceStable(cs, func(i, j int) bool {
+		a, b := cs[i], cs[j]
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if a.sameName != b.sameName {
+			return a.sameName
+		}
+		if a.dstI != b.dstI {
+			return a.dstI < b.dstI
+		}
+		return a.srcI < b.srcI
+	})
+}
+
+func isRegular(mode string) bool {
+	return mode == "100644" || mode == "100755"
+}
+
+func sameBasename(a, b string) bool {
+	return path.Base(a) == path.Base(b)
+}
+
+// renameReader reads the contents of the files and caches their chunk hashes.
+type renameReader struct {
+	repo   *Repo
+	opts   *RenameOptions
+	sizes  map[*TreeLeaf]int
+	chunks map[*TreeLeaf]map[uint32]int
+}
+
+func (rd *renameReader) read(l *TreeLeaf, old bool) ([]byte, error) {
+	read := rd.opts.ReadNew
+	if old {
+		read = rd.opts.ReadOld
+	}
+	if read != nil {
+		return read(l)
+	}
+	o, err := ReadObject(rd.repo, l.SHA)
+	if err != nil {
+		return nil, err
+	}
+	if o.Type != "blob" {
+		return nil, fmt.Errorf("%s is not a blob", l.SHA)
+	}
+	return o.Blob, nil
+}
+
+// load reads the file for similarity scoring, caching its size and chunk hashes.
+func (rd *renameReader) load(l *TreeLeaf, old bool) error {
+	if rd.sizes == nil {
+		rd.sizes = make(map[*TreeLeaf]int)
+		rd.chunks = make(map[*TreeLeaf]map[uint32]int)
+	}
+	if _, ok := rd.sizes[l]; ok {
+		return nil
+	}
+	b, err := rd.read(l, old)
+	if err != nil {
+		return err
+	}
+	rd.sizes[l] = len(b)
+	rd.chunks[l] = hashChunks(b)
+	return nil
+}
+
+// similarity returns the similarity of the regular files, which is the amount of the content
+// of src found in dst relative to the larger size, out of MaxScore. Pairs whose sizes are too
+// different to reach minScore are not read.
+func (rd *renameReader) similarity(src, dst *TreeLeaf, minScore int) (int, error) {
+	if !isRegular(src.Mode) || !isRegular(dst.Mode) {
+		return 0, nil
+	}
+	if err := rd.load(src, true); err != nil {
+		return 0, err
+	}
+	if err := rd.load(dst, false); err != nil {
+		return 0, err
+	}
+	maxSize, baseSize := rd.sizes[src], rd.sizes[dst]
+	if maxSize < baseSize {
+		maxSize, baseSize = baseSize, maxSize
+	}
+	if maxSize == 0 || maxSize*(MaxScore-minScore) < (maxSize-baseSize)*MaxScore {
+		return 0, nil
+	}
+	copied := 0
+	sc, dc := rd.chunks[src], rd.chunks[dst]
+	for h, n := range sc {
+		if m := dc[h]; m < n {
+			copied += m
+		} else {
+			copied += n
+		}
+	}
+	return copied * MaxScore / maxSize, nil
+}
+
+// hashChunks splits the content into lines, or into 64-byte chunks within long lines, and
+// returns the total size of the chunks for each hash. CRs before LFs in text are ignored.
+func hashChunks(b []byte) map[uint32]int {
+	const hashBase = 107927
+	head := b
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	text := !bytes.Contains(head, []byte{0})
+	m := make(map[uint32]int)
+	var accum1, accum2 uint32
+	n := 0
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		if text && c == '\r' && i+1 < len(b) && b[i+1] == '\n' {
+			continue
+		}
+		old := accum1
+		accum1 = (accum1 << 7) ^ (accum2 >> 25)
+		accum2 = (accum2 << 7) ^ (old >> 25)
+		accum1 += uint32(c)
+		if n++; n < 64 && c != '\n' {
+			continue
+		}
+		m[(accum1+accum2*0x61)%hashBase] += n
+		n, accum1, accum2 = 0, 0, 0
+	}
+	// Like git, an incomplete last chunk is not counted.
+	return m
+}
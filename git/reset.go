@@ -0,0 +1,93 @@
+package git
+
+import "os"
+
+// ResetMode specifies what Reset updates besides HEAD.
+type ResetMode int
+
+const (
+	// ResetSoft updates only HEAD.
+	ResetSoft ResetMode = iota
+	// ResetMixed updates HEAD and the index.
+	ResetMixed
+	// ResetHard updates HEAD, the index and the worktree.
+	ResetHard
+)
+
+// Reset points the current branch, or HEAD if it is detached, at the commit sha and saves
+// the previous HEAD in ORIG_HEAD. Depending on mode the index and the worktree are reset to
+// the tree of the commit. As with git, a merge, cherry-pick or revert in progress is
+// forgotten. msg is recorded in the reflogs.
+func Reset(repo *Repo, sha string, mode ResetMode, msg string) error {
+	tree, err := TreeSHA(repo, sha)
+	if err != nil {
+		return err
+	}
+	_, old, err := Head(repo)
+	if err != nil {
+		return err
+	}
+	switch mode {
+	case ResetMixed:
+		if err := ResetIndex(repo, tree, nil); err != nil {
+			return err
+		}
+	case ResetHard:
+		from := ""
+		if old != "" {
+			if from, err = TreeSHA(repo, old); err != nil {
+				return err
+			}
+		}
+		if err := CheckoutTree(repo, from, tree, true); err != nil {
+			return err
+		}
+	}
+	if old != "" {
+		if err := writeFile([]byte(old+"\n"), repo.path("ORIG_HEAD")); err != nil {
+			return err
+		}
+	}
+	if err := UpdateRef(repo, "HEAD", sha, "", msg); err != nil {
+		return err
+	}
+	return ClearMergeState(repo)
+}
+
+// ResetIndex resets the index entries matching the pathspecs to the tree, which may be ""
+// for an empty tree. All the entries are reset if pathspecs is empty. Entries which already
+// match the tree keep their stat data. The worktree is not touched.
+func ResetIndex(repo *Repo, tree string, pathspecs []string) error {
+	leaves, err := TreeEntries(repo, tree)
+	if err != nil {
+		return err
+	}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return err
+	}
+	updates := make(map[string]*IndexEntry)
+	for _, e := range idx.Entries {
+		if MatchPathspec(pathspecs, e.Path) {
+			updates[e.Path] = nil
+		}
+	}
+	for p, l := range leaves {
+		if !MatchPathspec(pathspecs, p) {
+			continue
+		}
+		if e := idx.Entry(p); entryIs(e, l) && len(idx.entries(p)) == 1 {
+			delete(updates, p)
+			continue
+		}
+		e := &IndexEntry{Mode: parseMode(l.Mode), SHA: l.SHA, Path: p}
+		if fi, err := os.Lstat(repo.wtPath(p)); err == nil && !fi.IsDir() {
+			// Record the size so that an unchanged file is detected by hashing it,
+			// while the zero mtime forces the hashing.
+			e.Size = uint32(fi.Size())
+		}
+		updates[p] = e
+	}
+	idx.update(updates)
+	return WriteIndex(repo, idx)
+}
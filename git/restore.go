@@ -0,0 +1,132 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// RestoreOptions specifies what Restore restores from where.
+type RestoreOptions struct {
+	// Source is the tree to restore from. If it is "", the worktree is restored from the index.
+	Source string
+	// Staged restores the index.
+	Staged bool
+	// Worktree restores the worktree.
+	Worktree bool
+	// Overlay leaves the files missing in the source as they are instead of removing them.
+	Overlay bool
+}
+
+// Restore restores the files matching the pathspecs in the index and/or the worktree from the
+// source. Unless opts.Overlay, tracked files matching the pathspecs but missing in the source are removed.
+// It fails if a pathspec matches no file known to git.
+func Restore(repo *Repo, pathspecs []string, opts RestoreOptions) error {
+	if opts.Source == "" && opts.Staged {
+		return fmt.Errorf("restoring the index needs a source tree")
+	}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return err
+	}
+	src := make(map[string]*TreeLeaf)
+	if opts.Source != "" {
+		if src, err = TreeEntries(repo, opts.Source); err != nil {
+			return err
+		}
+	} else {
+		for _, e := range idx.Entries {
+			if e.Stage == 0 {
+				src[e.Path] = &TreeLeaf{e.TreeMode(), e.Path, e.SHA}
+			}
+		}
+	}
+
+	matched := make(map[string]bool)
+	specMatched := make(map[string]bool)
+	var paths []string
+	add := func(p string) {
+		if matched[p] {
+			return
+		}
+		for _, s := range pathspecs {
+			if matchPathspec(s, p) {
+				matched[p] = true
+				specMatched[s] = true
+			}
+		}
+		if matched[p] {
+			paths = append(paths, p)
+		}
+	}
+	for p := range src {
+		add(p)
+	}
+	if !opts.Overlay {
+		for _, e := range idx.Entries {
+			add(e.Path)
+		}
+	}
+	for _, s := range pathspecs {
+		if !specMatched[s] {
+			return fmt.Errorf("pathspec '%s' did not match any file(s) known to git", s)
+		}
+	}
+	sort.Strings(paths)
+
+	updates := make(map[string]*IndexEntry)
+	for _, p := range paths {
+		l, e := src[p], idx.Entry(p)
+		if opts.Source == "" && l == nil {
+			return fmt.Errorf("path '%s' is unmerged", p)
+		}
+		if opts.Worktree {
+			if l == nil {
+				if e != nil || len(idx.entries(p)) > 0 {
+					if err := removeWorktreeFile(repo, p); err != nil {
+						return err
+					}
+				}
+			} else if ok, err := leafInWorktree(repo, l); err != nil {
+				return err
+			} else if !ok {
+				if err := writeWorktreeLeaf(repo, l); err != nil {
+					return err
+				}
+			}
+		}
+		if !opts.Staged {
+			if opts.Source == "" && e != nil {
+				// The worktree file now matches the index; refresh its stat data.
+				if ne, err := newIndexEntry(repo, p, e.SHA, e.Mode); err == nil {
+					updates[p] = ne
+				}
+			}
+			continue
+		}
+		if l == nil {
+			updates[p] = nil
+			continue
+		}
+		if entryIs(e, l) && len(idx.entries(p)) == 1 && !opts.Worktree {
+			continue
+		}
+		ne := &IndexEntry{Mode: parseMode(l.Mode), SHA: l.SHA, Path: p}
+		if opts.Worktree {
+			if ne, err = newIndexEntry(repo, p, l.SHA, parseMode(l.Mode)); err != nil {
+				return err
+			}
+		}
+		updates[p] = ne
+	}
+	idx.update(updates)
+	return WriteIndex(repo, idx)
+}
+
+// leafInWorktree reports whether the worktree file has the content and the mode of l.
+func leafInWorktree(repo *Repo, l *TreeLeaf) (bool, error) {
+	if _, err := os.Lstat(repo.wtPath(l.Path)); os.IsNotExist(err) {
+		return false, nil
+	}
+	return worktreeMatches(repo, &IndexEntry{Mode: parseMode(l.Mode), SHA: l.SHA, Path: l.Path})
+}
@@ -0,0 +1,208 @@
+package git
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ancestryRE = regexp.MustCompile(`^(.+)([~^])(\d*)$`)
+	reflogRE   = regexp.MustCompile(`^(.*)@\{(\d+)\}$`)
+)
+
+// resolveRevision resolves name with optional suffixes to a SHA without peeling the result.
+func resolveRevision(repo *Repo, name string) (string, error) {
+	if i := strings.Index(name, ":"); i >= 0 {
+		if i == 0 {
+			return resolveIndexPath(repo, name[1:])
+		}
+		return resolveTreePath(repo, name[:i], name[i+1:])
+	}
+	if strings.HasSuffix(name, "}") {
+		if i := strings.LastIndex(name, "^{"); i > 0 {
+			sha, err := resolveRevision(repo, name[:i])
+			if err != nil {
+				return "", err
+			}
+			typ := name[i+2 : len(name)-1]
+			if typ == "" {
+				// ^{} peels tags
+				for {
+					o, err := ReadObject(repo, sha)
+					if err != nil {
+						return "", err
+					}
+					if o.Type != "tag" {
+						return sha, nil
+					}
+					sha = o.KVLM.Get("object")[0]
+				}
+			}
+			return peel(repo, sha, typ, name)
+		}
+	}
+	if m := ancestryRE.FindStringSubmatch(name); m != nil {
+		n := 1
+		if m[3] != "" {
+			var err error
+			if n, err = strconv.Atoi(m[3]); err != nil {
+				return "", err
+			}
+		}
+		sha, err := ResolveRevision(repo, m[1], "commit")
+		if err != nil {
+			return "", err
+		}
+		if m[2] == "^" {
+			if n == 0 {
+				return sha, nil
+			}
+			ps, err := Parents(repo, sha)
+			if err != nil {
+				return "", err
+			}
+			if n > len(ps) {
+				return "", fmt.Errorf("%s: no such parent", name)
+			}
+			return ps[n-1], nil
+		}
+		for i := 0; i < n; i++ {
+			ps, err := Parents(repo, sha)
+			if err != nil {
+				return "", err
+			}
+			if len(ps) == 0 {
+				return "", fmt.Errorf("%s: no such ancestor", name)
+			}
+			sha = ps[0]
+		}
+		return sha, nil
+	}
+	if m := reflogRE.FindStringSubmatch(name); m != nil {
+		n, err := strconv.Atoi(m[2])
+		if err != nil {
+			return "", err
+		}
+		return resolveReflog(repo, m[1], n)
+	}
+	if name == "@" {
+		name = "HEAD"
+	}
+	ss, err := findSHA(repo, name)
+	if err != nil {
+		return "", err
+	}
+	if len(ss) != 1 {
+		return "", &nameResolutionError{name, ss}
+	}
+	return ss[0], nil
+}
+
+// resolveReflog resolves "<ref>@{<n>}", the value the ref had n updates ago according to its
+// reflog. The ref is the current branch if ref is "".
+func resolveReflog(repo *Repo, ref string, n int) (string, error) {
+	name, err := reflogRef(repo, ref)
+	if err != nil {
+		return "", err
+	}
+	es, err := Reflog(repo, name)
+	if err != nil {
+		return "", err
+	}
+	if n >= len(es) {
+		return "", fmt.Errorf("log for '%s' only has %d entries", ref, len(es))
+	}
+	return es[len(es)-1-n].New, nil
+}
+
+// reflogRef returns the full name of the ref whose reflog "<ref>@{<n>}" refers to.
+func reflogRef(repo *Repo, ref string) (string, error) {
+	switch {
+	case ref == "":
+		branch, _, err := Head(repo)
+		if err != nil || branch == "" {
+			return "HEAD", err
+		}
+		return branch, nil
+	case ref == "HEAD" || strings.HasPrefix(ref, "refs/"):
+		return ref, nil
+	}
+	for _, p := range []string{"refs/", "refs/tags/", "refs/heads/", "refs/remotes/"} {
+		if _, err := ReadRef(repo, p+ref); err == nil {
+			return p + ref, nil
+		}
+	}
+	return "", fmt.Errorf("no such ref %s", ref)
+}
+
+// resolveTreePath resolves "<rev>:<path>" to the SHA of the entry at the path in the tree-ish,
+// or the tree itself if the path is empty.
+func resolveTreePath(repo *Repo, rev, p string) (string, error) {
+	sha, err := ResolveRevision(repo, rev, "tree")
+	if err != nil {
+		return "", err
+	}
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		o, err := ReadObject(repo, sha)
+		if err != nil {
+			return "", err
+		}
+		if o.Type != "tree" {
+			return "", fmt.Errorf("path '%s' does not exist in '%s'", p, rev)
+		}
+		found := false
+		for _, l := range o.Tree {
+			if l.Path == name {
+				sha, found = l.SHA, true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("path '%s' does not exist in '%s'", p, rev)
+		}
+	}
+	return sha, nil
+}
+
+// resolveIndexPath resolves ":<path>" or ":<n>:<path>" to the SHA of the index entry at the
+// path in the stage n, 0 by default.
+func resolveIndexPath(repo *Repo, p string) (string, error) {
+	stage := 0
+	if len(p) >= 2 && '0' <= p[0] && p[0] <= '3' && p[1] == ':' {
+		stage, p = int(p[0]-'0'), p[2:]
+	}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range idx.Entries {
+		if e.Path == p && e.Stage == stage {
+			return e.SHA, nil
+		}
+	}
+	return "", fmt.Errorf("path '%s' does not exist in the index at stage %d", p, stage)
+}
+
+// Parents returns the parents of the commit. A shallow commit of a shallow clone has none.
+func Parents(repo *Repo, sha string) ([]string, error) {
+	o, err := ReadObject(repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	if o.Type != "commit" {
+		return nil, fmt.Errorf("%s is a %s, not a commit", sha, o.Type)
+	}
+	shallow, err := repo.shallowCommits()
+	if err != nil {
+		return nil, err
+	}
+	if shallow[sha] {
+		return nil, nil
+	}
+	return o.KVLM.Get("parent"), nil
+}
@@ -0,0 +1,688 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ogiekako/gogit/diff"
+	"gopkg.in/ini.v1"
+)
+
+// The files recording a cherry-pick or a revert in progress. The sequencer directory holds
+// the commits left to pick when several are picked, as git does.
+const (
+	cherryPickHeadFile = "CHERRY_PICK_HEAD"
+	revertHeadFile     = "REVERT_HEAD"
+	sequencerDir       = "sequencer"
+)
+
+// PickAction is what is done with a commit by Pick.
+type PickAction int
+
+const (
+	// ActionPick applies the change made by a commit, as git cherry-pick does.
+	ActionPick PickAction = iota
+	// ActionRevert applies the inverse of the change made by a commit, as git revert does.
+	ActionRevert
+)
+
+// String returns the name of the command, "cherry-pick" or "revert".
+func (a PickAction) String() string {
+	if a == ActionRevert {
+		return "revert"
+	}
+	return "cherry-pick"
+}
+
+// todoWord returns the word of the action in the todo list.
+func (a PickAction) todoWord() string {
+	if a == ActionRevert {
+		return "revert"
+	}
+	return "pick"
+}
+
+func (a PickAction) headFile() string {
+	if a == ActionRevert {
+		return revertHeadFile
+	}
+	return cherryPickHeadFile
+}
+
+// PickOptions configures Pick.
+type PickOptions struct {
+	Action PickAction
+	// Mainline is the 1-based number of the parent of a merge commit which its change is
+	// taken relative to. It must be given for merges and only for them.
+	Mainline int
+	// NoCommit applies the changes to the index and the worktree without committing them.
+	// The changes are applied on top of the index, which may differ from HEAD.
+	NoCommit bool
+	// RecordOrigin appends "(cherry picked from commit <sha>)" to the messages of commits
+	// cherry-picked.
+	RecordOrigin bool
+	// Tree configures merging the changes. The labels are set by Pick.
+	Tree MergeOptions
+}
+
+// PickStatus is the result of picking a commit.
+type PickStatus int
+
+const (
+	// PickCommitted means the change is committed.
+	PickCommitted PickStatus = iota
+	// PickApplied means the change is applied without committing as requested.
+	PickApplied
+	// PickConflicted means the change conflicts, and the conflicts are left to be resolved.
+	PickConflicted
+	// PickEmpty means the change cherry-picked makes no difference to HEAD, and is left to
+	// be committed with Commit allowing empty commits or skipped.
+	PickEmpty
+)
+
+// PickOutcome describes the result of picking a commit.
+type PickOutcome struct {
+	Action PickAction
+	// Commit is the commit picked.
+	Commit string
+	Status PickStatus
+	// New is the commit created if Status is PickCommitted.
+	New string
+	// Tree is the result of merging the change.
+	Tree *MergeResult
+}
+
+// Stopped reports whether the sequence stopped at the commit.
+func (o *PickOutcome) Stopped() bool {
+	return o.Status == PickConflicted || o.Status == PickEmpty
+}
+
+// pickMessages returns the label of the commit used in conflict markers, as in
+// "1234567 (subject)", and its message.
+func pickMessages(repo *Repo, sha string) (label, msg string, err error) {
+	o, err := ReadObject(repo, sha)
+	if err != nil {
+		return "", "", err
+	}
+	if o.Type != "commit" {
+		return "", "", fmt.Errorf("%s is a %s, not a commit", sha, o.Type)
+	}
+	if ms := o.KVLM.Get(""); len(ms) > 0 {
+		msg = ms[0]
+	}
+	return sha[:7] + " (" + strings.SplitN(msg, "\n", 2)[0] + ")", msg, nil
+}
+
+func commitAuthor(repo *Repo, sha string) (string, error) {
+	o, err := ReadObject(repo, sha)
+	if err != nil {
+		return "", err
+	}
+	as := o.KVLM.Get("author")
+	if len(as) == 0 {
+		return "", fmt.Errorf("commit %s has no author", sha)
+	}
+	return as[0], nil
+}
+
+var trailerLine = regexp.MustCompile(`^([A-Za-z0-9-]+: |\(cherry picked from commit )`)
+
+// appendOrigin appends the line recording the commit cherry-picked to the message, in the
+// same paragraph as trailers such as "Signed-off-by:" ending the message.
+func appendOrigin(msg, sha string) string {
+	msg = strings.TrimRight(msg, "\n")
+	paras := strings.Split(msg, "\n\n")
+	last := paras[len(paras)-1]
+	trailers := len(paras) > 1
+	for _, l := range strings.Split(last, "\n") {
+		if !trailerLine.MatchString(l) {
+			trailers = false
+		}
+	}
+	if !trailers {
+		msg += "\n"
+	}
+	return msg + "\n(cherry picked from commit " + sha + ")\n"
+}
+
+// Pick applies the change made by the commit sha, or its inverse, onto HEAD by merging, and
+// commits it unless opts.NoCommit is true. The author of a commit cherry-picked is kept.
+// If the change conflicts or a cherry-pick turns out to be empty, the index and the worktree
+// are left with the result, and the message and the commit are recorded in MERGE_MSG and
+// CHERRY_PICK_HEAD or REVERT_HEAD, so that committing concludes it. A revert which turns out
+// to be empty fails.
+// The index must match HEAD unless opts.NoCommit is true.
+func Pick(repo *Repo, sha string, opts *PickOptions) (*PickOutcome, error) {
+	if opts == nil {
+		opts = &PickOptions{}
+	}
+	action := opts.Action
+	m, err := mergePick(repo, sha, opts)
+	if err != nil {
+		return nil, err
+	}
+	head, headTree, msg, res := m.head, m.headTree, m.msg, m.res
+	out := &PickOutcome{Action: action, Commit: sha, Tree: res}
+
+	if opts.NoCommit {
+		out.Status = PickApplied
+		if len(res.Conflicts) > 0 {
+			out.Status = PickConflicted
+			msg += conflictsComment(repo)
+		}
+		return out, writeFile([]byte(msg), repo.path(mergeMsgFile))
+	}
+	if len(res.Conflicts) == 0 && res.Tree == headTree && action == ActionRevert {
+		return nil, errors.New("nothing to commit, working tree clean")
+	}
+	if len(res.Conflicts) > 0 || res.Tree == headTree {
+		out.Status = PickEmpty
+		if len(res.Conflicts) > 0 {
+			out.Status = PickConflicted
+			msg += conflictsComment(repo)
+		}
+		if err := writeFile([]byte(msg), repo.path(mergeMsgFile)); err != nil {
+			return nil, err
+		}
+		return out, writeFile([]byte(sha+"\n"), repo.path(action.headFile()))
+	}
+
+	author := Signature(repo, "author")
+	if action == ActionPick {
+		if author, err = commitAuthor(repo, sha); err != nil {
+			return nil, err
+		}
+	}
+	msg = CleanupMessage(msg, false)
+	var ps []string
+	old := ZeroSHA
+	if head != "" {
+		ps, old = []string{head}, head
+	}
+	if out.New, err = commitTree(repo, res.Tree, ps, author, msg); err != nil {
+		return nil, err
+	}
+	if err := UpdateRef(repo, "HEAD", out.New, old, action.String()+": "+strings.SplitN(msg, "\n", 2)[0]); err != nil {
+		return nil, err
+	}
+	out.Status = PickCommitted
+	return out, nil
+}
+
+// pickedChange is the result of merging the change made by a commit onto HEAD.
+type pickedChange struct {
+	head, headTree string
+	// msg is the default message of the commit of the change.
+	msg string
+	res *MergeResult
+}
+
+// mergePick merges the change made by the commit sha, or its inverse, onto the index and
+// checks out the result, leaving conflicts in the index and the worktree.
+func mergePick(repo *Repo, sha string, opts *PickOptions) (*pickedChange, error) {
+	action := opts.Action
+	parents, err := Parents(repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	parent := ""
+	switch {
+	case len(parents) > 1 && opts.Mainline == 0:
+		return nil, fmt.Errorf("commit %s is a merge but no -m option was given", sha)
+	case len(parents) > 1 && opts.Mainline > len(parents):
+		return nil, fmt.Errorf("commit %s does not have parent %d", sha, opts.Mainline)
+	case len(parents) > 1:
+		parent = parents[opts.Mainline-1]
+	case opts.Mainline > 0:
+		return nil, fmt.Errorf("mainline was specified but commit %s is not a merge", sha)
+	case len(parents) == 1:
+		parent = parents[0]
+	}
+
+	_, head, err := Head(repo)
+	if err != nil {
+		return nil, err
+	}
+	headTree := ""
+	if head != "" {
+		if headTree, err = TreeSHA(repo, head); err != nil {
+			return nil, err
+		}
+	}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return nil, err
+	}
+	ours := ""
+	if head != "" || len(idx.Entries) > 0 {
+		if ours, err = WriteTree(repo, idx); err != nil {
+			return nil, err
+		}
+	}
+	if !opts.NoCommit && ours != headTree {
+		return nil, dirtyIndexError(action)
+	}
+
+	label, msg, err := pickMessages(repo, sha)
+	if err != nil {
+		return nil, err
+	}
+	parentLabel := "parent of " + label
+	base, next := parent, sha
+	topts := opts.Tree
+	topts.OursLabel, topts.BaseLabel, topts.TheirsLabel = "HEAD", parentLabel, label
+	if action == ActionRevert {
+		base, next = sha, parent
+		topts.BaseLabel, topts.TheirsLabel = label, parentLabel
+		subject := strings.SplitN(msg, "\n", 2)[0]
+		msg = "Revert \"" + subject + "\"\n\nThis reverts commit " + sha
+		if len(parents) > 1 {
+			msg += ", reversing\nchanges made to " + parent
+		}
+		msg += ".\n"
+	} else if opts.RecordOrigin {
+		msg = appendOrigin(msg, sha)
+	}
+	var baseTree, nextTree string
+	if base != "" {
+		if baseTree, err = TreeSHA(repo, base); err != nil {
+			return nil, err
+		}
+	}
+	if next != "" {
+		if nextTree, err = TreeSHA(repo, next); err != nil {
+			return nil, err
+		}
+	}
+	res, err := MergeTrees(repo, baseTree, ours, nextTree, &topts)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckoutMerge(repo, ours, res, action.String()); err != nil {
+		return nil, err
+	}
+	return &pickedChange{head, headTree, msg, res}, nil
+}
+
+// conflictsComment returns the comment listing the unmerged paths appended to MERGE_MSG.
+func conflictsComment(repo *Repo) string {
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return ""
+	}
+	s := "\n# Conflicts:\n"
+	for _, p := range idx.Unmerged() {
+		s += "#\t" + p + "\n"
+	}
+	return s
+}
+
+// readPickHead returns the commit recorded in CHERRY_PICK_HEAD or REVERT_HEAD, or "" if
+// there is none.
+func readPickHead(repo *Repo, file string) (string, error) {
+	b, err := ioutil.ReadFile(repo.path(file))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(b)), err
+}
+
+// PickHead returns the commit at which a cherry-pick or a revert stopped, as recorded in
+// CHERRY_PICK_HEAD or REVERT_HEAD, with the action, or "" if none is stopped.
+func PickHead(repo *Repo) (PickAction, string, error) {
+	for _, a := range []PickAction{ActionPick, ActionRevert} {
+		if sha, err := readPickHead(repo, a.headFile()); err != nil || sha != "" {
+			return a, sha, err
+		}
+	}
+	return ActionPick, "", nil
+}
+
+// pickInProgress returns the action stopped, if any, and whether a sequence is in progress.
+func pickInProgress(repo *Repo) (action PickAction, stopped, sequence bool, err error) {
+	action, sha, err := PickHead(repo)
+	if err != nil {
+		return 0, false, false, err
+	}
+	stopped = sha != ""
+	if _, err := os.Stat(repo.path(sequencerDir)); err == nil {
+		sequence = true
+	} else if !os.IsNotExist(err) {
+		return 0, false, false, err
+	}
+	return action, stopped, sequence, nil
+}
+
+// todoItem is a line of the todo list of the sequencer.
+type todoItem struct {
+	action PickAction
+	sha    string
+}
+
+func writeSequence(repo *Repo, todo []todoItem, opts *PickOptions) error {
+	var b strings.Builder
+	for _, t := range todo {
+		_, msg, err := pickMessages(repo, t.sha)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", t.action.todoWord(), t.sha[:7], strings.SplitN(msg, "\n", 2)[0])
+	}
+	if err := writeFile([]byte(b.String()), repo.path(sequencerDir, "todo")); err != nil {
+		return err
+	}
+	_, head, err := Head(repo)
+	if err != nil {
+		return err
+	}
+	if err := writeFile([]byte(head+"\n"), repo.path(sequencerDir, "abort-safety")); err != nil {
+		return err
+	}
+	if opts == nil {
+		return nil
+	}
+	f := ini.Empty()
+	s := f.Section("options")
+	if opts.NoCommit {
+		s.Key("no-commit").SetValue("true")
+	}
+	if opts.RecordOrigin {
+		s.Key("record-origin").SetValue("true")
+	}
+	if opts.Mainline > 0 {
+		s.Key("mainline").SetValue(strconv.Itoa(opts.Mainline))
+	}
+	if opts.Tree.Favor != diff.FavorNone {
+		s.Key("strategy-option").SetValue([]string{"", "ours", "theirs", "union"}[opts.Tree.Favor])
+	}
+	return f.SaveToIndent(repo.path(sequencerDir, "opts"), "\t")
+}
+
+func readSequence(repo *Repo) ([]todoItem, *PickOptions, error) {
+	b, err := ioutil.ReadFile(repo.path(sequencerDir, "todo"))
+	if err != nil {
+		return nil, nil, err
+	}
+	var todo []todoItem
+	for _, l := range strings.Split(string(b), "\n") {
+		f := strings.Fields(l)
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		if len(f) < 2 {
+			return nil, nil, fmt.Errorf("malformed todo line %q", l)
+		}
+		t := todoItem{sha: f[1]}
+		switch f[0] {
+		case "pick", "p":
+		case "revert":
+			t.action = ActionRevert
+		default:
+			return nil, nil, fmt.Errorf("unknown action in todo line %q", l)
+		}
+		if t.sha, err = ResolveRevision(repo, t.sha, "commit"); err != nil {
+			return nil, nil, err
+		}
+		todo = append(todo, t)
+	}
+	opts := &PickOptions{}
+	f, err := ini.Load(repo.path(sequencerDir, "opts"))
+	if os.IsNotExist(err) {
+		return todo, opts, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	s := f.Section("options")
+	opts.NoCommit = s.Key("no-commit").MustBool(false)
+	opts.RecordOrigin = s.Key("record-origin").MustBool(false)
+	opts.Mainline = s.Key("mainline").MustInt(0)
+	switch s.Key("strategy-option").String() {
+	case "ours":
+		opts.Tree.Favor = diff.FavorOurs
+	case "theirs":
+		opts.Tree.Favor = diff.FavorTheirs
+	case "union":
+		opts.Tree.Favor = diff.FavorUnion
+	}
+	return todo, opts, nil
+}
+
+// Sequence picks the commits in order with Pick, stopping at the first one which conflicts or
+// turns out to be empty. When several commits are picked, those left are recorded in the
+// sequencer directory so that ContinueSequence, SkipSequence and AbortSequence resume or
+// abandon the sequence. It returns the outcomes of the commits picked, the last of which
+// tells if the sequence stopped.
+func Sequence(repo *Repo, commits []string, opts *PickOptions) ([]*PickOutcome, error) {
+	if opts == nil {
+		opts = &PickOptions{}
+	}
+	if _, stopped, sequence, err := pickInProgress(repo); err != nil {
+		return nil, err
+	} else if stopped || sequence {
+		return nil, errors.New("a cherry-pick or revert is already in progress; try \"git cherry-pick (--continue | --skip | --abort)\"")
+	}
+	if len(commits) == 0 {
+		return nil, errors.New("empty commit set passed")
+	}
+	if len(commits) == 1 {
+		out, err := Pick(repo, commits[0], opts)
+		if err != nil {
+			return nil, err
+		}
+		return []*PickOutcome{out}, nil
+	}
+	var todo []todoItem
+	for _, c := range commits {
+		todo = append(todo, todoItem{opts.Action, c})
+	}
+	_, head, err := Head(repo)
+	if err != nil {
+		return nil, err
+	}
+	if head == "" {
+		return nil, errors.New("cannot pick several commits onto an unborn branch")
+	}
+	if err := writeFile([]byte(head+"\n"), repo.path(sequencerDir, "head")); err != nil {
+		return nil, err
+	}
+	if err := writeSequence(repo, todo, opts); err != nil {
+		return nil, err
+	}
+	return runSequence(repo, todo, opts)
+}
+
+// runSequence picks the commits in the todo list, recording the progress.
+func runSequence(repo *Repo, todo []todoItem, opts *PickOptions) ([]*PickOutcome, error) {
+	var outs []*PickOutcome
+	for len(todo) > 0 {
+		o := *opts
+		o.Action = todo[0].action
+		out, err := Pick(repo, todo[0].sha, &o)
+		if err != nil {
+			return outs, err
+		}
+		outs = append(outs, out)
+		if out.Stopped() {
+			return outs, writeSequence(repo, todo, nil)
+		}
+		todo = todo[1:]
+		if err := writeSequence(repo, todo, nil); err != nil {
+			return outs, err
+		}
+	}
+	return outs, os.RemoveAll(repo.path(sequencerDir))
+}
+
+// ContinueSequence commits the resolution of the commit at which the cherry-pick or the revert
+// stopped, with the message in MERGE_MSG, and picks the commits left.
+func ContinueSequence(repo *Repo) ([]*PickOutcome, error) {
+	action, stopped, sequence, err := pickInProgress(repo)
+	if err != nil {
+		return nil, err
+	}
+	if !stopped && !sequence {
+		return nil, errors.New("no cherry-pick or revert in progress")
+	}
+	var outs []*PickOutcome
+	if stopped {
+		sha, err := readPickHead(repo, action.headFile())
+		if err != nil {
+			return nil, err
+		}
+		msg, err := MergeMessage(repo)
+		if err != nil {
+			return nil, err
+		}
+		c, err := Commit(repo, CleanupMessage(msg, true), nil)
+		if err != nil {
+			return nil, err
+		}
+		outs = append(outs, &PickOutcome{Action: action, Commit: sha, Status: PickCommitted, New: c})
+	}
+	if !sequence {
+		return outs, nil
+	}
+	todo, opts, err := readSequence(repo)
+	if err != nil {
+		return outs, err
+	}
+	if !opts.NoCommit {
+		if err := checkIndexClean(repo, action); err != nil {
+			return outs, err
+		}
+	}
+	if len(todo) > 0 {
+		todo = todo[1:]
+	}
+	rest, err := runSequence(repo, todo, opts)
+	return append(outs, rest...), err
+}
+
+// checkIndexClean returns an error if the index differs from HEAD.
+func checkIndexClean(repo *Repo, action PickAction) error {
+	_, head, err := Head(repo)
+	if err != nil {
+		return err
+	}
+	headTree := ""
+	if head != "" {
+		if headTree, err = TreeSHA(repo, head); err != nil {
+			return err
+		}
+	}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return err
+	}
+	if tree, err := WriteTree(repo, idx); err != nil {
+		return err
+	} else if tree != headTree {
+		return dirtyIndexError(action)
+	}
+	return nil
+}
+
+func dirtyIndexError(action PickAction) error {
+	return fmt.Errorf("your local changes would be overwritten by %s; commit your changes or stash them to proceed", action)
+}
+
+// SkipSequence discards the changes of the commit at which the cherry-pick or the revert
+// stopped and picks the commits left.
+func SkipSequence(repo *Repo) ([]*PickOutcome, error) {
+	_, stopped, sequence, err := pickInProgress(repo)
+	if err != nil {
+		return nil, err
+	}
+	if !stopped && !sequence {
+		return nil, errors.New("no cherry-pick or revert in progress")
+	}
+	if stopped {
+		_, head, err := Head(repo)
+		if err != nil {
+			return nil, err
+		}
+		if err := rewind(repo, head); err != nil {
+			return nil, err
+		}
+	}
+	if !sequence {
+		return nil, nil
+	}
+	todo, opts, err := readSequence(repo)
+	if err != nil {
+		return nil, err
+	}
+	if len(todo) > 0 {
+		todo = todo[1:]
+	}
+	return runSequence(repo, todo, opts)
+}
+
+// AbortSequence abandons the cherry-pick or the revert in progress, resetting HEAD, the index
+// and the worktree to the commit HEAD was at before the sequence started. If HEAD was moved
+// by other means since the sequence stopped, HEAD is left as it is.
+func AbortSequence(repo *Repo) error {
+	_, stopped, sequence, err := pickInProgress(repo)
+	if err != nil {
+		return err
+	}
+	if !stopped && !sequence {
+		return errors.New("no cherry-pick or revert in progress")
+	}
+	_, head, err := Head(repo)
+	if err != nil {
+		return err
+	}
+	if !sequence {
+		return rewind(repo, head)
+	}
+	defer os.RemoveAll(repo.path(sequencerDir))
+	b, err := ioutil.ReadFile(repo.path(sequencerDir, "head"))
+	if err != nil {
+		return err
+	}
+	if b, err := ioutil.ReadFile(repo.path(sequencerDir, "abort-safety")); err == nil && strings.TrimSpace(string(b)) != head {
+		if err := ClearMergeState(repo); err != nil {
+			return err
+		}
+		return errors.New("you seem to have moved HEAD; not rewinding, check your HEAD")
+	}
+	return rewind(repo, strings.TrimSpace(string(b)))
+}
+
+// rewind resets the index entries which differ from HEAD and the corresponding worktree files
+// to the commit sha, points HEAD at it and clears the merge state, as git reset --merge does.
+func rewind(repo *Repo, sha string) error {
+	if err := resetMerge(repo); err != nil {
+		return err
+	}
+	if err := ClearMergeState(repo); err != nil {
+		return err
+	}
+	_, head, err := Head(repo)
+	if err != nil {
+		return err
+	}
+	if sha != head {
+		from, err := TreeSHA(repo, head)
+		if err != nil {
+			return err
+		}
+		to, err := TreeSHA(repo, sha)
+		if err != nil {
+			return err
+		}
+		if err := CheckoutTree(repo, from, to, false); err != nil {
+			return err
+		}
+	}
+	if err := writeFile([]byte(head+"\n"), repo.path("ORIG_HEAD")); err != nil {
+		return err
+	}
+	return UpdateRef(repo, "HEAD", sha, head, "reset: moving to "+sha)
+}
@@ -0,0 +1,284 @@
+package git
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// infiniteDepth is the depth which deepens the history to its roots, as git fetch
+// --unshallow asks for.
+const infiniteDepth = 0x7fffffff
+
+// shallowCommits returns the commits listed in the shallow file of the repository, whose
+// parents are missing in a shallow clone.
+func (r *Repo) shallowCommits() (map[string]bool, error) {
+	if r.shallow != nil {
+		return r.shallow, nil
+	}
+	b, err := ioutil.ReadFile(r.path("shallow"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	r.shallow = make(map[string]bool)
+	for _, l := range strings.Fields(string(b)) {
+		r.shallow[l] = true
+	}
+	return r.shallow, nil
+}
+
+// IsShallow reports whether the repository is a shallow clone.
+func IsShallow(repo *Repo) (bool, error) {
+	s, err := repo.shallowCommits()
+	return len(s) > 0, err
+}
+
+// updateShallow adds the commits which became shallow to the shallow file and removes
+// those which are not any more, removing the file if no commit is left.
+func updateShallow(repo *Repo, u *shallowUpdate) error {
+	s, err := repo.shallowCommits()
+	if err != nil {
+		return err
+	}
+	for _, c := range u.shallow {
+		s[c] = true
+	}
+	for _, c := range u.unshallow {
+		delete(s, c)
+	}
+	if len(s) == 0 {
+		if err := os.Remove(repo.path("shallow")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var cs []string
+	for c := range s {
+		cs = append(cs, c)
+	}
+	sort.Strings(cs)
+	return writeFile([]byte(strings.Join(cs, "\n")+"\n"), repo.path("shallow"))
+}
+
+// shallowUpdate is the change of the shallow commits a server sends for a request which
+// deepens or shortens the history of the client.
+type shallowUpdate struct {
+	shallow, unshallow []string
+}
+
+// readShallowUpdate reads the shallow and unshallow lines up to a flush-pkt or a
+// delim-pkt.
+func readShallowUpdate(p *pktReader) (*shallowUpdate, error) {
+	u := &shallowUpdate{}
+	for {
+		kind, data, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if kind != pktData {
+			return u, nil
+		}
+		l := strings.TrimSuffix(string(data), "\n")
+		switch {
+		case strings.HasPrefix(l, "shallow "):
+			u.shallow = append(u.shallow, strings.TrimPrefix(l, "shallow "))
+		case strings.HasPrefix(l, "unshallow "):
+			u.unshallow = append(u.unshallow, strings.TrimPrefix(l, "unshallow "))
+		case strings.HasPrefix(l, "ERR "):
+			return nil, fmt.Errorf("remote error: %s", l[len("ERR "):])
+		default:
+			return nil, fmt.Errorf("protocol error: expected shallow or unshallow, got %q", l)
+		}
+	}
+}
+
+// deepenRequest is how a client asks UploadPack to limit the history it sends: to depth
+// commits from the wants, or from its shallow commits if relative, to the commits made at
+// or after since, or to the commits not reachable from the refs in exclude. shallow are the
+// shallow commits of the client.
+type deepenRequest struct {
+	shallow  []string
+	depth    int
+	relative bool
+	since    int64
+	exclude  []string
+}
+
+// parseLine parses a shallow, deepen, deepen-relative, deepen-since or deepen-not line of
+// a request, returning false if the line is none of them.
+func (d *deepenRequest) parseLine(l string) (bool, error) {
+	if l == "deepen-relative" {
+		d.relative = true
+		return true, nil
+	}
+	fs := strings.SplitN(l, " ", 2)
+	if len(fs) != 2 {
+		return false, nil
+	}
+	var err error
+	switch fs[0] {
+	case "shallow":
+		d.shallow = append(d.shallow, fs[1])
+	case "deepen":
+		if _, err = fmt.Sscan(fs[1], &d.depth); err == nil && d.depth <= 0 {
+			err = fmt.Errorf("invalid deepen: %s", fs[1])
+		}
+	case "deepen-since":
+		_, err = fmt.Sscan(fs[1], &d.since)
+	case "deepen-not":
+		d.exclude = append(d.exclude, fs[1])
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("protocol error: bad line %q", l)
+	}
+	return true, nil
+}
+
+// deepens reports whether the history is limited.
+func (d *deepenRequest) deepens() bool {
+	return d.depth > 0 || d.since != 0 || len(d.exclude) > 0
+}
+
+// shallowInfo reports whether a response tells the client about its shallow commits.
+func (d *deepenRequest) shallowInfo() bool {
+	return d.deepens() || len(d.shallow) > 0
+}
+
+// deepen walks the history from the wants the request limits, returning the commits
+// whose parents are not sent, which are shallow for the client, and the commits which
+// were shallow for the client but whose parents are sent now.
+func (d *deepenRequest) deepen(repo *Repo, wants []string) (shallow, unshallow []string, err error) {
+	if !d.deepens() {
+		return nil, nil, nil
+	}
+	if d.depth > 0 && (d.since != 0 || len(d.exclude) > 0) {
+		return nil, nil, fmt.Errorf("deepen and deepen-since (or deepen-not) cannot be used together")
+	}
+	excluded := make(map[string]bool)
+	if len(d.exclude) > 0 {
+		var tips []string
+		for _, name := range d.exclude {
+			sha, err := ResolveRevision(repo, name, "commit")
+			if err != nil {
+				return nil, nil, fmt.Errorf("deepen-not is not a ref: %s", name)
+			}
+			tips = append(tips, sha)
+		}
+		cs, err := RevList(repo, tips, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, c := range cs {
+			excluded[c] = true
+		}
+	}
+
+	g := newCommitGraph(repo)
+	// A breadth first walk finds each commit at its shortest distance from the wants, or
+	// from the shallow commits of the client, which are one commit deeper, if relative.
+	depth, from := d.depth, wants
+	if d.relative && depth > 0 {
+		depth, from = depth+1, d.shallow
+	}
+	dist := make(map[string]int)
+	var q []string
+	for _, w := range from {
+		c, err := peelTag(repo, w)
+		if err != nil {
+			return nil, nil, err
+		}
+		if typ, _, err := ReadRawObject(repo, c); err != nil || typ != "commit" {
+			continue
+		}
+		if _, ok := dist[c]; !ok {
+			dist[c] = 0
+			q = append(q, c)
+		}
+	}
+	selected := func(c string, n int) (bool, error) {
+		if depth > 0 {
+			return n < depth, nil
+		}
+		if excluded[c] {
+			return false, nil
+		}
+		if err := g.load(c); err != nil {
+			return false, err
+		}
+		return g.times[c] >= d.since, nil
+	}
+	for len(q) > 0 {
+		c := q[0]
+		q = q[1:]
+		if err := g.load(c); err != nil {
+			return nil, nil, err
+		}
+		cut := false
+		for _, p := range g.parents[c] {
+			ok, err := selected(p, dist[c]+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !ok {
+				cut = true
+				continue
+			}
+			if _, ok := dist[p]; !ok {
+				dist[p] = dist[c] + 1
+				q = append(q, p)
+			}
+		}
+		if cut {
+			shallow = append(shallow, c)
+		}
+	}
+	isShallow := make(map[string]bool)
+	for _, c := range shallow {
+		isShallow[c] = true
+	}
+	for _, c := range d.shallow {
+		if _, ok := dist[c]; ok && !isShallow[c] {
+			unshallow = append(unshallow, c)
+		}
+	}
+	return shallow, unshallow, nil
+}
+
+// writeShallowInfo tells the client which of its commits become shallow and which do not
+// any more, and returns the limits of the pack to send: the walk stops at the shallow
+// commits of the client and at the new ones, and the parents of the commits which are no
+// longer shallow are wanted.
+func (d *deepenRequest) writeShallowInfo(repo *Repo, w io.Writer, wants []string) (limits *packLimits, moreWants []string, err error) {
+	shallow, unshallow, err := d.deepen(repo, wants)
+	if err != nil {
+		return nil, nil, err
+	}
+	limits = &packLimits{shallow: make(map[string]bool)}
+	for _, c := range d.shallow {
+		limits.shallow[c] = true
+	}
+	for _, c := range shallow {
+		if !limits.shallow[c] {
+			if err := writePkt(w, "shallow %s\n", c); err != nil {
+				return nil, nil, err
+			}
+		}
+		limits.shallow[c] = true
+	}
+	for _, c := range unshallow {
+		if err := writePkt(w, "unshallow %s\n", c); err != nil {
+			return nil, nil, err
+		}
+		ps, err := Parents(repo, c)
+		if err != nil {
+			return nil, nil, err
+		}
+		moreWants = append(moreWants, ps...)
+	}
+	return limits, moreWants, nil
+}
@@ -0,0 +1,426 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// stashRef is the ref pointing to the latest stash entry. The entries are kept in its reflog,
+// stash@{0} being the latest.
+const stashRef = "refs/stash"
+
+// StashOptions configures StashPush.
+type StashOptions struct {
+	// Message describes the entry. "" means "WIP on <branch>: <commit> <subject>" of HEAD.
+	Message string
+	// IncludeUntracked also stashes the untracked files, removing them from the worktree.
+	IncludeUntracked bool
+	// KeepIndex leaves the changes in the index staged and checked out.
+	KeepIndex bool
+}
+
+// StashPush records the local changes as a stash entry under refs/stash and resets the index
+// and the worktree to HEAD, as git stash push does. As in git, the entry is a commit of the
+// worktree whose parents are HEAD, a commit of the index on HEAD and, if untracked files are
+// included, a parentless commit of them. It returns the entry, or "" if there is nothing to
+// stash.
+func StashPush(repo *Repo, opts *StashOptions) (string, error) {
+	if opts == nil {
+		opts = &StashOptions{}
+	}
+	branch, head, err := Head(repo)
+	if err != nil {
+		return "", err
+	}
+	if head == "" {
+		return "", errors.New("you do not have the initial commit yet")
+	}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return "", err
+	}
+	if u := idx.Unmerged(); len(u) > 0 {
+		return "", fmt.Errorf("%s: needs merge", u[0])
+	}
+	headTree, err := TreeSHA(repo, head)
+	if err != nil {
+		return "", err
+	}
+	indexTree, err := WriteTree(repo, idx)
+	if err != nil {
+		return "", err
+	}
+	changed := indexTree != headTree
+	leaves := make(map[string]*TreeLeaf)
+	for _, e := range idx.Entries {
+		if ok, err := worktreeMatches(repo, e); err != nil {
+			return "", err
+		} else if ok {
+			leaves[e.Path] = &TreeLeaf{e.TreeMode(), e.Path, e.SHA}
+			continue
+		}
+		changed = true
+		if _, err := os.Lstat(repo.wtPath(e.Path)); os.IsNotExist(err) {
+			continue
+		}
+		sha, mode, err := hashFile(repo, e.Path, e, true)
+		if err != nil {
+			return "", err
+		}
+		leaves[e.Path] = &TreeLeaf{strconv.FormatUint(uint64(mode), 8), e.Path, sha}
+	}
+	var untracked []string
+	if opts.IncludeUntracked {
+		if untracked, err = untrackedFiles(repo, idx); err != nil {
+			return "", err
+		}
+	}
+	if !changed && len(untracked) == 0 {
+		return "", nil
+	}
+
+	name := "(no branch)"
+	if branch != "" {
+		name = strings.TrimPrefix(branch, "refs/heads/")
+	}
+	on := fmt.Sprintf("%s: %s %s", name, head[:7], subjectOf(repo, head))
+	ic, err := CommitTree(repo, indexTree, []string{head}, "index on "+on+"\n")
+	if err != nil {
+		return "", err
+	}
+	parents := []string{head, ic}
+	if len(untracked) > 0 {
+		uleaves := make(map[string]*TreeLeaf)
+		for _, p := range untracked {
+			sha, mode, err := hashFile(repo, p, nil, true)
+			if err != nil {
+				return "", err
+			}
+			uleaves[p] = &TreeLeaf{strconv.FormatUint(uint64(mode), 8), p, sha}
+		}
+		tree, err := BuildTree(repo, uleaves)
+		if err != nil {
+			return "", err
+		}
+		uc, err := CommitTree(repo, tree, nil, "untracked files on "+on+"\n")
+		if err != nil {
+			return "", err
+		}
+		parents = append(parents, uc)
+	}
+	tree, err := BuildTree(repo, leaves)
+	if err != nil {
+		return "", err
+	}
+	// Unlike other commits, stash entries have no newline at the end of their messages.
+	msg := "WIP on " + on
+	if opts.Message != "" {
+		msg = "On " + name + ": " + opts.Message
+	}
+	w, err := CommitTree(repo, tree, parents, msg)
+	if err != nil {
+		return "", err
+	}
+	if err := UpdateRef(repo, stashRef, w, "", msg); err != nil {
+		return "", err
+	}
+
+	if err := Reset(repo, head, ResetHard, "reset: moving to HEAD"); err != nil {
+		return "", err
+	}
+	for _, p := range untracked {
+		if err := removeWorktreeFile(repo, p); err != nil {
+			return "", err
+		}
+	}
+	if opts.KeepIndex {
+		if err := CheckoutTree(repo, headTree, indexTree, false); err != nil {
+			return "", err
+		}
+	}
+	return w, nil
+}
+
+// untrackedFiles returns the files in the worktree which are not in the index, skipping .git
+// and nested repositories.
+func untrackedFiles(repo *Repo, idx *Index) ([]string, error) {
+	var res []string
+	var walk func(d string) error
+	walk = func(d string) error {
+		fs, err := ioutil.ReadDir(repo.wtPath(d))
+		if err != nil {
+			return err
+		}
+		for _, fi := range fs {
+			if fi.Name() == ".git" {
+				continue
+			}
+			p := joinPath(d, fi.Name())
+			if len(idx.entries(p)) > 0 {
+				continue
+			}
+			if !fi.IsDir() {
+				res = append(res, p)
+				continue
+			}
+			if _, err := os.Stat(repo.wtPath(p + "/.git")); err == nil {
+				continue
+			}
+			if err := walk(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return res, walk("")
+}
+
+// StashList returns the stash entries, the latest first so that the n-th is stash@{n}.
+func StashList(repo *Repo) ([]*ReflogEntry, error) {
+	es, err := Reflog(repo, stashRef)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(es)-1; i < j; i, j = i+1, j-1 {
+		es[i], es[j] = es[j], es[i]
+	}
+	return es, nil
+}
+
+// StashRevision returns the revision naming the stash entry given by the user, which may be
+// "" for the latest entry or just its number n for refs/stash@{n}. Other names are returned
+// as is.
+func StashRevision(name string) string {
+	if name == "" {
+		return stashRef + "@{0}"
+	}
+	if _, err := strconv.Atoi(name); err == nil {
+		return stashRef + "@{" + name + "}"
+	}
+	return name
+}
+
+// StashApply applies the changes recorded in the stash entry rev, as named by StashRevision,
+// merging them with MergeTrees into the index and the worktree. As git stash apply does, the
+// changes are left unstaged except for new files, unless index is true, in which case the
+// changes of the index are restored into it too. The untracked files of the entry are
+// restored afterwards. The result of the merge is returned even when it conflicts or the
+// untracked files cannot be restored.
+func StashApply(repo *Repo, rev string, index bool, opts *MergeOptions) (*MergeResult, error) {
+	if rev == StashRevision("") {
+		if es, err := Reflog(repo, stashRef); err != nil {
+			return nil, err
+		} else if len(es) == 0 {
+			return nil, errors.New("no stash entries found")
+		}
+	}
+	w, err := ResolveRevision(repo, rev, "commit")
+	if err != nil {
+		return nil, err
+	}
+	parents, err := Parents(repo, w)
+	if err != nil {
+		return nil, err
+	}
+	if len(parents) < 2 {
+		return nil, fmt.Errorf("'%s' is not a stash-like commit", rev)
+	}
+	var bTree, iTree, wTree string
+	for _, t := range []struct {
+		sha  string
+		tree *string
+	}{{parents[0], &bTree}, {parents[1], &iTree}, {w, &wTree}} {
+		if *t.tree, err = TreeSHA(repo, t.sha); err != nil {
+			return nil, err
+		}
+	}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return nil, err
+	}
+	if u := idx.Unmerged(); len(u) > 0 {
+		return nil, fmt.Errorf("%s: needs merge", u[0])
+	}
+	cTree, err := WriteTree(repo, idx)
+	if err != nil {
+		return nil, err
+	}
+
+	indexTree := ""
+	if index && bTree != iTree && cTree != iTree {
+		res, err := MergeTrees(repo, bTree, cTree, iTree, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Conflicts) > 0 {
+			return nil, errors.New("conflicts in index; try without --index")
+		}
+		indexTree = res.Tree
+		// Like git, which resets the index before merging the worktree, the merge is refused
+		// if the index had changes.
+		_, head, err := Head(repo)
+		if err != nil {
+			return nil, err
+		}
+		if err := Reset(repo, head, ResetMixed, "reset: moving to HEAD"); err != nil {
+			return nil, err
+		}
+		headTree, err := TreeSHA(repo, head)
+		if err != nil {
+			return nil, err
+		}
+		if cTree != headTree {
+			changes, err := DiffTrees(repo, headTree, cTree, &DiffTreeOptions{Recursive: true})
+			if err != nil {
+				return nil, err
+			}
+			lce := &LocalChangesError{Action: "merge"}
+			for _, c := range changes {
+				lce.Modified = append(lce.Modified, c.Path())
+			}
+			return nil, lce
+		}
+	}
+
+	var o MergeOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.OursLabel, o.BaseLabel, o.TheirsLabel = "Updated upstream", "Stash base", "Stashed changes"
+	if bTree == cTree {
+		o.OursLabel = "Version stash was based on"
+	}
+	res, err := MergeTrees(repo, bTree, cTree, wTree, &o)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckoutMerge(repo, cTree, res, "merge"); err != nil {
+		return nil, err
+	}
+	if len(res.Conflicts) == 0 {
+		if indexTree != "" {
+			err = ResetIndex(repo, indexTree, nil)
+		} else {
+			err = unstageChanges(repo, cTree, res.Tree)
+		}
+		if err != nil {
+			return res, err
+		}
+	}
+	if len(parents) > 2 {
+		if err := restoreUntracked(repo, parents[2]); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// unstageChanges resets the index entries of the files in the tree from which differ in the
+// tree to, leaving the files new in to staged.
+func unstageChanges(repo *Repo, from, to string) error {
+	olds, err := TreeEntries(repo, from)
+	if err != nil {
+		return err
+	}
+	news, err := TreeEntries(repo, to)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for p, l := range olds {
+		if !sameLeaf(l, news[p]) {
+			paths = append(paths, p)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+	return ResetIndex(repo, from, paths)
+}
+
+// restoreUntracked writes the files of the commit of untracked files of a stash entry to the
+// worktree, failing for the files which already exist after writing the others.
+func restoreUntracked(repo *Repo, commit string) error {
+	tree, err := TreeSHA(repo, commit)
+	if err != nil {
+		return err
+	}
+	leaves, err := TreeEntries(repo, tree)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for p := range leaves {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var b strings.Builder
+	for _, p := range paths {
+		if _, err := os.Lstat(repo.wtPath(p)); err == nil {
+			fmt.Fprintf(&b, "%s already exists, no checkout\n", p)
+			continue
+		}
+		if err := writeWorktreeLeaf(repo, leaves[p]); err != nil {
+			return err
+		}
+	}
+	if b.Len() > 0 {
+		return errors.New(b.String() + "could not restore untracked files from stash")
+	}
+	return nil
+}
+
+// StashDrop removes the stash entry rev, as named by StashRevision, from the reflog of
+// refs/stash, pointing refs/stash at the latest entry left or deleting it if none is left.
+// It returns the commit of the entry dropped.
+func StashDrop(repo *Repo, rev string) (string, error) {
+	es, err := Reflog(repo, stashRef)
+	if err != nil {
+		return "", err
+	}
+	if len(es) == 0 {
+		return "", errors.New("no stash entries found")
+	}
+	w, err := ResolveRevision(repo, rev, "commit")
+	if err != nil {
+		return "", err
+	}
+	if ps, err := Parents(repo, w); err != nil {
+		return "", err
+	} else if len(ps) < 2 {
+		return "", fmt.Errorf("'%s' is not a stash-like commit", rev)
+	}
+	m := reflogRE.FindStringSubmatch(rev)
+	if m == nil {
+		return "", fmt.Errorf("'%s' is not a stash reference", rev)
+	}
+	if ref, err := reflogRef(repo, m[1]); err != nil || ref != stashRef {
+		return "", fmt.Errorf("'%s' is not a stash reference", rev)
+	}
+	n, err := strconv.Atoi(m[2])
+	if err != nil {
+		return "", err
+	}
+	// rev is resolved above, so n is within the reflog.
+	i := len(es) - 1 - n
+	es = append(es[:i], es[i+1:]...)
+	// The entries stay chained as git reflog delete --rewrite keeps them.
+	if i < len(es) {
+		es[i].Old = ZeroSHA
+		if i > 0 {
+			es[i].Old = es[i-1].New
+		}
+	}
+	if len(es) == 0 {
+		return w, DeleteRef(repo, stashRef)
+	}
+	if err := writeReflog(repo, stashRef, es); err != nil {
+		return "", err
+	}
+	return w, writeFile([]byte(es[len(es)-1].New+"\n"), repo.path(stashRef))
+}
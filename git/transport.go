@@ -0,0 +1,342 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// transport is a connection to a remote repository.
+type transport interface {
+	// advertise returns the refs and the capabilities the service advertises.
+	advertise(service string) (*advertisement, error)
+	// request sends the request to the service and returns its response.
+	request(service string, body []byte) (io.ReadCloser, error)
+	close() error
+}
+
+// openTransport returns a transport to the repository at url, which is an HTTP(S) URL, an
+// ext:: URL, a file:// URL or a local path, or to the bundle file at a file:// URL or a
+// local path. version is the protocol version asked of git-upload-pack; the server may
+// answer with version 0 instead. git-receive-pack always speaks version 0. ext:: URLs are
+// refused unless extAllowed for the repository, which may be nil.
+func openTransport(repo *Repo, url string, version int) (transport, error) {
+	switch {
+	case strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://"):
+		return &httpTransport{url: strings.TrimSuffix(url, "/"), client: http.DefaultClient, version: version}, nil
+	case strings.HasPrefix(url, "ext::"):
+		if !extAllowed(repo) {
+			return nil, errors.New("transport 'ext' not allowed")
+		}
+		return &extTransport{command: strings.TrimPrefix(url, "ext::"), version: version}, nil
+	case strings.HasPrefix(url, "file://"), isLocalPath(url):
+		path := strings.TrimPrefix(url, "file://")
+		if isBundle(path) {
+			return &bundleTransport{path: path}, nil
+		}
+		return &localTransport{dir: path, version: version}, nil
+	}
+	return nil, fmt.Errorf("unsupported URL %s", url)
+}
+
+// extAllowed reports whether ext:: URLs may be used, which run any command they name. As in
+// git, GIT_ALLOW_PROTOCOL, a colon separated list of the protocols allowed, takes
+// precedence over protocol.ext.allow and protocol.allow of the repository, which may be nil,
+// and ext is never allowed by default. The policy "user" allows it unless
+// GIT_PROTOCOL_FROM_USER is 0.
+func extAllowed(repo *Repo) bool {
+	if s, ok := os.LookupEnv("GIT_ALLOW_PROTOCOL"); ok {
+		for _, p := range strings.Split(s, ":") {
+			if p == "ext" {
+				return true
+			}
+		}
+		return false
+	}
+	policy := ""
+	if repo != nil {
+		if policy = Config(repo, `protocol "ext"`, "allow"); policy == "" {
+			policy = Config(repo, "protocol", "allow")
+		}
+	}
+	switch policy {
+	case "always":
+		return true
+	case "user":
+		s := os.Getenv("GIT_PROTOCOL_FROM_USER")
+		return s == "" || s == "1"
+	}
+	return false
+}
+
+// protocolVersion returns the protocol version the service is asked to speak when
+// version is configured.
+func protocolVersion(service string, version int) int {
+	if service != "git-upload-pack" {
+		return 0
+	}
+	return version
+}
+
+// clientProtocolVersion returns protocol.version of the repository, which may be nil,
+// defaulting to version 2 as in git.
+func clientProtocolVersion(repo *Repo) int {
+	if repo != nil {
+		if v, err := strconv.Atoi(Config(repo, "protocol", "version")); err == nil {
+			return v
+		}
+	}
+	return 2
+}
+
+// bufferedBody is a response read from a connection which later responses are read from too.
+// newPktReader reads it without buffering it again.
+type bufferedBody struct {
+	*bufio.Reader
+}
+
+func (bufferedBody) Close() error { return nil }
+
+// extTransport talks the pack protocol with a command run as in git's ext:: URLs, e.g.
+// "ext::ssh host %S repo.git". Only one service is used for a transport.
+type extTransport struct {
+	command string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *pktReader
+	version int
+	// requested is true once a request is sent.
+	requested bool
+}
+
+// extArgs splits the command into arguments at spaces, replacing "% " with a space, "%%"
+// with "%", "%s" with the service name without "git-" and "%S" with the service name.
+func extArgs(command, service string) ([]string, error) {
+	var args []string
+	var b strings.Builder
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		if c == ' ' {
+			if b.Len() > 0 {
+				args = append(args, b.String())
+				b.Reset()
+			}
+			continue
+		}
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		if i++; i == len(command) {
+			return nil, fmt.Errorf("incomplete placeholder in ext:: command %q", command)
+		}
+		switch command[i] {
+		case ' ', '%':
+			b.WriteByte(command[i])
+		case 's':
+			b.WriteString(strings.TrimPrefix(service, "git-"))
+		case 'S':
+			b.WriteString(service)
+		default:
+			return nil, fmt.Errorf("bad placeholder %%%c in ext:: command %q", command[i], command)
+		}
+	}
+	if b.Len() > 0 {
+		args = append(args, b.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty ext:: command")
+	}
+	return args, nil
+}
+
+func (t *extTransport) advertise(service string) (*advertisement, error) {
+	args, err := extArgs(t.command, service)
+	if err != nil {
+		return nil, err
+	}
+	t.cmd = exec.Command(args[0], args[1:]...)
+	t.cmd.Stderr = os.Stderr
+	t.cmd.Env = append(os.Environ(), "GIT_EXT_SERVICE="+service, "GIT_EXT_SERVICE_NOPREFIX="+strings.TrimPrefix(service, "git-"))
+	if v := protocolVersion(service, t.version); v > 0 {
+		t.cmd.Env = append(t.cmd.Env, fmt.Sprintf("GIT_PROTOCOL=version=%d", v))
+	}
+	if t.stdin, err = t.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := t.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.cmd.Start(); err != nil {
+		return nil, err
+	}
+	t.stdout = newPktReader(stdout)
+	return readAdvertisement(t.stdout)
+}
+
+func (t *extTransport) request(service string, body []byte) (io.ReadCloser, error) {
+	if t.cmd == nil {
+		return nil, errors.New("request before the advertisement")
+	}
+	t.requested = true
+	if _, err := t.stdin.Write(body); err != nil {
+		return nil, err
+	}
+	return bufferedBody{t.stdout.r}, nil
+}
+
+// close tells the command that nothing is requested if so, and waits for it to exit.
+func (t *extTransport) close() error {
+	if t.cmd == nil {
+		return nil
+	}
+	if !t.requested {
+		writeFlush(t.stdin)
+	}
+	t.stdin.Close()
+	io.Copy(ioutil.Discard, t.stdout.r)
+	return t.cmd.Wait()
+}
+
+// isLocalPath returns whether the url is a path rather than a URL.
+func isLocalPath(url string) bool {
+	return !strings.Contains(url, "://") && !strings.HasPrefix(url, "ext::")
+}
+
+// localTransport runs the services in process on a repository in the local file system.
+type localTransport struct {
+	dir     string
+	version int
+}
+
+func (t *localTransport) open() (*Repo, error) {
+	repo, err := NewRepo(t.dir, false)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' does not appear to be a git repository", t.dir)
+	}
+	return repo, nil
+}
+
+func (t *localTransport) advertise(service string) (*advertisement, error) {
+	repo, err := t.open()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := serveStateless(repo, service, nil, &b, true, protocolVersion(service, t.version)); err != nil {
+		return nil, err
+	}
+	return readAdvertisement(newPktReader(&b))
+}
+
+func (t *localTransport) request(service string, body []byte) (io.ReadCloser, error) {
+	repo, err := t.open()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := serveStateless(repo, service, bytes.NewReader(body), &b, false, protocolVersion(service, t.version)); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(&b), nil
+}
+
+func (t *localTransport) close() error { return nil }
+
+// serveStateless runs the service, git-upload-pack or git-receive-pack, on the repository
+// for a request of the stateless protocol of the version, or only advertises the refs if
+// advertise is true.
+func serveStateless(repo *Repo, service string, r io.Reader, w io.Writer, advertise bool, version int) error {
+	switch service {
+	case "git-upload-pack":
+		return UploadPack(repo, r, w, &UploadPackOptions{StatelessRPC: !advertise, AdvertiseRefs: advertise, Version: version})
+	case "git-receive-pack":
+		return ReceivePack(repo, r, w, &ReceivePackOptions{StatelessRPC: !advertise, AdvertiseRefs: advertise, Version: version})
+	}
+	return fmt.Errorf("unknown service %s", service)
+}
+
+// httpTransport talks the smart HTTP protocol.
+type httpTransport struct {
+	url     string
+	client  *http.Client
+	version int
+}
+
+func (t *httpTransport) do(req *http.Request, service, contentType string) (io.ReadCloser, error) {
+	req.Header.Set("User-Agent", "git/"+agent)
+	if v := protocolVersion(service, t.version); v > 0 {
+		req.Header.Set("Git-Protocol", fmt.Sprintf("version=%d", v))
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access '%s': %v", t.url, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("repository '%s' not found", t.url)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		resp.Body.Close()
+		return nil, fmt.Errorf("authentication failed for '%s'", t.url)
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("unable to access '%s': The requested URL returned error: %d", t.url, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != contentType {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: not a smart HTTP git repository (Content-Type %q)", t.url, ct)
+	}
+	return resp.Body, nil
+}
+
+func (t *httpTransport) advertise(service string) (*advertisement, error) {
+	req, err := http.NewRequest("GET", t.url+"/info/refs?service="+service, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := t.do(req, service, "application/x-"+service+"-advertisement")
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	p := newPktReader(body)
+	// A protocol version 2 response starts with the version line instead.
+	if _, data, err := p.peek(); err != nil {
+		return nil, err
+	} else if string(data) != "version 2\n" {
+		if l, _, err := p.readLine(); err != nil {
+			return nil, err
+		} else if l != "# service="+service {
+			return nil, fmt.Errorf("protocol error: expected '# service=%s', got %q", service, l)
+		}
+		if _, flush, err := p.readLine(); err != nil {
+			return nil, err
+		} else if !flush {
+			return nil, errors.New("protocol error: expected flush after the service line")
+		}
+	}
+	return readAdvertisement(p)
+}
+
+func (t *httpTransport) request(service string, body []byte) (io.ReadCloser, error) {
+	req, err := http.NewRequest("POST", t.url+"/"+service, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-"+service+"-request")
+	req.Header.Set("Accept", "application/x-"+service+"-result")
+	return t.do(req, service, "application/x-"+service+"-result")
+}
+
+func (t *httpTransport) close() error { return nil }
@@ -0,0 +1,411 @@
+package git
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// UploadPackOptions are options of UploadPack.
+type UploadPackOptions struct {
+	// StatelessRPC serves a single request of the smart HTTP protocol: the refs are not
+	// advertised and a request which does not end with done is answered with
+	// acknowledgements only.
+	StatelessRPC bool
+	// AdvertiseRefs only advertises the refs.
+	AdvertiseRefs bool
+	// Version is the protocol version the client asked for. Version 1 is version 0 with
+	// a "version 1" line before the advertisement, and version 2 advertises capabilities
+	// and serves commands instead; other versions are served as version 0.
+	Version int
+}
+
+// UploadPack serves a fetch from the repository as git upload-pack does. It advertises
+// the refs to w, reads the objects the client wants and has from r, and writes a pack of
+// the objects the client is missing to w.
+func UploadPack(repo *Repo, r io.Reader, w io.Writer, opts *UploadPackOptions) error {
+	if opts.Version == 2 {
+		return uploadPackV2(repo, r, w, opts)
+	}
+	refs, err := advertisedRefs(repo)
+	if err != nil {
+		return err
+	}
+	if !opts.StatelessRPC {
+		if err := writeVersion(w, opts.Version); err != nil {
+			return err
+		}
+		if err := writeAdvertisement(w, refs, uploadPackCaps(repo)); err != nil {
+			return err
+		}
+	}
+	if opts.AdvertiseRefs {
+		return nil
+	}
+
+	p := newPktReader(r)
+	var wants []string
+	var caps capabilities
+	var deepen deepenRequest
+	var filter *objectFilter
+	for {
+		l, flush, err := p.readLine()
+		if err == io.EOF && len(wants) == 0 {
+			// The client needs nothing.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if flush {
+			break
+		}
+		if ok, err := deepen.parseLine(l); err != nil {
+			return err
+		} else if ok {
+			continue
+		}
+		if strings.HasPrefix(l, "filter ") {
+			if filter, err = parseFilter(strings.TrimPrefix(l, "filter ")); err != nil {
+				return err
+			}
+			continue
+		}
+		fs := strings.Fields(l)
+		if len(fs) < 2 || fs[0] != "want" {
+			return fmt.Errorf("protocol error: expected want, got %q", l)
+		}
+		if len(wants) == 0 {
+			caps = fs[2:]
+		}
+		wants = append(wants, fs[1])
+	}
+	if len(wants) == 0 {
+		return nil
+	}
+	if err := checkWants(repo, wants); err != nil {
+		return err
+	}
+	// A version 0 client asks for a depth relative to its shallow commits by capability.
+	deepen.relative = caps.has("deepen-relative")
+	limits := &packLimits{filter: filter}
+	if deepen.shallowInfo() {
+		l, more, err := deepen.writeShallowInfo(repo, w, wants)
+		if err != nil {
+			return err
+		}
+		if err := writeFlush(w); err != nil {
+			return err
+		}
+		limits.shallow, wants = l.shallow, append(wants, more...)
+	}
+
+	multiAck := 0
+	if caps.has("multi_ack_detailed") {
+		multiAck = 2
+	} else if caps.has("multi_ack") {
+		multiAck = 1
+	}
+	// Without multi_ack, only the first common object is acknowledged. With it, every
+	// common object is, and the last one again at the end.
+	var common []string
+	for done := false; !done; {
+		l, flush, err := p.readLine()
+		if err == io.EOF && opts.StatelessRPC && deepen.deepens() && len(common) == 0 {
+			// A stateless client deepening its history asks for the shallow commits
+			// alone first.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch {
+		case flush:
+			if len(common) == 0 || multiAck > 0 {
+				if err := writePkt(w, "NAK\n"); err != nil {
+					return err
+				}
+			}
+			if opts.StatelessRPC {
+				return nil
+			}
+		case strings.HasPrefix(l, "have "):
+			sha := strings.TrimPrefix(l, "have ")
+			if _, _, err := ReadRawObject(repo, sha); err != nil {
+				continue
+			}
+			common = append(common, sha)
+			switch {
+			case multiAck == 2:
+				err = writePkt(w, "ACK %s common\n", sha)
+			case multiAck == 1:
+				err = writePkt(w, "ACK %s continue\n", sha)
+			case len(common) == 1:
+				err = writePkt(w, "ACK %s\n", sha)
+			}
+			if err != nil {
+				return err
+			}
+		case l == "done":
+			if len(common) == 0 {
+				err = writePkt(w, "NAK\n")
+			} else if multiAck > 0 {
+				err = writePkt(w, "ACK %s\n", common[len(common)-1])
+			}
+			if err != nil {
+				return err
+			}
+			done = true
+		default:
+			return fmt.Errorf("protocol error: expected have or done, got %q", l)
+		}
+	}
+
+	max := 0
+	if caps.has("side-band-64k") {
+		max = pktMax
+	} else if caps.has("side-band") {
+		max = 1000
+	}
+	var tags []*RemoteRef
+	if caps.has("include-tag") {
+		tags = refs
+	}
+	if err := writePackResponse(repo, w, wants, common, tags, limits, max, !caps.has("no-progress")); err != nil {
+		return err
+	}
+	if max > 0 {
+		return writeFlush(w)
+	}
+	return nil
+}
+
+// writePackResponse writes a pack of the objects reachable from wants but not from common
+// within the limits, with the annotated tags among tags which point to them, to w. If max
+// is not 0, the pack is sent over side-band channel 1 in pkt-lines of at most max bytes,
+// with progress messages on channel 2 if progress is true.
+func writePackResponse(repo *Repo, w io.Writer, wants, common []string, tags []*RemoteRef, limits *packLimits, max int, progress bool) error {
+	out, pw := w, io.Writer(nil)
+	if max > 0 {
+		out = &sidebandWriter{w, bandData, max}
+		if progress {
+			pw = &sidebandWriter{w, bandProgress, max}
+		}
+	}
+	shas, err := packObjects(repo, wants, common, tags, limits)
+	if err == nil {
+		if pw != nil {
+			fmt.Fprintf(pw, "Enumerating objects: %d, done.\n", len(shas))
+		}
+		bw := bufio.NewWriterSize(out, pktMax-5)
+		if err = WritePack(repo, bw, shas); err == nil {
+			err = bw.Flush()
+		}
+	}
+	if err != nil {
+		if out != w {
+			(&sidebandWriter{w, bandError, pktMax}).Write([]byte(err.Error() + "\n"))
+		}
+		return err
+	}
+	if pw != nil {
+		fmt.Fprintf(pw, "Total %d (delta 0), reused 0 (delta 0), pack-reused 0\n", len(shas))
+	}
+	return nil
+}
+
+// uploadPackCaps returns the capabilities UploadPack advertises.
+func uploadPackCaps(repo *Repo) capabilities {
+	caps := capabilities{"multi_ack", "thin-pack", "side-band", "side-band-64k", "ofs-delta", "shallow", "deepen-since", "deepen-not", "deepen-relative", "no-progress", "include-tag", "multi_ack_detailed"}
+	if branch, _ := SymbolicRef(repo, "HEAD"); branch != "" {
+		caps = append(caps, "symref=HEAD:"+branch)
+	}
+	return append(caps, "allow-tip-sha1-in-want", "allow-reachable-sha1-in-want", "filter", "agent="+agent)
+}
+
+// checkWants returns an error for the first of the wanted objects which is not reachable
+// from the refs, which allow-reachable-sha1-in-want allows a client to ask for. Unreachable
+// objects, e.g. of dropped stashes, are not given away.
+func checkWants(repo *Repo, wants []string) error {
+	refs, err := AllRefs(repo)
+	if err != nil {
+		return err
+	}
+	tips := make(map[string]bool)
+	for _, sha := range refs {
+		tips[sha] = true
+	}
+	if _, sha, err := Head(repo); err == nil && sha != "" {
+		tips[sha] = true
+	}
+	var others []string
+	for _, sha := range wants {
+		if !hasObject(repo, sha) {
+			return fmt.Errorf("not our ref %s", sha)
+		}
+		if !tips[sha] {
+			others = append(others, sha)
+		}
+	}
+	if len(others) == 0 {
+		return nil
+	}
+	var starts []string
+	for sha := range tips {
+		starts = append(starts, sha)
+	}
+	shas, err := packObjects(repo, starts, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	reachable := make(map[string]bool)
+	for _, sha := range shas {
+		reachable[sha] = true
+	}
+	for _, sha := range others {
+		if !reachable[sha] {
+			return fmt.Errorf("not our ref %s", sha)
+		}
+	}
+	return nil
+}
+
+// packObjects returns the objects reachable from wants but not from haves, as
+// git rev-list --objects wants... --not haves... lists them. The annotated tags among tags
+// which point to the objects are added, as with the include-tag capability. The limits,
+// if not nil, stop the walk at shallow commits and filter the trees and blobs.
+func packObjects(repo *Repo, wants, haves []string, tags []*RemoteRef, limits *packLimits) ([]string, error) {
+	if limits == nil {
+		limits = &packLimits{}
+	}
+	var res []string
+	seen, listed := make(map[string]bool), make(map[string]bool)
+	add := func(sha string) bool {
+		if seen[sha] {
+			return false
+		}
+		seen[sha], listed[sha] = true, true
+		res = append(res, sha)
+		return true
+	}
+
+	var commits, haveCommits, trees []string
+	for _, sha := range wants {
+		for {
+			typ, data, err := ReadRawObject(repo, sha)
+			if err != nil {
+				return nil, err
+			}
+			if typ == "commit" {
+				commits = append(commits, sha)
+				break
+			}
+			if typ == "tree" {
+				trees = append(trees, sha)
+				break
+			}
+			if typ != "tag" {
+				add(sha)
+				break
+			}
+			add(sha)
+			o, err := newTag(repo).Decode(data)
+			if err != nil {
+				return nil, err
+			}
+			sha = o.KVLM.Get("object")[0]
+		}
+	}
+	var haveTrees []string
+	for _, sha := range haves {
+		if c, err := peelTag(repo, sha); err == nil {
+			sha = c
+		}
+		if typ, _, err := ReadRawObject(repo, sha); err != nil || typ != "commit" {
+			continue
+		}
+		if tree, err := TreeSHA(repo, sha); err == nil {
+			haveCommits = append(haveCommits, sha)
+			haveTrees = append(haveTrees, tree)
+		}
+	}
+
+	commits, err := revList(repo, commits, haveCommits, limits.shallow)
+	if err != nil {
+		return nil, err
+	}
+	// Objects the client has are marked seen without being listed.
+	for _, t := range haveTrees {
+		if err := walkTree(repo, t, func(sha string) bool {
+			if seen[sha] {
+				return false
+			}
+			seen[sha] = true
+			return true
+		}); err != nil {
+			return nil, err
+		}
+	}
+	// The trees wanted by name are sent whatever the filter is.
+	for _, c := range commits {
+		add(c)
+		if !limits.filter.allowsTree(0) {
+			continue
+		}
+		t, err := TreeSHA(repo, c)
+		if err != nil {
+			return nil, err
+		}
+		trees = append(trees, t)
+	}
+	for _, t := range trees {
+		if err := walkTreeFiltered(repo, t, 0, limits.filter, add); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range tags {
+		if !strings.HasPrefix(t.Name, "refs/tags/") || t.Peeled == "" || !listed[t.Peeled] {
+			continue
+		}
+		// The tags in a chain of tags down to the peeled object.
+		for sha := t.SHA; sha != t.Peeled && add(sha); {
+			_, data, err := ReadRawObject(repo, sha)
+			if err != nil {
+				return nil, err
+			}
+			o, err := newTag(repo).Decode(data)
+			if err != nil {
+				return nil, err
+			}
+			sha = o.KVLM.Get("object")[0]
+		}
+	}
+	return res, nil
+}
+
+// walkTree calls fn with the tree and, if fn returns true, with the objects in it,
+// recursing into subtrees. Gitlinks are skipped.
+func walkTree(repo *Repo, tree string, fn func(sha string) bool) error {
+	if !fn(tree) {
+		return nil
+	}
+	_, data, err := ReadRawObject(repo, tree)
+	if err != nil {
+		return err
+	}
+	t, err := parseTree(data)
+	if err != nil {
+		return err
+	}
+	for _, l := range t {
+		switch l.Mode {
+		case "160000":
+		case "40000":
+			if err := walkTree(repo, l.SHA, fn); err != nil {
+				return err
+			}
+		default:
+			fn(l.SHA)
+		}
+	}
+	return nil
+}
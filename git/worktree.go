@@ -0,0 +1,659 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// wtPath returns the path of the file in the worktree for the slash separated path p.
+func (r *Repo) wtPath(p string) string {
+	if w := filepath.Join(r.worktree, filepath.FromSlash(p)); w != "" {
+		return w
+	}
+	return "."
+}
+
+// VerifyPath returns an error if the slash separated path p must not be written to a
+// worktree: if it has an empty component, . or .., which would escape the directory, or
+// .git in any case, which would write into the repository.
+func VerifyPath(p string) error {
+	for _, c := range strings.Split(p, "/") {
+		if c == "" || c == "." || c == ".." || strings.EqualFold(c, ".git") {
+			return fmt.Errorf("invalid path '%s'", p)
+		}
+	}
+	return nil
+}
+
+// hasSymlinkLeadingPath reports whether a directory leading to the worktree file at p is a
+// symlink, through which the file may be outside the worktree.
+func hasSymlinkLeadingPath(repo *Repo, p string) bool {
+	cs := strings.Split(p, "/")
+	for i := 1; i < len(cs); i++ {
+		fi, err := os.Lstat(repo.wtPath(strings.Join(cs[:i], "/")))
+		if err != nil {
+			return false
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// mkdirLeadingPath creates the directories leading to the worktree file at p. As git does,
+// a symlink in place of one is replaced with a directory instead of being followed.
+func mkdirLeadingPath(repo *Repo, p string) error {
+	cs := strings.Split(p, "/")
+	for i := 1; i < len(cs); i++ {
+		d := repo.wtPath(strings.Join(cs[:i], "/"))
+		fi, err := os.Lstat(d)
+		if err == nil && fi.IsDir() {
+			continue
+		}
+		if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			err = os.Remove(d)
+		} else if os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Mkdir(d, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TreeSHA returns the SHA of the tree the commit, tag or tree sha points to.
+func TreeSHA(repo *Repo, sha string) (string, error) {
+	for {
+		o, err := ReadObject(repo, sha)
+		if err != nil {
+			return "", err
+		}
+		switch o.Type {
+		case "tree":
+			return sha, nil
+		case "commit":
+			return o.KVLM.Get("tree")[0], nil
+		case "tag":
+			sha = o.KVLM.Get("object")[0]
+		default:
+			return "", fmt.Errorf("%s is not a tree-ish", sha)
+		}
+	}
+}
+
+// EmptyTreeSHA is the SHA of the empty tree, which may not exist in the repository.
+const EmptyTreeSHA = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// TreeEntries returns the non-tree entries of the tree recursively, keyed by their
+// slash separated path. The Path field of the returned leaves is the full path.
+// sha may be "" for an empty tree.
+func TreeEntries(repo *Repo, sha string) (map[string]*TreeLeaf, error) {
+	m := make(map[string]*TreeLeaf)
+	if sha == "" || sha == EmptyTreeSHA {
+		return m, nil
+	}
+	return m, treeEntries(repo, sha, "", m)
+}
+
+func treeEntries(repo *Repo, sha, prefix string, m map[string]*TreeLeaf) error {
+	o, err := ReadObject(repo, sha)
+	if err != nil {
+		return err
+	}
+	if o.Type != "tree" {
+		return fmt.Errorf("format %s != tree", o.Type)
+	}
+	for _, l := range o.Tree {
+		p := prefix + l.Path
+		if l.Mode == "40000" {
+			if err := treeEntries(repo, l.SHA, p+"/", m); err != nil {
+				return err
+			}
+			continue
+		}
+		m[p] = &TreeLeaf{l.Mode, p, l.SHA}
+	}
+	return nil
+}
+
+// readWorktreeFile returns the content of the worktree file, or the link target if it is a symlink.
+func readWorktreeFile(repo *Repo, p string, fi os.FileInfo) ([]byte, error) {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		s, err := os.Readlink(repo.wtPath(p))
+		return []byte(s), err
+	}
+	return ioutil.ReadFile(repo.wtPath(p))
+}
+
+// ReadWorktreeFile returns the content of the worktree file at the slash separated path p,
+// or the link target if it is a symlink.
+func ReadWorktreeFile(repo *Repo, p string) ([]byte, error) {
+	fi, err := os.Lstat(repo.wtPath(p))
+	if err != nil {
+		return nil, err
+	}
+	return readWorktreeFile(repo, p, fi)
+}
+
+// hashWorktreeFile returns the blob SHA of the file in the worktree without storing it.
+func hashWorktreeFile(repo *Repo, p string, fi os.FileInfo) (string, error) {
+	b, err := readWorktreeFile(repo, p, fi)
+	if err != nil {
+		return "", err
+	}
+	return ObjectHash(b, "blob", nil)
+}
+
+// worktreeMatches reports whether the worktree file for the entry exists and has the
+// content and the mode the entry records. The file is hashed only if its stat data
+// differs from the entry.
+func worktreeMatches(repo *Repo, e *IndexEntry) (bool, error) {
+	fi, err := os.Lstat(repo.wtPath(e.Path))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if fi.IsDir() {
+		return e.Mode == modeGitlink, nil
+	}
+	if worktreeMode(repo, fi, e) != e.Mode {
+		return false, nil
+	}
+	if uint32(fi.Size()) == e.Size && fi.ModTime().Equal(e.MTime) {
+		return true, nil
+	}
+	sha, err := hashWorktreeFile(repo, e.Path, fi)
+	if err != nil {
+		return false, err
+	}
+	return sha == e.SHA, nil
+}
+
+// newIndexEntry creates an index entry for the worktree file at path recording sha and mode.
+func newIndexEntry(repo *Repo, path, sha string, mode uint32) (*IndexEntry, error) {
+	e := &IndexEntry{
+		Mode: mode,
+		SHA:  sha,
+		Path: path,
+	}
+	if mode == modeGitlink {
+		return e, nil
+	}
+	fi, err := os.Lstat(repo.wtPath(path))
+	if err != nil {
+		return nil, err
+	}
+	e.CTime = fi.ModTime()
+	e.MTime = fi.ModTime()
+	e.Size = uint32(fi.Size())
+	return e, nil
+}
+
+const (
+	modeRegular    = 0100644
+	modeExecutable = 0100755
+	modeSymlink    = 0120000
+	modeGitlink    = 0160000
+)
+
+// worktreeMode returns the mode to record for the worktree file.
+// old is the current index entry for the file or nil.
+// As git does, the executable bit is ignored if core.filemode is false and
+// a plain file replacing a symlink is still a symlink if core.symlinks is false.
+func worktreeMode(repo *Repo, fi os.FileInfo, old *IndexEntry) uint32 {
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		return modeSymlink
+	case fi.IsDir():
+		return modeGitlink
+	}
+	if old != nil && old.Mode == modeSymlink && !configBool(repo, "core", "symlinks", true) {
+		return modeSymlink
+	}
+	if !configBool(repo, "core", "filemode", true) {
+		if old != nil && old.Mode == modeExecutable {
+			return modeExecutable
+		}
+		return modeRegular
+	}
+	if fi.Mode()&0100 != 0 {
+		return modeExecutable
+	}
+	return modeRegular
+}
+
+// HashWorktreeFile computes the blob SHA and the mode of the worktree file at the slash separated
+// path p and stores the blob if write is true. Symlinks are hashed as their link target and
+// directories containing a nested repository as gitlinks to its HEAD.
+func HashWorktreeFile(repo *Repo, p string, write bool) (sha string, mode uint32, err error) {
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return "", 0, err
+	}
+	return hashFile(repo, p, idx.Entry(p), write)
+}
+
+// hashFile is HashWorktreeFile taking the current index entry old, which may be nil.
+func hashFile(repo *Repo, p string, old *IndexEntry, write bool) (string, uint32, error) {
+	fi, err := os.Lstat(repo.wtPath(p))
+	if err != nil {
+		return "", 0, err
+	}
+	mode := worktreeMode(repo, fi, old)
+	if fi.IsDir() {
+		sub, err := NewRepo(repo.wtPath(p), false)
+		if err != nil {
+			return "", 0, fmt.Errorf("%s: not a git repository: %v", p, err)
+		}
+		sha, err := ReadRef(sub, "HEAD")
+		return sha, mode, err
+	}
+	b, err := readWorktreeFile(repo, p, fi)
+	if err != nil {
+		return "", 0, err
+	}
+	var r *Repo
+	if write {
+		r = repo
+	}
+	sha, err := ObjectHash(b, "blob", r)
+	return sha, mode, err
+}
+
+// Add stores the worktree files at the slash separated paths as blobs and stages them,
+// recording their modes. Directories are added recursively, skipping .git, except that
+// a directory containing a nested repository is added as a gitlink. Paths which are
+// in the index but missing in the worktree are removed from the index.
+func Add(repo *Repo, paths []string) error {
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return err
+	}
+	updates := make(map[string]*IndexEntry)
+	var add func(p string) error
+	add = func(p string) error {
+		fi, err := os.Lstat(repo.wtPath(p))
+		if os.IsNotExist(err) {
+			removed := false
+			for _, e := range idx.Entries {
+				if e.Path == p || strings.HasPrefix(e.Path, p+"/") {
+					updates[e.Path] = nil
+					removed = true
+				}
+			}
+			if !removed {
+				return fmt.Errorf("pathspec '%s' did not match any files", p)
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if fi.IsDir() && p != "" {
+			if _, err := os.Stat(repo.wtPath(p + "/.git")); err == nil {
+				fi = nil
+			}
+		}
+		if fi != nil && fi.IsDir() {
+			fs, err := ioutil.ReadDir(repo.wtPath(p))
+			if err != nil {
+				return err
+			}
+			for _, c := range fs {
+				if c.Name() == ".git" {
+					continue
+				}
+				cp := c.Name()
+				if p != "" {
+					cp = p + "/" + cp
+				}
+				if err := add(cp); err != nil {
+					return err
+				}
+			}
+			// tracked files deleted from the directory
+			for _, e := range idx.Entries {
+				if p == "" || strings.HasPrefix(e.Path, p+"/") {
+					if _, err := os.Lstat(repo.wtPath(e.Path)); os.IsNotExist(err) {
+						updates[e.Path] = nil
+					}
+				}
+			}
+			return nil
+		}
+		sha, mode, err := hashFile(repo, p, idx.Entry(p), true)
+		if err != nil {
+			return err
+		}
+		e, err := newIndexEntry(repo, p, sha, mode)
+		if err != nil {
+			return err
+		}
+		updates[p] = e
+		return nil
+	}
+	for _, p := range paths {
+		p = filepath.ToSlash(filepath.Clean(p))
+		if p == "." {
+			p = ""
+		}
+		if err := add(p); err != nil {
+			return err
+		}
+	}
+	idx.update(updates)
+	return WriteIndex(repo, idx)
+}
+
+// writeWorktreeFile writes the tree entry l to the worktree and returns the index entry for it.
+func writeWorktreeFile(repo *Repo, l *TreeLeaf) (*IndexEntry, error) {
+	if err := writeWorktreeLeaf(repo, l); err != nil {
+		return nil, err
+	}
+	return newIndexEntry(repo, l.Path, l.SHA, parseMode(l.Mode))
+}
+
+// writeWorktreeLeaf writes the tree entry l to the worktree file at its path, refusing a
+// path outside the worktree or in .git.
+func writeWorktreeLeaf(repo *Repo, l *TreeLeaf) error {
+	if err := VerifyPath(l.Path); err != nil {
+		return err
+	}
+	if err := mkdirLeadingPath(repo, l.Path); err != nil {
+		return err
+	}
+	return WriteLeaf(repo, l, repo.wtPath(l.Path))
+}
+
+// WriteLeaf writes the non-tree entry l to the file at path, replacing an existing file.
+// It fails if the path of l does not pass VerifyPath.
+// Executable blobs are written with 0755 and symlinks are created as symlinks unless
+// core.symlinks is false, in which case they are written as plain files containing the link target.
+// For gitlinks (submodules) an empty directory is created.
+func WriteLeaf(repo *Repo, l *TreeLeaf, path string) error {
+	if err := VerifyPath(l.Path); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	mode := parseMode(l.Mode)
+	if mode == modeGitlink {
+		if fi, err := os.Lstat(path); err == nil && fi.IsDir() {
+			return nil
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		return os.Mkdir(path, 0755)
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	o, err := ReadObject(repo, l.SHA)
+	if err != nil {
+		return err
+	}
+	if o.Type != "blob" {
+		return fmt.Errorf("%s: format %s != blob", l.Path, o.Type)
+	}
+	switch {
+	case mode == modeSymlink && configBool(repo, "core", "symlinks", true):
+		return os.Symlink(string(o.Blob), path)
+	case mode == modeExecutable:
+		return ioutil.WriteFile(path, o.Blob, 0755)
+	default:
+		return ioutil.WriteFile(path, o.Blob, 0644)
+	}
+}
+
+// removeWorktreeFile removes the file and then its parent directories as long as they are empty.
+// Gitlink directories are removed only if they are empty. Nothing is removed through a
+// symlink or outside the worktree.
+func removeWorktreeFile(repo *Repo, p string) error {
+	if err := VerifyPath(p); err != nil {
+		return err
+	}
+	if hasSymlinkLeadingPath(repo, p) {
+		return nil
+	}
+	if fi, err := os.Lstat(repo.wtPath(p)); err == nil && fi.IsDir() {
+		os.Remove(repo.wtPath(p))
+	} else if err := os.Remove(repo.wtPath(p)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for d := filepath.Dir(p); d != "." && d != "/"; d = filepath.Dir(d) {
+		if err := os.Remove(repo.wtPath(d)); err != nil {
+			// not empty
+			break
+		}
+	}
+	return nil
+}
+
+func parseMode(mode string) uint32 {
+	var m uint32
+	fmt.Sscanf(mode, "%o", &m)
+	return m
+}
+
+func sameLeaf(a, b *TreeLeaf) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.SHA == b.SHA && parseMode(a.Mode) == parseMode(b.Mode)
+}
+
+func entryIs(e *IndexEntry, l *TreeLeaf) bool {
+	return e != nil && l != nil && e.SHA == l.SHA && e.Mode == parseMode(l.Mode)
+}
+
+// LocalChangesError is returned when a checkout would overwrite local changes.
+type LocalChangesError struct {
+	// Modified are the paths whose changes in the index or the worktree would be lost.
+	Modified []string
+	// Untracked are the untracked files which would be overwritten.
+	Untracked []string
+	// Action is the operation refused, which is "checkout" if empty.
+	Action string
+}
+
+func (e *LocalChangesError) Error() string {
+	action := e.Action
+	if action == "" {
+		action = "checkout"
+	}
+	var b strings.Builder
+	if len(e.Modified) > 0 {
+		b.WriteString("Your local changes to the following files would be overwritten by " + action + ":\n")
+		for _, p := range e.Modified {
+			fmt.Fprintf(&b, "\t%s\n", p)
+		}
+	}
+	if len(e.Untracked) > 0 {
+		b.WriteString("The following untracked working tree files would be overwritten by " + action + ":\n")
+		for _, p := range e.Untracked {
+			fmt.Fprintf(&b, "\t%s\n", p)
+		}
+	}
+	if action == "checkout" {
+		b.WriteString("Please commit your changes or stash them before you switch branches.")
+	} else {
+		b.WriteString("Please commit your changes or stash them before you " + action + ".")
+	}
+	return b.String()
+}
+
+// CheckoutTree updates the index and the worktree from the tree from to the tree to.
+// Either tree may be "" for an empty tree. Paths which are the same in both trees are left
+// untouched so that local changes to them are carried over.
+// Unless force is true, it fails with *LocalChangesError without touching anything if local
+// changes would be overwritten. If force is true, the index and the tracked files are reset
+// to the tree to, discarding local changes.
+func CheckoutTree(repo *Repo, from, to string, force bool) error {
+	olds, err := TreeEntries(repo, from)
+	if err != nil {
+		return err
+	}
+	news, err := TreeEntries(repo, to)
+	if err != nil {
+		return err
+	}
+	for p := range news {
+		if err := VerifyPath(p); err != nil {
+			return err
+		}
+	}
+	idx, err := ReadIndex(repo)
+	if err != nil {
+		return err
+	}
+	if !force && len(idx.Unmerged()) > 0 {
+		return errors.New("you need to resolve your current index first")
+	}
+
+	paths := make(map[string]bool)
+	for p := range olds {
+		paths[p] = true
+	}
+	for p := range news {
+		paths[p] = true
+	}
+	if force {
+		for _, e := range idx.Entries {
+			paths[e.Path] = true
+		}
+	}
+	var sorted []string
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	var lce LocalChangesError
+	var remove, write []string
+	for _, p := range sorted {
+		o, n, e := olds[p], news[p], idx.Entry(p)
+		if force {
+			if n == nil {
+				remove = append(remove, p)
+				continue
+			}
+			if entryIs(e, n) {
+				if ok, err := worktreeMatches(repo, e); err != nil {
+					return err
+				} else if ok {
+					continue
+				}
+			}
+			write = append(write, p)
+			continue
+		}
+		if sameLeaf(o, n) {
+			continue
+		}
+		if e == nil {
+			if o != nil && n != nil {
+				// deleted in the index
+				lce.Modified = append(lce.Modified, p)
+				continue
+			}
+			if n != nil {
+				if fi, err := os.Lstat(repo.wtPath(p)); err == nil {
+					if sha, err := hashWorktreeFile(repo, p, fi); err != nil || sha != n.SHA {
+						lce.Untracked = append(lce.Untracked, p)
+						continue
+					}
+				}
+				write = append(write, p)
+			}
+			continue
+		}
+		if !entryIs(e, o) && !entryIs(e, n) {
+			lce.Modified = append(lce.Modified, p)
+			continue
+		}
+		if entryIs(e, n) {
+			continue
+		}
+		if ok, err := worktreeMatches(repo, e); err != nil {
+			return err
+		} else if !ok {
+			if _, err := os.Lstat(repo.wtPath(p)); err == nil {
+				lce.Modified = append(lce.Modified, p)
+				continue
+			}
+		}
+		if n == nil {
+			remove = append(remove, p)
+		} else {
+			write = append(write, p)
+		}
+	}
+	if len(lce.Modified)+len(lce.Untracked) > 0 {
+		return &lce
+	}
+
+	updates := make(map[string]*IndexEntry)
+	for _, p := range remove {
+		if err := removeWorktreeFile(repo, p); err != nil {
+			return err
+		}
+		updates[p] = nil
+	}
+	for _, p := range write {
+		e, err := writeWorktreeFile(repo, news[p])
+		if err != nil {
+			return err
+		}
+		updates[p] = e
+	}
+	idx.update(updates)
+	return WriteIndex(repo, idx)
+}
+
+// Switch checks out the commit sha, updating the index and the worktree, and points HEAD at
+// the branch (e.g. refs/heads/master), creating it at sha if it does not exist.
+// If branch is "", HEAD is detached at sha. name is the user given name of the target,
+// which is recorded in the reflog.
+func Switch(repo *Repo, branch, sha, name string, force bool) error {
+	oldBranch, oldSHA, err := Head(repo)
+	if err != nil {
+		return err
+	}
+	from := ""
+	if oldSHA != "" {
+		if from, err = TreeSHA(repo, oldSHA); err != nil {
+			return err
+		}
+	}
+	to, err := TreeSHA(repo, sha)
+	if err != nil {
+		return err
+	}
+	if err := CheckoutTree(repo, from, to, force); err != nil {
+		return err
+	}
+	if branch != "" {
+		if _, err := ReadRef(repo, branch); err != nil {
+			if err := UpdateRef(repo, branch, sha, ZeroSHA, "branch: Created from "+name); err != nil {
+				return err
+			}
+		}
+	}
+	fromName := strings.TrimPrefix(oldBranch, "refs/heads/")
+	if oldBranch == "" {
+		fromName = oldSHA
+	}
+	return SetHead(repo, branch, sha, fmt.Sprintf("checkout: moving from %s to %s", fromName, name))
+}
@@ -8,12 +8,12 @@ import (
 	"os"
 
 	"github.com/google/subcommands"
-	_ "github.com/ogiekako/gogit/cmd" // register commands
+	"github.com/ogiekako/gogit/cmd" // register commands
 )
 
 func main() {
 	subcommands.Register(subcommands.HelpCommand(), "")
-	// TODO: implement ls-files command, parsing index file.
+	os.Args = cmd.NormalizeArgs(os.Args)
 	flag.Parse()
 	os.Exit(int(subcommands.Execute(context.Background())))
 }
@@ -0,0 +1,142 @@
+// Package smarthttp serves git repositories over the smart HTTP protocol, so that they can
+// be cloned, fetched and pushed to by git clients.
+package smarthttp
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ogiekako/gogit/git"
+)
+
+// Handler serves the repositories under Root. A request for
+// /<path>/info/refs?service=<service> or /<path>/<service>, where the service is
+// git-upload-pack or git-receive-pack, is served from the repository at Root/<path>,
+// which is either a worktree or a bare repository. If there is none, the repository
+// at Root/<path> without .git is tried.
+//
+// As with git http-backend, the config http.uploadpack and http.receivepack of the
+// repository enable or disable the services. Without the config, git-upload-pack is
+// enabled and git-receive-pack is enabled if ReceivePack is true.
+type Handler struct {
+	// Root is the directory the repositories are in.
+	Root string
+	// ReceivePack enables pushing to repositories without http.receivepack.
+	ReceivePack bool
+}
+
+var services = map[string]bool{"git-upload-pack": true, "git-receive-pack": true}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p := path.Clean("/" + req.URL.Path)
+	var dir, service string
+	advertise := strings.HasSuffix(p, "/info/refs")
+	if advertise {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		dir, service = strings.TrimSuffix(p, "/info/refs"), req.URL.Query().Get("service")
+		if !services[service] {
+			http.Error(w, "The dumb HTTP protocol is not supported", http.StatusForbidden)
+			return
+		}
+	} else {
+		i := strings.LastIndexByte(p, '/')
+		dir, service = p[:i], p[i+1:]
+		if !services[service] {
+			http.NotFound(w, req)
+			return
+		}
+		if req.Method != "POST" {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if ct := req.Header.Get("Content-Type"); ct != "application/x-"+service+"-request" {
+			http.Error(w, fmt.Sprintf("Unexpected Content-Type %q", ct), http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	repo, err := h.open(dir)
+	if err != nil {
+		http.Error(w, "Repository not found", http.StatusNotFound)
+		return
+	}
+	if !h.enabled(repo, service) {
+		http.Error(w, "Service not enabled: "+service, http.StatusForbidden)
+		return
+	}
+
+	version := git.ProtocolVersion(req.Header.Get("Git-Protocol"))
+	hdr := w.Header()
+	hdr.Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+	hdr.Set("Pragma", "no-cache")
+	hdr.Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	if advertise {
+		hdr.Set("Content-Type", "application/x-"+service+"-advertisement")
+		if req.Method == "HEAD" {
+			return
+		}
+		// As with git http-backend, a protocol version 2 response starts with the
+		// capabilities instead.
+		if version != 2 || service != "git-upload-pack" {
+			line := "# service=" + service + "\n"
+			fmt.Fprintf(w, "%04x%s0000", len(line)+4, line)
+		}
+		err = serve(repo, service, nil, w, true, version)
+	} else {
+		var body io.Reader = req.Body
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(req.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer zr.Close()
+			body = zr
+		}
+		hdr.Set("Content-Type", "application/x-"+service+"-result")
+		err = serve(repo, service, body, w, false, version)
+	}
+	if err != nil {
+		log.Printf("%s %s: %v", service, dir, err)
+	}
+}
+
+// open returns the repository dir names.
+func (h *Handler) open(dir string) (*git.Repo, error) {
+	repo, err := git.NewRepo(filepath.Join(h.Root, filepath.FromSlash(dir)), false)
+	if err != nil && strings.HasSuffix(dir, ".git") {
+		return git.NewRepo(filepath.Join(h.Root, filepath.FromSlash(strings.TrimSuffix(dir, ".git"))), false)
+	}
+	return repo, err
+}
+
+// enabled returns whether the service may be used on the repository.
+func (h *Handler) enabled(repo *git.Repo, service string) bool {
+	key := strings.TrimPrefix(strings.Replace(service, "-", "", -1), "git")
+	switch strings.ToLower(git.Config(repo, "http", key)) {
+	case "true", "yes", "on", "1":
+		return true
+	case "false", "no", "off", "0":
+		return false
+	}
+	return service == "git-upload-pack" || h.ReceivePack
+}
+
+// serve runs the service on the repository for a request of the stateless protocol, or
+// only advertises the refs if advertise is true. version is the protocol version the client
+// asked for.
+func serve(repo *git.Repo, service string, r io.Reader, w io.Writer, advertise bool, version int) error {
+	if service == "git-upload-pack" {
+		return git.UploadPack(repo, r, w, &git.UploadPackOptions{StatelessRPC: !advertise, AdvertiseRefs: advertise, Version: version})
+	}
+	return git.ReceivePack(repo, r, w, &git.ReceivePackOptions{StatelessRPC: !advertise, AdvertiseRefs: advertise, Version: version})
+}
@@ -0,0 +1,112 @@
+package smarthttp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ogiekako/gogit/git"
+)
+
+func TestHandler(t *testing.T) {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if _, err := git.NewRepo(filepath.Join(root, "r"), true); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(&Handler{Root: root})
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		method, path, contentType string
+		wantStatus                int
+		wantContentType, wantBody string
+	}{
+		{"GET", "/r/info/refs?service=git-upload-pack", "", http.StatusOK, "application/x-git-upload-pack-advertisement", "001e# service=git-upload-pack\n0000"},
+		{"GET", "/r.git/info/refs?service=git-upload-pack", "", http.StatusOK, "application/x-git-upload-pack-advertisement", "001e# service=git-upload-pack\n0000"},
+		{"GET", "/r/info/refs", "", http.StatusForbidden, "", ""},
+		{"GET", "/r/info/refs?service=git-receive-pack", "", http.StatusForbidden, "", ""},
+		{"GET", "/nope/info/refs?service=git-upload-pack", "", http.StatusNotFound, "", ""},
+		{"GET", "/r/git-upload-pack", "", http.StatusMethodNotAllowed, "", ""},
+		{"POST", "/r/git-upload-pack", "text/plain", http.StatusUnsupportedMediaType, "", ""},
+		{"POST", "/r/git-upload-pack", "application/x-git-upload-pack-request", http.StatusOK, "application/x-git-upload-pack-result", ""},
+		{"POST", "/r/objects", "application/x-git-upload-pack-request", http.StatusNotFound, "", ""},
+	} {
+		req, err := http.NewRequest(tc.method, srv.URL+tc.path, strings.NewReader(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.wantStatus {
+			t.Errorf("%s %s: status %d; want %d", tc.method, tc.path, resp.StatusCode, tc.wantStatus)
+			continue
+		}
+		if tc.wantStatus != http.StatusOK {
+			continue
+		}
+		if got := resp.Header.Get("Content-Type"); got != tc.wantContentType {
+			t.Errorf("%s %s: Content-Type %q; want %q", tc.method, tc.path, got, tc.wantContentType)
+		}
+		if got := string(b); !strings.HasPrefix(got, tc.wantBody) {
+			t.Errorf("%s %s: body %q; want prefix %q", tc.method, tc.path, got, tc.wantBody)
+		}
+	}
+
+	// A protocol version 2 advertisement starts with the version line.
+	req, err := http.NewRequest("GET", srv.URL+"/r/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "000eversion 2\n"; resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(b), want) {
+		t.Errorf("version 2 advertisement: %d %q; want prefix %q", resp.StatusCode, b, want)
+	}
+
+	// http.receivepack of the repository enables pushing.
+	r, err := git.NewRepo(filepath.Join(root, "r"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := git.SetConfig(r, "http", "receivepack", "true"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Get(srv.URL + "/r/info/refs?service=git-receive-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "001f# service=git-receive-pack\n0000"; resp.StatusCode != http.StatusOK || !strings.HasPrefix(string(b), want) || !strings.Contains(string(b), "capabilities^{}\x00report-status") {
+		t.Errorf("receive-pack advertisement: %d %q", resp.StatusCode, b)
+	}
+}